@@ -9,18 +9,24 @@ import (
 	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/feature"
 	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/ddns"
 	"github.com/HouzuoGuo/laitos/frontend/dnsd"
 	"github.com/HouzuoGuo/laitos/frontend/healthcheck"
 	"github.com/HouzuoGuo/laitos/frontend/httpd"
 	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
+	"github.com/HouzuoGuo/laitos/frontend/httpproxy"
+	"github.com/HouzuoGuo/laitos/frontend/imapd"
 	"github.com/HouzuoGuo/laitos/frontend/mailp"
+	"github.com/HouzuoGuo/laitos/frontend/portfwd"
 	"github.com/HouzuoGuo/laitos/frontend/smtpd"
+	"github.com/HouzuoGuo/laitos/frontend/sockclient"
 	"github.com/HouzuoGuo/laitos/frontend/sockd"
 	"github.com/HouzuoGuo/laitos/frontend/telegram_bot"
 	"github.com/HouzuoGuo/laitos/global"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Configuration of a standard set of bridges that are useful to both HTTP daemon and mail processor.
@@ -39,10 +45,17 @@ type HTTPHandlers struct {
 	SelfTestEndpoint    string `json:"SelfTestEndpoint"`
 	InformationEndpoint string `json:"InformationEndpoint"`
 
+	BlockPageEndpoint       string              `json:"BlockPageEndpoint"` // Serve block page to visitors of names black-listed by DNS daemon in sinkhole mode
+	BlockPageEndpointConfig api.HandleBlockPage `json:"BlockPageEndpointConfig"`
+
 	BrowserEndpoint string `json:"BrowserEndpoint"`
 
 	CommandFormEndpoint string `json:"CommandFormEndpoint"`
 
+	DNSOverHTTPSEndpoint   string             `json:"DNSOverHTTPSEndpoint"` // Answer DNS-over-HTTPS queries using DNS daemon configuration
+	DNSStatsEndpoint       string             `json:"DNSStatsEndpoint"`
+	DNSStatsEndpointConfig api.HandleDNSStats `json:"DNSStatsEndpointConfig"`
+
 	GitlabBrowserEndpoint       string                  `json:"GitlabBrowserEndpoint"`
 	GitlabBrowserEndpointConfig api.HandleGitlabBrowser `json:"GitlabBrowserEndpointConfig"`
 
@@ -52,6 +65,8 @@ type HTTPHandlers struct {
 	MailMeEndpoint       string           `json:"MailMeEndpoint"`
 	MailMeEndpointConfig api.HandleMailMe `json:"MailMeEndpointConfig"`
 
+	SockTrafficEndpoint string `json:"SockTrafficEndpoint"` // Present traffic counters of sock daemon users
+
 	WebProxyEndpoint string `json:"WebProxyEndpoint"`
 
 	TwilioSMSEndpoint        string                   `json:"TwilioSMSEndpoint"`
@@ -64,9 +79,14 @@ type Config struct {
 	Features feature.FeatureSet `json:"Features"` // Feature configuration is shared by all services
 	Mailer   email.Mailer       `json:"Mailer"`   // Mail configuration for notifications and mail processor results
 
+	MailQueue email.Queue `json:"MailQueue"` // (Optional) Queue outgoing mails that cannot be delivered right away
+
 	HealthCheck healthcheck.HealthCheck `json:"HealthCheck"` // Periodic self health check
 
-	DNSDaemon dnsd.DNSD `json:"DNSDaemon"` // DNS daemon configuration
+	DDNS ddns.DDNS `json:"DDNS"` // Update DNS names when public IP address changes
+
+	DNSDaemon        dnsd.DNSD       `json:"DNSDaemon"`        // DNS daemon configuration
+	DNSDaemonBridges StandardBridges `json:"DNSDaemonBridges"` // DNS daemon bridge configuration, used by command queries.
 
 	HTTPDaemon   httpd.HTTPD     `json:"HTTPDaemon"`   // HTTP daemon configuration
 	HTTPBridges  StandardBridges `json:"HTTPBridges"`  // HTTP daemon bridge configuration
@@ -78,10 +98,31 @@ type Config struct {
 	MailProcessor        mailp.MailProcessor `json:"MailProcessor"`        // Incoming mail processor configuration
 	MailProcessorBridges StandardBridges     `json:"MailProcessorBridges"` // Incoming mail processor bridge configuration
 
-	SockDaemon sockd.Sockd `json:"SockDaemon"` // Intentionally undocumented
+	IMAPDaemon imapd.IMAPD `json:"IMAPDaemon"` // IMAP daemon that serves mails stored by SMTP daemon
+
+	SockDaemon sockd.Sockd           `json:"SockDaemon"` // Intentionally undocumented
+	HTTPProxy  httpproxy.HTTPProxy   `json:"HTTPProxy"`  // HTTP forward proxy for devices that only support HTTP proxy
+	SockClient sockclient.SockClient `json:"SockClient"` // Local proxy that tunnels connections to remote sock daemons
+
+	PortForward portfwd.PortForward `json:"PortForward"` // Forward local ports to remote hosts
 
 	TelegramBot        telegram.TelegramBot `json:"TelegramBot"`        // Telegram bot configuration
 	TelegramBotBridges StandardBridges      `json:"TelegramBotBridges"` // Telegram bot bridge configuration
+
+	dnsDaemon *sharedDNSD      // DNS daemon is shared by DNS frontend, DDNS, and HTTP handlers that answer DNS queries
+	mailQueue *sharedMailQueue // Outgoing mail queue is shared by all mailers and features
+}
+
+// Hold the DNS daemon constructed from a configuration, so that copies of the configuration share the same daemon.
+type sharedDNSD struct {
+	daemon *dnsd.DNSD
+	mutex  sync.Mutex
+}
+
+// Hold the outgoing mail queue constructed from a configuration, so that copies of the configuration share the same queue.
+type sharedMailQueue struct {
+	queue *email.Queue
+	mutex sync.Mutex
 }
 
 // Deserialise JSON data into config structures.
@@ -89,13 +130,102 @@ func (config *Config) DeserialiseFromJSON(in []byte) error {
 	if err := json.Unmarshal(in, config); err != nil {
 		return err
 	}
+	config.dnsDaemon = new(sharedDNSD)
+	config.mailQueue = new(sharedMailQueue)
 	return nil
 }
 
-// Construct a DNS daemon from configuration and return.
+/*
+Construct the outgoing mail queue from configuration and return, or return nil if the queue is not configured. The queue
+is constructed only once for a deserialised configuration and its copies.
+*/
+func (config Config) GetMailQueue() *email.Queue {
+	if config.MailQueue.Directory == "" {
+		return nil
+	}
+	if config.mailQueue == nil {
+		return config.makeMailQueue()
+	}
+	config.mailQueue.mutex.Lock()
+	defer config.mailQueue.mutex.Unlock()
+	if config.mailQueue.queue == nil {
+		config.mailQueue.queue = config.makeMailQueue()
+	}
+	return config.mailQueue.queue
+}
+
+// Construct a new outgoing mail queue from configuration and return.
+func (config Config) makeMailQueue() *email.Queue {
+	ret := config.MailQueue
+	ret.Logger = global.Logger{ComponentName: "MailQueue", ComponentID: ret.Directory}
+	ret.Mailer = config.Mailer
+	if err := ret.Initialise(); err != nil {
+		ret.Logger.Fatalf("GetMailQueue", "Config", err, "failed to initialise")
+		return nil
+	}
+	return &ret
+}
+
+// Return the common mailer, which queues mails that cannot be delivered right away if the queue is configured.
+func (config Config) getMailer() email.Mailer {
+	ret := config.Mailer
+	ret.Queue = config.GetMailQueue()
+	return ret
+}
+
+// Return the feature configuration, in which EnvControl inspects the outgoing mail queue if it is configured.
+func (config Config) getFeatures() feature.FeatureSet {
+	ret := config.Features
+	ret.EnvControl.MailQueue = config.GetMailQueue()
+	return ret
+}
+
+/*
+Construct a DNS daemon from configuration and return. The DNS daemon is constructed only once for a deserialised
+configuration and its copies.
+*/
 func (config Config) GetDNSD() *dnsd.DNSD {
+	if config.dnsDaemon == nil {
+		return config.makeDNSD()
+	}
+	config.dnsDaemon.mutex.Lock()
+	defer config.dnsDaemon.mutex.Unlock()
+	if config.dnsDaemon.daemon == nil {
+		config.dnsDaemon.daemon = config.makeDNSD()
+	}
+	return config.dnsDaemon.daemon
+}
+
+// Construct a new DNS daemon from configuration and return.
+func (config Config) makeDNSD() *dnsd.DNSD {
 	ret := config.DNSDaemon
 	ret.Logger = global.Logger{ComponentName: "DNSD", ComponentID: fmt.Sprintf("%s:%d", ret.UDPListenAddress, ret.UDPListenPort)}
+	// Command processor is only assembled if DNS daemon is to run commands from TXT queries
+	if ret.CommandDomain != "" {
+		mailNotification := config.DNSDaemonBridges.NotifyViaEmail
+		mailNotification.Mailer = config.getMailer()
+		mailNotification.Logger = ret.Logger
+
+		features := config.getFeatures()
+		if err := features.Initialise(); err != nil {
+			ret.Logger.Fatalf("GetDNSD", "Config", err, "failed to initialise features")
+			return nil
+		}
+		ret.Logger.Printf("GetDNSD", "Config", nil, "enabled features are - %v", features.GetTriggers())
+		ret.Processor = &common.CommandProcessor{
+			Features: &features,
+			CommandBridges: []bridge.CommandBridge{
+				&config.DNSDaemonBridges.PINAndShortcuts,
+				&config.DNSDaemonBridges.TranslateSequences,
+			},
+			ResultBridges: []bridge.ResultBridge{
+				&bridge.ResetCombinedText{}, // this is mandatory but not configured by user's config file
+				&config.DNSDaemonBridges.LintText,
+				&bridge.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&mailNotification,
+			},
+		}
+	}
 	if err := ret.Initialise(); err != nil {
 		ret.Logger.Fatalf("GetDNSD", "Config", err, "failed to initialise")
 		return nil
@@ -103,16 +233,32 @@ func (config Config) GetDNSD() *dnsd.DNSD {
 	return &ret
 }
 
+// Construct a dynamic DNS updater and return.
+func (config Config) GetDDNS() *ddns.DDNS {
+	ret := config.DDNS
+	ret.Logger = global.Logger{ComponentName: "DDNS", ComponentID: "Global"}
+	ret.Mailer = config.getMailer()
+	// Local records are kept by the DNS daemon that is shared with DNS frontend
+	if len(ret.LocalNames) > 0 {
+		ret.DNSDaemon = config.GetDNSD()
+	}
+	if err := ret.Initialise(); err != nil {
+		ret.Logger.Fatalf("GetDDNS", "Config", err, "failed to initialise")
+		return nil
+	}
+	return &ret
+}
+
 // Construct a health checker and return.
 func (config Config) GetHealthCheck() *healthcheck.HealthCheck {
 	ret := config.HealthCheck
 	ret.Logger = global.Logger{ComponentName: "HealthCheck", ComponentID: "Global"}
-	ret.Features = config.Features
+	ret.Features = config.getFeatures()
 	if err := ret.Features.Initialise(); err != nil {
 		ret.Logger.Fatalf("GetHealthCheck", "Config", err, "failed to initialise features")
 		return nil
 	}
-	ret.Mailer = config.Mailer
+	ret.Mailer = config.getMailer()
 	if err := ret.Initialise(); err != nil {
 		ret.Logger.Fatalf("GetHealthCheck", "Config", err, "failed to initialise")
 		return nil
@@ -126,10 +272,10 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 	ret.Logger = global.Logger{ComponentName: "HTTPD", ComponentID: fmt.Sprintf("%s:%d", ret.ListenAddress, ret.ListenPort)}
 
 	mailNotification := config.HTTPBridges.NotifyViaEmail
-	mailNotification.Mailer = config.Mailer
+	mailNotification.Mailer = config.getMailer()
 	mailNotification.Logger = ret.Logger
 
-	features := config.Features
+	features := config.getFeatures()
 	if err := features.Initialise(); err != nil {
 		ret.Logger.Fatalf("GetHTTPD", "Config", err, "failed to initialise features")
 		return nil
@@ -154,6 +300,14 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 	if config.HTTPHandlers.InformationEndpoint != "" {
 		handlers[config.HTTPHandlers.InformationEndpoint] = &api.HandleSystemInfo{}
 	}
+	if config.HTTPHandlers.BlockPageEndpoint != "" {
+		dnsDaemon := config.GetDNSD()
+		blockPage := config.HTTPHandlers.BlockPageEndpointConfig
+		blockPage.DNSDaemon = dnsDaemon
+		handlers[config.HTTPHandlers.BlockPageEndpoint] = &blockPage
+		ret.BlockPageEndpoint = config.HTTPHandlers.BlockPageEndpoint
+		ret.IsBlockedHost = dnsDaemon.IsBlockedName
+	}
 	if config.HTTPHandlers.BrowserEndpoint != "" {
 		/*
 		 Configure a browser image endpoint for browser page.
@@ -172,6 +326,12 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 	if config.HTTPHandlers.CommandFormEndpoint != "" {
 		handlers[config.HTTPHandlers.CommandFormEndpoint] = &api.HandleCommandForm{}
 	}
+	if config.HTTPHandlers.DNSOverHTTPSEndpoint != "" {
+		handlers[config.HTTPHandlers.DNSOverHTTPSEndpoint] = &api.HandleDNSOverHTTPS{DNSDaemon: config.GetDNSD()}
+	}
+	if config.HTTPHandlers.DNSStatsEndpoint != "" {
+		handlers[config.HTTPHandlers.DNSStatsEndpoint] = &config.HTTPHandlers.DNSStatsEndpointConfig
+	}
 	if config.HTTPHandlers.GitlabBrowserEndpoint != "" {
 		handlers[config.HTTPHandlers.GitlabBrowserEndpoint] = &config.HTTPHandlers.GitlabBrowserEndpointConfig
 	}
@@ -182,9 +342,12 @@ func (config Config) GetHTTPD() *httpd.HTTPD {
 	}
 	if config.HTTPHandlers.MailMeEndpoint != "" {
 		handler := config.HTTPHandlers.MailMeEndpointConfig
-		handler.Mailer = config.Mailer
+		handler.Mailer = config.getMailer()
 		handlers[config.HTTPHandlers.MailMeEndpoint] = &handler
 	}
+	if config.HTTPHandlers.SockTrafficEndpoint != "" {
+		handlers[config.HTTPHandlers.SockTrafficEndpoint] = &api.HandleSockTraffic{}
+	}
 	if proxyEndpoint := config.HTTPHandlers.WebProxyEndpoint; proxyEndpoint != "" {
 		handlers[proxyEndpoint] = &api.HandleWebProxy{MyEndpoint: proxyEndpoint}
 	}
@@ -256,6 +419,15 @@ func (config Config) GetLightHTTPD() *httpd.HTTPD {
 	if config.HTTPHandlers.InformationEndpoint != "" {
 		handlers[config.HTTPHandlers.InformationEndpoint] = &api.HandleSystemInfo{}
 	}
+	// Sinkhole visitors usually arrive via plain HTTP, hence the block page is served here as well.
+	if config.HTTPHandlers.BlockPageEndpoint != "" {
+		dnsDaemon := config.GetDNSD()
+		blockPage := config.HTTPHandlers.BlockPageEndpointConfig
+		blockPage.DNSDaemon = dnsDaemon
+		handlers[config.HTTPHandlers.BlockPageEndpoint] = &blockPage
+		ret.BlockPageEndpoint = config.HTTPHandlers.BlockPageEndpoint
+		ret.IsBlockedHost = dnsDaemon.IsBlockedName
+	}
 	ret.SpecialHandlers = handlers
 	// Call initialise and print out prefixes of installed routes
 	if err := ret.Initialise(); err != nil {
@@ -283,10 +455,10 @@ func (config Config) GetMailProcessor() *mailp.MailProcessor {
 	ret.Logger = global.Logger{ComponentName: "MailProcessor", ComponentID: ret.ReplyMailer.MTAHost}
 
 	mailNotification := config.MailProcessorBridges.NotifyViaEmail
-	mailNotification.Mailer = config.Mailer
+	mailNotification.Mailer = config.getMailer()
 	mailNotification.Logger = ret.Logger
 
-	features := config.Features
+	features := config.getFeatures()
 	if err := features.Initialise(); err != nil {
 		ret.Logger.Fatalf("GetMailProcessor", "Config", err, "failed to initialise features")
 		return nil
@@ -306,7 +478,7 @@ func (config Config) GetMailProcessor() *mailp.MailProcessor {
 			&mailNotification,
 		},
 	}
-	ret.ReplyMailer = config.Mailer
+	ret.ReplyMailer = config.getMailer()
 	return &ret
 }
 
@@ -318,7 +490,7 @@ func (config Config) GetMailDaemon() *smtpd.SMTPD {
 	ret := config.MailDaemon
 	ret.Logger = global.Logger{ComponentName: "SMTPD", ComponentID: fmt.Sprintf("%s:%d", ret.ListenAddress, ret.ListenPort)}
 	ret.MailProcessor = config.GetMailProcessor()
-	ret.ForwardMailer = config.Mailer
+	ret.ForwardMailer = config.getMailer()
 	if err := ret.Initialise(); err != nil {
 		ret.Logger.Fatalf("GetMailDaemon", "Config", err, "failed to initialise")
 		return nil
@@ -326,6 +498,50 @@ func (config Config) GetMailDaemon() *smtpd.SMTPD {
 	return &ret
 }
 
+// Construct an HTTP proxy from configuration and return.
+func (config Config) GetHTTPProxy() *httpproxy.HTTPProxy {
+	ret := config.HTTPProxy
+	ret.Logger = global.Logger{ComponentName: "HTTPProxy", ComponentID: fmt.Sprintf("%s:%d", ret.ListenAddress, ret.ListenPort)}
+	if err := ret.Initialise(); err != nil {
+		ret.Logger.Fatalf("GetHTTPProxy", "Config", err, "failed to initialise")
+		return nil
+	}
+	return &ret
+}
+
+// Construct an IMAP daemon from configuration and return.
+func (config Config) GetIMAPDaemon() *imapd.IMAPD {
+	ret := config.IMAPDaemon
+	ret.Logger = global.Logger{ComponentName: "IMAPD", ComponentID: fmt.Sprintf("%s:%d", ret.ListenAddress, ret.ListenPort)}
+	if err := ret.Initialise(); err != nil {
+		ret.Logger.Fatalf("GetIMAPDaemon", "Config", err, "failed to initialise")
+		return nil
+	}
+	return &ret
+}
+
+// Construct a port forwarder from configuration and return.
+func (config Config) GetPortForward() *portfwd.PortForward {
+	ret := config.PortForward
+	ret.Logger = global.Logger{ComponentName: "PortForward", ComponentID: fmt.Sprintf("%d forwards", len(ret.Forwards))}
+	if err := ret.Initialise(); err != nil {
+		ret.Logger.Fatalf("GetPortForward", "Config", err, "failed to initialise")
+		return nil
+	}
+	return &ret
+}
+
+// Construct a sock client from configuration and return.
+func (config Config) GetSockClient() *sockclient.SockClient {
+	ret := config.SockClient
+	ret.Logger = global.Logger{ComponentName: "SockClient", ComponentID: fmt.Sprintf("%s:%d", ret.ListenAddress, ret.ListenPort)}
+	if err := ret.Initialise(); err != nil {
+		ret.Logger.Fatalf("GetSockClient", "Config", err, "failed to initialise")
+		return nil
+	}
+	return &ret
+}
+
 // Intentionally undocumented
 func (config Config) GetSockDaemon() *sockd.Sockd {
 	ret := config.SockDaemon
@@ -343,10 +559,10 @@ func (config Config) GetTelegramBot() *telegram.TelegramBot {
 	ret.Logger = global.Logger{ComponentName: "TelegramBot"}
 
 	mailNotification := config.TelegramBotBridges.NotifyViaEmail
-	mailNotification.Mailer = config.Mailer
+	mailNotification.Mailer = config.getMailer()
 	mailNotification.Logger = ret.Logger
 
-	features := config.Features
+	features := config.getFeatures()
 	if err := features.Initialise(); err != nil {
 		ret.Logger.Fatalf("GetTelegramBot", "Config", err, "failed to initialise features")
 		return nil
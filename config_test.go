@@ -803,3 +803,57 @@ func TelegramBotTest(t *testing.T, config Config) {
 		t.Fatal(err)
 	}
 }
+
+func TestConfig_GetDNSD(t *testing.T) {
+	configJSON := []byte(`{"DNSDaemon": {"AllowQueryIPPrefixes": ["127.0"], "PerIPLimit": 10, "TCPListenAddress": "127.0.0.1", "TCPListenPort": 61212, "TCPForwardTo": "8.8.8.8:53"}}`)
+	var config Config
+	if err := config.DeserialiseFromJSON(configJSON); err != nil {
+		t.Fatal(err)
+	}
+	// Copies of the configuration share the same DNS daemon
+	copied := config
+	if daemon := config.GetDNSD(); daemon == nil || daemon != copied.GetDNSD() {
+		t.Fatal("DNS daemon is not shared")
+	}
+	// Another configuration gets its own DNS daemon
+	var another Config
+	if err := another.DeserialiseFromJSON(configJSON); err != nil {
+		t.Fatal(err)
+	}
+	if another.GetDNSD() == config.GetDNSD() {
+		t.Fatal("DNS daemon should not be shared across configurations")
+	}
+}
+
+func TestConfig_GetMailQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-config-mailqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queueDir := dir + "/queue"
+	var config Config
+	if err := config.DeserialiseFromJSON([]byte(`{"Mailer": {"MailFrom": "a@example.com", "MTAHost": "127.0.0.1", "MTAPort": 25}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if config.GetMailQueue() != nil || config.getMailer().Queue != nil || config.getFeatures().EnvControl.MailQueue != nil {
+		t.Fatal("mail queue should not have been configured")
+	}
+	configJSON := fmt.Sprintf(`{"Mailer": {"MailFrom": "a@example.com", "MTAHost": "127.0.0.1", "MTAPort": 25}, "MailQueue": {"Directory": "%s"}}`, queueDir)
+	if err := config.DeserialiseFromJSON([]byte(configJSON)); err != nil {
+		t.Fatal(err)
+	}
+	// Deserialising configuration does not create the queue directory
+	if _, err := os.Stat(queueDir); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	// Copies of the configuration share the same queue, which is used by mailer and features.
+	copied := config
+	queue := config.GetMailQueue()
+	if queue == nil || queue != copied.GetMailQueue() || copied.getMailer().Queue != queue || copied.getFeatures().EnvControl.MailQueue != queue {
+		t.Fatal("mail queue is not shared")
+	}
+	if _, err := os.Stat(queueDir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,235 @@
+// Collect statistics of DNS queries answered by DNS daemon.
+package dnsstats
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MaxTrackedNames  = 10000   // Keep counters of up to this many domain names
+	NumMinuteBuckets = 24 * 60 // Keep per-client counters of the latest 24 hours, one bucket per minute.
+	DefaultTopN      = 10      // Number of top domain names to show in text report
+)
+
+var Common = NewStats() // Statistics of all DNS queries handled by DNS daemons of this program
+
+// Number of queries made toward a domain name, or made by a client.
+type Count struct {
+	Name  string `json:"Name"`
+	Count int64  `json:"Count"`
+}
+
+// Number of queries made by each client within the latest minute, hour, and day.
+type ClientCounts struct {
+	LastMinute []Count `json:"LastMinute"`
+	LastHour   []Count `json:"LastHour"`
+	LastDay    []Count `json:"LastDay"`
+}
+
+// Fetch result of a blacklist source used by DNS daemon.
+type BlacklistSource struct {
+	Location    string    `json:"Location"`   // URL or file path of the source
+	NumEntries  int       `json:"NumEntries"` // Number of names found in the latest successful fetch
+	LastError   string    `json:"LastError"`  // Error of the latest attempt, empty if it succeeded.
+	LastAttempt time.Time `json:"LastAttempt"`
+	LastSuccess time.Time `json:"LastSuccess"`
+}
+
+// A point-in-time copy of statistics, suitable for serialising into JSON.
+type Snapshot struct {
+	Since       time.Time    `json:"Since"`
+	Total       int64        `json:"Total"`
+	Blocked     int64        `json:"Blocked"`
+	RRLDropped  int64        `json:"RRLDropped"` // UDP queries dropped by response rate limit
+	RRLSlipped  int64        `json:"RRLSlipped"` // UDP queries answered by a truncated response due to response rate limit
+	Truncated   int64        `json:"Truncated"`  // UDP responses truncated because they were too large for the client
+	TopQueried  []Count      `json:"TopQueried"`
+	TopBlocked  []Count      `json:"TopBlocked"`
+	ClientCount ClientCounts `json:"ClientCount"`
+
+	BlacklistSources []BlacklistSource `json:"BlacklistSources"`
+}
+
+// Count queries by domain name and by client over sliding windows of time.
+type Stats struct {
+	mutex       *sync.Mutex
+	since       time.Time
+	total       int64
+	blocked     int64
+	rrlDropped  int64
+	rrlSlipped  int64
+	truncated   int64
+	queried     map[string]int64
+	blockedName map[string]int64
+	buckets     [NumMinuteBuckets]map[string]int64 // per-client counters, one bucket per minute
+	bucketMin   [NumMinuteBuckets]int64            // the unix minute each bucket belongs to
+	sources     []BlacklistSource                  // latest fetch result of blacklist sources
+}
+
+// Return initialised and empty statistics.
+func NewStats() *Stats {
+	return &Stats{
+		mutex:       new(sync.Mutex),
+		since:       time.Now(),
+		queried:     make(map[string]int64),
+		blockedName: make(map[string]int64),
+	}
+}
+
+// Keep only the more frequently seen half of the counters if there are too many.
+func pruneCounters(counters map[string]int64) map[string]int64 {
+	if len(counters) < MaxTrackedNames {
+		return counters
+	}
+	top := sortCounters(counters, MaxTrackedNames/2)
+	ret := make(map[string]int64, MaxTrackedNames)
+	for _, count := range top {
+		ret[count.Name] = count.Count
+	}
+	return ret
+}
+
+// Return up to topN counters in descending order of count. If topN is less than 1, return all of them.
+func sortCounters(counters map[string]int64, topN int) []Count {
+	ret := make([]Count, 0, len(counters))
+	for name, count := range counters {
+		ret = append(ret, Count{Name: name, Count: count})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count == ret[j].Count {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].Count > ret[j].Count
+	})
+	if topN > 0 && len(ret) > topN {
+		ret = ret[:topN]
+	}
+	return ret
+}
+
+// Count a query made by client toward the domain name. Domain name may be empty if it could not be determined.
+func (stats *Stats) Record(clientIP, name string, blocked bool) {
+	stats.RecordAt(time.Now(), clientIP, name, blocked)
+}
+
+// Count a query that happened at the specified time.
+func (stats *Stats) RecordAt(when time.Time, clientIP, name string, blocked bool) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.total++
+	if name != "" {
+		stats.queried[name]++
+		stats.queried = pruneCounters(stats.queried)
+	}
+	if blocked {
+		stats.blocked++
+		if name != "" {
+			stats.blockedName[name]++
+			stats.blockedName = pruneCounters(stats.blockedName)
+		}
+	}
+	minute := when.Unix() / 60
+	index := minute % NumMinuteBuckets
+	if stats.buckets[index] == nil || stats.bucketMin[index] != minute {
+		stats.buckets[index] = make(map[string]int64)
+		stats.bucketMin[index] = minute
+	}
+	stats.buckets[index][clientIP]++
+}
+
+// Count a UDP query that exceeded response rate limit. It was either dropped or answered by a truncated response.
+func (stats *Stats) RecordRateLimited(dropped bool) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	if dropped {
+		stats.rrlDropped++
+	} else {
+		stats.rrlSlipped++
+	}
+}
+
+// Count a UDP response that was truncated because it was too large for the client.
+func (stats *Stats) RecordTruncated() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.truncated++
+}
+
+// Remember the latest fetch result of blacklist sources.
+func (stats *Stats) SetBlacklistSources(sources []BlacklistSource) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.sources = append([]BlacklistSource{}, sources...)
+}
+
+// Return number of queries made by each client within the latest number of minutes, in descending order of count.
+func (stats *Stats) clientCounts(now time.Time, minutes int64) []Count {
+	nowMinute := now.Unix() / 60
+	sum := make(map[string]int64)
+	for i, bucket := range stats.buckets {
+		if bucket == nil || stats.bucketMin[i] <= nowMinute-minutes || stats.bucketMin[i] > nowMinute {
+			continue
+		}
+		for client, count := range bucket {
+			sum[client] += count
+		}
+	}
+	return sortCounters(sum, 0)
+}
+
+// Return a copy of the statistics, with up to topN most frequently queried domain names.
+func (stats *Stats) GetSnapshot(topN int) Snapshot {
+	return stats.GetSnapshotAt(time.Now(), topN)
+}
+
+// Return a copy of the statistics as seen at the specified time.
+func (stats *Stats) GetSnapshotAt(now time.Time, topN int) Snapshot {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	return Snapshot{
+		Since:      stats.since,
+		Total:      stats.total,
+		Blocked:    stats.blocked,
+		RRLDropped: stats.rrlDropped,
+		RRLSlipped: stats.rrlSlipped,
+		Truncated:  stats.truncated,
+		TopQueried: sortCounters(stats.queried, topN),
+		TopBlocked: sortCounters(stats.blockedName, topN),
+		ClientCount: ClientCounts{
+			LastMinute: stats.clientCounts(now, 1),
+			LastHour:   stats.clientCounts(now, 60),
+			LastDay:    stats.clientCounts(now, NumMinuteBuckets),
+		},
+		BlacklistSources: append([]BlacklistSource{}, stats.sources...),
+	}
+}
+
+// Return a human readable multi-line text report of the statistics.
+func (stats *Stats) Format(topN int) string {
+	snapshot := stats.GetSnapshot(topN)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Since %s: %d queries, %d blocked\n", snapshot.Since.Format(time.RFC3339), snapshot.Total, snapshot.Blocked)
+	fmt.Fprintf(buf, "Rate limited: %d dropped, %d truncated; oversized responses truncated: %d\n", snapshot.RRLDropped, snapshot.RRLSlipped, snapshot.Truncated)
+	writeCounts := func(title string, counts []Count) {
+		fmt.Fprintf(buf, "%s:\n", title)
+		for _, count := range counts {
+			fmt.Fprintf(buf, "%d %s\n", count.Count, count.Name)
+		}
+	}
+	writeCounts("Top queried", snapshot.TopQueried)
+	writeCounts("Top blocked", snapshot.TopBlocked)
+	writeCounts("Clients in last hour", snapshot.ClientCount.LastHour)
+	fmt.Fprintf(buf, "Blacklist sources:\n")
+	for _, src := range snapshot.BlacklistSources {
+		fmt.Fprintf(buf, "%d %s", src.NumEntries, src.Location)
+		if src.LastError != "" {
+			fmt.Fprintf(buf, " - last attempt at %s failed: %s", src.LastAttempt.Format(time.RFC3339), src.LastError)
+		}
+		fmt.Fprintf(buf, "\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,76 @@
+package dnsstats
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	stats := NewStats()
+	now := time.Now()
+	stats.RecordAt(now.Add(-2*time.Hour), "1.1.1.1", "a.com", false)
+	stats.RecordAt(now.Add(-30*time.Minute), "1.1.1.1", "a.com", false)
+	stats.RecordAt(now.Add(-30*time.Minute), "2.2.2.2", "ads.com", true)
+	stats.RecordAt(now, "2.2.2.2", "ads.com", true)
+	stats.RecordAt(now, "2.2.2.2", "b.com", false)
+	stats.RecordAt(now, "3.3.3.3", "", false)
+	stats.RecordRateLimited(true)
+	stats.RecordRateLimited(true)
+	stats.RecordRateLimited(false)
+	stats.RecordTruncated()
+
+	snapshot := stats.GetSnapshotAt(now, 1)
+	if snapshot.Total != 6 || snapshot.Blocked != 2 || snapshot.RRLDropped != 2 || snapshot.RRLSlipped != 1 || snapshot.Truncated != 1 {
+		t.Fatal(snapshot)
+	}
+	if !reflect.DeepEqual(snapshot.TopQueried, []Count{{"a.com", 2}}) || !reflect.DeepEqual(snapshot.TopBlocked, []Count{{"ads.com", 2}}) {
+		t.Fatal(snapshot)
+	}
+	if !reflect.DeepEqual(snapshot.ClientCount.LastMinute, []Count{{"2.2.2.2", 2}, {"3.3.3.3", 1}}) {
+		t.Fatal(snapshot.ClientCount.LastMinute)
+	}
+	if !reflect.DeepEqual(snapshot.ClientCount.LastHour, []Count{{"2.2.2.2", 3}, {"1.1.1.1", 1}, {"3.3.3.3", 1}}) {
+		t.Fatal(snapshot.ClientCount.LastHour)
+	}
+	if !reflect.DeepEqual(snapshot.ClientCount.LastDay, []Count{{"2.2.2.2", 3}, {"1.1.1.1", 2}, {"3.3.3.3", 1}}) {
+		t.Fatal(snapshot.ClientCount.LastDay)
+	}
+	// Buckets older than a day are not counted
+	if snapshot := stats.GetSnapshotAt(now.Add(25*time.Hour), 0); len(snapshot.ClientCount.LastDay) != 0 || len(snapshot.TopQueried) != 3 {
+		t.Fatal(snapshot)
+	}
+	if text := stats.Format(10); !strings.Contains(text, "6 queries, 2 blocked") || !strings.Contains(text, "2 ads.com") ||
+		!strings.Contains(text, "2 dropped, 1 truncated") {
+		t.Fatal(text)
+	}
+	// Blacklist sources are reported along with query statistics
+	stats.SetBlacklistSources([]BlacklistSource{
+		{Location: "/good", NumEntries: 123, LastAttempt: now, LastSuccess: now},
+		{Location: "http://bad", LastError: "timeout", LastAttempt: now},
+	})
+	if snapshot := stats.GetSnapshot(0); len(snapshot.BlacklistSources) != 2 || snapshot.BlacklistSources[0].NumEntries != 123 {
+		t.Fatal(snapshot.BlacklistSources)
+	}
+	if text := stats.Format(10); !strings.Contains(text, "123 /good\n") || !strings.Contains(text, "0 http://bad - last attempt at") ||
+		!strings.Contains(text, "failed: timeout") {
+		t.Fatal(text)
+	}
+}
+
+func TestStats_Prune(t *testing.T) {
+	stats := NewStats()
+	for i := 0; i < 3; i++ {
+		stats.Record("1.1.1.1", "frequent.com", false)
+	}
+	for i := 0; i < MaxTrackedNames; i++ {
+		stats.Record("1.1.1.1", strings.Repeat("x", i%50)+string(rune('a'+i%26))+time.Duration(i).String(), false)
+	}
+	if len(stats.queried) >= MaxTrackedNames {
+		t.Fatal(len(stats.queried))
+	}
+	if stats.queried["frequent.com"] != 3 {
+		t.Fatal("frequent name should have been kept")
+	}
+}
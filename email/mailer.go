@@ -3,6 +3,7 @@ package email
 import (
 	"fmt"
 	"net/smtp"
+	"net/textproto"
 	"strings"
 )
 
@@ -15,30 +16,75 @@ type Mailer struct {
 	MTAPort      int    `json:"MTAPort"`      // Port number of SMTP service on mail transportation agent
 	AuthUsername string `json:"AuthUsername"` // (Optional) Username for plain authentication, if the SMTP server requires it.
 	AuthPassword string `json:"AuthPassword"` // (Optional) Password for plain authentication, if the SMTP server requires it.
+
+	DirectDelivery bool `json:"DirectDelivery"` // (Optional) Deliver mails directly to MX hosts of recipient domains instead of the MTA
+
+	Queue *Queue `json:"-"` // (Optional) Mails that cannot be delivered right away are queued for later delivery
 }
 
-// Return true only if all mail parameters are present.
+// Return true only if all mail parameters are present. MTA is not needed by direct delivery.
 func (mailer *Mailer) IsConfigured() bool {
-	return mailer.MailFrom != "" && mailer.MTAHost != "" && mailer.MTAPort != 0
+	return mailer.MailFrom != "" && (mailer.DirectDelivery || mailer.MTAHost != "" && mailer.MTAPort != 0)
 }
 
-// Deliver mail to all recipients. Block until mail is sent or an error has occurred.
+/*
+Deliver mail to all recipients. Block until mail is sent or an error has occurred.
+If the mailer has a queue, mail that cannot be delivered right away is queued for later delivery and nil is returned.
+*/
 func (mailer *Mailer) Send(subject string, textBody string, recipients ...string) error {
-	var auth smtp.Auth
-	if mailer.AuthUsername != "" {
-		auth = smtp.PlainAuth("", mailer.AuthUsername, mailer.AuthPassword, mailer.MTAHost)
-	}
 	// Construct appropriate mail headers
 	mailBody := fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
 		mailer.MailFrom, strings.Join(recipients, ", "), subject, textBody)
-	return smtp.SendMail(fmt.Sprintf("%s:%d", mailer.MTAHost, mailer.MTAPort), auth, mailer.MailFrom, recipients, []byte(mailBody))
+	return mailer.SendRaw(mailer.MailFrom, []byte(mailBody), recipients...)
 }
 
-// Deliver unmodified mail body to all recipients. Block until mail is sent or an error has occurred.
+/*
+Deliver unmodified mail body to all recipients. Block until mail is sent or an error has occurred.
+If the mailer has a queue, mail that cannot be delivered right away is queued for later delivery. Recipients that
+failed permanently are not queued, and they are returned in a delivery error.
+*/
 func (mailer *Mailer) SendRaw(fromAddr string, rawMailBody []byte, recipients ...string) error {
+	err := mailer.deliver(fromAddr, rawMailBody, recipients...)
+	if err == nil || mailer.Queue == nil {
+		return err
+	}
+	// Recipients who have already received the mail do not need it again
+	permanent, temporary := splitFailedRecipients(err, recipients)
+	if len(temporary) > 0 {
+		if queueErr := mailer.Queue.Enqueue(fromAddr, rawMailBody, err, temporary...); queueErr != nil {
+			return queueErr
+		}
+	}
+	if len(permanent) == 0 {
+		return nil
+	}
+	if _, isDeliveryErr := err.(*DeliveryError); !isDeliveryErr {
+		return err
+	}
+	rejected := new(DeliveryError)
+	for _, rcpt := range permanent {
+		rejected.add(rcpt, recipientError(err, rcpt))
+	}
+	return rejected
+}
+
+// Make a single attempt to deliver mail to all recipients.
+func (mailer *Mailer) deliver(fromAddr string, rawMailBody []byte, recipients ...string) error {
+	if mailer.DirectDelivery {
+		return mailer.deliverDirect(fromAddr, rawMailBody, recipients...)
+	}
 	var auth smtp.Auth
 	if mailer.AuthUsername != "" {
 		auth = smtp.PlainAuth("", mailer.AuthUsername, mailer.AuthPassword, mailer.MTAHost)
 	}
 	return smtp.SendMail(fmt.Sprintf("%s:%d", mailer.MTAHost, mailer.MTAPort), auth, fromAddr, recipients, rawMailBody)
 }
+
+// Return true if the error is a permanent SMTP failure (5xx), which means retrying the delivery will not help.
+func IsPermanentError(err error) bool {
+	if deliveryErr, ok := err.(*DeliveryError); ok {
+		return deliveryErr.Permanent
+	}
+	smtpErr, ok := err.(*textproto.Error)
+	return ok && smtpErr.Code >= 500
+}
@@ -0,0 +1,236 @@
+package email
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MXIOTimeoutSec = 120 // Give up on an MX host that does not finish a conversation within this many seconds
+
+var (
+	lookupMX   = net.LookupMX   // Look up MX records of a domain, it is only replaced by test cases.
+	lookupHost = net.LookupHost // Look up addresses of a domain without MX record, it is only replaced by test cases.
+	mxPort     = 25             // Port number of SMTP service on MX hosts, it is only replaced by test cases.
+)
+
+// DeliveryError tells which recipients did not receive the mail during direct delivery, and why.
+type DeliveryError struct {
+	Recipients []string         // Recipients that did not receive the mail
+	Errs       map[string]error // Error of each recipient that did not receive the mail
+	Permanent  bool             // True only if all of the recipients failed permanently
+	Err        error            // Error of the last recipient that failed
+}
+
+func (err *DeliveryError) Error() string {
+	return fmt.Sprintf("failed to deliver to %v - %v", err.Recipients, err.Err)
+}
+
+// Remember that the recipient did not receive the mail. Permanent becomes false if the recipient failed temporarily.
+func (err *DeliveryError) add(rcpt string, rcptErr error) {
+	if err.Errs == nil {
+		err.Errs = make(map[string]error)
+		err.Permanent = true
+	}
+	err.Recipients = append(err.Recipients, rcpt)
+	err.Errs[rcpt] = rcptErr
+	err.Permanent = err.Permanent && IsPermanentError(rcptErr)
+	err.Err = rcptErr
+}
+
+// Return the error that prevented the recipient from receiving the mail.
+func recipientError(err error, rcpt string) error {
+	if deliveryErr, ok := err.(*DeliveryError); ok {
+		return deliveryErr.Errs[rcpt]
+	}
+	return err
+}
+
+/*
+Among the recipients that have not received the mail according to the delivery error, return those that failed
+permanently and those that may succeed in a later attempt.
+*/
+func splitFailedRecipients(err error, recipients []string) (permanent, temporary []string) {
+	if deliveryErr, ok := err.(*DeliveryError); ok {
+		recipients = deliveryErr.Recipients
+	}
+	for _, rcpt := range recipients {
+		if IsPermanentError(recipientError(err, rcpt)) {
+			permanent = append(permanent, rcpt)
+		} else {
+			temporary = append(temporary, rcpt)
+		}
+	}
+	return
+}
+
+// Return the domain name of the mail address in lower case.
+func addressDomain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+}
+
+// Return true only if the error says that the name does not exist in DNS.
+func isNoSuchHost(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.Err == "no such host"
+}
+
+/*
+Return MX host names of the domain in the order of preference. A domain without MX record is its own MX host, but a
+domain that does not exist at all fails permanently.
+*/
+func mxHosts(domain string) ([]string, error) {
+	records, err := lookupMX(domain)
+	if err != nil {
+		if !isNoSuchHost(err) {
+			return nil, err
+		}
+		// The resolver does not tell a domain without MX record apart from a domain that does not exist
+		if _, err := lookupHost(domain); isNoSuchHost(err) {
+			return nil, &textproto.Error{Code: 550, Msg: fmt.Sprintf("domain %s does not exist", domain)}
+		} else if err != nil {
+			return nil, err
+		}
+		records = nil
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Pref < records[j].Pref })
+	hosts := make([]string, 0, len(records))
+	for _, record := range records {
+		// A null MX record (RFC 7505) means the domain does not accept mails
+		if host := strings.TrimSuffix(record.Host, "."); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(records) > 0 && len(hosts) == 0 {
+		return nil, &textproto.Error{Code: 556, Msg: fmt.Sprintf("domain %s does not accept mails", domain)}
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, domain)
+	}
+	return hosts, nil
+}
+
+/*
+Deliver mail to the recipients via an MX host. If the host offers STARTTLS, the conversation is encrypted
+opportunistically without verifying host certificate. Should TLS fail, the conversation is retried in plain text.
+Recipients rejected by the host are returned in a delivery error, the others still receive the mail.
+*/
+func (mailer *Mailer) deliverToHost(host string, fromAddr string, rawMailBody []byte, recipients []string, useTLS bool) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(mxPort)), MXIOTimeoutSec*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(MXIOTimeoutSec * time.Second))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if err := client.Hello(addressDomain(mailer.MailFrom)); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok && useTLS {
+		if err := client.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+			client.Close()
+			return mailer.deliverToHost(host, fromAddr, rawMailBody, recipients, false)
+		}
+	}
+	if err := client.Mail(fromAddr); err != nil {
+		return err
+	}
+	var rejected *DeliveryError
+	for _, rcpt := range recipients {
+		if err := client.Rcpt(rcpt); err != nil {
+			// A rejected recipient does not stop the others from receiving the mail, unlike an IO error.
+			if _, isReply := err.(*textproto.Error); !isReply {
+				return err
+			}
+			if rejected == nil {
+				rejected = new(DeliveryError)
+			}
+			rejected.add(rcpt, err)
+		}
+	}
+	if rejected != nil && len(rejected.Recipients) == len(recipients) {
+		client.Quit()
+		return rejected
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(rawMailBody); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := client.Quit(); err != nil {
+		return err
+	}
+	if rejected != nil {
+		return rejected
+	}
+	return nil
+}
+
+// Deliver mail to recipients of the domain by trying its MX hosts in the order of preference.
+func (mailer *Mailer) deliverToDomain(domain string, fromAddr string, rawMailBody []byte, recipients []string) error {
+	hosts, err := mxHosts(domain)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		err = mailer.deliverToHost(host, fromAddr, rawMailBody, recipients, true)
+		// Other MX hosts of the domain will not accept what this host rejected
+		if _, rejected := err.(*DeliveryError); err == nil || rejected || IsPermanentError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+/*
+Deliver mail directly to MX hosts of recipient domains. Recipients of the same domain receive the mail together.
+The returned delivery error tells which recipients did not receive the mail, and whether each of them failed
+permanently.
+*/
+func (mailer *Mailer) deliverDirect(fromAddr string, rawMailBody []byte, recipients ...string) error {
+	var domains []string
+	domainRecipients := make(map[string][]string)
+	for _, rcpt := range recipients {
+		domain := addressDomain(rcpt)
+		if _, exists := domainRecipients[domain]; !exists {
+			domains = append(domains, domain)
+		}
+		domainRecipients[domain] = append(domainRecipients[domain], rcpt)
+	}
+	deliveryErr := new(DeliveryError)
+	for _, domain := range domains {
+		err := mailer.deliverToDomain(domain, fromAddr, rawMailBody, domainRecipients[domain])
+		if err == nil {
+			continue
+		}
+		// Host rejected some of the recipients, or the entire domain failed.
+		if rejected, ok := err.(*DeliveryError); ok {
+			for _, rcpt := range rejected.Recipients {
+				deliveryErr.add(rcpt, rejected.Errs[rcpt])
+			}
+		} else {
+			for _, rcpt := range domainRecipients[domain] {
+				deliveryErr.add(rcpt, err)
+			}
+		}
+	}
+	if len(deliveryErr.Recipients) == 0 {
+		return nil
+	}
+	return deliveryErr
+}
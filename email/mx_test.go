@@ -0,0 +1,145 @@
+package email
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMailer_DirectDelivery(t *testing.T) {
+	mta := startTestMTA(t)
+	defer mta.listener.Close()
+	defer func(originalLookup func(string) ([]*net.MX, error), originalLookupHost func(string) ([]string, error), originalPort int) {
+		lookupMX, lookupHost, mxPort = originalLookup, originalLookupHost, originalPort
+	}(lookupMX, lookupHost, mxPort)
+	mxPort = mta.port()
+	lookupMX = func(domain string) ([]*net.MX, error) {
+		switch domain {
+		case "a.example":
+			// The most preferred host does not listen
+			return []*net.MX{{Host: "127.0.0.1.", Pref: 20}, {Host: "127.0.0.2.", Pref: 10}}, nil
+		case "noreply.example":
+			return []*net.MX{{Host: ".", Pref: 0}}, nil
+		case "nomx.example", "nxdomain.example":
+			return nil, &net.DNSError{Err: "no such host", Name: domain}
+		default:
+			return nil, &net.DNSError{Err: "server misbehaving", Name: domain}
+		}
+	}
+	lookupHost = func(domain string) ([]string, error) {
+		if domain == "nomx.example" {
+			return []string{"127.0.0.1"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: domain}
+	}
+	// MX hosts come in the order of preference, and a domain without MX record is its own MX host.
+	if hosts, err := mxHosts("a.example"); err != nil || !reflect.DeepEqual(hosts, []string{"127.0.0.2", "127.0.0.1"}) {
+		t.Fatal(hosts, err)
+	}
+	if hosts, err := mxHosts("nomx.example"); err != nil || !reflect.DeepEqual(hosts, []string{"nomx.example"}) {
+		t.Fatal(hosts, err)
+	}
+	if _, err := mxHosts("noreply.example"); err == nil || !IsPermanentError(err) {
+		t.Fatal(err)
+	}
+	// A domain that does not exist fails permanently
+	if _, err := mxHosts("nxdomain.example"); err == nil || !IsPermanentError(err) {
+		t.Fatal(err)
+	}
+	if _, err := mxHosts("broken.example"); err == nil || IsPermanentError(err) {
+		t.Fatal(err)
+	}
+
+	mailer := Mailer{MailFrom: "laitos@example.com", DirectDelivery: true}
+	if !mailer.IsConfigured() {
+		t.Fatal("not configured")
+	}
+	// Recipients of the same domain receive the mail together
+	if err := mailer.Send("direct", "body", "x@a.example", "y@A.example"); err != nil {
+		t.Fatal(err)
+	}
+	mta.mutex.Lock()
+	mail := mta.mails[0]
+	mta.mutex.Unlock()
+	if mta.numMails() != 1 || !strings.Contains(mail, "RCPT TO:<x@a.example>RCPT TO:<y@A.example>") || !strings.Contains(mail, "Subject: direct") {
+		t.Fatal(mail)
+	}
+	// Failure to start TLS falls back to plain text
+	mta.mutex.Lock()
+	mta.offerTLS = true
+	mta.mutex.Unlock()
+	if err := mailer.SendRaw("sender@example.com", []byte("Subject: plain\r\n\r\nbody"), "z@a.example"); err != nil || mta.numMails() != 2 {
+		t.Fatal(err, mta.numMails())
+	}
+
+	// Only permanent failures make a permanent error
+	err := mailer.SendRaw("sender@example.com", []byte("Subject: mixed\r\n\r\nbody"), "x@a.example", "y@noreply.example", "z@broken.example")
+	deliveryErr, ok := err.(*DeliveryError)
+	if !ok || deliveryErr.Permanent || !reflect.DeepEqual(deliveryErr.Recipients, []string{"y@noreply.example", "z@broken.example"}) || mta.numMails() != 3 {
+		t.Fatal(err)
+	}
+	if err := mailer.SendRaw("sender@example.com", []byte("Subject: rejected\r\n\r\nbody"), "y@noreply.example"); !IsPermanentError(err) {
+		t.Fatal(err)
+	}
+	mta.setRcptReply("550 no such user")
+	if err := mailer.SendRaw("sender@example.com", []byte("Subject: rejected\r\n\r\nbody"), "x@a.example"); !IsPermanentError(err) {
+		t.Fatal(err)
+	}
+
+	// Only the recipients that did not receive the mail are queued
+	dir, err := ioutil.TempDir("", "laitos-test-mail-queue-direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue := &Queue{Directory: dir, Mailer: mailer}
+	if err := queue.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	mailer.Queue = queue
+	mta.setRcptReply("250 OK")
+	if err := mailer.SendRaw("sender@example.com", []byte("Subject: partial\r\n\r\nbody"), "x@a.example", "z@broken.example"); err != nil || mta.numMails() != 4 {
+		t.Fatal(err, mta.numMails())
+	}
+	if mails, err := queue.load(); err != nil || len(mails) != 1 || !reflect.DeepEqual(mails[0].Recipients, []string{"z@broken.example"}) {
+		t.Fatal(mails, err)
+	}
+	if !IsPermanentError(&DeliveryError{Permanent: true, Err: errors.New("")}) {
+		t.Fatal("should be permanent")
+	}
+
+	// Rejected recipients do not stop the others from receiving the mail, only temporary failures are queued.
+	mta.setRcptReplies(map[string]string{"bad@a.example": "550 no such user", "busy@a.example": "450 mailbox is busy"})
+	err = mailer.SendRaw("sender@example.com", []byte("Subject: per recipient\r\n\r\nbody"), "x@a.example", "bad@a.example", "busy@a.example")
+	deliveryErr, ok = err.(*DeliveryError)
+	if !ok || !deliveryErr.Permanent || !reflect.DeepEqual(deliveryErr.Recipients, []string{"bad@a.example"}) || mta.numMails() != 5 {
+		t.Fatal(err, mta.numMails())
+	}
+	mta.mutex.Lock()
+	mail = mta.mails[4]
+	mta.mutex.Unlock()
+	if !strings.Contains(mail, "RCPT TO:<x@a.example>") || strings.Contains(mail, "RCPT TO:<bad@a.example>") || strings.Contains(mail, "RCPT TO:<busy@a.example>") {
+		t.Fatal(mail)
+	}
+	mails, err := queue.load()
+	if err != nil || len(mails) != 2 || !reflect.DeepEqual(mails[1].Recipients, []string{"busy@a.example"}) {
+		t.Fatal(mails, err)
+	}
+	// Upon retry, recipients that fail permanently are bounced right away while the others stay in queue.
+	if err := queue.Enqueue("sender@example.com", []byte("Subject: retry\r\n\r\nbody"), nil, "bad@a.example", "busy@a.example"); err != nil {
+		t.Fatal(err)
+	}
+	if out := queue.Flush(); out != "delivered 0, still queued 3, gave up 0" {
+		t.Fatal(out)
+	}
+	mails, err = queue.load()
+	if err != nil || len(mails) != 4 || !reflect.DeepEqual(mails[2].Recipients, []string{"busy@a.example"}) ||
+		mails[3].FromAddr != "" || !reflect.DeepEqual(mails[3].Recipients, []string{"sender@example.com"}) ||
+		!strings.Contains(string(mails[3].Body), "bad@a.example") || strings.Contains(string(mails[3].Body), "busy@a.example") {
+		t.Fatal(mails, err)
+	}
+}
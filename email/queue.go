@@ -0,0 +1,332 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QueueProcessIntervalSec = 10             // Look for queued mails that are due for another attempt at this interval
+	QueueFileSuffix         = ".mail.json"   // Queued mails are stored in files that have this suffix
+	MaxBouncedHeaderLength  = 4096           // Bounce notice carries at most this many bytes of the original mail header
+	BounceSubject           = "-undelivered" // Subject of bounce notice, it comes after OutgoingMailSubjectKeyword.
+	QueueLockFile           = ".lock"        // Queued mails are processed only by the holder of exclusive lock on this file
+)
+
+// ErrQueueBusy is returned when another program or routine is processing the queue at the moment.
+var ErrQueueBusy = errors.New("mail queue is being processed by someone else, try again later")
+
+// A mail waiting in the queue for another delivery attempt.
+type QueuedMail struct {
+	ID          string    `json:"ID"`          // Unique identifier, it is also the file name in queue directory.
+	FromAddr    string    `json:"FromAddr"`    // Envelope sender, empty for bounce notices.
+	Recipients  []string  `json:"Recipients"`  // Envelope recipients
+	Body        []byte    `json:"Body"`        // Raw mail body
+	QueuedAt    time.Time `json:"QueuedAt"`    // When the mail entered the queue
+	Attempts    int       `json:"Attempts"`    // Number of failed delivery attempts
+	NextAttempt time.Time `json:"NextAttempt"` // The earliest time of next delivery attempt
+	LastError   string    `json:"LastError"`   // Error of the latest delivery attempt
+}
+
+/*
+A disk-backed queue of outgoing mails that could not be delivered right away. Queued mails are retried at exponentially
+increasing intervals, and those that expire or fail permanently are bounced to their sender. If the mail was sent by
+laitos itself, the administrators are notified instead.
+*/
+type Queue struct {
+	Directory           string   `json:"Directory"`           // Store queued mails in this directory
+	InitialRetrySec     int      `json:"InitialRetrySec"`     // (Optional) Retry a failed mail after this many seconds, the interval doubles after each failure. Default is 60.
+	MaxRetryIntervalSec int      `json:"MaxRetryIntervalSec"` // (Optional) Retry interval does not grow beyond this many seconds. Default is 3600.
+	ExpireHours         int      `json:"ExpireHours"`         // (Optional) Give up on a mail that has been queued for this many hours. Default is 72.
+	AdminRecipients     []string `json:"AdminRecipients"`     // (Optional) Notify these addresses of undelivered mails sent by laitos itself
+
+	Mailer Mailer        `json:"-"` // Deliver queued mails and bounce notices via this mailer
+	Logger global.Logger `json:"-"` // Logger
+
+	mutex    *sync.Mutex // Protect against concurrent access to queued mail files
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// Check configuration and initialise internal states.
+func (queue *Queue) Initialise() error {
+	if queue.Directory == "" {
+		return errors.New("Queue.Initialise: Directory must not be empty")
+	}
+	if !queue.Mailer.IsConfigured() {
+		return errors.New("Queue.Initialise: mailer must be configured")
+	}
+	if queue.InitialRetrySec < 0 || queue.MaxRetryIntervalSec < 0 || queue.ExpireHours < 0 {
+		return errors.New("Queue.Initialise: retry intervals and expiry must not be negative")
+	}
+	if queue.InitialRetrySec == 0 {
+		queue.InitialRetrySec = 60
+	}
+	if queue.MaxRetryIntervalSec == 0 {
+		queue.MaxRetryIntervalSec = 3600
+	}
+	if queue.ExpireHours == 0 {
+		queue.ExpireHours = 72
+	}
+	if err := os.MkdirAll(queue.Directory, 0700); err != nil {
+		return fmt.Errorf("Queue.Initialise: failed to create directory - %v", err)
+	}
+	queue.mutex = new(sync.Mutex)
+	queue.stop = make(chan struct{})
+	queue.stopOnce = new(sync.Once)
+	return nil
+}
+
+// Write the queued mail into its file.
+func (queue *Queue) save(mail *QueuedMail) error {
+	content, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	filePath := path.Join(queue.Directory, mail.ID+QueueFileSuffix)
+	// Write a temporary file first so that a crash does not leave a corrupted mail behind
+	if err := ioutil.WriteFile(filePath+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// Read all queued mails, the oldest mail comes first.
+func (queue *Queue) load() ([]*QueuedMail, error) {
+	files, err := ioutil.ReadDir(queue.Directory)
+	if err != nil {
+		return nil, err
+	}
+	mails := make([]*QueuedMail, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), QueueFileSuffix) {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(queue.Directory, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mail := new(QueuedMail)
+		if err := json.Unmarshal(content, mail); err != nil {
+			queue.Logger.Warningf("load", file.Name(), err, "failed to read queued mail")
+			continue
+		}
+		mails = append(mails, mail)
+	}
+	sort.Slice(mails, func(i, j int) bool { return mails[i].QueuedAt.Before(mails[j].QueuedAt) })
+	return mails, nil
+}
+
+// Store the mail in queue for later delivery. The error is from the initial delivery attempt.
+func (queue *Queue) Enqueue(fromAddr string, rawMailBody []byte, deliveryErr error, recipients ...string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	now := time.Now()
+	mail := &QueuedMail{
+		ID:          fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int31()),
+		FromAddr:    fromAddr,
+		Recipients:  recipients,
+		Body:        rawMailBody,
+		QueuedAt:    now,
+		Attempts:    1,
+		NextAttempt: now.Add(queue.retryInterval(1)),
+	}
+	if deliveryErr != nil {
+		mail.LastError = deliveryErr.Error()
+	}
+	if err := queue.save(mail); err != nil {
+		return fmt.Errorf("Queue.Enqueue: failed to store mail - %v", err)
+	}
+	queue.Logger.Printf("Enqueue", fromAddr, deliveryErr, "queued mail %s to %v", mail.ID, recipients)
+	return nil
+}
+
+// Return the interval between the failed attempt and the next attempt.
+func (queue *Queue) retryInterval(attempts int) time.Duration {
+	interval := time.Duration(queue.InitialRetrySec) * time.Second
+	maxInterval := time.Duration(queue.MaxRetryIntervalSec) * time.Second
+	for i := 1; i < attempts && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	return interval
+}
+
+/*
+Attempt to deliver queued mails. If force is false, only those due for another attempt are delivered, otherwise all
+of them are. Return the number of mails delivered, still queued, and given up on. If someone else is processing the
+queue at the moment, ErrQueueBusy is returned.
+*/
+func (queue *Queue) Process(force bool) (delivered, queued, failed int, err error) {
+	lock, err := queue.lockDirectory()
+	if err == ErrQueueBusy {
+		return 0, 0, 0, err
+	} else if err != nil {
+		return 0, 0, 0, fmt.Errorf("Queue.Process: failed to lock queue directory - %v", err)
+	}
+	defer lock.Close()
+	queue.mutex.Lock()
+	mails, err := queue.load()
+	queue.mutex.Unlock()
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Queue.Process: failed to read queued mails - %v", err)
+	}
+	now := time.Now()
+	for _, mail := range mails {
+		if !force && now.Before(mail.NextAttempt) {
+			queued++
+			continue
+		}
+		// Mutex is not held during delivery, so that new mails may enter the queue in the meantime.
+		deliveryErr := queue.Mailer.deliver(mail.FromAddr, mail.Body, mail.Recipients...)
+		filePath := path.Join(queue.Directory, mail.ID+QueueFileSuffix)
+		queue.mutex.Lock()
+		if deliveryErr == nil {
+			queue.Logger.Printf("Process", mail.FromAddr, nil, "delivered queued mail %s to %v after %d attempts", mail.ID, mail.Recipients, mail.Attempts+1)
+			os.Remove(filePath)
+			delivered++
+		} else {
+			mail.Attempts++
+			mail.LastError = deliveryErr.Error()
+			permanent, temporary := splitFailedRecipients(deliveryErr, mail.Recipients)
+			if now.Sub(mail.QueuedAt) > time.Duration(queue.ExpireHours)*time.Hour {
+				permanent, temporary = append(permanent, temporary...), nil
+			}
+			if len(temporary) == 0 {
+				mail.Recipients = permanent
+				queue.giveUp(mail)
+				os.Remove(filePath)
+				failed++
+			} else {
+				// Recipients that failed permanently are bounced right away, the others will be retried.
+				if len(permanent) > 0 {
+					bounced := *mail
+					bounced.Recipients = permanent
+					bounced.LastError = recipientError(deliveryErr, permanent[len(permanent)-1]).Error()
+					queue.giveUp(&bounced)
+				}
+				mail.Recipients = temporary
+				mail.NextAttempt = now.Add(queue.retryInterval(mail.Attempts))
+				if saveErr := queue.save(mail); saveErr != nil {
+					queue.Logger.Warningf("Process", mail.ID, saveErr, "failed to update queued mail")
+				}
+				queued++
+			}
+		}
+		queue.mutex.Unlock()
+	}
+	return
+}
+
+/*
+Remove the undeliverable mail from queue and notify its sender. Mails sent by laitos itself are not bounced, the
+administrators are notified instead. Bounce notices carry an empty sender so that they never bounce again.
+*/
+func (queue *Queue) giveUp(mail *QueuedMail) {
+	queue.Logger.Warningf("giveUp", mail.FromAddr, errors.New(mail.LastError), "gave up on mail %s to %v after %d attempts", mail.ID, mail.Recipients, mail.Attempts)
+	if mail.FromAddr == "" {
+		return
+	}
+	noticeTo := []string{mail.FromAddr}
+	if strings.EqualFold(mail.FromAddr, queue.Mailer.MailFrom) {
+		noticeTo = queue.AdminRecipients
+	}
+	if len(noticeTo) == 0 {
+		return
+	}
+	header := mail.Body
+	if end := bytes.Index(header, []byte("\r\n\r\n")); end != -1 {
+		header = header[:end]
+	} else if end := bytes.Index(header, []byte("\n\n")); end != -1 {
+		header = header[:end]
+	}
+	if len(header) > MaxBouncedHeaderLength {
+		header = header[:MaxBouncedHeaderLength]
+	}
+	noticeBody := fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n"+
+		"The mail queued at %s could not be delivered to %s after %d attempts.\r\nThe last error was: %s\r\n\r\nHeader of the mail:\r\n\r\n%s\r\n",
+		queue.Mailer.MailFrom, strings.Join(noticeTo, ", "), OutgoingMailSubjectKeyword+BounceSubject,
+		mail.QueuedAt.Format(time.RFC1123Z), strings.Join(mail.Recipients, ", "), mail.Attempts, mail.LastError, header)
+	now := time.Now()
+	notice := &QueuedMail{
+		ID:          fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int31()),
+		Recipients:  noticeTo,
+		Body:        []byte(noticeBody),
+		QueuedAt:    now,
+		NextAttempt: now,
+	}
+	if err := queue.save(notice); err != nil {
+		queue.Logger.Warningf("giveUp", mail.ID, err, "failed to queue bounce notice")
+	}
+}
+
+// Deliver all queued mails right away, regardless of their schedule. Return a summary of the outcome.
+func (queue *Queue) Flush() string {
+	delivered, queued, failed, err := queue.Process(true)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("delivered %d, still queued %d, gave up %d", delivered, queued, failed)
+}
+
+// Return a description of queued mails, one mail per line.
+func (queue *Queue) Inspect() string {
+	queue.mutex.Lock()
+	mails, err := queue.load()
+	queue.mutex.Unlock()
+	if err != nil {
+		return fmt.Sprintf("failed to read queued mails - %v", err)
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%d mails in queue\n", len(mails))
+	for _, mail := range mails {
+		fmt.Fprintf(&out, "%s from <%s> to %v, queued %s, %d attempts, next %s, last error: %s\n",
+			mail.ID, mail.FromAddr, mail.Recipients, mail.QueuedAt.Format(time.RFC3339), mail.Attempts,
+			mail.NextAttempt.Format(time.RFC3339), mail.LastError)
+	}
+	return out.String()
+}
+
+/*
+You may call this function only after having called Initialise()!
+Periodically deliver queued mails that are due for another attempt, block until queue is told to stop.
+*/
+func (queue *Queue) StartAndBlock() error {
+	queue.Logger.Printf("StartAndBlock", queue.Directory, nil, "going to process queued mails")
+	ticker := time.NewTicker(QueueProcessIntervalSec * time.Second)
+	defer ticker.Stop()
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		// Another program may be processing the same queue directory, it will get to the due mails.
+		if _, _, _, err := queue.Process(false); err != nil && err != ErrQueueBusy {
+			queue.Logger.Warningf("StartAndBlock", queue.Directory, err, "failed to process queued mails")
+		}
+		select {
+		case <-queue.stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop processing queued mails. Mails remain in the queue directory.
+func (queue *Queue) Stop() {
+	queue.stopOnce.Do(func() {
+		close(queue.stop)
+	})
+}
@@ -0,0 +1,50 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package email
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+)
+
+// Queue directories being processed by this program, file locks are not available on this platform.
+var lockedDirectories = struct {
+	dirs  map[string]struct{}
+	mutex sync.Mutex
+}{dirs: make(map[string]struct{})}
+
+// Releases the lock of a queue directory when closed.
+type directoryLock struct {
+	dir  string
+	once sync.Once
+}
+
+func (lock *directoryLock) Close() error {
+	lock.once.Do(func() {
+		lockedDirectories.mutex.Lock()
+		delete(lockedDirectories.dirs, lock.dir)
+		lockedDirectories.mutex.Unlock()
+	})
+	return nil
+}
+
+/*
+Take exclusive lock on queue directory, so that only one routine processes the queue at a time. On this platform the
+lock only excludes routines of this program, hence do not let multiple programs share a queue directory. Closing the
+returned lock releases it.
+*/
+func (queue *Queue) lockDirectory() (io.Closer, error) {
+	dir, err := filepath.Abs(queue.Directory)
+	if err != nil {
+		return nil, err
+	}
+	lockedDirectories.mutex.Lock()
+	defer lockedDirectories.mutex.Unlock()
+	if _, locked := lockedDirectories.dirs[dir]; locked {
+		return nil, ErrQueueBusy
+	}
+	lockedDirectories.dirs[dir] = struct{}{}
+	return &directoryLock{dir: dir}, nil
+}
@@ -0,0 +1,307 @@
+package email
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A minimal SMTP server that replies to RCPT TO with the configured reply and records delivered mails.
+type testMTA struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	rcptReply   string
+	rcptReplies map[string]string // Replies to specific recipient addresses, they override rcptReply.
+	offerTLS    bool              // Advertise STARTTLS but fail to start TLS
+	mails       []string
+}
+
+func startTestMTA(t *testing.T) *testMTA {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mta := &testMTA{listener: listener, rcptReply: "250 OK"}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mta.converse(conn)
+		}
+	}()
+	return mta
+}
+
+func (mta *testMTA) port() int {
+	return mta.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (mta *testMTA) setRcptReply(reply string) {
+	mta.mutex.Lock()
+	mta.rcptReply = reply
+	mta.mutex.Unlock()
+}
+
+func (mta *testMTA) setRcptReplies(replies map[string]string) {
+	mta.mutex.Lock()
+	mta.rcptReplies = replies
+	mta.mutex.Unlock()
+}
+
+func (mta *testMTA) numMails() int {
+	mta.mutex.Lock()
+	defer mta.mutex.Unlock()
+	return len(mta.mails)
+}
+
+func (mta *testMTA) converse(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 test MTA")
+	var mail []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			mta.mutex.Lock()
+			offerTLS := mta.offerTLS
+			mta.mutex.Unlock()
+			if offerTLS {
+				reply("250-test MTA")
+				reply("250 STARTTLS")
+			} else {
+				reply("250 test MTA")
+			}
+		case cmd == "STARTTLS":
+			reply("454 TLS not available")
+		case strings.HasPrefix(cmd, "MAIL FROM"):
+			mail = []string{strings.TrimSpace(line)}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO"):
+			mta.mutex.Lock()
+			rcptReply := mta.rcptReply
+			addr := line[strings.IndexByte(line, '<')+1 : strings.LastIndexByte(line, '>')]
+			if reply, exists := mta.rcptReplies[addr]; exists {
+				rcptReply = reply
+			}
+			mta.mutex.Unlock()
+			if strings.HasPrefix(rcptReply, "250") {
+				mail = append(mail, strings.TrimSpace(line))
+			}
+			reply(rcptReply)
+		case cmd == "DATA":
+			reply("354 go ahead")
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				mail = append(mail, dataLine)
+			}
+			mta.mutex.Lock()
+			mta.mails = append(mta.mails, strings.Join(mail, ""))
+			mta.mutex.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	mta := startTestMTA(t)
+	defer mta.listener.Close()
+	dir, err := ioutil.TempDir("", "laitos-test-mail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mailer := Mailer{MailFrom: "laitos@example.com", MTAHost: "127.0.0.1", MTAPort: mta.port()}
+	queue := Queue{}
+	if err := queue.Initialise(); err == nil || !strings.Contains(err.Error(), "Directory") {
+		t.Fatal(err)
+	}
+	queue.Directory = dir
+	if err := queue.Initialise(); err == nil || !strings.Contains(err.Error(), "mailer") {
+		t.Fatal(err)
+	}
+	queue.Mailer = mailer
+	queue.AdminRecipients = []string{"admin@example.com"}
+	if err := queue.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if queue.InitialRetrySec != 60 || queue.MaxRetryIntervalSec != 3600 || queue.ExpireHours != 72 {
+		t.Fatalf("%+v", queue)
+	}
+	if interval := queue.retryInterval(1); interval != time.Minute {
+		t.Fatal(interval)
+	}
+	if interval := queue.retryInterval(3); interval != 4*time.Minute {
+		t.Fatal(interval)
+	}
+	if interval := queue.retryInterval(100); interval != time.Hour {
+		t.Fatal(interval)
+	}
+	mailer.Queue = &queue
+
+	// Mail that can be delivered right away does not enter the queue
+	if err := mailer.Send("subject", "body", "a@example.com"); err != nil || mta.numMails() != 1 {
+		t.Fatal(err, mta.numMails())
+	}
+	// Temporary failure puts the mail into queue
+	mta.setRcptReply("450 mailbox is busy")
+	if err := mailer.SendRaw("sender@example.com", []byte("Subject: queued\r\n\r\nbody"), "b@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if out := queue.Inspect(); !strings.HasPrefix(out, "1 mails in queue") || !strings.Contains(out, "mailbox is busy") {
+		t.Fatal(out)
+	}
+	// The mail is not due yet
+	if delivered, queued, failed, err := queue.Process(false); err != nil || delivered != 0 || queued != 1 || failed != 0 {
+		t.Fatal(delivered, queued, failed, err)
+	}
+	// Flushing retries regardless of schedule, the attempt fails once again.
+	if out := queue.Flush(); out != "delivered 0, still queued 1, gave up 0" {
+		t.Fatal(out)
+	}
+	if out := queue.Inspect(); !strings.Contains(out, "2 attempts") {
+		t.Fatal(out)
+	}
+	// Succeed when MTA is ready again
+	mta.setRcptReply("250 OK")
+	if out := queue.Flush(); out != "delivered 1, still queued 0, gave up 0" || mta.numMails() != 2 {
+		t.Fatal(out, mta.numMails())
+	}
+
+	// Only one routine processes the queue at a time, while the queue remains open to new mails.
+	lock, err := queue.lockDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := queue.Flush(); out != ErrQueueBusy.Error() {
+		t.Fatal(out)
+	}
+	if _, _, _, err := queue.Process(false); err != ErrQueueBusy {
+		t.Fatal(err)
+	}
+	lock.Close()
+	if out := queue.Flush(); out != "delivered 0, still queued 0, gave up 0" {
+		t.Fatal(out)
+	}
+
+	// Permanent failure is returned right away and the mail is not queued
+	mta.setRcptReply("550 no such user")
+	if err := mailer.SendRaw("sender@example.com", []byte("Subject: rejected\r\n\r\nbody"), "c@example.com"); err == nil || !IsPermanentError(err) {
+		t.Fatal(err)
+	}
+	if out := queue.Inspect(); !strings.HasPrefix(out, "0 mails in queue") {
+		t.Fatal(out)
+	}
+
+	// Mail that fails permanently during retry bounces to its sender
+	mta.setRcptReply("450 mailbox is busy")
+	if err := mailer.SendRaw("sender@example.com", []byte("Subject: to bounce\r\n\r\nbody"), "d@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	mta.setRcptReply("550 no such user")
+	if out := queue.Flush(); out != "delivered 0, still queued 0, gave up 1" {
+		t.Fatal(out)
+	}
+	mta.setRcptReply("250 OK")
+	if out := queue.Flush(); out != "delivered 1, still queued 0, gave up 0" || mta.numMails() != 3 {
+		t.Fatal(out, mta.numMails())
+	}
+	mta.mutex.Lock()
+	bounce := mta.mails[2]
+	mta.mutex.Unlock()
+	if !strings.HasPrefix(bounce, "MAIL FROM:<>") || !strings.Contains(bounce, "To: sender@example.com") ||
+		!strings.Contains(bounce, "Subject: to bounce") || !strings.Contains(bounce, "no such user") {
+		t.Fatal(bounce)
+	}
+
+	// Expired mail sent by laitos itself notifies the administrators, and notices that fail are dropped.
+	mta.setRcptReply("450 mailbox is busy")
+	if err := mailer.Send("expiring", "body", "e@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	mails, err := queue.load()
+	if err != nil || len(mails) != 1 {
+		t.Fatal(mails, err)
+	}
+	mails[0].QueuedAt = time.Now().Add(-73 * time.Hour)
+	if err := queue.save(mails[0]); err != nil {
+		t.Fatal(err)
+	}
+	if out := queue.Flush(); out != "delivered 0, still queued 0, gave up 1" {
+		t.Fatal(out)
+	}
+	if out := queue.Inspect(); !strings.HasPrefix(out, "1 mails in queue") || !strings.Contains(out, "from <> to [admin@example.com]") {
+		t.Fatal(out)
+	}
+	mta.setRcptReply("550 no such user")
+	if out := queue.Flush(); out != "delivered 0, still queued 0, gave up 1" {
+		t.Fatal(out)
+	}
+	if out := queue.Inspect(); !strings.HasPrefix(out, "0 mails in queue") {
+		t.Fatal(out)
+	}
+
+	// Queued mails are retried in background
+	mta.setRcptReply("450 mailbox is busy")
+	if err := mailer.Send("background", "body", "f@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	mta.setRcptReply("250 OK")
+	mails, _ = queue.load()
+	mails[0].NextAttempt = time.Now()
+	queue.save(mails[0])
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- queue.StartAndBlock()
+	}()
+	time.Sleep(1 * time.Second)
+	if mta.numMails() != 4 {
+		t.Fatal(mta.numMails())
+	}
+	queue.Stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not stop")
+	}
+	// Repeatedly stopping the queue should have no negative consequence
+	queue.Stop()
+
+	// Unreachable MTA is a temporary failure
+	mta.listener.Close()
+	if err := mailer.Send("unreachable", "body", "g@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if out := queue.Inspect(); !strings.HasPrefix(out, "1 mails in queue") || !strings.Contains(out, strconv.Itoa(mta.port())) {
+		t.Fatal(out)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package email
+
+import (
+	"io"
+	"os"
+	"path"
+	"syscall"
+)
+
+/*
+Take exclusive lock on the lock file in queue directory, so that only one program or routine processes the queue at a
+time. Closing the returned file releases the lock.
+*/
+func (queue *Queue) lockDirectory() (io.Closer, error) {
+	lockFile, err := os.OpenFile(path.Join(queue.Directory, QueueLockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lockFile.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrQueueBusy
+		}
+		return nil, err
+	}
+	return lockFile, nil
+}
@@ -4,18 +4,23 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"github.com/HouzuoGuo/laitos/dnsstats"
+	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/env"
 	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/traffic"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"time"
 )
 
-var ErrBadEnvInfoChoice = errors.New(`elock | estop | log | warn | runtime | stack`)
+var ErrNoMailQueue = errors.New("outgoing mail queue is not configured")
+var ErrBadEnvInfoChoice = errors.New(`elock | estop | log | warn | runtime | stack | dnsstats | socktraffic | mailq | mailqflush`)
 
 // Retrieve environment information and trigger emergency stop upon request.
 type EnvControl struct {
+	MailQueue *email.Queue `json:"-"` // Outgoing mail queue to be inspected and flushed
 }
 
 func (info *EnvControl) IsConfigured() bool {
@@ -53,6 +58,20 @@ func (info *EnvControl) Execute(cmd Command) *Result {
 		return &Result{Output: GetLatestWarnings()}
 	case "stack":
 		return &Result{Output: GetGoroutineStacktraces()}
+	case "dnsstats":
+		return &Result{Output: dnsstats.Common.Format(dnsstats.DefaultTopN)}
+	case "socktraffic":
+		return &Result{Output: traffic.Common.Format()}
+	case "mailq":
+		if info.MailQueue == nil {
+			return &Result{Error: ErrNoMailQueue}
+		}
+		return &Result{Output: info.MailQueue.Inspect()}
+	case "mailqflush":
+		if info.MailQueue == nil {
+			return &Result{Error: ErrNoMailQueue}
+		}
+		return &Result{Output: info.MailQueue.Flush()}
 	default:
 		return &Result{Error: ErrBadEnvInfoChoice}
 	}
@@ -1,7 +1,10 @@
 package feature
 
 import (
+	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/global"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 )
@@ -35,4 +38,31 @@ func TestEnvInfo_Execute(t *testing.T) {
 	if ret := info.Execute(Command{Content: "stack"}); ret.Error != nil || strings.Index(ret.Output, "routine") == -1 {
 		t.Fatal(ret)
 	}
+	if ret := info.Execute(Command{Content: "dnsstats"}); ret.Error != nil || strings.Index(ret.Output, "Top queried") == -1 {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "socktraffic"}); ret.Error != nil || ret.Output == "" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "mailq"}); ret.Error != ErrNoMailQueue {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "mailqflush"}); ret.Error != ErrNoMailQueue {
+		t.Fatal(ret)
+	}
+	queueDir, err := ioutil.TempDir("", "laitos-test-envinfo-mailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(queueDir)
+	info.MailQueue = &email.Queue{Directory: queueDir, Mailer: email.Mailer{MailFrom: "a@example.com", MTAHost: "127.0.0.1", MTAPort: 25}}
+	if err := info.MailQueue.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if ret := info.Execute(Command{Content: "mailq"}); ret.Error != nil || ret.Output != "0 mails in queue\n" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "mailqflush"}); ret.Error != nil || ret.Output != "delivered 0, still queued 0, gave up 0" {
+		t.Fatal(ret)
+	}
 }
@@ -31,6 +31,10 @@ func (email *SendMail) SelfTest() error {
 	if !email.IsConfigured() {
 		return ErrIncompleteConfig
 	}
+	// Direct delivery does not rely on a particular MTA
+	if email.Mailer.DirectDelivery {
+		return nil
+	}
 	if _, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", email.Mailer.MTAHost, email.Mailer.MTAPort), TestTimeoutSec*time.Second); err != nil {
 		return err
 	}
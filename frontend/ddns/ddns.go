@@ -0,0 +1,143 @@
+package ddns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/email"
+	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/global"
+	"net"
+	"time"
+)
+
+const DefaultIntervalSec = 300 // Check public IP address every 5 minutes by default
+
+/*
+Periodically discover public IP address of this host. When the address changes, update names on authoritative name
+servers (RFC 2136), on dynamic DNS providers (dyndns2), and among local records of DNS daemon, then send a notification
+mail.
+*/
+type DDNS struct {
+	IntervalSec int             `json:"IntervalSec"` // (Optional) check public IP address at this interval, default to 300 seconds.
+	RFC2136     []RFC2136Target `json:"RFC2136"`     // (Optional) update these names via RFC 2136 dynamic update
+	DynDNS2     []DynDNS2Target `json:"DynDNS2"`     // (Optional) update these names via dyndns2 HTTP protocol
+	LocalNames  []string        `json:"LocalNames"`  // (Optional) point these local records of DNS daemon to the public IP address
+	Recipients  []string        `json:"Recipients"`  // (Optional) notify these addresses when public IP address changes
+
+	Mailer      email.Mailer  `json:"-"` // Send notification mails via this mailer
+	DNSDaemon   *dnsd.DNSD    `json:"-"` // Update local records of this initialised DNS daemon
+	GetPublicIP func() string `json:"-"` // Discover public IP address via this function, default to env.GetPublicIP.
+	Logger      global.Logger `json:"-"`
+
+	lastIP     string // Public IP address that all targets have been updated with
+	notifiedIP string // Public IP address that recipients have been notified of
+}
+
+// Check configuration and initialise internal states.
+func (ddns *DDNS) Initialise() error {
+	if len(ddns.RFC2136) == 0 && len(ddns.DynDNS2) == 0 && len(ddns.LocalNames) == 0 {
+		return errors.New("DDNS.Initialise: there must be at least one name to update")
+	}
+	if ddns.IntervalSec < 1 {
+		ddns.IntervalSec = DefaultIntervalSec
+	}
+	for i := range ddns.RFC2136 {
+		if err := ddns.RFC2136[i].Initialise(); err != nil {
+			return fmt.Errorf("DDNS.Initialise: %v", err)
+		}
+	}
+	for i := range ddns.DynDNS2 {
+		if err := ddns.DynDNS2[i].Initialise(); err != nil {
+			return fmt.Errorf("DDNS.Initialise: %v", err)
+		}
+	}
+	if len(ddns.LocalNames) > 0 && ddns.DNSDaemon == nil {
+		return errors.New("DDNS.Initialise: DNS daemon must be present if LocalNames are configured")
+	}
+	if len(ddns.Recipients) > 0 && !ddns.Mailer.IsConfigured() {
+		return errors.New("DDNS.Initialise: Recipients are configured but mailer is not")
+	}
+	if ddns.GetPublicIP == nil {
+		ddns.GetPublicIP = env.GetPublicIP
+	}
+	ddns.lastIP = ""
+	ddns.notifiedIP = ""
+	return nil
+}
+
+// Update all names with the IP address. Return a text report of the updates and the number of updates that failed.
+func (ddns *DDNS) UpdateAll(ip string) (string, int) {
+	report := new(bytes.Buffer)
+	var numFailures int
+	logResult := func(kind, name string, err error) {
+		if err == nil {
+			fmt.Fprintf(report, "%s %s: OK\n", kind, name)
+			ddns.Logger.Printf("UpdateAll", name, nil, "updated %s record to %s", kind, ip)
+		} else {
+			numFailures++
+			fmt.Fprintf(report, "%s %s: %v\n", kind, name, err)
+			ddns.Logger.Warningf("UpdateAll", name, err, "failed to update %s record to %s", kind, ip)
+		}
+	}
+	for _, target := range ddns.RFC2136 {
+		logResult("RFC2136", target.Name, target.Update(ip))
+	}
+	for _, target := range ddns.DynDNS2 {
+		logResult("dyndns2", target.Hostname, target.Update(ip))
+	}
+	for _, name := range ddns.LocalNames {
+		logResult("local", name, ddns.DNSDaemon.SetLocalRecord(name, ip))
+	}
+	return report.String(), numFailures
+}
+
+/*
+Discover public IP address and update all names if the address has changed since last time. Failed updates are retried
+at next check, though recipients are notified of each new address only once. Return true only if all names carry the
+latest address.
+*/
+func (ddns *DDNS) Execute() bool {
+	ip := ddns.GetPublicIP()
+	if net.ParseIP(ip) == nil {
+		ddns.Logger.Warningf("Execute", ip, nil, "failed to determine public IP address")
+		return false
+	}
+	if ip == ddns.lastIP {
+		return true
+	}
+	previousIP := ddns.lastIP
+	if previousIP == "" {
+		previousIP = "(unknown)"
+	}
+	ddns.Logger.Printf("Execute", ip, nil, "public IP address has changed from %s", previousIP)
+	report, numFailures := ddns.UpdateAll(ip)
+	if numFailures == 0 {
+		ddns.lastIP = ip
+	}
+	if ip != ddns.notifiedIP && len(ddns.Recipients) > 0 {
+		body := fmt.Sprintf("Public IP address has changed from %s to %s.\n\n%s", previousIP, ip, report)
+		if err := ddns.Mailer.Send(email.OutgoingMailSubjectKeyword+"-ddns", body, ddns.Recipients...); err == nil {
+			ddns.notifiedIP = ip
+		} else {
+			ddns.Logger.Warningf("Execute", ip, err, "failed to send notification mail")
+		}
+	}
+	return numFailures == 0
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start public IP address check loop and block until this program exits.
+*/
+func (ddns *DDNS) StartAndBlock() error {
+	ddns.Logger.Printf("StartAndBlock", "", nil, "going to check public IP address every %d seconds", ddns.IntervalSec)
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		ddns.Execute()
+		time.Sleep(time.Duration(ddns.IntervalSec) * time.Second)
+	}
+}
@@ -0,0 +1,93 @@
+package ddns
+
+import (
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDDNS(t *testing.T) {
+	ddns := DDNS{}
+	if err := ddns.Initialise(); err == nil || !strings.Contains(err.Error(), "at least one name") {
+		t.Fatal(err)
+	}
+	ddns.LocalNames = []string{"home.example.com"}
+	if err := ddns.Initialise(); err == nil || !strings.Contains(err.Error(), "DNS daemon") {
+		t.Fatal(err)
+	}
+	ddns.DNSDaemon = &dnsd.DNSD{
+		TCPListenAddress: "127.0.0.1",
+		TCPListenPort:    16861,
+		TCPForwardTo:     "127.0.0.1:53",
+		PerIPLimit:       10,
+		AllowQueryCIDRs:  []string{"127.0.0.0/8"},
+	}
+	if err := ddns.DNSDaemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	ddns.Recipients = []string{"howard@localhost"}
+	if err := ddns.Initialise(); err == nil || !strings.Contains(err.Error(), "mailer") {
+		t.Fatal(err)
+	}
+	ddns.Recipients = nil
+
+	// A dyndns2 provider that accepts the first update and refuses the others
+	var numDynDNS2Updates int
+	var lastQuery string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.Write([]byte("badauth"))
+			return
+		}
+		numDynDNS2Updates++
+		lastQuery = r.URL.RawQuery
+		if numDynDNS2Updates > 1 {
+			w.Write([]byte("abuse"))
+			return
+		}
+		w.Write([]byte("good " + r.FormValue("myip")))
+	}))
+	defer provider.Close()
+	ddns.DynDNS2 = []DynDNS2Target{{URL: "ftp://example.com", Hostname: "home.example.com"}}
+	if err := ddns.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	ddns.DynDNS2 = []DynDNS2Target{{URL: provider.URL + "/nic/update", Hostname: "home.example.com", Username: "user", Password: "pass"}}
+	received := make(chan []byte, 10)
+	ddns.RFC2136 = []RFC2136Target{{Server: startUpdateServer(t, 0, received), Zone: "example.com", Name: "home.example.com", TSIGKeyName: "key", TSIGSecret: testSecret}}
+	publicIP := ""
+	ddns.GetPublicIP = func() string { return publicIP }
+	if err := ddns.Initialise(); err != nil || ddns.IntervalSec != DefaultIntervalSec {
+		t.Fatal(err, ddns.IntervalSec)
+	}
+
+	// Nothing is updated if public IP is unknown
+	if ddns.Execute() || numDynDNS2Updates != 0 || len(received) != 0 {
+		t.Fatal("should not have updated")
+	}
+	// All names are updated
+	publicIP = "1.2.3.4"
+	if !ddns.Execute() || numDynDNS2Updates != 1 || len(received) != 1 || lastQuery != "hostname=home.example.com&myip=1.2.3.4" {
+		t.Fatal("did not update", numDynDNS2Updates, len(received), lastQuery)
+	}
+	if ipv4, _, exists := ddns.DNSDaemon.GetLocalRecord("home.example.com"); !exists || ipv4.String() != "1.2.3.4" {
+		t.Fatal(ipv4, exists)
+	}
+	// Nothing is updated if public IP stays the same
+	if !ddns.Execute() || numDynDNS2Updates != 1 || len(received) != 1 {
+		t.Fatal("should not have updated")
+	}
+	// Failed updates are retried at next check
+	publicIP = "5.6.7.8"
+	if ddns.Execute() || numDynDNS2Updates != 2 || len(received) != 2 {
+		t.Fatal("should have failed")
+	}
+	if ddns.Execute() || numDynDNS2Updates != 3 || len(received) != 3 {
+		t.Fatal("should have retried")
+	}
+	if ipv4, _, _ := ddns.DNSDaemon.GetLocalRecord("home.example.com"); ipv4.String() != "5.6.7.8" {
+		t.Fatal(ipv4)
+	}
+}
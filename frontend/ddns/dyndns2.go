@@ -0,0 +1,54 @@
+package ddns
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/httpclient"
+	"net/http"
+	"strings"
+)
+
+const DynDNS2TimeoutSec = 30 // Timeout of HTTP request made toward dyndns2 endpoint
+
+// Update a name via the "dyndns2" HTTP protocol that is supported by most dynamic DNS providers.
+type DynDNS2Target struct {
+	URL      string `json:"URL"`      // Update endpoint, e.g. "https://members.dyndns.org/nic/update"
+	Hostname string `json:"Hostname"` // Name to update, e.g. "home.example.com"
+	Username string `json:"Username"` // Username for basic authentication
+	Password string `json:"Password"` // Password for basic authentication
+}
+
+// Check configuration of the target.
+func (target *DynDNS2Target) Initialise() error {
+	if target.URL == "" || target.Hostname == "" {
+		return errors.New("DynDNS2Target.Initialise: URL and Hostname must not be empty")
+	}
+	if !strings.HasPrefix(target.URL, "http://") && !strings.HasPrefix(target.URL, "https://") {
+		return fmt.Errorf("DynDNS2Target.Initialise: \"%s\" is not an HTTP URL", target.URL)
+	}
+	return nil
+}
+
+// Replace the address of the name with the IP address.
+func (target *DynDNS2Target) Update(ip string) error {
+	resp, err := httpclient.DoHTTP(httpclient.Request{
+		TimeoutSec: DynDNS2TimeoutSec,
+		RequestFunc: func(req *http.Request) error {
+			req.SetBasicAuth(target.Username, target.Password)
+			req.Header.Set("User-Agent", "laitos")
+			return nil
+		},
+	}, strings.Replace(target.URL, "%", "%%", -1)+"?hostname=%s&myip=%s", target.Hostname, ip)
+	if err != nil {
+		return fmt.Errorf("DynDNS2Target.Update: %v", err)
+	}
+	if err := resp.Non2xxToError(); err != nil {
+		return fmt.Errorf("DynDNS2Target.Update: %v", err)
+	}
+	// Successful updates are answered by "good <IP>" or "nochg <IP>", other answers such as "badauth" are errors.
+	answer := strings.TrimSpace(string(resp.Body))
+	if !strings.HasPrefix(answer, "good") && !strings.HasPrefix(answer, "nochg") {
+		return fmt.Errorf("DynDNS2Target.Update: provider refused to update \"%s\" - %s", target.Hostname, answer)
+	}
+	return nil
+}
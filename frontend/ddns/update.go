@@ -0,0 +1,153 @@
+package ddns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	OpcodeUpdate      = 5                 // DNS opcode of dynamic update (RFC 2136)
+	TypeSOA           = 6                 // DNS resource record type of start of authority, used by zone section of update message.
+	TypeTSIG          = 250               // DNS resource record type of transaction signature (RFC 2845)
+	ClassANY          = 255               // DNS class that deletes an RRset in update message, it is also the class of TSIG record.
+	TSIGAlgorithm     = "hmac-sha256."    // The only supported TSIG algorithm
+	TSIGFudgeSec      = 300               // Permitted clock difference between laitos and name server
+	DefaultRecordTTL  = 300               // TTL of updated records by default
+	DefaultUpdatePort = "53"              // Send update messages to this port if name server address does not come with one
+	UpdateTimeoutSec  = dnsd.IOTimeoutSec // IO timeout of the conversation with name server
+)
+
+// Update a name on an authoritative name server via RFC 2136 dynamic update signed by a TSIG key.
+type RFC2136Target struct {
+	Server      string `json:"Server"`      // Name server address, e.g. "ns1.example.com:53"
+	Zone        string `json:"Zone"`        // Zone that the name belongs to, e.g. "example.com"
+	Name        string `json:"Name"`        // Name to update, e.g. "home.example.com"
+	TTL         int    `json:"TTL"`         // (Optional) TTL of the updated record, default to 300 seconds.
+	TSIGKeyName string `json:"TSIGKeyName"` // Name of TSIG key shared with name server
+	TSIGSecret  string `json:"TSIGSecret"`  // Base64-encoded secret of TSIG key, the key algorithm must be hmac-sha256.
+}
+
+// Check configuration of the target and fill in default values.
+func (target *RFC2136Target) Initialise() error {
+	if target.Server == "" || target.Zone == "" || target.Name == "" {
+		return errors.New("RFC2136Target.Initialise: Server, Zone, and Name must not be empty")
+	}
+	if _, _, err := net.SplitHostPort(target.Server); err != nil {
+		target.Server = net.JoinHostPort(target.Server, DefaultUpdatePort)
+	}
+	if target.TSIGKeyName == "" || target.TSIGSecret == "" {
+		return fmt.Errorf("RFC2136Target.Initialise: TSIG key of \"%s\" must not be empty", target.Name)
+	}
+	if _, err := base64.StdEncoding.DecodeString(target.TSIGSecret); err != nil {
+		return fmt.Errorf("RFC2136Target.Initialise: TSIG secret of \"%s\" is not base64 - %v", target.Name, err)
+	}
+	if target.TTL < 1 {
+		target.TTL = DefaultRecordTTL
+	}
+	return nil
+}
+
+// Append a resource record in uncompressed wire format to the message.
+func appendRecord(msg []byte, name string, rType, class uint16, ttl uint32, data []byte) []byte {
+	msg = append(msg, dnsd.EncodeName(name)...)
+	header := make([]byte, 10)
+	binary.BigEndian.PutUint16(header, rType)
+	binary.BigEndian.PutUint16(header[2:], class)
+	binary.BigEndian.PutUint32(header[4:], ttl)
+	binary.BigEndian.PutUint16(header[8:], uint16(len(data)))
+	msg = append(msg, header...)
+	return append(msg, data...)
+}
+
+/*
+Create an update message (without length prefix) that replaces the A or AAAA record of the name with the IP address,
+and sign the message with TSIG key.
+*/
+func (target *RFC2136Target) BuildUpdate(id uint16, ip net.IP, timeSigned time.Time) ([]byte, error) {
+	rType, data := uint16(dnsd.TypeAAAA), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		rType, data = dnsd.TypeA, ip4
+	} else if data == nil {
+		return nil, errors.New("RFC2136Target.BuildUpdate: bad IP address")
+	}
+	secret, err := base64.StdEncoding.DecodeString(target.TSIGSecret)
+	if err != nil {
+		return nil, fmt.Errorf("RFC2136Target.BuildUpdate: bad TSIG secret - %v", err)
+	}
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = OpcodeUpdate << 3
+	binary.BigEndian.PutUint16(msg[4:], 1) // zone section
+	binary.BigEndian.PutUint16(msg[8:], 2) // update section
+	// Zone section
+	msg = append(msg, dnsd.EncodeName(target.Zone)...)
+	msg = append(msg, 0, TypeSOA, 0, dnsd.ClassIN)
+	// Update section deletes the existing RRset and then adds the new address
+	msg = appendRecord(msg, target.Name, rType, ClassANY, 0, nil)
+	msg = appendRecord(msg, target.Name, rType, dnsd.ClassIN, uint32(target.TTL), data)
+
+	// TSIG variables are signed along with the message (RFC 2845 section 3.4)
+	keyName := dnsd.EncodeName(strings.ToLower(target.TSIGKeyName))
+	algorithm := dnsd.EncodeName(TSIGAlgorithm)
+	timeFudge := make([]byte, 8)
+	binary.BigEndian.PutUint16(timeFudge, uint16(timeSigned.Unix()>>32))
+	binary.BigEndian.PutUint32(timeFudge[2:], uint32(timeSigned.Unix()))
+	binary.BigEndian.PutUint16(timeFudge[6:], TSIGFudgeSec)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write([]byte{0, ClassANY, 0, 0, 0, 0})
+	mac.Write(algorithm)
+	mac.Write(timeFudge)
+	mac.Write([]byte{0, 0, 0, 0}) // error and other length
+	signature := mac.Sum(nil)
+
+	// TSIG record data is made of algorithm, time signed, fudge, MAC, original ID, error, and other data.
+	tsigData := append([]byte{}, algorithm...)
+	tsigData = append(tsigData, timeFudge...)
+	tsigData = append(tsigData, byte(len(signature)>>8), byte(len(signature)))
+	tsigData = append(tsigData, signature...)
+	tsigData = append(tsigData, msg[0], msg[1], 0, 0, 0, 0)
+	msg = appendRecord(msg, target.TSIGKeyName, TypeTSIG, ClassANY, 0, tsigData)
+	binary.BigEndian.PutUint16(msg[10:], 1) // additional section carries TSIG record
+	return msg, nil
+}
+
+// Replace the address of the name on name server with the IP address.
+func (target *RFC2136Target) Update(ip string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("RFC2136Target.Update: \"%s\" is not an IP address", ip)
+	}
+	id := uint16(rand.Intn(65536))
+	msg, err := target.BuildUpdate(id, addr, time.Now())
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", target.Server, UpdateTimeoutSec*time.Second)
+	if err != nil {
+		return fmt.Errorf("RFC2136Target.Update: failed to connect to %s - %v", target.Server, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(UpdateTimeoutSec * time.Second))
+	response, err := dnsd.ExchangeTCPQuery(conn, msg)
+	if err != nil {
+		return fmt.Errorf("RFC2136Target.Update: %v", err)
+	}
+	if len(response) < 12 || binary.BigEndian.Uint16(response) != id {
+		return errors.New("RFC2136Target.Update: malformed response from name server")
+	}
+	if rcode := response[3] & 0xf; rcode != 0 {
+		return fmt.Errorf("RFC2136Target.Update: name server refused to update \"%s\" with response code %d", target.Name, rcode)
+	}
+	return nil
+}
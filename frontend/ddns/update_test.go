@@ -0,0 +1,125 @@
+package ddns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var testSecret = base64.StdEncoding.EncodeToString([]byte("laitos-test-tsig-secret"))
+
+// Start a TCP name server that answers each update message with the response code, and sends received messages to the channel.
+func startUpdateServer(t *testing.T, rcode byte, received chan []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			lenBuf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, lenBuf); err != nil {
+				conn.Close()
+				continue
+			}
+			msg := make([]byte, binary.BigEndian.Uint16(lenBuf))
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				conn.Close()
+				continue
+			}
+			received <- msg
+			response := append([]byte{}, msg[:12]...)
+			response[2] |= 0x80
+			response[3] = rcode
+			conn.Write(append([]byte{0, 12}, response...))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRFC2136Target_BuildUpdate(t *testing.T) {
+	target := RFC2136Target{Server: "127.0.0.1", Zone: "example.com", Name: "home.example.com", TSIGKeyName: "Laitos-Key", TSIGSecret: "not base64"}
+	if err := target.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	target.TSIGSecret = testSecret
+	if err := target.Initialise(); err != nil || target.Server != "127.0.0.1:53" || target.TTL != DefaultRecordTTL {
+		t.Fatal(err, target)
+	}
+	now := time.Unix(1500000000, 0)
+	msg, err := target.BuildUpdate(1234, net.ParseIP("1.2.3.4"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(msg) != 1234 || msg[2]>>3 != OpcodeUpdate ||
+		binary.BigEndian.Uint16(msg[4:]) != 1 || binary.BigEndian.Uint16(msg[8:]) != 2 || binary.BigEndian.Uint16(msg[10:]) != 1 {
+		t.Fatal(msg[:12])
+	}
+	// The message ends with TSIG record of the key
+	keyName := dnsd.EncodeName("Laitos-Key")
+	algorithm := dnsd.EncodeName(TSIGAlgorithm)
+	tsigLen := len(keyName) + 10 + len(algorithm) + 10 + sha256.Size + 6
+	tsig := msg[len(msg)-tsigLen:]
+	if string(tsig[:len(keyName)]) != string(keyName) || binary.BigEndian.Uint16(tsig[len(keyName):]) != TypeTSIG {
+		t.Fatal(tsig)
+	}
+	// Verify the MAC against message without TSIG record, its additional count is zero.
+	unsigned := append([]byte{}, msg[:len(msg)-tsigLen]...)
+	binary.BigEndian.PutUint16(unsigned[10:], 0)
+	rdata := tsig[len(keyName)+10:]
+	if string(rdata[:len(algorithm)]) != string(algorithm) {
+		t.Fatal(rdata)
+	}
+	timeFudge := rdata[len(algorithm) : len(algorithm)+8]
+	if binary.BigEndian.Uint32(timeFudge[2:]) != 1500000000 || binary.BigEndian.Uint16(timeFudge[6:]) != TSIGFudgeSec {
+		t.Fatal(timeFudge)
+	}
+	secret, _ := base64.StdEncoding.DecodeString(testSecret)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(unsigned)
+	mac.Write(dnsd.EncodeName("laitos-key"))
+	mac.Write([]byte{0, ClassANY, 0, 0, 0, 0})
+	mac.Write(algorithm)
+	mac.Write(timeFudge)
+	mac.Write([]byte{0, 0, 0, 0})
+	if signature := rdata[len(algorithm)+10 : len(algorithm)+10+sha256.Size]; !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Fatal("wrong MAC")
+	}
+	// IPv6 addresses update AAAA record
+	msg, err = target.BuildUpdate(1, net.ParseIP("fd00::1"), now)
+	if err != nil || len(msg) != len(unsigned)+tsigLen+12 {
+		t.Fatal(err, len(msg))
+	}
+}
+
+func TestRFC2136Target_Update(t *testing.T) {
+	received := make(chan []byte, 10)
+	target := RFC2136Target{Server: startUpdateServer(t, 0, received), Zone: "example.com", Name: "home.example.com", TSIGKeyName: "key", TSIGSecret: testSecret}
+	if err := target.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Update("not an IP"); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := target.Update("1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg[2]>>3 != OpcodeUpdate {
+		t.Fatal(msg)
+	}
+	// Name server refuses to update
+	target.Server = startUpdateServer(t, 5, received)
+	if err := target.Update("1.2.3.4"); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,319 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/dnsstats"
+	"github.com/HouzuoGuo/laitos/httpclient"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	MinURLBlacklistEntries = 100 // A downloaded blacklist with fewer entries is most likely an error page rather than a blacklist
+
+	BlacklistFormatHosts   = "hosts"   // Hosts file format, e.g. "0.0.0.0 ads.example.com"
+	BlacklistFormatDomains = "domains" // Plain domain list, one domain name per line
+	BlacklistFormatAdblock = "adblock" // Adblock-style rules, only "||domain^" rules are used
+)
+
+// PGL and MVPS lists are used when no blacklist source is configured.
+var DefaultBlacklistSources = []BlacklistSource{
+	{URL: "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=nohtml&showintro=0&mimetype=plaintext", Format: BlacklistFormatDomains},
+	{URL: "http://winhelp2002.mvps.org/hosts.txt", Format: BlacklistFormatHosts},
+}
+
+// A source of ad-server blacklist, either downloaded from a URL or read from a local file.
+type BlacklistSource struct {
+	URL      string `json:"URL"`      // Download the blacklist from this URL
+	FilePath string `json:"FilePath"` // Or read the blacklist from this local file
+	Format   string `json:"Format"`   // Content format - hosts, domains, or adblock
+
+	MinEntries int `json:"MinEntries"` // (Optional) consider the fetch failed if there are fewer entries, default to 100 for URL and 1 for file.
+}
+
+// Return the URL or file path of the source.
+func (src BlacklistSource) Location() string {
+	if src.URL != "" {
+		return src.URL
+	}
+	return src.FilePath
+}
+
+// Return an error if the source is not sufficiently configured.
+func (src BlacklistSource) Validate() error {
+	if (src.URL == "") == (src.FilePath == "") {
+		return errors.New("BlacklistSource.Validate: either URL or FilePath must be present, but not both")
+	}
+	if src.MinEntries < 0 {
+		return fmt.Errorf("BlacklistSource.Validate: MinEntries of %s must not be negative", src.Location())
+	}
+	switch src.Format {
+	case BlacklistFormatHosts, BlacklistFormatDomains, BlacklistFormatAdblock:
+		return nil
+	default:
+		return fmt.Errorf("BlacklistSource.Validate: unknown format \"%s\" of %s", src.Format, src.Location())
+	}
+}
+
+/*
+Download or read the source content, and then return domain names found in there. If there are fewer names than the
+minimum, the content is unlikely a genuine blacklist (e.g. a captive portal page) and an error is returned.
+*/
+func (src BlacklistSource) Fetch() ([]string, error) {
+	var content []byte
+	minEntries := src.MinEntries
+	if src.URL != "" {
+		if minEntries == 0 {
+			minEntries = MinURLBlacklistEntries
+		}
+		// URL is not a format string, and format arguments of DoHTTP get query-escaped, hence escape % signs instead.
+		resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: 30}, strings.Replace(src.URL, "%", "%%", -1))
+		if err != nil {
+			return nil, err
+		}
+		if statusErr := resp.Non2xxToError(); statusErr != nil {
+			return nil, statusErr
+		}
+		content = resp.Body
+	} else {
+		var err error
+		if content, err = ioutil.ReadFile(src.FilePath); err != nil {
+			return nil, err
+		}
+	}
+	if minEntries == 0 {
+		minEntries = 1
+	}
+	names := ParseBlacklist(src.Format, string(content))
+	if len(names) < minEntries {
+		return nil, fmt.Errorf("BlacklistSource.Fetch: %s is suspiciously short at only %d entries", src.Location(), len(names))
+	}
+	return names, nil
+}
+
+// Fetch result of a blacklist source.
+type BlacklistSourceStatus struct {
+	NumEntries  int       // Number of domain names retrieved by the latest successful attempt
+	LastError   error     // Error of the latest attempt, nil if it succeeded
+	LastAttempt time.Time // Time of the latest attempt
+	LastSuccess time.Time // Time of the latest successful attempt
+}
+
+// Return a normalised domain name, or empty string if the input does not look like a domain name.
+func normaliseBlacklistName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if len(name) < 3 || strings.IndexRune(name, '.') < 1 || strings.ContainsAny(name, " \t/*:?#$^|@") {
+		return ""
+	}
+	return name
+}
+
+// Parse blacklist file content in the specified format and return domain names.
+func ParseBlacklist(format, content string) []string {
+	names := make([]string, 0, 16384)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		switch format {
+		case BlacklistFormatHosts:
+			if hash := strings.IndexRune(line, '#'); hash != -1 {
+				line = line[:hash]
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			for _, field := range fields[1:] {
+				switch field {
+				case "localhost", "localhost.localdomain", "local", "broadcasthost":
+					continue
+				}
+				if name := normaliseBlacklistName(field); name != "" {
+					names = append(names, name)
+				}
+			}
+		case BlacklistFormatDomains:
+			if hash := strings.IndexRune(line, '#'); hash != -1 {
+				line = line[:hash]
+			}
+			if name := normaliseBlacklistName(line); name != "" {
+				names = append(names, name)
+			}
+		case BlacklistFormatAdblock:
+			// Only domain-anchored rules such as "||ads.example.com^" and "||ads.example.com^$third-party" are useful
+			if !strings.HasPrefix(line, "||") {
+				continue
+			}
+			caret := strings.IndexRune(line, '^')
+			if caret == -1 || caret+1 < len(line) && line[caret+1] != '$' {
+				continue
+			}
+			if name := normaliseBlacklistName(line[2:caret]); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// Download ad-servers list from pgl.yoyo.org and return those domain names.
+func (dnsd *DNSD) GetAdBlacklistPGL() ([]string, error) {
+	names, err := DefaultBlacklistSources[0].Fetch()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) < 100 {
+		return nil, fmt.Errorf("DNSD.GetAdBlacklistPGL: PGL's ad-server list is suspiciously short at only %d lines", len(names))
+	}
+	return names, nil
+}
+
+// Download ad-servers list from winhelp2002.mvps.org and return those domain names.
+func (dnsd *DNSD) GetAdBlacklistMVPS() ([]string, error) {
+	names, err := DefaultBlacklistSources[1].Fetch()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) < 100 {
+		return nil, fmt.Errorf("DNSD.GetAdBlacklistMVPS: MVPS' ad-server list is suspiciously short at only %d lines", len(names))
+	}
+	return names, nil
+}
+
+// Read blacklist cache file and use its content as the blacklist. Return number of entries read.
+func (dnsd *DNSD) LoadBlacklistCache() (int, error) {
+	content, err := ioutil.ReadFile(dnsd.BlacklistCachePath)
+	if err != nil {
+		return 0, err
+	}
+	names := ParseBlacklist(BlacklistFormatDomains, string(content))
+	dnsd.BlackListMutex.Lock()
+	dnsd.BlackList = make(map[string]struct{}, len(names))
+	for _, name := range names {
+		dnsd.BlackList[name] = struct{}{}
+	}
+	dnsd.blacklistCache = names
+	dnsd.BlackListMutex.Unlock()
+	return len(names), nil
+}
+
+// Write the current blacklist into cache file, one domain name per line.
+func (dnsd *DNSD) SaveBlacklistCache() error {
+	dnsd.BlackListMutex.Lock()
+	names := make([]string, 0, len(dnsd.BlackList))
+	for name := range dnsd.BlackList {
+		names = append(names, name)
+	}
+	dnsd.BlackListMutex.Unlock()
+	sort.Strings(names)
+	// Write into a temporary file first so that a crash will not leave a truncated cache behind
+	tmpPath := dnsd.BlacklistCachePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strings.Join(names, "\n")), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dnsd.BlacklistCachePath)
+}
+
+/*
+Fetch all blacklist sources and merge their domain names into a new blacklist. If a source fails, its entries from the
+previous successful attempt are kept. Until every source has succeeded once, entries read from cache file are kept
+too. The merged blacklist is written into cache file if cache is enabled.
+*/
+func (dnsd *DNSD) UpdateBlacklist() {
+	sources := dnsd.BlacklistSources
+	if len(sources) == 0 {
+		sources = DefaultBlacklistSources
+	}
+	var numFailed, numNeverSucceeded int
+	for _, src := range sources {
+		names, err := src.Fetch()
+		location := src.Location()
+		dnsd.BlackListMutex.Lock()
+		status := dnsd.BlacklistSourceStatus[location]
+		status.LastAttempt = time.Now()
+		status.LastError = err
+		if err == nil {
+			status.NumEntries = len(names)
+			status.LastSuccess = status.LastAttempt
+			dnsd.blacklistBySource[location] = names
+		} else {
+			numFailed++
+			if _, hasPrevious := dnsd.blacklistBySource[location]; !hasPrevious {
+				numNeverSucceeded++
+			}
+		}
+		dnsd.BlacklistSourceStatus[location] = status
+		dnsd.BlackListMutex.Unlock()
+		if err == nil {
+			dnsd.Logger.Printf("UpdateBlacklist", location, nil, "successfully retrieved ad-blacklist with %d entries", len(names))
+			if src.URL == DefaultBlacklistSources[1].URL {
+				dnsd.Logger.Printf("UpdateBlacklist", location, nil, "Please comply with the following liences for your usage of http://winhelp2002.mvps.org/hosts.txt: %s", MVPSLicense)
+			}
+		} else {
+			dnsd.Logger.Warningf("UpdateBlacklist", location, err, "failed to update ad-blacklist")
+		}
+	}
+	dnsd.recordBlacklistSourceStatus()
+	if numFailed == len(sources) {
+		dnsd.Logger.Warningf("UpdateBlacklist", "", nil, "all sources failed, ad-blacklist is left unchanged")
+		return
+	}
+	dnsd.BlackListMutex.Lock()
+	newList := make(map[string]struct{}, len(dnsd.BlackList))
+	if numNeverSucceeded > 0 {
+		// Entries of a source that has never succeeded may only be found in the cache
+		for _, name := range dnsd.blacklistCache {
+			newList[name] = struct{}{}
+		}
+	} else {
+		dnsd.blacklistCache = nil
+	}
+	for _, names := range dnsd.blacklistBySource {
+		for _, name := range names {
+			newList[name] = struct{}{}
+		}
+	}
+	dnsd.BlackList = newList
+	dnsd.Logger.Printf("UpdateBlacklist", "", nil, "ad-blacklist now has %d entries", len(dnsd.BlackList))
+	dnsd.BlackListMutex.Unlock()
+	if dnsd.BlacklistCachePath != "" {
+		if err := dnsd.SaveBlacklistCache(); err != nil {
+			dnsd.Logger.Warningf("UpdateBlacklist", dnsd.BlacklistCachePath, err, "failed to write blacklist cache")
+		}
+	}
+}
+
+// Return a copy of fetch result of all blacklist sources, keyed by source URL or file path.
+func (dnsd *DNSD) GetBlacklistSourceStatus() map[string]BlacklistSourceStatus {
+	dnsd.BlackListMutex.Lock()
+	defer dnsd.BlackListMutex.Unlock()
+	ret := make(map[string]BlacklistSourceStatus, len(dnsd.BlacklistSourceStatus))
+	for location, status := range dnsd.BlacklistSourceStatus {
+		ret[location] = status
+	}
+	return ret
+}
+
+// Copy fetch result of all blacklist sources into DNS statistics, so that they are reported along with the statistics.
+func (dnsd *DNSD) recordBlacklistSourceStatus() {
+	status := dnsd.GetBlacklistSourceStatus()
+	sources := make([]dnsstats.BlacklistSource, 0, len(status))
+	for location, s := range status {
+		src := dnsstats.BlacklistSource{
+			Location:    location,
+			NumEntries:  s.NumEntries,
+			LastAttempt: s.LastAttempt,
+			LastSuccess: s.LastSuccess,
+		}
+		if s.LastError != nil {
+			src.LastError = s.LastError.Error()
+		}
+		sources = append(sources, src)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Location < sources[j].Location })
+	dnsstats.Common.SetBlacklistSources(sources)
+}
@@ -0,0 +1,152 @@
+package dnsd
+
+import (
+	"github.com/HouzuoGuo/laitos/dnsstats"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBlacklist(t *testing.T) {
+	hosts := `# comment 0.0.0.0 commented.example.com
+127.0.0.1 localhost
+0.0.0.0 ads.example.com # trailing comment
+0.0.0.0   Tracker.Example.com.   more.example.com
+not-an-ip bad.example.com
+`
+	if names := ParseBlacklist(BlacklistFormatHosts, hosts); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com", "more.example.com"}) {
+		t.Fatal(names)
+	}
+	domains := `# comment
+ads.example.com
+
+  tracker.example.com  # comment
+com
+`
+	if names := ParseBlacklist(BlacklistFormatDomains, domains); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	adblock := `! comment
+||ads.example.com^
+||tracker.example.com^$third-party
+@@||allowed.example.com^
+||example.com/path^
+||partial.example.com^path
+/banner/*
+`
+	if names := ParseBlacklist(BlacklistFormatAdblock, adblock); !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestBlacklistSource_Fetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "list=a%2Fb" {
+			http.Error(w, r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ads.example.com\ntracker.example.com\n"))
+	}))
+	defer server.Close()
+	// Percent signs in URL are not mistaken for format verbs
+	src := BlacklistSource{URL: server.URL + "/?list=a%2Fb", Format: BlacklistFormatDomains, MinEntries: 2}
+	if names, err := src.Fetch(); err != nil || !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names, err)
+	}
+	// Downloaded list is expected to be much longer by default
+	src.MinEntries = 0
+	if _, err := src.Fetch(); err == nil || !strings.Contains(err.Error(), "short") {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSD_UpdateBlacklist(t *testing.T) {
+	listFile := "/tmp/test-laitos-dnsd-blacklist"
+	cacheFile := "/tmp/test-laitos-dnsd-blacklist-cache"
+	defer os.Remove(listFile)
+	defer os.Remove(cacheFile)
+	os.Remove(cacheFile)
+	if err := ioutil.WriteFile(listFile, []byte("||ads.example.com^\n||tracker.example.com^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	daemon := DNSD{
+		TCPListenAddress:     "127.0.0.1",
+		TCPListenPort:        16321,
+		TCPForwardTo:         "127.0.0.1:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		BlacklistSources:     []BlacklistSource{{FilePath: listFile, Format: "bad format"}},
+		BlacklistCachePath:   cacheFile,
+	}
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "format") == -1 {
+		t.Fatal(err)
+	}
+	daemon.BlacklistSources = []BlacklistSource{
+		{FilePath: listFile, Format: BlacklistFormatAdblock},
+		{FilePath: "/tmp/test-laitos-dnsd-does-not-exist", Format: BlacklistFormatHosts},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.UpdateBlacklist()
+	if !daemon.NamesAreBlackListed([]string{"ads.example.com"}) || daemon.NamesAreBlackListed([]string{"example.com"}) {
+		t.Fatal(daemon.BlackList)
+	}
+	status := daemon.GetBlacklistSourceStatus()
+	if s := status[listFile]; s.NumEntries != 2 || s.LastError != nil {
+		t.Fatal(s)
+	}
+	if s := status["/tmp/test-laitos-dnsd-does-not-exist"]; s.NumEntries != 0 || s.LastError == nil {
+		t.Fatal(s)
+	}
+	// The merged blacklist should be loaded from cache upon start-up
+	if content, err := ioutil.ReadFile(cacheFile); err != nil || string(content) != "ads.example.com\ntracker.example.com" {
+		t.Fatal(string(content), err)
+	}
+	daemon.BlacklistSources = []BlacklistSource{{FilePath: "/tmp/test-laitos-dnsd-does-not-exist", Format: BlacklistFormatHosts}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !daemon.NamesAreBlackListed([]string{"tracker.example.com"}) {
+		t.Fatal(daemon.BlackList)
+	}
+	// Failing sources must not wipe the cached entries
+	daemon.UpdateBlacklist()
+	if !daemon.NamesAreBlackListed([]string{"tracker.example.com"}) {
+		t.Fatal(daemon.BlackList)
+	}
+	// A source with too few entries is considered failed
+	daemon.BlacklistSources = []BlacklistSource{{FilePath: listFile, Format: BlacklistFormatAdblock, MinEntries: 3}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.UpdateBlacklist()
+	if s := daemon.GetBlacklistSourceStatus()[listFile]; s.NumEntries != 0 || s.LastError == nil || !strings.Contains(s.LastError.Error(), "short") {
+		t.Fatal(s)
+	}
+	if sources := dnsstats.Common.GetSnapshot(0).BlacklistSources; len(sources) != 1 || sources[0].Location != listFile || sources[0].LastError == "" {
+		t.Fatal(sources)
+	}
+	// Cached entries are dropped after all sources have succeeded
+	if err := ioutil.WriteFile(listFile, []byte("||ads.example.com^\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	daemon.BlacklistSources = []BlacklistSource{{FilePath: listFile, Format: BlacklistFormatAdblock}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !daemon.NamesAreBlackListed([]string{"tracker.example.com"}) {
+		t.Fatal(daemon.BlackList)
+	}
+	daemon.UpdateBlacklist()
+	if !daemon.NamesAreBlackListed([]string{"ads.example.com"}) || daemon.NamesAreBlackListed([]string{"tracker.example.com"}) {
+		t.Fatal(daemon.BlackList)
+	}
+	if sources := dnsstats.Common.GetSnapshot(0).BlacklistSources; len(sources) != 1 || sources[0].NumEntries != 1 || sources[0].LastError != "" {
+		t.Fatal(sources)
+	}
+}
@@ -0,0 +1,204 @@
+package dnsd
+
+import (
+	"encoding/base32"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/feature"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CommandTimeoutSec     = 25   // Command execution is constrained by this timeout
+	CommandExpirySec      = 180  // Forget incomplete command chunks and command results after this many seconds
+	MaxTXTStringLength    = 255  // Maximum length of a single character-string in TXT record
+	MaxCommandChunks      = 64   // Maximum number of chunks a command may be split into
+	MaxPendingCommands    = 256  // Maximum number of incomplete commands waiting for more chunks
+	MaxCommandResults     = 1024 // Maximum number of command results kept for retries
+	MaxConcurrentCommands = 16   // Maximum number of UDP command queries handled at the same time
+	CommandChunkHeaderSep = "-"  // Separates ID, index, and total in chunk header label, it does not appear in base32 alphabet.
+)
+
+// Base32 without padding is case-insensitive and fits into DNS labels.
+var CommandEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Chunks of a long command that are received so far.
+type commandChunks struct {
+	parts    []string
+	received int
+	expiry   time.Time
+}
+
+// Outcome of a command query, it is kept for a while so that retries made by resolvers do not run the command again.
+type commandResult struct {
+	done   chan struct{}
+	output string
+	expiry time.Time
+}
+
+/*
+Return the labels that precede the command domain, or nil if the name does not belong to command domain. Command names
+look like "<base32 PIN+command>.cmd.example.com", or "<ID>-<index>-<total>.<base32 command chunk>.cmd.example.com" if
+the command is split into several queries.
+*/
+func (dnsd *DNSD) commandLabels(name string) []string {
+	if dnsd.CommandDomain == "" {
+		return nil
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	suffix := "." + dnsd.CommandDomain
+	if !strings.HasSuffix(name, suffix) || len(name) == len(suffix) {
+		return nil
+	}
+	return strings.Split(name[:len(name)-len(suffix)], ".")
+}
+
+// Return true if the query packet (without length prefix) asks for a name under command domain.
+func (dnsd *DNSD) IsCommandQuery(query []byte) bool {
+	if dnsd.CommandDomain == "" {
+		return false
+	}
+	name, _, _, err := ParseQuestion(query)
+	return err == nil && dnsd.commandLabels(name) != nil
+}
+
+// Remove expired command chunks and results. Caller must hold command mutex.
+func (dnsd *DNSD) pruneCommandState(now time.Time) {
+	for key, chunks := range dnsd.commandChunks {
+		if now.After(chunks.expiry) {
+			delete(dnsd.commandChunks, key)
+		}
+	}
+	for key, result := range dnsd.commandResults {
+		if now.After(result.expiry) {
+			delete(dnsd.commandResults, key)
+		}
+	}
+}
+
+/*
+Store a chunk of command and return the complete command data once all chunks have arrived. If there are more chunks to
+come, return empty data and a message that acknowledges the chunk. Caller must hold command mutex.
+*/
+func (dnsd *DNSD) storeCommandChunk(header, data string, now time.Time) (complete string, ack string) {
+	fields := strings.Split(header, CommandChunkHeaderSep)
+	if len(fields) != 3 || fields[0] == "" {
+		return "", "bad chunk header"
+	}
+	index, errIndex := strconv.Atoi(fields[1])
+	total, errTotal := strconv.Atoi(fields[2])
+	if errIndex != nil || errTotal != nil || total < 1 || total > MaxCommandChunks || index < 0 || index >= total {
+		return "", "bad chunk header"
+	}
+	chunks, exists := dnsd.commandChunks[fields[0]]
+	if !exists && len(dnsd.commandChunks) >= MaxPendingCommands {
+		return "", "too many pending commands"
+	}
+	if !exists || len(chunks.parts) != total {
+		chunks = &commandChunks{parts: make([]string, total)}
+		dnsd.commandChunks[fields[0]] = chunks
+	}
+	chunks.expiry = now.Add(CommandExpirySec * time.Second)
+	if chunks.parts[index] == "" && data != "" {
+		chunks.received++
+	}
+	chunks.parts[index] = data
+	if chunks.received < total {
+		return "", fmt.Sprintf("received chunk %d of %d", index+1, total)
+	}
+	delete(dnsd.commandChunks, fields[0])
+	return strings.Join(chunks.parts, ""), ""
+}
+
+// Split text into TXT record data made of character-strings that are at most 255 bytes long.
+func MakeTXTData(text string) []byte {
+	ret := make([]byte, 0, len(text)+len(text)/MaxTXTStringLength+1)
+	for {
+		chunk := text
+		if len(chunk) > MaxTXTStringLength {
+			chunk = chunk[:MaxTXTStringLength]
+		}
+		ret = append(ret, byte(len(chunk)))
+		ret = append(ret, chunk...)
+		text = text[len(chunk):]
+		if text == "" {
+			break
+		}
+	}
+	return ret
+}
+
+/*
+If the query asks for a name under command domain, run the command encoded in the name and return TXT response that
+carries command output. The second return value is false if the query is not a command query.
+*/
+func (dnsd *DNSD) AnswerCommandQuery(clientIP string, query []byte) ([]byte, bool) {
+	if dnsd.CommandDomain == "" {
+		return nil, false
+	}
+	name, qType, _, err := ParseQuestion(query)
+	if err != nil {
+		return nil, false
+	}
+	labels := dnsd.commandLabels(name)
+	if labels == nil {
+		return nil, false
+	}
+	// Only TXT queries carry command output, other types of queries get nothing.
+	if qType != TypeTXT {
+		response, _ := BuildResponse(query, nil)
+		return response, true
+	}
+	output := dnsd.runCommandName(clientIP, strings.ToLower(name), labels)
+	response, err := BuildResponse(query, []ResourceRecord{{Name: name, Type: TypeTXT, Class: ClassIN, TTL: 0, Data: MakeTXTData(output)}})
+	if err != nil {
+		return nil, false
+	}
+	return response, true
+}
+
+// Decode and run the command carried by name labels, or acknowledge a command chunk. Retries of the same name share one result.
+func (dnsd *DNSD) runCommandName(clientIP, key string, labels []string) string {
+	now := time.Now()
+	dnsd.commandMutex.Lock()
+	dnsd.pruneCommandState(now)
+	if result, exists := dnsd.commandResults[key]; exists {
+		dnsd.commandMutex.Unlock()
+		select {
+		case <-result.done:
+			return result.output
+		case <-time.After(IOTimeoutSec * time.Second):
+			return "command is still running"
+		}
+	}
+	if len(dnsd.commandResults) >= MaxCommandResults {
+		dnsd.commandMutex.Unlock()
+		return "too many commands"
+	}
+	result := &commandResult{done: make(chan struct{}), expiry: now.Add(CommandExpirySec * time.Second)}
+	dnsd.commandResults[key] = result
+	var data string
+	if strings.Contains(labels[0], CommandChunkHeaderSep) {
+		var ack string
+		if data, ack = dnsd.storeCommandChunk(labels[0], strings.Join(labels[1:], ""), now); data == "" {
+			result.output = ack
+			close(result.done)
+			dnsd.commandMutex.Unlock()
+			return ack
+		}
+	} else {
+		data = strings.Join(labels, "")
+	}
+	dnsd.commandMutex.Unlock()
+
+	cmd, err := CommandEncoding.DecodeString(strings.ToUpper(data))
+	if err != nil {
+		result.output = "bad command encoding"
+	} else {
+		dnsd.Logger.Printf("AnswerCommandQuery", clientIP, nil, "running command of %d bytes", len(cmd))
+		result.output = dnsd.Processor.Process(feature.Command{TimeoutSec: CommandTimeoutSec, Content: string(cmd)}).CombinedOutput
+	}
+	close(result.done)
+	return result.output
+}
@@ -0,0 +1,170 @@
+package dnsd
+
+import (
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Encode the command into a name under command domain, split into labels of at most 63 characters.
+func makeCommandName(header, cmd, domain string) string {
+	encoded := strings.ToLower(CommandEncoding.EncodeToString([]byte(cmd)))
+	labels := make([]string, 0, 4)
+	if header != "" {
+		labels = append(labels, header)
+	}
+	for len(encoded) > 63 {
+		labels = append(labels, encoded[:63])
+		encoded = encoded[63:]
+	}
+	labels = append(labels, encoded, domain)
+	return strings.Join(labels, ".")
+}
+
+// Return the text carried by TXT answer of the response.
+func getTXTAnswer(t *testing.T, response []byte) string {
+	answers, err := ParseAnswers(response)
+	if err != nil || len(answers) != 1 || answers[0].Type != TypeTXT || answers[0].TTL != 0 {
+		t.Fatal(answers, err)
+	}
+	var text string
+	for data := answers[0].Data; len(data) > 0; data = data[1+int(data[0]):] {
+		text += string(data[1 : 1+int(data[0])])
+	}
+	return text
+}
+
+func TestMakeTXTData(t *testing.T) {
+	if data := MakeTXTData(""); len(data) != 1 || data[0] != 0 {
+		t.Fatal(data)
+	}
+	data := MakeTXTData(strings.Repeat("a", 300))
+	if len(data) != 302 || data[0] != 255 || data[256] != 45 {
+		t.Fatal(len(data), data[0], data[256])
+	}
+}
+
+func TestDNSD_CommandQuery(t *testing.T) {
+	daemon := DNSD{
+		UDPListenAddress: "127.0.0.1",
+		UDPListenPort:    16859,
+		UDPForwardTo:     "127.0.0.1:53",
+		PerIPLimit:       10,
+		// Command queries may come from clients that are not allowed to make ordinary queries
+		AllowQueryCIDRs: []string{"10.0.0.0/8"},
+		CommandDomain:   "CMD.example.com.",
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "command processor") {
+		t.Fatal(err)
+	}
+	daemon.Processor = &common.CommandProcessor{}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), common.ErrBadProcessorConfig) {
+		t.Fatal(err)
+	}
+	daemon.Processor = common.GetTestCommandProcessor()
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if daemon.CommandDomain != "cmd.example.com" {
+		t.Fatal(daemon.CommandDomain)
+	}
+	// Ordinary names are not command queries
+	if _, isCommand := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(1, "github.com", TypeTXT)); isCommand {
+		t.Fatal("should not be a command query")
+	}
+	if _, isCommand := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(1, "cmd.example.com", TypeTXT)); isCommand {
+		t.Fatal("should not be a command query")
+	}
+	// Non-TXT queries of command names get nothing
+	name := makeCommandName("", "verysecret.s echo hello", "cmd.example.com")
+	if response, isCommand := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(1, name, TypeA)); !isCommand {
+		t.Fatal("should be a command query")
+	} else if answers, err := ParseAnswers(response); err != nil || len(answers) != 0 {
+		t.Fatal(answers, err)
+	}
+	// Run a command in a single query
+	if response, err := daemon.AnswerQuery("127.0.0.1", BuildQuery(2, name, TypeTXT)); err != nil || getTXTAnswer(t, response) != "hello" {
+		t.Fatal(err)
+	}
+	// Long output is lint-ed by result bridge
+	longCmd := "verysecret.s echo " + strings.Repeat("abcdefghij", 10)
+	if response, isCommand := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(3, makeCommandName("", longCmd, "cmd.example.com"), TypeTXT)); !isCommand || getTXTAnswer(t, response) != strings.Repeat("abcdefghij", 3)+"abcde" {
+		t.Fatal(getTXTAnswer(t, response))
+	}
+	// Long command is split across chunks
+	encoded := CommandEncoding.EncodeToString([]byte(longCmd))
+	chunkLen := len(encoded)/4 + 1
+	for i := 0; i < 4; i++ {
+		chunk := encoded[i*chunkLen:]
+		if len(chunk) > chunkLen {
+			chunk = chunk[:chunkLen]
+		}
+		chunkName := "x1-" + string(rune('0'+i)) + "-4." + strings.ToLower(chunk) + ".cmd.example.com"
+		response, isCommand := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(4, chunkName, TypeTXT))
+		if !isCommand {
+			t.Fatal("should be a command query")
+		}
+		text := getTXTAnswer(t, response)
+		if i < 3 && text != "received chunk "+string(rune('1'+i))+" of 4" || i == 3 && text != strings.Repeat("abcdefghij", 3)+"abcde" {
+			t.Fatal(i, text)
+		}
+	}
+	// Bad input
+	if response, _ := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(5, "x2-5-3.abc.cmd.example.com", TypeTXT)); getTXTAnswer(t, response) != "bad chunk header" {
+		t.Fatal(getTXTAnswer(t, response))
+	}
+	if response, _ := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(6, "1.cmd.example.com", TypeTXT)); getTXTAnswer(t, response) != "bad command encoding" {
+		t.Fatal(getTXTAnswer(t, response))
+	}
+
+	// New chunk IDs are dropped once there are too many incomplete commands
+	daemon.commandMutex.Lock()
+	for i := len(daemon.commandChunks); i < MaxPendingCommands; i++ {
+		daemon.commandChunks["pending"+strconv.Itoa(i)] = &commandChunks{parts: make([]string, 2), expiry: time.Now().Add(time.Minute)}
+	}
+	daemon.commandMutex.Unlock()
+	if response, _ := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(6, "x3-0-2.abc.cmd.example.com", TypeTXT)); getTXTAnswer(t, response) != "too many pending commands" {
+		t.Fatal(getTXTAnswer(t, response))
+	}
+	if response, _ := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(6, "pending0-1-2.abc.cmd.example.com", TypeTXT)); getTXTAnswer(t, response) != "received chunk 2 of 2" {
+		t.Fatal(getTXTAnswer(t, response))
+	}
+	// New commands are refused once there are too many results
+	daemon.commandMutex.Lock()
+	for i := len(daemon.commandResults); i < MaxCommandResults; i++ {
+		daemon.commandResults["result"+strconv.Itoa(i)] = &commandResult{done: make(chan struct{}), expiry: time.Now().Add(time.Minute)}
+	}
+	daemon.commandMutex.Unlock()
+	if response, _ := daemon.AnswerCommandQuery("127.0.0.1", BuildQuery(6, "2.cmd.example.com", TypeTXT)); getTXTAnswer(t, response) != "too many commands" {
+		t.Fatal(getTXTAnswer(t, response))
+	}
+	daemon.commandMutex.Lock()
+	daemon.commandChunks = make(map[string]*commandChunks)
+	daemon.commandResults = make(map[string]*commandResult)
+	daemon.commandMutex.Unlock()
+
+	// Command query via UDP is answered even though the client is not allowed to make ordinary queries
+	go func() {
+		if err := daemon.StartAndBlockUDP(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	conn, err := net.Dial("udp", "127.0.0.1:16859")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(BuildQuery(7, makeCommandName("", "verysecret.s echo udp", "cmd.example.com"), TypeTXT)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MaxPacketSize)
+	n, err := conn.Read(buf)
+	if err != nil || getTXTAnswer(t, buf[:n]) != "udp" {
+		t.Fatal(err)
+	}
+}
@@ -2,13 +2,17 @@ package dnsd
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/HouzuoGuo/laitos/env"
+	"github.com/HouzuoGuo/laitos/frontend/common"
 	"github.com/HouzuoGuo/laitos/global"
-	"github.com/HouzuoGuo/laitos/httpclient"
+	"github.com/HouzuoGuo/laitos/ipfilter"
+	"github.com/HouzuoGuo/laitos/namepattern"
 	"github.com/HouzuoGuo/laitos/ratelimit"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -19,7 +23,7 @@ const (
 	IOTimeoutSec               = 120  // IO timeout for both read and write operations
 	MaxPacketSize              = 9038 // Maximum acceptable UDP packet size
 	NumQueueRatio              = 10   // Upon initialisation, create (PerIPLimit/NumQueueRatio) number of queues to handle queries.
-	BlacklistUpdateIntervalSec = 7200 // Update ad-server blacklist at this interval
+	BlacklistUpdateIntervalSec = 7200 // Update ad-server blacklist at this interval by default
 	MinNameQuerySize           = 14   // If a query packet is shorter than this length, it cannot possibly be a name query.
 	MVPSLicense                = `Disclaimer: this file is free to use for personal use only. Furthermore it is NOT permitted to ` +
 		`copy any of the contents or host on any other site without permission or meeting the full criteria of the below license ` +
@@ -32,6 +36,7 @@ type UDPQuery struct {
 	MyServer    *net.UDPConn
 	ClientAddr  *net.UDPAddr
 	QueryPacket []byte
+	Profile     *PolicyProfile // Policy profile of the client, nil for the default profile.
 }
 
 // A query to forward to DNS forwarder via TCP.
@@ -44,69 +49,228 @@ type TCPForwarderQuery struct {
 type DNSD struct {
 	UDPListenAddress   string           `json:"UDPListenAddress"` // UDP network address to listen to, e.g. 0.0.0.0 for all network interfaces.
 	UDPListenPort      int              `json:"UDPListenPort"`    // UDP port to listen on
-	UDPForwardTo       string           `json:"UDPForwardTo"`     // Forward UDP DNS queries to this address (IP:Port)
-	UDPForwarderConns  []net.Conn       `json:"-"`                // UDP connections made toward forwarder
+	UDPForwardTo       string           `json:"UDPForwardTo"`     // Forward UDP DNS queries to this address (IP:Port), "tls://IP:Port", or "https://host/dns-query"
+	UDPForwarder       Forwarder        `json:"-"`                // Forward UDP DNS queries via this forwarder if UDPForwardTo is encrypted
+	UDPForwarderConns  []net.Conn       `json:"-"`                // UDP connections made toward plain text forwarder
 	UDPForwarderQueues []chan *UDPQuery `json:"-"`                // Processing queues that handle UDP forward queries
 	UDPBlackHoleQueues []chan *UDPQuery `json:"-"`                // Processing queues that handle UDP black-list answers
 
-	TCPListenAddress string `json:"TCPListenAddress"` // TCP network address to listen to, e.g. 0.0.0.0 for all network interfaces.
-	TCPListenPort    int    `json:"TCPListenPort"`    // TCP port to listen on
-	TCPForwardTo     string `json:"TCPForwardTo"`     // Forward TCP DNS queries to this address (IP:Port)
+	TCPListenAddress string    `json:"TCPListenAddress"` // TCP network address to listen to, e.g. 0.0.0.0 for all network interfaces.
+	TCPListenPort    int       `json:"TCPListenPort"`    // TCP port to listen on
+	TCPForwardTo     string    `json:"TCPForwardTo"`     // Forward TCP DNS queries to this address (IP:Port), "tls://IP:Port", or "https://host/dns-query"
+	TCPForwarder     Forwarder `json:"-"`                // Forward TCP, DNS-over-TLS, and DNS-over-HTTPS queries via this forwarder
 
-	AllowQueryIPPrefixes []string `json:"AllowQueryIPPrefixes"` // Only allow queries from IP addresses that carry any of the prefixes
-	PerIPLimit           int      `json:"PerIPLimit"`           // How many times in 10 seconds interval an IP may send DNS request
+	ForwarderTLSConfig *tls.Config `json:"-"` // (Optional) TLS client configuration for DNS-over-TLS and DNS-over-HTTPS forwarders
 
-	RateLimit      *ratelimit.RateLimit `json:"-"` // Rate limit counter
-	BlackListMutex *sync.Mutex          `json:"-"` // Protect against concurrent access to black list
-	BlackList      map[string]struct{}  `json:"-"` // Do not answer to type A queries made toward these domains
-	Logger         global.Logger        `json:"-"` // Logger
+	TLSListenAddress string          `json:"TLSListenAddress"` // (Optional) DNS-over-TLS network address to listen to, e.g. 0.0.0.0 for all network interfaces.
+	TLSListenPort    int             `json:"TLSListenPort"`    // (Optional) DNS-over-TLS port to listen on, usually 853. Queries are forwarded to TCPForwardTo.
+	TLSCertPath      string          `json:"TLSCertPath"`      // (Optional) serve DNS-over-TLS via this certificate
+	TLSKeyPath       string          `json:"TLSKeyPath"`       // (Optional) serve DNS-over-TLS via this certificate (key)
+	TLSCertificate   tls.Certificate `json:"-"`                // TLS certificate read from the certificate and key files
+
+	CommandDomain string                   `json:"CommandDomain"` // (Optional) run commands carried by TXT queries of names under this domain, e.g. cmd.example.com
+	Processor     *common.CommandProcessor `json:"-"`             // Feature command processor for command queries
+
+	SinkholeIPv4 string `json:"SinkholeIPv4"` // (Optional) answer black-listed A queries with this address (laitos HTTP daemon) instead of 0.0.0.0
+	SinkholeIPv6 string `json:"SinkholeIPv6"` // (Optional) answer black-listed AAAA queries with this address (laitos HTTP daemon)
+
+	LocalRecords map[string]string `json:"LocalRecords"` // (Optional) answer queries of these names with the IP addresses instead of forwarding them
+
+	AllowQueryIPPrefixes []string           `json:"AllowQueryIPPrefixes"` // (Legacy) allow queries from IP addresses that carry any of the prefixes, e.g. "10.1" for 10.1.0.0/16
+	AllowQueryCIDRs      []string           `json:"AllowQueryCIDRs"`      // Only allow queries from these IPv4/IPv6 CIDR blocks or addresses
+	DenyQueryCIDRs       []string           `json:"DenyQueryCIDRs"`       // (Optional) deny queries from these CIDR blocks or addresses even if they are allowed
+	ClientFilter         *ipfilter.IPFilter `json:"-"`                    // Client IP filter made of the allow and deny lists above
+	PerIPLimit           int                `json:"PerIPLimit"`           // How many times in 10 seconds interval an IP may send DNS request
+	LogQueries           bool               `json:"LogQueries"`           // (Optional) log every query, statistics are collected regardless.
+	RRLResponsesPerSec   int                `json:"RRLResponsesPerSec"`   // (Optional) UDP responses per second toward a client network for the same name, default to 20.
+	RRLSlip              int                `json:"RRLSlip"`              // (Optional) answer every Nth rate-limited UDP query by a truncated response and drop the rest, default to 2, negative drops all.
+
+	Profiles                   []PolicyProfile   `json:"Profiles"`                   // (Optional) policies selected by client CIDR, the first matching profile applies.
+	BlacklistSources           []BlacklistSource `json:"BlacklistSources"`           // (Optional) ad-server blacklist sources, PGL and MVPS lists are used if this is empty.
+	BlacklistCachePath         string            `json:"BlacklistCachePath"`         // (Optional) persist merged blacklist in this file and load it upon start-up
+	BlacklistUpdateIntervalSec int               `json:"BlacklistUpdateIntervalSec"` // (Optional) update blacklist at this interval, default to 7200 seconds.
+	AllowList                  []string          `json:"AllowList"`                  // (Optional) never block these names, it overrides all blacklists. Supports "*.name" and "/regex/".
+	BlockList                  []string          `json:"BlockList"`                  // (Optional) always block these names in addition to blacklist. Supports "*.name" and "/regex/".
+
+	RateLimit             *ratelimit.RateLimit             `json:"-"` // Rate limit counter
+	ResponseLimit         *ResponseRateLimit               `json:"-"` // Rate limit of UDP responses by client network and name
+	BlackListMutex        *sync.Mutex                      `json:"-"` // Protect against concurrent access to black list and source status
+	BlackList             map[string]struct{}              `json:"-"` // Do not answer to type A queries made toward these domains
+	BlacklistSourceStatus map[string]BlacklistSourceStatus `json:"-"` // Fetch result of each blacklist source, keyed by URL or file path.
+	AllowPatterns         *namepattern.NamePatterns                    `json:"-"` // Compiled AllowList
+	BlockPatterns         *namepattern.NamePatterns                    `json:"-"` // Compiled BlockList
+	Logger                global.Logger                    `json:"-"` // Logger
+
+	blacklistBySource map[string][]string       // Latest successfully fetched domain names of each blacklist source
+	blacklistCache    []string                  // Domain names read from cache file, kept until all sources have succeeded once
+	sinkholeIPv4      net.IP                    // Parsed SinkholeIPv4
+	sinkholeIPv6      net.IP                    // Parsed SinkholeIPv6
+	temporaryAllow    map[string]time.Time      // Names allowed via block page and their expiry time
+	commandChunks     map[string]*commandChunks // Incomplete commands keyed by chunk ID
+	commandResults    map[string]*commandResult // Recent command results keyed by query name
+	commandMutex      *sync.Mutex               // Protect against concurrent access to command chunks and results
+	commandSlots      chan struct{}             // Limit number of UDP command queries handled concurrently
+	localRecords      map[string]localAddrs     // Addresses of local records, they come from LocalRecords and may change at run time.
+	localMutex        *sync.Mutex               // Protect against concurrent access to local records
+	blacklistUpdater  *sync.Once                // Start blacklist updater only once
 }
 
 // Check configuration and initialise internal states.
 func (dnsd *DNSD) Initialise() error {
-	if dnsd.UDPListenAddress == "" && dnsd.TCPListenAddress == "" {
+	if dnsd.UDPListenAddress == "" && dnsd.TCPListenAddress == "" && dnsd.TLSListenAddress == "" {
 		return errors.New("DNSD.Initialise: listen address must not be empty")
 	}
-	if dnsd.UDPListenPort < 1 && dnsd.TCPListenPort < 1 {
+	if dnsd.UDPListenPort < 1 && dnsd.TCPListenPort < 1 && dnsd.TLSListenPort < 1 {
 		return errors.New("DNSD.Initialise: listen port must be greater than 0")
 	}
 	if dnsd.UDPForwardTo == "" && dnsd.TCPForwardTo == "" {
 		return errors.New("DNSD.Initialise: the server is not useful if UDPForwardTo address is empty")
 	}
+	if dnsd.TLSListenPort > 0 {
+		if dnsd.TCPForwardTo == "" {
+			return errors.New("DNSD.Initialise: DNS-over-TLS queries are forwarded via TCP, TCPForwardTo must not be empty")
+		}
+		if dnsd.TLSCertPath == "" || dnsd.TLSKeyPath == "" {
+			return errors.New("DNSD.Initialise: if TLS is to be enabled, both TLS certificate and key path must be present.")
+		}
+		var err error
+		dnsd.TLSCertificate, err = tls.LoadX509KeyPair(dnsd.TLSCertPath, dnsd.TLSKeyPath)
+		if err != nil {
+			return fmt.Errorf("DNSD.Initialise: failed to read TLS certificate - %v", err)
+		}
+	}
 	if dnsd.PerIPLimit < 10 {
 		return errors.New("DNSD.Initialise: PerIPLimit must be greater than 9")
 	}
-	if len(dnsd.AllowQueryIPPrefixes) == 0 {
-		return errors.New("DNSD.Initialise: allowable IP prefixes list must not be empty")
+	if len(dnsd.AllowQueryIPPrefixes) == 0 && len(dnsd.AllowQueryCIDRs) == 0 {
+		return errors.New("DNSD.Initialise: allowable IP prefixes and CIDR lists must not be both empty")
 	}
+	// Legacy IP prefixes are converted into CIDR blocks at octet boundary
+	allowCIDRs := make([]string, 0, len(dnsd.AllowQueryIPPrefixes)+len(dnsd.AllowQueryCIDRs))
 	for _, prefix := range dnsd.AllowQueryIPPrefixes {
 		if prefix == "" {
 			return errors.New("DNSD.Initialise: any allowable IP prefixes must not be empty string")
 		}
+		cidr, err := ipfilter.PrefixToCIDR(prefix)
+		if err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+		allowCIDRs = append(allowCIDRs, cidr)
+	}
+	allowCIDRs = append(allowCIDRs, dnsd.AllowQueryCIDRs...)
+	dnsd.ClientFilter = &ipfilter.IPFilter{Allow: allowCIDRs, Deny: dnsd.DenyQueryCIDRs}
+	if err := dnsd.ClientFilter.Initialise(); err != nil {
+		return fmt.Errorf("DNSD.Initialise: %v", err)
+	}
+	for _, src := range dnsd.BlacklistSources {
+		if err := src.Validate(); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
+	if dnsd.BlacklistUpdateIntervalSec < 1 {
+		dnsd.BlacklistUpdateIntervalSec = BlacklistUpdateIntervalSec
 	}
 	dnsd.BlackListMutex = new(sync.Mutex)
 	dnsd.BlackList = make(map[string]struct{})
+	dnsd.BlacklistSourceStatus = make(map[string]BlacklistSourceStatus)
+	dnsd.blacklistBySource = make(map[string][]string)
+	dnsd.blacklistCache = nil
+	dnsd.blacklistUpdater = new(sync.Once)
+	dnsd.temporaryAllow = make(map[string]time.Time)
+	dnsd.CommandDomain = strings.Trim(strings.ToLower(strings.TrimSpace(dnsd.CommandDomain)), ".")
+	if dnsd.CommandDomain != "" {
+		if dnsd.Processor == nil {
+			return errors.New("DNSD.Initialise: command processor must be present if CommandDomain is configured")
+		}
+		if errs := dnsd.Processor.IsSaneForInternet(); len(errs) > 0 {
+			return fmt.Errorf("DNSD.Initialise: %+v", errs)
+		}
+	}
+	dnsd.commandChunks = make(map[string]*commandChunks)
+	dnsd.commandResults = make(map[string]*commandResult)
+	dnsd.commandMutex = new(sync.Mutex)
+	dnsd.commandSlots = make(chan struct{}, MaxConcurrentCommands)
+	dnsd.localRecords = make(map[string]localAddrs)
+	dnsd.localMutex = new(sync.Mutex)
+	for name, ip := range dnsd.LocalRecords {
+		if err := dnsd.SetLocalRecord(name, ip); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
+	dnsd.sinkholeIPv4, dnsd.sinkholeIPv6 = nil, nil
+	if dnsd.SinkholeIPv4 != "" {
+		if dnsd.sinkholeIPv4 = net.ParseIP(dnsd.SinkholeIPv4).To4(); dnsd.sinkholeIPv4 == nil {
+			return fmt.Errorf("DNSD.Initialise: SinkholeIPv4 \"%s\" is not an IPv4 address", dnsd.SinkholeIPv4)
+		}
+	}
+	if dnsd.SinkholeIPv6 != "" {
+		if ip := net.ParseIP(dnsd.SinkholeIPv6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("DNSD.Initialise: SinkholeIPv6 \"%s\" is not an IPv6 address", dnsd.SinkholeIPv6)
+		} else {
+			dnsd.sinkholeIPv6 = ip.To16()
+		}
+	}
+	var err error
+	if dnsd.AllowPatterns, err = namepattern.NewNamePatterns(dnsd.AllowList); err != nil {
+		return fmt.Errorf("DNSD.Initialise: AllowList - %v", err)
+	}
+	if dnsd.BlockPatterns, err = namepattern.NewNamePatterns(dnsd.BlockList); err != nil {
+		return fmt.Errorf("DNSD.Initialise: BlockList - %v", err)
+	}
+	for i := range dnsd.Profiles {
+		if err := dnsd.Profiles[i].Initialise(dnsd); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
+	// Blacklist cache allows the daemon to block ads right away, even before network becomes available.
+	if dnsd.BlacklistCachePath != "" {
+		if numEntries, err := dnsd.LoadBlacklistCache(); err == nil {
+			dnsd.Logger.Printf("Initialise", dnsd.BlacklistCachePath, nil, "loaded %d blacklist entries from cache", numEntries)
+		} else if !os.IsNotExist(err) {
+			dnsd.Logger.Warningf("Initialise", dnsd.BlacklistCachePath, err, "failed to read blacklist cache")
+		}
+	}
 	dnsd.RateLimit = &ratelimit.RateLimit{
 		MaxCount: dnsd.PerIPLimit,
 		UnitSecs: RateLimitIntervalSec,
 		Logger:   dnsd.Logger,
 	}
 	dnsd.RateLimit.Initialise()
+	if dnsd.RRLSlip == 0 {
+		dnsd.RRLSlip = DefaultRRLSlip
+	}
+	dnsd.ResponseLimit = &ResponseRateLimit{ResponsesPerSec: dnsd.RRLResponsesPerSec, Slip: dnsd.RRLSlip}
+	dnsd.ResponseLimit.Initialise()
+	dnsd.RRLResponsesPerSec = dnsd.ResponseLimit.ResponsesPerSec
+	// Encrypted forwarders keep their own connections, plain text TCP forwarder makes a new connection for each query.
+	if dnsd.TCPForwardTo != "" {
+		if dnsd.TCPForwarder, err = NewForwarder(dnsd.TCPForwardTo, true, dnsd.ForwarderTLSConfig); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
+	if dnsd.UDPForwardTo != "" {
+		if dnsd.UDPForwarder, err = NewForwarder(dnsd.UDPForwardTo, false, dnsd.ForwarderTLSConfig); err != nil {
+			return fmt.Errorf("DNSD.Initialise: %v", err)
+		}
+	}
 	// Create a number of forwarder queues to handle incoming UDP DNS queries
 	numQueues := dnsd.PerIPLimit / NumQueueRatio
 	dnsd.UDPForwarderConns = make([]net.Conn, numQueues)
 	dnsd.UDPForwarderQueues = make([]chan *UDPQuery, numQueues)
 	dnsd.UDPBlackHoleQueues = make([]chan *UDPQuery, numQueues)
 	for i := 0; i < numQueues; i++ {
-		forwarderAddr, err := net.ResolveUDPAddr("udp", dnsd.UDPForwardTo)
-		if err != nil {
-			return fmt.Errorf("DNSD.Initialise: failed to resolve address - %v", err)
-		}
-		forwarderConn, err := net.DialTimeout("udp", forwarderAddr.String(), IOTimeoutSec*time.Second)
-		if err != nil {
-			return fmt.Errorf("DNSD.Initialise: failed to connect to forwarder - %v", err)
+		// Queries toward an encrypted forwarder are exchanged by UDPForwarder, leaving the connection nil.
+		if dnsd.UDPForwardTo != "" && !IsEncryptedForwarder(dnsd.UDPForwardTo) {
+			forwarderAddr, err := net.ResolveUDPAddr("udp", dnsd.UDPForwardTo)
+			if err != nil {
+				return fmt.Errorf("DNSD.Initialise: failed to resolve address - %v", err)
+			}
+			forwarderConn, err := net.DialTimeout("udp", forwarderAddr.String(), IOTimeoutSec*time.Second)
+			if err != nil {
+				return fmt.Errorf("DNSD.Initialise: failed to connect to forwarder - %v", err)
+			}
+			dnsd.UDPForwarderConns[i] = forwarderConn
 		}
-		dnsd.UDPForwarderConns[i] = forwarderConn
 		dnsd.UDPForwarderQueues[i] = make(chan *UDPQuery, 16) // there really is no need for a deeper queue
 		dnsd.UDPBlackHoleQueues[i] = make(chan *UDPQuery, 4)  // there is also no need for a deeper queue here
 	}
@@ -116,69 +280,12 @@ func (dnsd *DNSD) Initialise() error {
 	if myPublicIP == "" {
 		// Not a fatal error
 		dnsd.Logger.Warningf("Initialise", "", nil, "unable to determine public IP address, the server will not be able to query itself.")
-	} else {
-		dnsd.AllowQueryIPPrefixes = append(dnsd.AllowQueryIPPrefixes, myPublicIP)
+	} else if err := dnsd.ClientFilter.AddAllow(myPublicIP); err != nil {
+		dnsd.Logger.Warningf("Initialise", myPublicIP, err, "failed to allow the server to query itself")
 	}
 	return nil
 }
 
-// Download ad-servers list from pgl.yoyo.org and return those domain names.
-func (dnsd *DNSD) GetAdBlacklistPGL() ([]string, error) {
-	yoyo := "https://pgl.yoyo.org/adservers/serverlist.php?hostformat=nohtml&showintro=0&mimetype=plaintext"
-	resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: 30}, yoyo)
-	if err != nil {
-		return nil, err
-	}
-	if statusErr := resp.Non2xxToError(); statusErr != nil {
-		return nil, statusErr
-	}
-	lines := strings.Split(string(resp.Body), "\n")
-	if len(lines) < 100 {
-		return nil, fmt.Errorf("DNSD.GetAdBlacklistPGL: PGL's ad-server list is suspiciously short at only %d lines", len(lines))
-	}
-	names := make([]string, 0, len(lines))
-	for _, line := range lines {
-		names = append(names, strings.TrimSpace(line))
-	}
-	return names, nil
-}
-
-// Download ad-servers list from winhelp2002.mvps.org and return those domain names.
-func (dnsd *DNSD) GetAdBlacklistMVPS() ([]string, error) {
-	yoyo := "http://winhelp2002.mvps.org/hosts.txt"
-	resp, err := httpclient.DoHTTP(httpclient.Request{TimeoutSec: 30}, yoyo)
-	if err != nil {
-		return nil, err
-	}
-	if statusErr := resp.Non2xxToError(); statusErr != nil {
-		return nil, statusErr
-	}
-	// Collect host names from the hosts file content
-	names := make([]string, 0, 16384)
-	for _, line := range strings.Split(string(resp.Body), "\n") {
-		indexZero := strings.Index(line, "0.0.0.0")
-		nameEnd := strings.IndexRune(line, '#')
-		if indexZero == -1 {
-			// Skip lines that do not have a host name
-			continue
-		}
-		if nameEnd == -1 {
-			nameEnd = len(line)
-		}
-		nameBegin := indexZero + len("0.0.0.0")
-		if nameBegin >= nameEnd {
-			// The line looks like # this is a comment 0.0.0.0
-
-			continue
-		}
-		names = append(names, strings.TrimSpace(line[nameBegin:nameEnd]))
-	}
-	if len(names) < 100 {
-		return nil, fmt.Errorf("DNSD.GetAdBlacklistMVPS: MVPS' ad-server list is suspiciously short at only %d lines", len(names))
-	}
-	return names, nil
-}
-
 var StandardResponseNoError = []byte{129, 128} // DNS response packet flag - standard response, no indication of error.
 
 //                            Domain     A    IN      TTL 1466  IPv4     0.0.0.0
@@ -219,6 +326,10 @@ func ExtractDomainName(packet []byte) (ret []string) {
 		return
 	}
 	indexTypeAClassIN := bytes.Index(packet[13:], []byte{0, 1, 0, 1})
+	// AAAA queries are recognised too, so that they are subject to black list.
+	if indexTypeAAAAClassIN := bytes.Index(packet[13:], []byte{0, 28, 0, 1}); indexTypeAAAAClassIN > 0 && (indexTypeAClassIN < 1 || indexTypeAAAAClassIN < indexTypeAClassIN) {
+		indexTypeAClassIN = indexTypeAAAAClassIN
+	}
 	if indexTypeAClassIN < 1 {
 		return
 	}
@@ -256,43 +367,29 @@ func ExtractDomainName(packet []byte) (ret []string) {
 
 /*
 You may call this function only after having called Initialise()!
-Start DNS daemon on both UDP and TCP ports, block until this program exits.
+Keep updating ad-block black list in background. Calling the function more than once has no further effect.
 */
-func (dnsd *DNSD) StartAndBlock() error {
-	// Keep updating ad-block black list in background
-	go func() {
-		for {
-			pglEntries, pglErr := dnsd.GetAdBlacklistPGL()
-			if pglErr == nil {
-				dnsd.Logger.Printf("GetAdBlacklistPGL", "", nil, "successfully retrieved ad-blacklist with %d entries", len(pglEntries))
-			} else {
-				dnsd.Logger.Warningf("GetAdBlacklistPGL", "", pglErr, "failed to update ad-blacklist")
-			}
-			mvpsEntries, mvpsErr := dnsd.GetAdBlacklistMVPS()
-			if mvpsErr == nil {
-				dnsd.Logger.Printf("GetAdBlacklistMVPS", "", nil, "successfully retrieved ad-blacklist with %d entries", len(mvpsEntries))
-				dnsd.Logger.Printf("GetAdBlacklistMVPS", "", nil, "Please comply with the following liences for your usage of http://winhelp2002.mvps.org/hosts.txt: %s", MVPSLicense)
-			} else {
-				dnsd.Logger.Warningf("GetAdBlacklistMVPS", "", mvpsErr, "failed to update ad-blacklist")
-			}
-			dnsd.BlackListMutex.Lock()
-			dnsd.BlackList = make(map[string]struct{})
-			if pglErr == nil {
-				for _, name := range pglEntries {
-					dnsd.BlackList[name] = struct{}{}
-				}
-			}
-			if mvpsErr == nil {
-				for _, name := range mvpsEntries {
-					dnsd.BlackList[name] = struct{}{}
+func (dnsd *DNSD) StartBlacklistUpdater() {
+	dnsd.blacklistUpdater.Do(func() {
+		go func() {
+			for {
+				dnsd.UpdateBlacklist()
+				for i := range dnsd.Profiles {
+					dnsd.Profiles[i].UpdateBlacklist(dnsd.Logger)
 				}
+				time.Sleep(time.Duration(dnsd.BlacklistUpdateIntervalSec) * time.Second)
 			}
-			dnsd.Logger.Printf("StartAndBlock", "", nil, "ad-blacklist now has %d entries", len(dnsd.BlackList))
-			dnsd.BlackListMutex.Unlock()
-			time.Sleep(BlacklistUpdateIntervalSec * time.Second)
-		}
-	}()
-	errChan := make(chan error, 2)
+		}()
+	})
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start DNS daemon on UDP, TCP, and DNS-over-TLS ports, block until this program exits.
+*/
+func (dnsd *DNSD) StartAndBlock() error {
+	dnsd.StartBlacklistUpdater()
+	errChan := make(chan error, 3)
 	if dnsd.UDPListenPort != 0 {
 		go func() {
 			if err := dnsd.StartAndBlockUDP(); err != nil {
@@ -307,11 +404,32 @@ func (dnsd *DNSD) StartAndBlock() error {
 			}
 		}()
 	}
+	if dnsd.TLSListenPort != 0 {
+		go func() {
+			if err := dnsd.StartAndBlockTLS(); err != nil {
+				errChan <- err
+			}
+		}()
+	}
 	return <-errChan
 }
 
-// Return true if any of the input domain names is black listed.
+// Return true only if the client IP is allowed to query.
+func (dnsd *DNSD) IsAllowedClient(clientIP string) bool {
+	return dnsd.ClientFilter.IsAllowed(clientIP)
+}
+
+/*
+Return true if any of the input domain names is black listed. Names matched by the allow-list are never black listed,
+names matched by the block-list always are.
+*/
 func (dnsd *DNSD) NamesAreBlackListed(names []string) bool {
+	if dnsd.isTemporarilyAllowed(names) || dnsd.AllowPatterns.Match(names) {
+		return false
+	}
+	if dnsd.BlockPatterns.Match(names) {
+		return true
+	}
 	dnsd.BlackListMutex.Lock()
 	defer dnsd.BlackListMutex.Unlock()
 	var blacklisted bool
@@ -69,8 +69,8 @@ func TestDNSD_StartAndBlockUDP(t *testing.T) {
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
 	}
-	if len(daemon.AllowQueryIPPrefixes) != 2 {
-		t.Fatal("did not put my own IP into prefixes")
+	if len(daemon.ClientFilter.Allow) != 2 {
+		t.Fatal("did not put my own IP into allowed CIDRs")
 	}
 	// Update ad-server blacklist
 	if entries, err := daemon.GetAdBlacklistPGL(); err != nil || len(entries) < 100 {
@@ -177,8 +177,8 @@ func TestDNSD_StartAndBlockTCP(t *testing.T) {
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
 	}
-	if len(daemon.AllowQueryIPPrefixes) != 2 {
-		t.Fatal("did not put my own IP into prefixes")
+	if len(daemon.ClientFilter.Allow) != 2 {
+		t.Fatal("did not put my own IP into allowed CIDRs")
 	}
 	// Server should start within two seconds
 	go func() {
@@ -244,3 +244,62 @@ func TestDNSD_StartAndBlockTCP(t *testing.T) {
 		t.Fatal("did not answer to blacklist domain")
 	}
 }
+
+func TestDNSD_IsAllowedClient(t *testing.T) {
+	daemon := DNSD{
+		TCPListenAddress:     "127.0.0.1",
+		TCPListenPort:        16856,
+		TCPForwardTo:         "127.0.0.1:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"10.1"},
+		AllowQueryCIDRs:      []string{"fd00::/8", "192.168.0.1"},
+		DenyQueryCIDRs:       []string{"10.1.2.0/24"},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.1.0.1":    true,
+		"10.100.0.1":  false,
+		"10.1.2.3":    false,
+		"192.168.0.1": true,
+		"[fd00::1]":   true,
+		"fe80::1":     false,
+	} {
+		if daemon.IsAllowedClient(ip) != allowed {
+			t.Fatal(ip, allowed)
+		}
+	}
+	daemon.AllowQueryCIDRs = []string{"10.0.0.0/40"}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestDNSD_NamesAreBlackListed(t *testing.T) {
+	daemon := DNSD{
+		TCPListenAddress:     "127.0.0.1",
+		TCPListenPort:        16321,
+		TCPForwardTo:         "127.0.0.1:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		AllowList:            []string{"good.ads.example.com"},
+		BlockList:            []string{"*.tracker.net"},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.BlackList["ads.example.com"] = struct{}{}
+	if daemon.NamesAreBlackListed(ExtractDomainName(githubComUDPQuery)) {
+		t.Fatal("should not have been blocked")
+	}
+	if !daemon.NamesAreBlackListed([]string{"x.ads.example.com", "ads.example.com", "example.com", "com"}) {
+		t.Fatal("should have been blocked")
+	}
+	if daemon.NamesAreBlackListed([]string{"good.ads.example.com", "ads.example.com", "example.com", "com"}) {
+		t.Fatal("allow-list should win")
+	}
+	if !daemon.NamesAreBlackListed([]string{"a.tracker.net", "tracker.net", "net"}) || daemon.NamesAreBlackListed([]string{"tracker.net", "net"}) {
+		t.Fatal("block-list did not work")
+	}
+}
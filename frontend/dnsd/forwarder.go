@@ -0,0 +1,173 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ForwarderSchemeTLS   = "tls://"   // Forwarder address prefix of DNS-over-TLS server, e.g. tls://1.1.1.1:853
+	ForwarderSchemeHTTPS = "https://" // Forwarder address prefix of DNS-over-HTTPS server, e.g. https://1.1.1.1/dns-query
+	DefaultDoTPort       = "853"      // Port number of DNS-over-TLS server if forwarder address does not specify it
+	TLSForwarderPoolSize = 16         // Keep up to this many idle connections open toward a DNS-over-TLS forwarder
+)
+
+// Send a query packet (without length prefix) to a DNS server and return its response.
+type Forwarder interface {
+	Exchange(query []byte) ([]byte, error)
+}
+
+// Return true if queries forwarded to the address are encrypted.
+func IsEncryptedForwarder(address string) bool {
+	return strings.HasPrefix(address, ForwarderSchemeTLS) || strings.HasPrefix(address, ForwarderSchemeHTTPS)
+}
+
+/*
+Create a forwarder according to the address, which may be "tls://host[:port]" for DNS-over-TLS, "https://host/path" for
+DNS-over-HTTPS, or "host:port" for plain DNS via UDP or TCP. TLS configuration is optional, it is useful for trusting
+specific certificate authorities.
+*/
+func NewForwarder(address string, useTCP bool, tlsConfig *tls.Config) (Forwarder, error) {
+	if strings.HasPrefix(address, ForwarderSchemeTLS) {
+		hostPort := strings.TrimPrefix(address, ForwarderSchemeTLS)
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			host, port = hostPort, DefaultDoTPort
+		}
+		if host == "" {
+			return nil, fmt.Errorf("NewForwarder: malformed DNS-over-TLS address \"%s\"", address)
+		}
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		return &TLSForwarder{
+			Address:   net.JoinHostPort(host, port),
+			TLSConfig: config,
+			idleConns: make(chan net.Conn, TLSForwarderPoolSize),
+		}, nil
+	} else if strings.HasPrefix(address, ForwarderSchemeHTTPS) {
+		if _, err := url.Parse(address); err != nil {
+			return nil, fmt.Errorf("NewForwarder: malformed DNS-over-HTTPS address \"%s\" - %v", address, err)
+		}
+		return &HTTPSForwarder{
+			URL: address,
+			Client: &http.Client{
+				Timeout: IOTimeoutSec * time.Second,
+				Transport: &http.Transport{
+					TLSClientConfig:     tlsConfig,
+					MaxIdleConnsPerHost: TLSForwarderPoolSize,
+					IdleConnTimeout:     IOTimeoutSec * time.Second,
+				},
+			},
+		}, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("NewForwarder: malformed forwarder address \"%s\" - %v", address, err)
+	}
+	return &PlainForwarder{Address: address, UseTCP: useTCP}, nil
+}
+
+// Forward queries in clear text via UDP or TCP.
+type PlainForwarder struct {
+	Address string
+	UseTCP  bool
+}
+
+func (fwd *PlainForwarder) Exchange(query []byte) ([]byte, error) {
+	if fwd.UseTCP {
+		return ForwardTCPQuery(fwd.Address, query)
+	}
+	return ForwardUDPQuery(fwd.Address, query)
+}
+
+// Forward queries to a DNS-over-TLS server. Connections are kept open and reused for subsequent queries.
+type TLSForwarder struct {
+	Address   string        // host:port of the DNS-over-TLS server
+	TLSConfig *tls.Config   // TLS client configuration, server name must be set.
+	idleConns chan net.Conn // connections that are ready for the next query
+}
+
+// Return an idle connection from pool, or make a new connection if the pool is empty.
+func (fwd *TLSForwarder) getConn() (conn net.Conn, reused bool, err error) {
+	select {
+	case conn = <-fwd.idleConns:
+		return conn, true, nil
+	default:
+	}
+	conn, err = tls.DialWithDialer(&net.Dialer{Timeout: IOTimeoutSec * time.Second}, "tcp", fwd.Address, fwd.TLSConfig)
+	return
+}
+
+// Put the connection back into pool, or close it if the pool is full.
+func (fwd *TLSForwarder) putConn(conn net.Conn) {
+	select {
+	case fwd.idleConns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (fwd *TLSForwarder) Exchange(query []byte) ([]byte, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, reused, err := fwd.getConn()
+		if err != nil {
+			return nil, fmt.Errorf("TLSForwarder.Exchange: failed to connect to %s - %v", fwd.Address, err)
+		}
+		conn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+		response, err := ExchangeTCPQuery(conn, query)
+		if err == nil {
+			fwd.putConn(conn)
+			return response, nil
+		}
+		conn.Close()
+		// Server may have closed an idle connection, retry once with a new connection.
+		if !reused {
+			return nil, err
+		}
+	}
+	return nil, errors.New("TLSForwarder.Exchange: failed to exchange query over idle connections")
+}
+
+// Forward queries to a DNS-over-HTTPS server via POST requests. HTTP client reuses connections.
+type HTTPSForwarder struct {
+	URL    string
+	Client *http.Client
+}
+
+func (fwd *HTTPSForwarder) Exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, fwd.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("HTTPSForwarder.Exchange: failed to make request - %v", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := fwd.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPSForwarder.Exchange: failed to send query to forwarder - %v", err)
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxPacketSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("HTTPSForwarder.Exchange: failed to read response from forwarder - %v", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("HTTPSForwarder.Exchange: forwarder responded with HTTP %d", resp.StatusCode)
+	}
+	if len(response) > MaxPacketSize || len(response) < 1 {
+		return nil, errors.New("HTTPSForwarder.Exchange: bad response length from forwarder")
+	}
+	return response, nil
+}
@@ -0,0 +1,158 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewForwarder(t *testing.T) {
+	if _, err := NewForwarder("no-port", false, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if fwd, err := NewForwarder("8.8.8.8:53", true, nil); err != nil || !fwd.(*PlainForwarder).UseTCP {
+		t.Fatal(fwd, err)
+	}
+	if fwd, err := NewForwarder("tls://1.1.1.1", false, nil); err != nil || fwd.(*TLSForwarder).Address != "1.1.1.1:853" || fwd.(*TLSForwarder).TLSConfig.ServerName != "1.1.1.1" {
+		t.Fatal(fwd, err)
+	}
+	if fwd, err := NewForwarder("tls://dns.example.com:8853", false, nil); err != nil || fwd.(*TLSForwarder).Address != "dns.example.com:8853" {
+		t.Fatal(fwd, err)
+	}
+	if fwd, err := NewForwarder("https://1.1.1.1/dns-query", false, nil); err != nil || fwd.(*HTTPSForwarder).URL != "https://1.1.1.1/dns-query" {
+		t.Fatal(fwd, err)
+	}
+}
+
+func TestTLSForwarder(t *testing.T) {
+	certPath := "/tmp/test-laitos-dnsd-forwarder.crt"
+	keyPath := "/tmp/test-laitos-dnsd-forwarder.key"
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	testhelper.WriteTestCertificate(t, certPath, keyPath)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A DNS-over-TLS stand-in that answers each query with the query itself plus the tail
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var numConns int32
+	tail := []byte("tls forwarded answer")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&numConns, 1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					lenBuf := make([]byte, 2)
+					if _, err := io.ReadFull(conn, lenBuf); err != nil {
+						return
+					}
+					query := make([]byte, int(lenBuf[0])*256+int(lenBuf[1]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := append(query, tail...)
+					conn.Write(append([]byte{byte(len(resp) / 256), byte(len(resp) % 256)}, resp...))
+				}
+			}(conn)
+		}
+	}()
+	// Untrusted certificate must be rejected
+	fwd, err := NewForwarder("tls://"+listener.Addr().String(), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fwd.Exchange(githubComUDPQuery); err == nil {
+		t.Fatal("did not error")
+	}
+	// Trust the test certificate and connection is reused among queries
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	atomic.StoreInt32(&numConns, 0)
+	daemon := DNSD{
+		TCPListenAddress:     "127.0.0.1",
+		TCPListenPort:        16854,
+		TCPForwardTo:         "tls://" + listener.Addr().String(),
+		ForwarderTLSConfig:   &tls.Config{RootCAs: pool},
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		resp, err := daemon.ForwardQuery(githubComUDPQuery)
+		if err != nil || !bytes.Equal(resp, append(append([]byte{}, githubComUDPQuery...), tail...)) {
+			t.Fatal(resp, err)
+		}
+	}
+	if n := atomic.LoadInt32(&numConns); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestHTTPSForwarder(t *testing.T) {
+	tail := []byte("https forwarded answer")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(append(query, tail...))
+	}))
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	daemon := DNSD{
+		UDPListenAddress:     "127.0.0.1",
+		UDPListenPort:        16855,
+		UDPForwardTo:         server.URL + "/dns-query",
+		ForwarderTLSConfig:   &tls.Config{RootCAs: pool},
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// UDP queries are not sent over plain UDP connections
+	for _, conn := range daemon.UDPForwarderConns {
+		if conn != nil {
+			t.Fatal("should not have made UDP connection")
+		}
+	}
+	resp, err := daemon.ForwardQuery(githubComUDPQuery)
+	if err != nil || !bytes.Equal(resp, append(append([]byte{}, githubComUDPQuery...), tail...)) {
+		t.Fatal(resp, err)
+	}
+	// Upstream errors are reported
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusInternalServerError)
+	})
+	if _, err := daemon.UDPForwarder.Exchange(githubComUDPQuery); err == nil {
+		t.Fatal("did not error")
+	}
+}
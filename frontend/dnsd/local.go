@@ -0,0 +1,72 @@
+package dnsd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const LocalRecordTTL = 60 // TTL of local record answers is kept short because the addresses may change at run time
+
+// IPv4 and IPv6 addresses of a local record, either may be nil.
+type localAddrs struct {
+	ipv4 net.IP
+	ipv6 net.IP
+}
+
+// Set the IPv4 or IPv6 address of a local record, replacing the address of the same family. Queries of the name are answered locally.
+func (dnsd *DNSD) SetLocalRecord(name, ip string) error {
+	name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" {
+		return fmt.Errorf("DNSD.SetLocalRecord: name must not be empty")
+	}
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	if addr == nil {
+		return fmt.Errorf("DNSD.SetLocalRecord: \"%s\" is not an IP address", ip)
+	}
+	dnsd.localMutex.Lock()
+	defer dnsd.localMutex.Unlock()
+	addrs := dnsd.localRecords[name]
+	if ip4 := addr.To4(); ip4 != nil {
+		addrs.ipv4 = ip4
+	} else {
+		addrs.ipv6 = addr.To16()
+	}
+	dnsd.localRecords[name] = addrs
+	return nil
+}
+
+// Return the IPv4 and IPv6 addresses of a local record, either may be nil. The last return value is false if there is no such record.
+func (dnsd *DNSD) GetLocalRecord(name string) (ipv4, ipv6 net.IP, exists bool) {
+	dnsd.localMutex.Lock()
+	defer dnsd.localMutex.Unlock()
+	addrs, exists := dnsd.localRecords[strings.Trim(strings.ToLower(name), ".")]
+	return addrs.ipv4, addrs.ipv6, exists
+}
+
+/*
+If the query asks for a local record, return a response that carries the record's address. Queries of other types, or
+of an address family that the record does not have, are answered with nothing. The second return value is false if the
+query does not ask for a local record.
+*/
+func (dnsd *DNSD) AnswerLocalQuery(query []byte) ([]byte, bool) {
+	name, qType, _, err := ParseQuestion(query)
+	if err != nil {
+		return nil, false
+	}
+	ipv4, ipv6, exists := dnsd.GetLocalRecord(name)
+	if !exists {
+		return nil, false
+	}
+	var answers []ResourceRecord
+	if qType == TypeA && ipv4 != nil {
+		answers = []ResourceRecord{{Name: name, Type: TypeA, Class: ClassIN, TTL: LocalRecordTTL, Data: ipv4}}
+	} else if qType == TypeAAAA && ipv6 != nil {
+		answers = []ResourceRecord{{Name: name, Type: TypeAAAA, Class: ClassIN, TTL: LocalRecordTTL, Data: ipv6}}
+	}
+	response, err := BuildResponse(query, answers)
+	if err != nil {
+		return nil, false
+	}
+	return response, true
+}
@@ -0,0 +1,61 @@
+package dnsd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestDNSD_LocalRecords(t *testing.T) {
+	daemon := DNSD{
+		TCPListenAddress: "127.0.0.1",
+		TCPListenPort:    16862,
+		TCPForwardTo:     "127.0.0.1:53",
+		PerIPLimit:       10,
+		AllowQueryCIDRs:  []string{"127.0.0.0/8"},
+		LocalRecords:     map[string]string{"home.example.com": "not an IP"},
+	}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.LocalRecords = map[string]string{"Home.Example.com.": "1.2.3.4"}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, isLocal := daemon.AnswerLocalQuery(BuildQuery(1, "github.com", TypeA)); isLocal {
+		t.Fatal("should not be local")
+	}
+	response, isLocal := daemon.AnswerLocalQuery(BuildQuery(1, "HOME.example.com", TypeA))
+	if !isLocal {
+		t.Fatal("should be local")
+	}
+	if answers, err := ParseAnswers(response); err != nil || len(answers) != 1 || answers[0].Name != "HOME.example.com" ||
+		answers[0].TTL != LocalRecordTTL || !bytes.Equal(answers[0].Data, net.ParseIP("1.2.3.4").To4()) {
+		t.Fatal(answers, err)
+	}
+	// The record does not have an IPv6 address yet
+	if response, isLocal := daemon.AnswerLocalQuery(BuildQuery(2, "home.example.com", TypeAAAA)); !isLocal {
+		t.Fatal("should be local")
+	} else if answers, err := ParseAnswers(response); err != nil || len(answers) != 0 {
+		t.Fatal(answers, err)
+	}
+	// Addresses may change at run time
+	if err := daemon.SetLocalRecord("home.example.com", "fd00::1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.SetLocalRecord("home.example.com", "5.6.7.8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.SetLocalRecord("", "5.6.7.8"); err == nil {
+		t.Fatal("did not error")
+	}
+	if ipv4, ipv6, exists := daemon.GetLocalRecord("home.example.com"); !exists || ipv4.String() != "5.6.7.8" || ipv6.String() != "fd00::1" {
+		t.Fatal(ipv4, ipv6, exists)
+	}
+	// Local records are answered without consulting forwarder
+	if response, err := daemon.AnswerQuery("127.0.0.1", BuildQuery(3, "home.example.com", TypeAAAA)); err != nil {
+		t.Fatal(err)
+	} else if answers, err := ParseAnswers(response); err != nil || len(answers) != 1 || !bytes.Equal(answers[0].Data, net.ParseIP("fd00::1")) {
+		t.Fatal(answers, err)
+	}
+}
@@ -0,0 +1,168 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	TypeA     = 1  // DNS resource record type of IPv4 address
+	TypeCNAME = 5  // DNS resource record type of canonical name
+	TypeTXT   = 16 // DNS resource record type of text strings
+	TypeAAAA  = 28 // DNS resource record type of IPv6 address
+	ClassIN   = 1  // DNS class of Internet
+)
+
+var ErrMalformedMessage = errors.New("malformed DNS message")
+
+// A resource record in the answer section of a DNS message.
+type ResourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte // Record data as is, names in it are not decompressed.
+}
+
+// Read a possibly compressed domain name at the offset, return the name and offset of the next field.
+func readName(packet []byte, offset int) (string, int, error) {
+	labels := make([]string, 0, 8)
+	next := -1
+	// Guard against pointer loops
+	for jumps := 0; jumps < 64; {
+		if offset >= len(packet) {
+			return "", 0, ErrMalformedMessage
+		}
+		length := int(packet[offset])
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(packet) {
+				return "", 0, ErrMalformedMessage
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(packet[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+length > len(packet) {
+				return "", 0, ErrMalformedMessage
+			}
+			labels = append(labels, string(packet[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, ErrMalformedMessage
+}
+
+// Encode domain name in uncompressed wire format.
+func EncodeName(name string) []byte {
+	ret := make([]byte, 0, len(name)+2)
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		ret = append(ret, byte(len(label)))
+		ret = append(ret, label...)
+	}
+	return append(ret, 0)
+}
+
+// Return name and type of the first question in the query, as well as the offset at which the question ends.
+func ParseQuestion(packet []byte) (name string, qType uint16, end int, err error) {
+	if len(packet) < 12 || binary.BigEndian.Uint16(packet[4:]) < 1 {
+		return "", 0, 0, ErrMalformedMessage
+	}
+	name, offset, err := readName(packet, 12)
+	if err != nil {
+		return
+	}
+	if offset+4 > len(packet) {
+		return "", 0, 0, ErrMalformedMessage
+	}
+	return name, binary.BigEndian.Uint16(packet[offset:]), offset + 4, nil
+}
+
+// Return the resource records of answer section in the response.
+func ParseAnswers(packet []byte) ([]ResourceRecord, error) {
+	if len(packet) < 12 {
+		return nil, ErrMalformedMessage
+	}
+	numQuestions := int(binary.BigEndian.Uint16(packet[4:]))
+	numAnswers := int(binary.BigEndian.Uint16(packet[6:]))
+	offset := 12
+	for i := 0; i < numQuestions; i++ {
+		_, next, err := readName(packet, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4
+	}
+	ret := make([]ResourceRecord, 0, numAnswers)
+	for i := 0; i < numAnswers; i++ {
+		name, next, err := readName(packet, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(packet) {
+			return nil, ErrMalformedMessage
+		}
+		dataLen := int(binary.BigEndian.Uint16(packet[next+8:]))
+		if next+10+dataLen > len(packet) {
+			return nil, ErrMalformedMessage
+		}
+		ret = append(ret, ResourceRecord{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(packet[next:]),
+			Class: binary.BigEndian.Uint16(packet[next+2:]),
+			TTL:   binary.BigEndian.Uint32(packet[next+4:]),
+			Data:  packet[next+10 : next+10+dataLen],
+		})
+		offset = next + 10 + dataLen
+	}
+	return ret, nil
+}
+
+// Create a recursive query packet (without length prefix) of a single question.
+func BuildQuery(id uint16, name string, qType uint16) []byte {
+	packet := make([]byte, 12, 12+len(name)+6)
+	binary.BigEndian.PutUint16(packet, id)
+	packet[2] = 1 // recursion desired
+	binary.BigEndian.PutUint16(packet[4:], 1)
+	packet = append(packet, EncodeName(name)...)
+	return append(packet, byte(qType>>8), byte(qType), 0, ClassIN)
+}
+
+// Create a response packet (without length prefix) that answers the first question of query with the records.
+func BuildResponse(query []byte, answers []ResourceRecord) ([]byte, error) {
+	_, _, questionEnd, err := ParseQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 12, questionEnd+len(answers)*32)
+	copy(packet, query[:2])
+	copy(packet[2:], StandardResponseNoError)
+	binary.BigEndian.PutUint16(packet[4:], 1)
+	binary.BigEndian.PutUint16(packet[6:], uint16(len(answers)))
+	packet = append(packet, query[12:questionEnd]...)
+	for _, rr := range answers {
+		packet = append(packet, EncodeName(rr.Name)...)
+		header := make([]byte, 10)
+		binary.BigEndian.PutUint16(header, rr.Type)
+		binary.BigEndian.PutUint16(header[2:], rr.Class)
+		binary.BigEndian.PutUint32(header[4:], rr.TTL)
+		binary.BigEndian.PutUint16(header[8:], uint16(len(rr.Data)))
+		packet = append(packet, header...)
+		packet = append(packet, rr.Data...)
+	}
+	return packet, nil
+}
@@ -0,0 +1,47 @@
+package dnsd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestBuildAndParseMessage(t *testing.T) {
+	query := BuildQuery(0x1234, "www.example.com", TypeAAAA)
+	if name, qType, end, err := ParseQuestion(query); err != nil || name != "www.example.com" || qType != TypeAAAA || end != len(query) {
+		t.Fatal(name, qType, end, err)
+	}
+	if names := ExtractDomainName(BuildQuery(1, "www.example.com", TypeA)); !reflect.DeepEqual(names, []string{"www.example.com", "example.com", "com"}) {
+		t.Fatal(names)
+	}
+	answers := []ResourceRecord{
+		{Name: "www.example.com", Type: TypeA, Class: ClassIN, TTL: 300, Data: []byte{1, 2, 3, 4}},
+		{Name: "www.example.com", Type: TypeTXT, Class: ClassIN, TTL: 0, Data: []byte{2, 'h', 'i'}},
+	}
+	response, err := BuildResponse(query, answers)
+	if err != nil || response[0] != 0x12 || response[1] != 0x34 || !bytes.Equal(response[2:4], StandardResponseNoError) {
+		t.Fatal(response, err)
+	}
+	if parsed, err := ParseAnswers(response); err != nil || !reflect.DeepEqual(parsed, answers) {
+		t.Fatal(parsed, err)
+	}
+	// Compressed name points to the question
+	compressed := append([]byte{}, query...)
+	compressed[7] = 1
+	compressed = append(compressed, 0xC0, 12, 0, TypeA, 0, ClassIN, 0, 0, 0, 60, 0, 4, 5, 6, 7, 8)
+	if parsed, err := ParseAnswers(compressed); err != nil || len(parsed) != 1 || parsed[0].Name != "www.example.com" || !bytes.Equal(parsed[0].Data, []byte{5, 6, 7, 8}) {
+		t.Fatal(parsed, err)
+	}
+	// Pointer loop and truncated messages are rejected
+	loop := append([]byte{}, query[:12]...)
+	loop = append(loop, 0xC0, 12, 0, 1, 0, 1)
+	if _, _, _, err := ParseQuestion(loop); err != ErrMalformedMessage {
+		t.Fatal(err)
+	}
+	if _, err := ParseAnswers(compressed[:len(compressed)-2]); err != ErrMalformedMessage {
+		t.Fatal(err)
+	}
+	if _, _, _, err := ParseQuestion([]byte{1, 2, 3}); err != ErrMalformedMessage {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,198 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/ipfilter"
+	"github.com/HouzuoGuo/laitos/namepattern"
+	"strings"
+	"sync"
+)
+
+/*
+A named policy that applies to queries made by certain clients, it comes with its own block-lists, allow-lists, and
+forwarder. Clients that do not match any profile are served by the default profile, which is made of the global black
+list, allow-list, block-list, and forwarders of DNS daemon.
+*/
+type PolicyProfile struct {
+	Name                   string            `json:"Name"`                   // Name of the profile that shows up in log
+	ClientCIDRs            []string          `json:"ClientCIDRs"`            // Apply the profile to queries made by these IPv4/IPv6 CIDR blocks or addresses
+	BlacklistSources       []BlacklistSource `json:"BlacklistSources"`       // (Optional) additional blacklists, e.g. adult content.
+	IgnoreDefaultBlacklist bool              `json:"IgnoreDefaultBlacklist"` // (Optional) do not block names found in the default profile's blacklist and block-list
+	AllowList              []string          `json:"AllowList"`              // (Optional) never block these names. Supports "*.name" and "/regex/".
+	BlockList              []string          `json:"BlockList"`              // (Optional) always block these names. Supports "*.name" and "/regex/".
+	ForwardTo              string            `json:"ForwardTo"`              // (Optional) forward queries to this address (IP:Port, tls://, https://) instead of the default forwarders
+	SafeSearch             map[string]string `json:"SafeSearch"`             // (Optional) answer queries of key names with addresses of value names, e.g. www.google.com: forcesafesearch.google.com
+
+	clientFilter  *ipfilter.IPFilter
+	allowPatterns *namepattern.NamePatterns
+	blockPatterns *namepattern.NamePatterns
+	forwarder     Forwarder
+	safeSearch    map[string]string
+	blacklist     map[string]struct{}
+	mutex         *sync.Mutex
+}
+
+// Check configuration and initialise internal states. Encrypted forwarder uses TLS configuration of the DNS daemon.
+func (profile *PolicyProfile) Initialise(dnsd *DNSD) error {
+	if profile.Name == "" {
+		return errors.New("PolicyProfile.Initialise: name must not be empty")
+	}
+	if len(profile.ClientCIDRs) == 0 {
+		return fmt.Errorf("PolicyProfile.Initialise: ClientCIDRs of profile \"%s\" must not be empty", profile.Name)
+	}
+	profile.clientFilter = &ipfilter.IPFilter{Allow: profile.ClientCIDRs}
+	if err := profile.clientFilter.Initialise(); err != nil {
+		return fmt.Errorf("PolicyProfile.Initialise: profile \"%s\" - %v", profile.Name, err)
+	}
+	for _, src := range profile.BlacklistSources {
+		if err := src.Validate(); err != nil {
+			return fmt.Errorf("PolicyProfile.Initialise: profile \"%s\" - %v", profile.Name, err)
+		}
+	}
+	var err error
+	if profile.allowPatterns, err = namepattern.NewNamePatterns(profile.AllowList); err != nil {
+		return fmt.Errorf("PolicyProfile.Initialise: AllowList of profile \"%s\" - %v", profile.Name, err)
+	}
+	if profile.blockPatterns, err = namepattern.NewNamePatterns(profile.BlockList); err != nil {
+		return fmt.Errorf("PolicyProfile.Initialise: BlockList of profile \"%s\" - %v", profile.Name, err)
+	}
+	profile.forwarder = nil
+	if profile.ForwardTo != "" {
+		if profile.forwarder, err = NewForwarder(profile.ForwardTo, true, dnsd.ForwarderTLSConfig); err != nil {
+			return fmt.Errorf("PolicyProfile.Initialise: profile \"%s\" - %v", profile.Name, err)
+		}
+	}
+	profile.safeSearch = make(map[string]string, len(profile.SafeSearch))
+	for name, target := range profile.SafeSearch {
+		name = normaliseBlacklistName(name)
+		target = normaliseBlacklistName(target)
+		if name == "" || target == "" {
+			return fmt.Errorf("PolicyProfile.Initialise: SafeSearch of profile \"%s\" must not contain empty name", profile.Name)
+		}
+		profile.safeSearch[name] = target
+	}
+	profile.blacklist = make(map[string]struct{})
+	profile.mutex = new(sync.Mutex)
+	return nil
+}
+
+// Fetch all blacklist sources of the profile and replace its blacklist. If all sources fail, the blacklist is left unchanged.
+func (profile *PolicyProfile) UpdateBlacklist(logger global.Logger) {
+	if len(profile.BlacklistSources) == 0 {
+		return
+	}
+	newList := make(map[string]struct{})
+	var numFailed int
+	for _, src := range profile.BlacklistSources {
+		names, err := src.Fetch()
+		if err != nil {
+			numFailed++
+			logger.Warningf("UpdateBlacklist", profile.Name, err, "failed to update blacklist from %s", src.Location())
+			continue
+		}
+		for _, name := range names {
+			newList[name] = struct{}{}
+		}
+	}
+	if numFailed == len(profile.BlacklistSources) {
+		return
+	}
+	profile.mutex.Lock()
+	profile.blacklist = newList
+	profile.mutex.Unlock()
+	logger.Printf("UpdateBlacklist", profile.Name, nil, "profile blacklist now has %d entries", len(newList))
+}
+
+// Return the target name if the name is subject to safe-search rewrite. Return empty string otherwise.
+func (profile *PolicyProfile) SafeSearchTarget(name string) string {
+	return profile.safeSearch[strings.TrimSuffix(strings.ToLower(name), ".")]
+}
+
+// Return the profile that applies to the client IP, or nil if the client is served by the default profile.
+func (dnsd *DNSD) GetProfile(clientIP string) *PolicyProfile {
+	for i := range dnsd.Profiles {
+		if dnsd.Profiles[i].clientFilter.IsAllowed(clientIP) {
+			return &dnsd.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// Return true if any of the input names is black listed by the profile. Nil profile is the default profile.
+func (dnsd *DNSD) NamesAreBlackListedByProfile(profile *PolicyProfile, names []string) bool {
+	if profile == nil {
+		return dnsd.NamesAreBlackListed(names)
+	}
+	if dnsd.isTemporarilyAllowed(names) || profile.allowPatterns.Match(names) {
+		return false
+	}
+	if profile.blockPatterns.Match(names) {
+		return true
+	}
+	profile.mutex.Lock()
+	for _, name := range names {
+		if _, blacklisted := profile.blacklist[name]; blacklisted {
+			profile.mutex.Unlock()
+			return true
+		}
+	}
+	profile.mutex.Unlock()
+	return !profile.IgnoreDefaultBlacklist && dnsd.NamesAreBlackListed(names)
+}
+
+/*
+Answer the query according to the profile's safe-search rewrite and forwarder. If the profile is nil or neither of them
+applies to the query, return false and let the default forwarder answer the query.
+*/
+func (dnsd *DNSD) ForwardQueryByProfile(profile *PolicyProfile, query []byte) (response []byte, handled bool, err error) {
+	if profile == nil {
+		return nil, false, nil
+	}
+	forward := dnsd.ForwardQuery
+	if profile.forwarder != nil {
+		forward = profile.forwarder.Exchange
+	}
+	// Safe-search applies to queries of all types, not only to the type-A queries that carry the names.
+	if name, _, _, parseErr := ParseQuestion(query); parseErr == nil {
+		if target := profile.SafeSearchTarget(name); target != "" {
+			response, err = dnsd.AnswerSafeSearch(query, target, forward)
+			return response, true, err
+		}
+	}
+	if profile.forwarder != nil {
+		response, err = forward(query)
+		return response, true, err
+	}
+	return nil, false, nil
+}
+
+/*
+Answer an address query by resolving the target name instead, and present the target's addresses under the original
+name. Queries of other types are answered with an empty response so that they cannot bypass the rewrite.
+*/
+func (dnsd *DNSD) AnswerSafeSearch(query []byte, target string, forward func([]byte) ([]byte, error)) ([]byte, error) {
+	name, qType, _, err := ParseQuestion(query)
+	if err != nil {
+		return nil, fmt.Errorf("DNSD.AnswerSafeSearch: %v", err)
+	}
+	answers := make([]ResourceRecord, 0, 4)
+	if qType == TypeA || qType == TypeAAAA {
+		targetResponse, err := forward(BuildQuery(uint16(query[0])<<8|uint16(query[1]), target, qType))
+		if err != nil {
+			return nil, err
+		}
+		targetAnswers, err := ParseAnswers(targetResponse)
+		if err != nil {
+			return nil, fmt.Errorf("DNSD.AnswerSafeSearch: failed to parse response of \"%s\" - %v", target, err)
+		}
+		for _, rr := range targetAnswers {
+			if rr.Type == qType {
+				rr.Name = name
+				answers = append(answers, rr)
+			}
+		}
+	}
+	return BuildResponse(query, answers)
+}
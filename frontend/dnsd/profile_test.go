@@ -0,0 +1,131 @@
+package dnsd
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// Start a TCP DNS server that answers A queries with the address of the name, or 1.2.3.4 for unknown names.
+func startAddressTCPResolver(t *testing.T, addresses map[string]net.IP) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				lenBuf := make([]byte, 2)
+				if _, err := io.ReadFull(conn, lenBuf); err != nil {
+					return
+				}
+				query := make([]byte, int(lenBuf[0])*256+int(lenBuf[1]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				name, _, _, _ := ParseQuestion(query)
+				address, found := addresses[name]
+				if !found {
+					address = net.IPv4(1, 2, 3, 4)
+				}
+				resp, _ := BuildResponse(query, []ResourceRecord{{Name: name, Type: TypeA, Class: ClassIN, TTL: 60, Data: address.To4()}})
+				conn.Write(append([]byte{byte(len(resp) / 256), byte(len(resp) % 256)}, resp...))
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestPolicyProfile(t *testing.T) {
+	safeAddr := net.IPv4(216, 239, 38, 120)
+	daemon := DNSD{
+		TCPListenAddress:     "127.0.0.1",
+		TCPListenPort:        16857,
+		TCPForwardTo:         "127.0.0.1:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127", "10"},
+		Profiles: []PolicyProfile{{
+			Name:        "kids",
+			ClientCIDRs: []string{"10.0.0.0/24"},
+			BlockList:   []string{"*.adult.com"},
+			AllowList:   []string{"ads-for-kids.com"},
+			ForwardTo:   startAddressTCPResolver(t, map[string]net.IP{"forcesafesearch.google.com": safeAddr}),
+			SafeSearch:  map[string]string{"www.google.com": "forcesafesearch.google.com"},
+		}},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.BlackList["ads.com"] = struct{}{}
+	daemon.BlackList["ads-for-kids.com"] = struct{}{}
+
+	// Profile is selected by client CIDR
+	if profile := daemon.GetProfile("10.0.0.5"); profile == nil || profile.Name != "kids" {
+		t.Fatal(profile)
+	}
+	if profile := daemon.GetProfile("10.0.1.5"); profile != nil {
+		t.Fatal(profile)
+	}
+	kids := daemon.GetProfile("10.0.0.5")
+	// Profile has its own block-list and allow-list in addition to the default black list
+	if !daemon.NamesAreBlackListedByProfile(kids, []string{"www.adult.com", "adult.com", "com"}) ||
+		!daemon.NamesAreBlackListedByProfile(kids, []string{"ads.com", "com"}) ||
+		daemon.NamesAreBlackListedByProfile(kids, []string{"ads-for-kids.com", "com"}) {
+		t.Fatal("wrong profile black list")
+	}
+	if daemon.NamesAreBlackListedByProfile(nil, []string{"www.adult.com", "adult.com", "com"}) ||
+		!daemon.NamesAreBlackListedByProfile(nil, []string{"ads-for-kids.com", "com"}) {
+		t.Fatal("wrong default black list")
+	}
+	kids.IgnoreDefaultBlacklist = true
+	if daemon.NamesAreBlackListedByProfile(kids, []string{"ads.com", "com"}) {
+		t.Fatal("should have ignored default black list")
+	}
+
+	// Safe-search rewrite answers with target's address under the original name
+	resp, err := daemon.AnswerQuery("10.0.0.5", BuildQuery(1, "WWW.Google.com", TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, err := ParseAnswers(resp)
+	if err != nil || len(answers) != 1 || answers[0].Name != "WWW.Google.com" || !bytes.Equal(answers[0].Data, safeAddr.To4()) {
+		t.Fatal(answers, err)
+	}
+	// Other query types of the rewritten name are answered with nothing
+	resp, err = daemon.AnswerQuery("10.0.0.5", BuildQuery(2, "www.google.com", TypeTXT))
+	if answers, err := ParseAnswers(resp); err != nil || len(answers) != 0 {
+		t.Fatal(answers, err)
+	}
+	// Other names are answered by profile's forwarder
+	resp, err = daemon.AnswerQuery("10.0.0.5", BuildQuery(3, "example.com", TypeA))
+	if answers, err := ParseAnswers(resp); err != nil || len(answers) != 1 || !bytes.Equal(answers[0].Data, []byte{1, 2, 3, 4}) {
+		t.Fatal(answers, err)
+	}
+	// Black-listed names are answered by black hole
+	resp, err = daemon.AnswerQuery("10.0.0.5", BuildQuery(4, "www.adult.com", TypeA))
+	if err != nil || bytes.Index(resp, BlackHoleAnswer) == -1 {
+		t.Fatal(resp, err)
+	}
+
+	// Bad profiles
+	for _, bad := range []PolicyProfile{
+		{ClientCIDRs: []string{"10.0.0.0/8"}},
+		{Name: "a"},
+		{Name: "a", ClientCIDRs: []string{"10.0.0.0/99"}},
+		{Name: "a", ClientCIDRs: []string{"10.0.0.0/8"}, BlockList: []string{"/(/"}},
+		{Name: "a", ClientCIDRs: []string{"10.0.0.0/8"}, ForwardTo: "no-port"},
+		{Name: "a", ClientCIDRs: []string{"10.0.0.0/8"}, SafeSearch: map[string]string{"www.google.com": ""}},
+		{Name: "a", ClientCIDRs: []string{"10.0.0.0/8"}, BlacklistSources: []BlacklistSource{{Format: BlacklistFormatHosts}}},
+	} {
+		daemon.Profiles = []PolicyProfile{bad}
+		if err := daemon.Initialise(); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/dnsstats"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+Answer a query packet (without length prefix) made by the client. A black-listed name is answered by black hole (or
+sinkhole) response, queries under command domain run commands, local records are answered right away, and other queries
+are answered by forwarder. The client's policy profile decides which names are black-listed and which forwarder to use.
+The function is used by TCP, DNS-over-TLS, and DNS-over-HTTPS queries.
+*/
+func (dnsd *DNSD) AnswerQuery(clientIP string, query []byte) ([]byte, error) {
+	// Command queries are neither black-listed nor forwarded, and their names stay out of statistics and log.
+	if response, isCommand := dnsd.AnswerCommandQuery(clientIP, query); isCommand {
+		return response, nil
+	}
+	if response, isLocal := dnsd.AnswerLocalQuery(query); isLocal {
+		name, _, _, _ := ParseQuestion(query)
+		dnsstats.Common.Record(clientIP, strings.ToLower(name), false)
+		return response, nil
+	}
+	profile := dnsd.GetProfile(clientIP)
+	domainName := ExtractDomainName(query)
+	if len(domainName) == 0 {
+		// If I cannot figure out what domain is from the query, simply forward it without much concern.
+		dnsstats.Common.Record(clientIP, "", false)
+		if dnsd.LogQueries {
+			dnsd.Logger.Printf("AnswerQuery", clientIP, nil, "handle non-name query")
+		}
+	} else if dnsd.NamesAreBlackListedByProfile(profile, domainName) {
+		dnsstats.Common.Record(clientIP, domainName[0], true)
+		if dnsd.LogQueries {
+			dnsd.Logger.Printf("AnswerQuery", clientIP, nil, "handle black-listed domain \"%s\"", domainName[0])
+		}
+		return dnsd.BlackHoleResponse(query), nil
+	} else {
+		dnsstats.Common.Record(clientIP, domainName[0], false)
+		if dnsd.LogQueries {
+			dnsd.Logger.Printf("AnswerQuery", clientIP, nil, "handle domain \"%s\"", domainName[0])
+		}
+	}
+	if response, handled, err := dnsd.ForwardQueryByProfile(profile, query); handled {
+		return response, err
+	}
+	return dnsd.ForwardQuery(query)
+}
+
+// Send the query packet (without length prefix) to forwarder and return its response. TCP forwarder is preferred over UDP.
+func (dnsd *DNSD) ForwardQuery(query []byte) ([]byte, error) {
+	if len(query) > MaxPacketSize {
+		return nil, errors.New("DNSD.ForwardQuery: query is too large")
+	}
+	if dnsd.TCPForwarder != nil {
+		return dnsd.TCPForwarder.Exchange(query)
+	} else if dnsd.UDPForwarder != nil {
+		return dnsd.UDPForwarder.Exchange(query)
+	}
+	return nil, errors.New("DNSD.ForwardQuery: forwarder is not initialised")
+}
+
+// Send the query packet to a TCP DNS server and return its response.
+func ForwardTCPQuery(serverAddr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", serverAddr, IOTimeoutSec*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("ForwardTCPQuery: failed to connect to forwarder - %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	return ExchangeTCPQuery(conn, query)
+}
+
+// Write the query in length-prefixed form into the connection and read the length-prefixed response.
+func ExchangeTCPQuery(conn net.Conn, query []byte) ([]byte, error) {
+	// Write length and query in one go, so that a TLS connection sends them in one record.
+	request := make([]byte, 2+len(query))
+	request[0] = byte(len(query) / 256)
+	request[1] = byte(len(query) % 256)
+	copy(request[2:], query)
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("ExchangeTCPQuery: failed to write query to forwarder - %v", err)
+	}
+	// Retrieve forwarder's response
+	responseLenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, responseLenBuf); err != nil {
+		return nil, fmt.Errorf("ExchangeTCPQuery: failed to read length from forwarder - %v", err)
+	}
+	responseLen := int(responseLenBuf[0])*256 + int(responseLenBuf[1])
+	if responseLen > MaxPacketSize || responseLen < 1 {
+		return nil, errors.New("ExchangeTCPQuery: bad response length from forwarder")
+	}
+	response := make([]byte, responseLen)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, fmt.Errorf("ExchangeTCPQuery: failed to read response from forwarder - %v", err)
+	}
+	return response, nil
+}
+
+// Send the query packet to a UDP DNS server and return its response.
+func ForwardUDPQuery(serverAddr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", serverAddr, IOTimeoutSec*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("ForwardUDPQuery: failed to connect to forwarder - %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, fmt.Errorf("ForwardUDPQuery: failed to write query to forwarder - %v", err)
+	}
+	response := make([]byte, MaxPacketSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, fmt.Errorf("ForwardUDPQuery: failed to read response from forwarder - %v", err)
+	}
+	return response[:n], nil
+}
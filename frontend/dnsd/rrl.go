@@ -0,0 +1,189 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRRLResponsesPerSec = 20     // Default number of UDP responses per second toward a client network for the same name
+	DefaultRRLSlip            = 2      // By default, answer every other rate-limited query with a truncated response and drop the rest
+	RRLIPv4PrefixLen          = 24     // IPv4 clients of the same /24 network share a response rate limit
+	RRLIPv6PrefixLen          = 56     // IPv6 clients of the same /56 network share a response rate limit
+	RRLMaxBuckets             = 100000 // Forget idle rate limit buckets when there are more than this many
+	MinUDPResponseSize        = 512    // Maximum size of UDP response toward a client that does not advertise a larger buffer via EDNS
+	TypeOPT                   = 41     // DNS resource record type of EDNS pseudo-record
+)
+
+// Decision made by response rate limit about a UDP query.
+type RRLAction int
+
+const (
+	RRLActionAnswer RRLAction = iota // Answer the query as usual
+	RRLActionSlip                    // Answer the query by a truncated response, so that a genuine client retries over TCP.
+	RRLActionDrop                    // Do not answer the query at all
+)
+
+// Token bucket of a client network and response name.
+type rrlBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	numLimited int
+}
+
+/*
+Limit the rate of identical UDP responses toward a client network, in the manner of response rate limiting (RRL) of
+authoritative name servers. A flood of queries made with spoofed source address therefore cannot use the daemon to
+amplify traffic toward a victim, while the victim's legitimate queries for other names are not affected.
+*/
+type ResponseRateLimit struct {
+	ResponsesPerSec int // Number of responses per second toward a client network for the same name, it is also the burst size.
+	Slip            int // Answer every Nth rate-limited query by a truncated response, 1 truncates all, less than 1 drops all.
+
+	buckets map[string]*rrlBucket
+	mutex   *sync.Mutex
+}
+
+// Initialise internal states.
+func (rrl *ResponseRateLimit) Initialise() {
+	if rrl.ResponsesPerSec < 1 {
+		rrl.ResponsesPerSec = DefaultRRLResponsesPerSec
+	}
+	rrl.buckets = make(map[string]*rrlBucket)
+	rrl.mutex = new(sync.Mutex)
+}
+
+// Return the rate limit key made of client network and lower case response name.
+func RRLKey(clientIP, name string) string {
+	ip := net.ParseIP(clientIP)
+	network := clientIP
+	if ip4 := ip.To4(); ip4 != nil {
+		network = ip4.Mask(net.CIDRMask(RRLIPv4PrefixLen, 32)).String()
+	} else if ip != nil {
+		network = ip.Mask(net.CIDRMask(RRLIPv6PrefixLen, 128)).String()
+	}
+	return network + "|" + strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Decide what to do with a UDP query made by the client toward the name. Name may be empty if it could not be determined.
+func (rrl *ResponseRateLimit) Check(clientIP, name string) RRLAction {
+	return rrl.CheckAt(time.Now(), clientIP, name)
+}
+
+// Decide what to do with a UDP query that arrived at the specified time.
+func (rrl *ResponseRateLimit) CheckAt(now time.Time, clientIP, name string) RRLAction {
+	key := RRLKey(clientIP, name)
+	rrl.mutex.Lock()
+	defer rrl.mutex.Unlock()
+	bucket, exists := rrl.buckets[key]
+	if !exists {
+		if len(rrl.buckets) >= RRLMaxBuckets {
+			rrl.prune(now)
+		}
+		bucket = &rrlBucket{tokens: float64(rrl.ResponsesPerSec), lastRefill: now}
+		rrl.buckets[key] = bucket
+	}
+	// Refill the bucket in proportion to time elapsed since last refill
+	if elapsed := now.Sub(bucket.lastRefill).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * float64(rrl.ResponsesPerSec)
+		if bucket.tokens > float64(rrl.ResponsesPerSec) {
+			bucket.tokens = float64(rrl.ResponsesPerSec)
+		}
+		bucket.lastRefill = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.numLimited = 0
+		return RRLActionAnswer
+	}
+	bucket.numLimited++
+	if rrl.Slip > 0 && bucket.numLimited%rrl.Slip == 0 {
+		return RRLActionSlip
+	}
+	return RRLActionDrop
+}
+
+// Remove buckets that have been idle long enough to be full again, or all of them if that is not enough. Caller must hold mutex.
+func (rrl *ResponseRateLimit) prune(now time.Time) {
+	for key, bucket := range rrl.buckets {
+		if now.Sub(bucket.lastRefill) >= time.Second {
+			delete(rrl.buckets, key)
+		}
+	}
+	if len(rrl.buckets) >= RRLMaxBuckets {
+		rrl.buckets = make(map[string]*rrlBucket)
+	}
+}
+
+/*
+Return the largest UDP response that the client can receive for the query. It is 512 bytes unless the query carries an
+EDNS OPT record that advertises a larger buffer, which is capped at MaxPacketSize.
+*/
+func UDPResponseSizeLimit(query []byte) int {
+	if len(query) < 12 {
+		return MinUDPResponseSize
+	}
+	numQuestions := int(binary.BigEndian.Uint16(query[4:]))
+	numRecords := int(binary.BigEndian.Uint16(query[6:])) + int(binary.BigEndian.Uint16(query[8:])) + int(binary.BigEndian.Uint16(query[10:]))
+	offset := 12
+	for i := 0; i < numQuestions; i++ {
+		_, next, err := readName(query, offset)
+		if err != nil {
+			return MinUDPResponseSize
+		}
+		offset = next + 4
+	}
+	for i := 0; i < numRecords; i++ {
+		_, next, err := readName(query, offset)
+		if err != nil || next+10 > len(query) {
+			return MinUDPResponseSize
+		}
+		if binary.BigEndian.Uint16(query[next:]) == TypeOPT {
+			// The class field of OPT record carries the requester's UDP payload size
+			size := int(binary.BigEndian.Uint16(query[next+2:]))
+			if size < MinUDPResponseSize {
+				return MinUDPResponseSize
+			} else if size > MaxPacketSize {
+				return MaxPacketSize
+			}
+			return size
+		}
+		offset = next + 10 + int(binary.BigEndian.Uint16(query[next+8:]))
+	}
+	return MinUDPResponseSize
+}
+
+// Return a copy of the response with TC flag set and only the header and question left, so that the client retries over TCP.
+func TruncateResponse(response []byte) []byte {
+	if len(response) < 12 {
+		return response
+	}
+	end := 12
+	if _, _, questionEnd, err := ParseQuestion(response); err == nil {
+		end = questionEnd
+	}
+	ret := make([]byte, end)
+	copy(ret, response[:end])
+	ret[2] |= 0x02
+	if end == 12 {
+		binary.BigEndian.PutUint16(ret[4:], 0)
+	} else {
+		binary.BigEndian.PutUint16(ret[4:], 1)
+	}
+	binary.BigEndian.PutUint16(ret[6:], 0)
+	binary.BigEndian.PutUint16(ret[8:], 0)
+	binary.BigEndian.PutUint16(ret[10:], 0)
+	return ret
+}
+
+// Create a truncated response (without length prefix) to the query, it asks the client to retry over TCP.
+func TruncatedResponse(query []byte) []byte {
+	response, err := BuildResponse(query, nil)
+	if err != nil {
+		return nil
+	}
+	return TruncateResponse(response)
+}
@@ -0,0 +1,152 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRRLKey(t *testing.T) {
+	if key := RRLKey("192.168.1.2", "Example.COM."); key != "192.168.1.0|example.com" {
+		t.Fatal(key)
+	}
+	if RRLKey("192.168.1.2", "example.com") != RRLKey("192.168.1.200", "example.com") ||
+		RRLKey("192.168.1.2", "example.com") == RRLKey("192.168.2.2", "example.com") {
+		t.Fatal("wrong IPv4 network")
+	}
+	if RRLKey("2001:db8:0:1::1", "a") != RRLKey("2001:db8:0:ff::2", "a") || RRLKey("2001:db8:0:1::1", "a") == RRLKey("2001:db8:0:100::1", "a") {
+		t.Fatal("wrong IPv6 network")
+	}
+	if key := RRLKey("not an IP", ""); key != "not an IP|" {
+		t.Fatal(key)
+	}
+}
+
+func TestResponseRateLimit(t *testing.T) {
+	rrl := ResponseRateLimit{ResponsesPerSec: 2, Slip: 2}
+	rrl.Initialise()
+	now := time.Now()
+	expected := []RRLAction{RRLActionAnswer, RRLActionAnswer, RRLActionDrop, RRLActionSlip, RRLActionDrop, RRLActionSlip}
+	for i, action := range expected {
+		if result := rrl.CheckAt(now, "10.0.0.1", "example.com"); result != action {
+			t.Fatal(i, result)
+		}
+	}
+	// Other names and other networks are not affected
+	if rrl.CheckAt(now, "10.0.0.2", "github.com") != RRLActionAnswer || rrl.CheckAt(now, "10.0.1.1", "example.com") != RRLActionAnswer {
+		t.Fatal("should have answered")
+	}
+	// Budget is refilled over time
+	if rrl.CheckAt(now.Add(500*time.Millisecond), "10.0.0.3", "example.com") != RRLActionAnswer ||
+		rrl.CheckAt(now.Add(500*time.Millisecond), "10.0.0.3", "example.com") != RRLActionDrop {
+		t.Fatal("wrong refill")
+	}
+	// Without slip, all rate-limited queries are dropped
+	rrl = ResponseRateLimit{ResponsesPerSec: 1, Slip: -1}
+	rrl.Initialise()
+	for i := 0; i < 10; i++ {
+		if result := rrl.CheckAt(now, "10.0.0.1", "example.com"); i == 0 && result != RRLActionAnswer || i > 0 && result != RRLActionDrop {
+			t.Fatal(i, result)
+		}
+	}
+	// Default budget
+	rrl = ResponseRateLimit{}
+	rrl.Initialise()
+	if rrl.ResponsesPerSec != DefaultRRLResponsesPerSec {
+		t.Fatal(rrl.ResponsesPerSec)
+	}
+}
+
+func TestUDPResponseSizeLimit(t *testing.T) {
+	query := BuildQuery(1, "example.com", TypeA)
+	if size := UDPResponseSizeLimit(query); size != MinUDPResponseSize {
+		t.Fatal(size)
+	}
+	if size := UDPResponseSizeLimit([]byte{1, 2, 3}); size != MinUDPResponseSize {
+		t.Fatal(size)
+	}
+	// Add an EDNS OPT record to additional section
+	withOPT := func(size uint16) []byte {
+		packet := append([]byte{}, query...)
+		binary.BigEndian.PutUint16(packet[10:], 1)
+		return append(packet, 0, 0, TypeOPT, byte(size>>8), byte(size), 0, 0, 0, 0, 0, 0)
+	}
+	if size := UDPResponseSizeLimit(withOPT(4096)); size != 4096 {
+		t.Fatal(size)
+	}
+	if size := UDPResponseSizeLimit(withOPT(100)); size != MinUDPResponseSize {
+		t.Fatal(size)
+	}
+	if size := UDPResponseSizeLimit(withOPT(65000)); size != MaxPacketSize {
+		t.Fatal(size)
+	}
+}
+
+func TestTruncateResponse(t *testing.T) {
+	query := BuildQuery(1, "example.com", TypeA)
+	response, err := BuildResponse(query, []ResourceRecord{{Name: "example.com", Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{1, 2, 3, 4}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := TruncateResponse(response)
+	if len(truncated) != len(query) || truncated[2]&0x02 == 0 || binary.BigEndian.Uint16(truncated[6:]) != 0 {
+		t.Fatal(truncated)
+	}
+	if name, qType, _, err := ParseQuestion(truncated); err != nil || name != "example.com" || qType != TypeA {
+		t.Fatal(name, qType, err)
+	}
+	if answers, err := ParseAnswers(truncated); err != nil || len(answers) != 0 {
+		t.Fatal(answers, err)
+	}
+	if response := TruncatedResponse(query); response[0] != 0 || response[1] != 1 || response[2]&0x82 != 0x82 {
+		t.Fatal(response)
+	}
+}
+
+func TestDNSD_ResponseRateLimit(t *testing.T) {
+	daemon := DNSD{
+		UDPListenAddress: "127.0.0.1",
+		UDPListenPort:    16860,
+		UDPForwardTo:     "127.0.0.1:53",
+		PerIPLimit:       10,
+		AllowQueryCIDRs:  []string{"127.0.0.0/8"},
+		BlockList:        []string{"ads.example.com"},
+		// Limit the daemon to one response per second and always answer rate-limited queries by truncated responses
+		RRLResponsesPerSec: 1,
+		RRLSlip:            1,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlockUDP(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	conn, err := net.Dial("udp", "127.0.0.1:16860")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxPacketSize)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write(BuildQuery(uint16(i), "ads.example.com", TypeA)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers, err := ParseAnswers(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first query is answered by black hole, the second query is answered by a truncated response.
+		if i == 0 && (len(answers) != 1 || buf[2]&0x02 != 0) || i == 1 && (len(answers) != 0 || buf[2]&0x02 == 0) {
+			t.Fatal(i, answers, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package dnsd
+
+import (
+	"strings"
+	"time"
+)
+
+const SinkholeTTL = 60 // TTL of sinkhole answers is kept short so that a temporarily allowed name resolves again soon
+
+/*
+Create a response packet (without length prefix) for a black-listed query. In sinkhole mode, A and AAAA queries are
+answered by the sinkhole addresses, so that web browsers visit the block page served by HTTP daemon. Otherwise, A queries
+are answered by 0.0.0.0 and AAAA queries are answered with nothing.
+*/
+func (dnsd *DNSD) BlackHoleResponse(query []byte) []byte {
+	name, qType, _, err := ParseQuestion(query)
+	if err != nil {
+		return RespondWith0(query)
+	}
+	var answers []ResourceRecord
+	switch qType {
+	case TypeA:
+		if dnsd.sinkholeIPv4 == nil {
+			return RespondWith0(query)
+		}
+		answers = []ResourceRecord{{Name: name, Type: TypeA, Class: ClassIN, TTL: SinkholeTTL, Data: dnsd.sinkholeIPv4}}
+	case TypeAAAA:
+		if dnsd.sinkholeIPv6 != nil {
+			answers = []ResourceRecord{{Name: name, Type: TypeAAAA, Class: ClassIN, TTL: SinkholeTTL, Data: dnsd.sinkholeIPv6}}
+		}
+	default:
+		return RespondWith0(query)
+	}
+	response, err := BuildResponse(query, answers)
+	if err != nil {
+		return RespondWith0(query)
+	}
+	return response
+}
+
+// Return true if sinkhole mode is enabled for either IPv4 or IPv6.
+func (dnsd *DNSD) IsSinkholeEnabled() bool {
+	return dnsd.sinkholeIPv4 != nil || dnsd.sinkholeIPv6 != nil
+}
+
+// Stop blocking the name and its sub-domains for a while, regardless of which profile or list blocks it.
+func (dnsd *DNSD) AllowTemporarily(name string, duration time.Duration) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" {
+		return
+	}
+	dnsd.BlackListMutex.Lock()
+	defer dnsd.BlackListMutex.Unlock()
+	dnsd.temporaryAllow[name] = time.Now().Add(duration)
+}
+
+// Return true if any of the names is temporarily allowed. Expired entries are removed along the way.
+func (dnsd *DNSD) isTemporarilyAllowed(names []string) bool {
+	dnsd.BlackListMutex.Lock()
+	defer dnsd.BlackListMutex.Unlock()
+	if len(dnsd.temporaryAllow) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if expiry, found := dnsd.temporaryAllow[name]; found {
+			if now.Before(expiry) {
+				return true
+			}
+			delete(dnsd.temporaryAllow, name)
+		}
+	}
+	return false
+}
+
+// Return true if the host name is black-listed for the client. HTTP daemon uses it to decide whether to serve block page.
+func (dnsd *DNSD) IsBlockedName(clientIP, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" {
+		return false
+	}
+	names := []string{name}
+	for {
+		index := strings.IndexRune(name, '.')
+		if index < 1 || index == len(name)-1 {
+			break
+		}
+		name = name[index+1:]
+		names = append(names, name)
+	}
+	return dnsd.NamesAreBlackListedByProfile(dnsd.GetProfile(clientIP), names)
+}
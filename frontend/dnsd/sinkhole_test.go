@@ -0,0 +1,72 @@
+package dnsd
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSD_Sinkhole(t *testing.T) {
+	daemon := DNSD{
+		TCPListenAddress:     "127.0.0.1",
+		TCPListenPort:        16858,
+		TCPForwardTo:         "127.0.0.1:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Without sinkhole, A queries are answered by 0.0.0.0 and AAAA queries are answered by nothing
+	queryA := BuildQuery(1, "ads.example.com", TypeA)
+	queryAAAA := BuildQuery(2, "ads.example.com", TypeAAAA)
+	if daemon.IsSinkholeEnabled() || !bytes.Equal(daemon.BlackHoleResponse(queryA), RespondWith0(queryA)) {
+		t.Fatal("wrong black hole answer")
+	}
+	if answers, err := ParseAnswers(daemon.BlackHoleResponse(queryAAAA)); err != nil || len(answers) != 0 {
+		t.Fatal(answers, err)
+	}
+	// AAAA queries are subject to black list too
+	if names := ExtractDomainName(queryAAAA); !reflect.DeepEqual(names, []string{"ads.example.com", "example.com", "com"}) {
+		t.Fatal(names)
+	}
+
+	// Sinkhole answers with the configured addresses
+	daemon.SinkholeIPv4 = "not an IP"
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.SinkholeIPv4 = "192.168.1.1"
+	daemon.SinkholeIPv6 = "192.168.1.1"
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.SinkholeIPv6 = "fd00::1"
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if answers, err := ParseAnswers(daemon.BlackHoleResponse(queryA)); err != nil || len(answers) != 1 ||
+		answers[0].Name != "ads.example.com" || answers[0].TTL != SinkholeTTL || !bytes.Equal(answers[0].Data, net.ParseIP("192.168.1.1").To4()) {
+		t.Fatal(answers, err)
+	}
+	if answers, err := ParseAnswers(daemon.BlackHoleResponse(queryAAAA)); err != nil || len(answers) != 1 ||
+		answers[0].Type != TypeAAAA || !bytes.Equal(answers[0].Data, net.ParseIP("fd00::1")) {
+		t.Fatal(answers, err)
+	}
+
+	// Temporarily allowed names are not blocked until they expire
+	daemon.BlackList["example.com"] = struct{}{}
+	if !daemon.IsBlockedName("127.0.0.1", "ADS.example.com.") || daemon.IsBlockedName("127.0.0.1", "github.com") {
+		t.Fatal("wrong blocked name")
+	}
+	daemon.AllowTemporarily("example.com", 1*time.Second)
+	if daemon.IsBlockedName("127.0.0.1", "ads.example.com") || daemon.NamesAreBlackListed(ExtractDomainName(queryA)) {
+		t.Fatal("should have been allowed")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if !daemon.IsBlockedName("127.0.0.1", "ads.example.com") {
+		t.Fatal("should have expired")
+	}
+}
@@ -3,11 +3,13 @@ package dnsd
 import (
 	"fmt"
 	"github.com/HouzuoGuo/laitos/global"
+	"io"
 	"net"
 	"strings"
 	"time"
 )
 
+// Check client against rate limit and allowed IP prefixes, then answer a single query and close the connection.
 func (dnsd *DNSD) HandleTCPQuery(clientConn net.Conn) {
 	defer clientConn.Close()
 	// Check address against rate limit
@@ -15,105 +17,57 @@ func (dnsd *DNSD) HandleTCPQuery(clientConn net.Conn) {
 	if !dnsd.RateLimit.Add(clientIP, true) {
 		return
 	}
-	// Check address against allowed IP prefixes
-	var prefixOK bool
-	for _, prefix := range dnsd.AllowQueryIPPrefixes {
-		if strings.HasPrefix(clientIP, prefix) {
-			prefixOK = true
-			break
-		}
-	}
-	if !prefixOK {
-		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, nil, "client IP is not allowed to query")
-		return
-	}
+	// Command queries arrive via recursive resolvers, hence clients that are not allowed may still run commands.
+	dnsd.AnswerTCPQuery(clientIP, clientConn, dnsd.IsAllowedClient(clientIP))
+}
+
+/*
+Read a length-prefixed query from client connection and answer it with black hole response or forwarder's response.
+A client that is not allowed to query may only make command queries. Return true only if the query has been answered.
+The connection is left open.
+*/
+func (dnsd *DNSD) AnswerTCPQuery(clientIP string, clientConn net.Conn, isAllowedClient bool) bool {
 	// Read query length
 	clientConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
 	queryLenBuf := make([]byte, 2)
-	_, err := clientConn.Read(queryLenBuf)
+	_, err := io.ReadFull(clientConn, queryLenBuf)
 	if err != nil {
-		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read query length from client")
-		return
+		if err != io.EOF {
+			dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read query length from client")
+		}
+		return false
 	}
 	queryLen := int(queryLenBuf[0])*256 + int(queryLenBuf[1])
 	// Read query
 	if queryLen > MaxPacketSize || queryLen < 1 {
 		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, nil, "bad query length from client")
-		return
+		return false
 	}
 	queryBuf := make([]byte, queryLen)
-	_, err = clientConn.Read(queryBuf)
+	_, err = io.ReadFull(clientConn, queryBuf)
 	if err != nil {
 		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read query from client")
-		return
+		return false
 	}
-	domainName := ExtractDomainName(queryBuf)
-	// Formulate response
-	var responseLen int
-	var responseLenBuf []byte
-	var responseBuf []byte
-	var doForward bool
-	if len(domainName) == 0 {
-		// If I cannot figure out what domain is from the query, simply forward it without much concern.
-		dnsd.Logger.Printf("HandleTCPQuery", clientIP, nil, "handle non-name query")
-		doForward = true
-	} else {
-		// This is a domain name query, check the name against black list and then forward.
-		if dnsd.NamesAreBlackListed(domainName) {
-			dnsd.Logger.Printf("HandleTCPQuery", clientIP, nil, "handle black-listed domain \"%s\"", domainName[0])
-			responseBuf = RespondWith0(queryBuf)
-			responseLen = len(responseBuf)
-			responseLenBuf = make([]byte, 2)
-			responseLenBuf[0] = byte(responseLen / 256)
-			responseLenBuf[1] = byte(responseLen % 256)
-		} else {
-			dnsd.Logger.Printf("HandleTCPQuery", clientIP, nil, "handle domain \"%s\"", domainName[0])
-			doForward = true
-		}
+	if !isAllowedClient && !dnsd.IsCommandQuery(queryBuf) {
+		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, nil, "client IP is not allowed to query")
+		return false
 	}
-	// If queried domain is not black listed, forward the query to forwarder.
-	if doForward {
-		myForwarder, err := net.DialTimeout("tcp", dnsd.TCPForwardTo, IOTimeoutSec*time.Second)
-		if err != nil {
-			dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to connect to forwarder")
-			return
-		}
-		defer myForwarder.Close()
-		// Send original query to forwarder without modification
-		myForwarder.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err = myForwarder.Write(queryLenBuf); err != nil {
-			dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to write length to forwarder")
-			return
-		} else if _, err = myForwarder.Write(queryBuf); err != nil {
-			dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to write query to forwarder")
-			return
-		}
-		// Retrieve forwarder's response
-		responseLenBuf = make([]byte, 2)
-		if _, err = myForwarder.Read(responseLenBuf); err != nil {
-			dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read length from forwarder")
-			return
-		}
-		responseLen = int(responseLenBuf[0])*256 + int(responseLenBuf[1])
-		if responseLen > MaxPacketSize || responseLen < 1 {
-			dnsd.Logger.Warningf("HandleTCPQuery", clientIP, nil, "bad response length from forwarder")
-			return
-		}
-		responseBuf = make([]byte, responseLen)
-		if _, err = myForwarder.Read(responseBuf); err != nil {
-			dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to read response from forwarder")
-			return
-		}
+	responseBuf, err := dnsd.AnswerQuery(clientIP, queryBuf)
+	if err != nil {
+		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to answer query")
+		return false
 	}
+	responseLenBuf := []byte{byte(len(responseBuf) / 256), byte(len(responseBuf) % 256)}
 	// Send response to my client
 	if _, err = clientConn.Write(responseLenBuf); err != nil {
 		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to answer length to client")
-		return
+		return false
 	} else if _, err = clientConn.Write(responseBuf); err != nil {
 		dnsd.Logger.Warningf("HandleTCPQuery", clientIP, err, "failed to answer to client")
-		return
+		return false
 	}
-	return
+	return true
 }
 
 /*
@@ -0,0 +1,58 @@
+package dnsd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"net"
+	"strings"
+)
+
+/*
+Answer DNS-over-TLS queries using the same length-prefixed framing as TCP queries. Unlike plain TCP connections, a client
+may send many queries over one TLS connection, hence rate limit is applied to each query. Close the connection in the end.
+*/
+func (dnsd *DNSD) HandleTLSQueries(clientConn net.Conn) {
+	defer clientConn.Close()
+	clientIP := clientConn.RemoteAddr().String()[:strings.LastIndexByte(clientConn.RemoteAddr().String(), ':')]
+	// Check address against allowed IP prefixes
+	if !dnsd.IsAllowedClient(clientIP) {
+		dnsd.Logger.Warningf("HandleTLSQueries", clientIP, nil, "client IP is not allowed to query")
+		return
+	}
+	for {
+		if global.EmergencyLockDown {
+			return
+		}
+		// Check address against rate limit
+		if !dnsd.RateLimit.Add(clientIP, true) {
+			return
+		}
+		if !dnsd.AnswerTCPQuery(clientIP, clientConn, true) {
+			return
+		}
+	}
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start DNS daemon to listen on DNS-over-TLS port only. Block caller.
+*/
+func (dnsd *DNSD) StartAndBlockTLS() error {
+	listenAddr := fmt.Sprintf("%s:%d", dnsd.TLSListenAddress, dnsd.TLSListenPort)
+	listener, err := tls.Listen("tcp", listenAddr, &tls.Config{Certificates: []tls.Certificate{dnsd.TLSCertificate}})
+	if err != nil {
+		return err
+	}
+	dnsd.Logger.Printf("StartAndBlockTLS", listenAddr, nil, "going to listen for queries")
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		clientConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go dnsd.HandleTLSQueries(clientConn)
+	}
+}
@@ -0,0 +1,113 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a TCP DNS server that answers every query with the query itself plus the tail bytes, return its address.
+func startEchoTCPResolver(t *testing.T, tail []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					lenBuf := make([]byte, 2)
+					if _, err := io.ReadFull(conn, lenBuf); err != nil {
+						return
+					}
+					query := make([]byte, int(lenBuf[0])*256+int(lenBuf[1]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := append(query, tail...)
+					conn.Write([]byte{byte(len(resp) / 256), byte(len(resp) % 256)})
+					conn.Write(resp)
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDNSD_StartAndBlockTLS(t *testing.T) {
+	certPath := "/tmp/test-laitos-dnsd-tls.crt"
+	keyPath := "/tmp/test-laitos-dnsd-tls.key"
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	testhelper.WriteTestCertificate(t, certPath, keyPath)
+	tail := []byte("this is a forwarded answer")
+	daemon := DNSD{
+		TLSListenAddress:     "127.0.0.1",
+		TLSListenPort:        16853,
+		TCPForwardTo:         startEchoTCPResolver(t, tail),
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+	}
+	if err := daemon.Initialise(); err == nil || strings.Index(err.Error(), "certificate") == -1 {
+		t.Fatal(err)
+	}
+	daemon.TLSCertPath = certPath
+	daemon.TLSKeyPath = keyPath
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.BlackList["github.com"] = struct{}{}
+	go func() {
+		if err := daemon.StartAndBlockTLS(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+
+	clientConn, err := tls.Dial("tcp", "127.0.0.1:16853", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	// Several queries are answered on the same connection
+	for i := 0; i < 3; i++ {
+		if _, err := clientConn.Write(githubComTCPQuery); err != nil {
+			t.Fatal(err)
+		}
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(clientConn, lenBuf); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, int(lenBuf[0])*256+int(lenBuf[1]))
+		if _, err := io.ReadFull(clientConn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Index(resp, BlackHoleAnswer) == -1 {
+			t.Fatal(resp)
+		}
+	}
+	// Not black listed name is forwarded
+	delete(daemon.BlackList, "github.com")
+	if _, err := clientConn.Write(githubComTCPQuery); err != nil {
+		t.Fatal(err)
+	}
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, lenBuf); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, int(lenBuf[0])*256+int(lenBuf[1]))
+	if _, err := io.ReadFull(clientConn, resp); err != nil || !bytes.HasSuffix(resp, tail) {
+		t.Fatal(err, resp)
+	}
+}
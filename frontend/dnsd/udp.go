@@ -2,6 +2,7 @@ package dnsd
 
 import (
 	"fmt"
+	"github.com/HouzuoGuo/laitos/dnsstats"
 	"github.com/HouzuoGuo/laitos/global"
 	"math/rand"
 	"net"
@@ -9,25 +10,47 @@ import (
 	"time"
 )
 
-// Send forward queries to forwarder and forward the response to my DNS client.
+/*
+Send forward queries to forwarder and forward the response to my DNS client. If forwarder connection is nil, the queries
+are exchanged via encrypted forwarder instead.
+*/
 func (dnsd *DNSD) HandleUDPQueries(myQueue chan *UDPQuery, forwarderConn net.Conn) {
 	packetBuf := make([]byte, MaxPacketSize)
 	for {
 		query := <-myQueue
-		// Set deadline for IO with forwarder
-		forwarderConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := forwarderConn.Write(query.QueryPacket); err != nil {
-			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to write to forwarder")
-			continue
-		}
-		packetLength, err := forwarderConn.Read(packetBuf)
-		if err != nil {
-			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to read from forwarder")
-			continue
+		var response []byte
+		if profileResponse, handled, err := dnsd.ForwardQueryByProfile(query.Profile, query.QueryPacket); handled {
+			if err != nil {
+				dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to answer query of profile \"%s\"", query.Profile.Name)
+				continue
+			}
+			response = profileResponse
+		} else if forwarderConn == nil {
+			var err error
+			if dnsd.UDPForwarder == nil {
+				response, err = dnsd.ForwardQuery(query.QueryPacket)
+			} else {
+				response, err = dnsd.UDPForwarder.Exchange(query.QueryPacket)
+			}
+			if err != nil {
+				dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to exchange query with forwarder")
+				continue
+			}
+		} else {
+			// Set deadline for IO with forwarder
+			forwarderConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+			if _, err := forwarderConn.Write(query.QueryPacket); err != nil {
+				dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to write to forwarder")
+				continue
+			}
+			packetLength, err := forwarderConn.Read(packetBuf)
+			if err != nil {
+				dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to read from forwarder")
+				continue
+			}
+			response = packetBuf[:packetLength]
 		}
-		// Set deadline for responding to my DNS client
-		query.MyServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := query.MyServer.WriteTo(packetBuf[:packetLength], query.ClientAddr); err != nil {
+		if err := dnsd.WriteUDPResponse(query.MyServer, query.ClientAddr, query.QueryPacket, response); err != nil {
 			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "failed to answer to client")
 			continue
 		}
@@ -38,15 +61,61 @@ func (dnsd *DNSD) HandleUDPQueries(myQueue chan *UDPQuery, forwarderConn net.Con
 func (dnsd *DNSD) HandleBlackHoleAnswer(myQueue chan *UDPQuery) {
 	for {
 		query := <-myQueue
-		// Set deadline for responding to my DNS client
-		blackHoleAnswer := RespondWith0(query.QueryPacket)
-		query.MyServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
-		if _, err := query.MyServer.WriteTo(blackHoleAnswer, query.ClientAddr); err != nil {
+		blackHoleAnswer := dnsd.BlackHoleResponse(query.QueryPacket)
+		if err := dnsd.WriteUDPResponse(query.MyServer, query.ClientAddr, query.QueryPacket, blackHoleAnswer); err != nil {
 			dnsd.Logger.Warningf("HandleUDPQueries", query.ClientAddr.String(), err, "IO failure")
 		}
 	}
 }
 
+// Run the command carried by the query and send command output to my DNS client.
+func (dnsd *DNSD) HandleUDPCommandQuery(myServer *net.UDPConn, clientAddr *net.UDPAddr, query []byte) {
+	response, _ := dnsd.AnswerCommandQuery(clientAddr.IP.String(), query)
+	if len(response) == 0 {
+		return
+	}
+	if err := dnsd.WriteUDPResponse(myServer, clientAddr, query, response); err != nil {
+		dnsd.Logger.Warningf("HandleUDPCommandQuery", clientAddr.String(), err, "failed to answer to client")
+	}
+}
+
+/*
+Send response to my DNS client. If the response is larger than what the client can receive over UDP, the client gets a
+truncated response instead and should retry over TCP.
+*/
+func (dnsd *DNSD) WriteUDPResponse(myServer *net.UDPConn, clientAddr *net.UDPAddr, query, response []byte) error {
+	if len(response) > UDPResponseSizeLimit(query) {
+		dnsstats.Common.RecordTruncated()
+		response = TruncateResponse(response)
+	}
+	// Set deadline for responding to my DNS client
+	myServer.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	_, err := myServer.WriteTo(response, clientAddr)
+	return err
+}
+
+/*
+Apply response rate limit to the query. Return true if the query should be answered as usual. Otherwise the query is
+either dropped or answered by a truncated response right away, and the caller should not process it any further.
+*/
+func (dnsd *DNSD) checkResponseLimit(myServer *net.UDPConn, clientAddr *net.UDPAddr, query []byte) bool {
+	name, _, _, _ := ParseQuestion(query)
+	switch dnsd.ResponseLimit.Check(clientAddr.IP.String(), name) {
+	case RRLActionSlip:
+		dnsstats.Common.RecordRateLimited(false)
+		if response := TruncatedResponse(query); response != nil {
+			if err := dnsd.WriteUDPResponse(myServer, clientAddr, query, response); err != nil {
+				dnsd.Logger.Warningf("UDPLoop", clientAddr.String(), err, "failed to answer to client")
+			}
+		}
+		return false
+	case RRLActionDrop:
+		dnsstats.Common.RecordRateLimited(true)
+		return false
+	}
+	return true
+}
+
 /*
 You may call this function only after having called Initialise()!
 Start DNS daemon to listen on UDP port only. Block caller.
@@ -84,51 +153,86 @@ func (dnsd *DNSD) StartAndBlockUDP() error {
 		if !dnsd.RateLimit.Add(clientIP, true) {
 			continue
 		}
-		// Check address against allowed IP prefixes
-		var prefixOK bool
-		for _, prefix := range dnsd.AllowQueryIPPrefixes {
-			if strings.HasPrefix(clientIP, prefix) {
-				prefixOK = true
-				break
+		forwardPacket := make([]byte, packetLength)
+		copy(forwardPacket, packetBuf[:packetLength])
+		// Command queries arrive via recursive resolvers, hence clients that are not allowed may still run commands.
+		if dnsd.IsCommandQuery(forwardPacket) {
+			if !dnsd.checkResponseLimit(udpServer, clientAddr, forwardPacket) {
+				continue
 			}
+			select {
+			case dnsd.commandSlots <- struct{}{}:
+				go func(clientAddr *net.UDPAddr, query []byte) {
+					dnsd.HandleUDPCommandQuery(udpServer, clientAddr, query)
+					<-dnsd.commandSlots
+				}(clientAddr, forwardPacket)
+			default:
+				dnsd.Logger.Warningf("UDPLoop", clientIP, nil, "too many command queries are being handled, dropping this one.")
+			}
+			continue
 		}
-		if !prefixOK {
+		// Check address against allowed IP prefixes
+		if !dnsd.IsAllowedClient(clientIP) {
 			dnsd.Logger.Warningf("UDPLoop", clientIP, nil, "client IP is not allowed to query")
 			continue
 		}
+		// Limit identical responses toward a client network, a spoofed-source flood cannot be amplified that way.
+		if !dnsd.checkResponseLimit(udpServer, clientAddr, forwardPacket) {
+			continue
+		}
+		// Local records are answered right away
+		if response, isLocal := dnsd.AnswerLocalQuery(forwardPacket); isLocal {
+			name, _, _, _ := ParseQuestion(forwardPacket)
+			dnsstats.Common.Record(clientIP, strings.ToLower(name), false)
+			if err := dnsd.WriteUDPResponse(udpServer, clientAddr, forwardPacket, response); err != nil {
+				dnsd.Logger.Warningf("UDPLoop", clientIP, err, "failed to answer to client")
+			}
+			continue
+		}
 
 		// Prepare parameters for forwarding the query
 		randForwarder := rand.Intn(len(dnsd.UDPForwarderQueues))
-		forwardPacket := make([]byte, packetLength)
-		copy(forwardPacket, packetBuf[:packetLength])
 		domainName := ExtractDomainName(forwardPacket)
+		profile := dnsd.GetProfile(clientIP)
 		if len(domainName) == 0 {
 			// If I cannot figure out what domain is from the query, simply forward it without much concern.
-			dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randForwarder), clientIP, nil,
-				"handle non-name query (backlog %d)", len(dnsd.UDPForwarderQueues[randForwarder]))
+			dnsstats.Common.Record(clientIP, "", false)
+			if dnsd.LogQueries {
+				dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randForwarder), clientIP, nil,
+					"handle non-name query (backlog %d)", len(dnsd.UDPForwarderQueues[randForwarder]))
+			}
 			dnsd.UDPForwarderQueues[randForwarder] <- &UDPQuery{
 				ClientAddr:  clientAddr,
 				MyServer:    udpServer,
 				QueryPacket: forwardPacket,
+				Profile:     profile,
 			}
-		} else if dnsd.NamesAreBlackListed(domainName) {
+		} else if dnsd.NamesAreBlackListedByProfile(profile, domainName) {
 			// Requested domain name is black-listed
 			randBlackListResponder := rand.Intn(len(dnsd.UDPBlackHoleQueues))
-			dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randBlackListResponder), clientIP, nil,
-				"handle black-listed domain \"%s\" (backlog %d)", domainName[0], len(dnsd.UDPBlackHoleQueues[randBlackListResponder]))
+			dnsstats.Common.Record(clientIP, domainName[0], true)
+			if dnsd.LogQueries {
+				dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randBlackListResponder), clientIP, nil,
+					"handle black-listed domain \"%s\" (backlog %d)", domainName[0], len(dnsd.UDPBlackHoleQueues[randBlackListResponder]))
+			}
 			dnsd.UDPBlackHoleQueues[randBlackListResponder] <- &UDPQuery{
 				ClientAddr:  clientAddr,
 				MyServer:    udpServer,
 				QueryPacket: forwardPacket,
+				Profile:     profile,
 			}
 		} else {
 			// This is a normal domain name query and not black-listed
-			dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randForwarder), clientIP, nil,
-				"handle domain \"%s\" (backlog %d)", domainName[0], len(dnsd.UDPForwarderQueues[randForwarder]))
+			dnsstats.Common.Record(clientIP, domainName[0], false)
+			if dnsd.LogQueries {
+				dnsd.Logger.Printf(fmt.Sprintf("UDP-%d", randForwarder), clientIP, nil,
+					"handle domain \"%s\" (backlog %d)", domainName[0], len(dnsd.UDPForwarderQueues[randForwarder]))
+			}
 			dnsd.UDPForwarderQueues[randForwarder] <- &UDPQuery{
 				ClientAddr:  clientAddr,
 				MyServer:    udpServer,
 				QueryPacket: forwardPacket,
+				Profile:     profile,
 			}
 		}
 	}
@@ -1,12 +1,22 @@
 package api
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/dnsstats"
 	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
 	"github.com/HouzuoGuo/laitos/global"
 	"github.com/HouzuoGuo/laitos/httpclient"
+	"github.com/HouzuoGuo/laitos/traffic"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -242,3 +252,202 @@ func TestAllHandlers(t *testing.T) {
 		t.Fatal(err, string(resp.Body))
 	}
 }
+
+func TestHandleDNSStats(t *testing.T) {
+	handle := &HandleDNSStats{}
+	fun, err := handle.MakeHandler(global.Logger{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsstats.Common.Record("127.0.0.1", "example.com", true)
+	req := httptest.NewRequest(http.MethodGet, "/dns_stats", nil)
+	w := httptest.NewRecorder()
+	fun(w, req)
+	var snapshot dnsstats.Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil || snapshot.Total < 1 || snapshot.Blocked < 1 {
+		t.Fatal(err, w.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, "/dns_stats?format=text", nil)
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if !strings.Contains(w.Body.String(), "example.com") {
+		t.Fatal(w.Body.String())
+	}
+}
+
+func TestHandleDNSOverHTTPS(t *testing.T) {
+	// A TCP DNS forwarder that answers every query with the query itself
+	forwarder, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forwarder.Close()
+	go func() {
+		for {
+			conn, err := forwarder.Accept()
+			if err != nil {
+				return
+			}
+			lenBuf := make([]byte, 2)
+			io.ReadFull(conn, lenBuf)
+			query := make([]byte, int(lenBuf[0])*256+int(lenBuf[1]))
+			io.ReadFull(conn, query)
+			conn.Write(append(lenBuf, query...))
+			conn.Close()
+		}
+	}()
+	daemon := &dnsd.DNSD{
+		TCPListenAddress:           "127.0.0.1",
+		TCPListenPort:              16321,
+		TCPForwardTo:               forwarder.Addr().String(),
+		PerIPLimit:                 10,
+		AllowQueryIPPrefixes:       []string{"127"},
+		BlacklistSources:           []dnsd.BlacklistSource{{FilePath: "/tmp/test-laitos-does-not-exist", Format: dnsd.BlacklistFormatHosts}},
+		BlacklistUpdateIntervalSec: 3600,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	handle := &HandleDNSOverHTTPS{}
+	if _, err := handle.MakeHandler(global.Logger{}, nil); err == nil {
+		t.Fatal("did not error")
+	}
+	handle.DNSDaemon = daemon
+	fun, err := handle.MakeHandler(global.Logger{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := hex.DecodeString("e575012000010000000000010667697468756203636f6d00000100010000291000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GET query is forwarded
+	req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	w := httptest.NewRecorder()
+	fun(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != DNSMessageContentType || !bytes.Equal(w.Body.Bytes(), query) {
+		t.Fatal(w.Code, w.Body.Bytes())
+	}
+	// POST query of a black-listed name is answered by black hole
+	daemon.BlackList["github.com"] = struct{}{}
+	req = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(query))
+	req.Header.Set("Content-Type", DNSMessageContentType)
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), dnsd.RespondWith0(query)) {
+		t.Fatal(w.Code, w.Body.Bytes())
+	}
+	// Bad requests
+	req = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(query))
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatal(w.Code)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/dns-query?dns=abc", nil)
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+}
+
+func TestHandleBlockPage(t *testing.T) {
+	daemon := &dnsd.DNSD{
+		TCPListenAddress:     "127.0.0.1",
+		TCPListenPort:        16322,
+		TCPForwardTo:         "127.0.0.1:53",
+		PerIPLimit:           10,
+		AllowQueryIPPrefixes: []string{"127"},
+		SinkholeIPv4:         "127.0.0.1",
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.BlackList["ads.example.com"] = struct{}{}
+	handle := &HandleBlockPage{}
+	if _, err := handle.MakeHandler(global.Logger{}, common.GetTestCommandProcessor()); err == nil {
+		t.Fatal("did not error")
+	}
+	handle.DNSDaemon = daemon
+	if _, err := handle.MakeHandler(global.Logger{}, common.GetTestCommandProcessor()); err == nil || !strings.Contains(err.Error(), "AllowPIN") {
+		t.Fatal(err)
+	}
+	// Command processor PIN must not be used to allow names
+	handle.AllowPIN = "verysecret"
+	if _, err := handle.MakeHandler(global.Logger{}, common.GetTestCommandProcessor()); err == nil || !strings.Contains(err.Error(), "command processor") {
+		t.Fatal(err)
+	}
+	handle.AllowPIN = "allowsecret"
+	fun, err := handle.MakeHandler(global.Logger{}, common.GetTestCommandProcessor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Visit to a blocked host via plain HTTP shows the name without allow form
+	req := httptest.NewRequest(http.MethodGet, "http://ads.example.com:80/banner.js", nil)
+	w := httptest.NewRecorder()
+	fun(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "<b>ads.example.com</b> is blocked by laitos") || strings.Contains(body, `name="pin"`) || !strings.Contains(body, "HTTPS") {
+		t.Fatal(body)
+	}
+	// PIN sent via plain HTTP is ignored
+	req = httptest.NewRequest(http.MethodPost, "http://ads.example.com/", strings.NewReader("pin=allowsecret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if !daemon.IsBlockedName("192.0.2.1", "ads.example.com") {
+		t.Fatal(w.Body.String())
+	}
+	// Visit via HTTPS shows the allow form
+	req = httptest.NewRequest(http.MethodGet, "https://ads.example.com/banner.js", nil)
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if body := w.Body.String(); !strings.Contains(body, `name="pin"`) {
+		t.Fatal(body)
+	}
+	// Incorrect PIN does not allow the name
+	req = httptest.NewRequest(http.MethodPost, "https://ads.example.com/", strings.NewReader("pin=verysecret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "Incorrect PIN") || !daemon.IsBlockedName("192.0.2.1", "ads.example.com") {
+		t.Fatal(body)
+	}
+	// Correct PIN allows the name temporarily
+	req = httptest.NewRequest(http.MethodPost, "https://ads.example.com/", strings.NewReader("pin=allowsecret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "now allowed for 10 minutes") || daemon.IsBlockedName("192.0.2.1", "ads.example.com") {
+		t.Fatal(body)
+	}
+	// Name that is not blocked
+	req = httptest.NewRequest(http.MethodGet, "/blocked?name=github.com", nil)
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "not blocked") {
+		t.Fatal(body)
+	}
+}
+
+func TestHandleSockTraffic(t *testing.T) {
+	handle := &HandleSockTraffic{}
+	fun, err := handle.MakeHandler(global.Logger{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traffic.Common.Add("api-test-user", 1, 2)
+	req := httptest.NewRequest(http.MethodGet, "/sock_traffic", nil)
+	w := httptest.NewRecorder()
+	fun(w, req)
+	var snapshot []traffic.Counters
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil || len(snapshot) < 1 || snapshot[0].TotalDownload < 2 {
+		t.Fatal(err, w.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, "/sock_traffic?format=text", nil)
+	w = httptest.NewRecorder()
+	fun(w, req)
+	if !strings.Contains(w.Body.String(), "api-test-user") {
+		t.Fatal(w.Body.String())
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/bridge"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/global"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const HandleBlockPagePage = `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+    <title>Blocked by laitos</title>
+</head>
+<body>
+    <p>The name <b>%s</b> is blocked by laitos.</p>
+    %s
+</body>
+</html>
+` // Block page content
+
+const HandleBlockPageForm = `<form action="#" method="post">
+        <p>Enter PIN to allow the name for %d minutes: <input type="password" name="pin" /><input type="submit" value="Allow"/></p>
+        <p>%s</p>
+    </form>` // Temporary allow form of block page
+
+const DefaultBlockPageAllowDurationSec = 600 // Temporary allow lasts 10 minutes by default
+
+const HandleBlockPageTLSOnly = `<p>Visit this page via HTTPS to allow the name temporarily.</p>` // Shown in place of the allow form over plain HTTP
+
+/*
+Serve a page that tells visitors the name they visit is blocked by DNS daemon in sinkhole mode. Visitors who know the
+allow PIN may allow the name temporarily. The PIN is only accepted over TLS, since visits to blocked names usually
+arrive via plain HTTP.
+*/
+type HandleBlockPage struct {
+	AllowPIN         string     `json:"AllowPIN"`         // Visitors use this PIN to allow a blocked name, it must differ from command processor PIN.
+	AllowDurationSec int        `json:"AllowDurationSec"` // (Optional) temporary allow lasts this long, default to 600 seconds.
+	DNSDaemon        *dnsd.DNSD `json:"-"`                // Check and allow names via this initialised DNS daemon
+}
+
+// Return the PIN of command processor's PIN bridge, or empty string if there is none.
+func getProcessorPIN(cmdProc *common.CommandProcessor) string {
+	if cmdProc == nil {
+		return ""
+	}
+	for _, cmdBridge := range cmdProc.CommandBridges {
+		if pin, yes := cmdBridge.(*bridge.PINAndShortcuts); yes {
+			return pin.PIN
+		}
+	}
+	return ""
+}
+
+func (block *HandleBlockPage) MakeHandler(logger global.Logger, cmdProc *common.CommandProcessor) (http.HandlerFunc, error) {
+	if block.DNSDaemon == nil {
+		return nil, errors.New("HandleBlockPage.MakeHandler: DNS daemon must be configured")
+	}
+	if block.AllowPIN == "" {
+		return nil, errors.New("HandleBlockPage.MakeHandler: AllowPIN must not be empty")
+	}
+	// The allow PIN is typed by whoever visits a blocked name, it must not grant access to command processor.
+	if block.AllowPIN == getProcessorPIN(cmdProc) {
+		return nil, errors.New("HandleBlockPage.MakeHandler: AllowPIN must not be the same as command processor PIN")
+	}
+	if block.AllowDurationSec < 1 {
+		block.AllowDurationSec = DefaultBlockPageAllowDurationSec
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		NoCache(w)
+		clientIP := r.RemoteAddr[:strings.LastIndexByte(r.RemoteAddr, ':')]
+		// The blocked name is the host that visitor intended to visit, or it comes from parameter if page is visited directly.
+		name := r.FormValue("name")
+		if name == "" {
+			name = r.Host
+			if host, _, err := net.SplitHostPort(r.Host); err == nil {
+				name = host
+			}
+		}
+		if !block.DNSDaemon.IsBlockedName(clientIP, name) {
+			w.Write([]byte(fmt.Sprintf(HandleBlockPagePage, html.EscapeString(name), "<p>The name is not blocked at the moment, please try again.</p>")))
+			return
+		}
+		if r.TLS == nil {
+			w.Write([]byte(fmt.Sprintf(HandleBlockPagePage, html.EscapeString(name), HandleBlockPageTLSOnly)))
+			return
+		}
+		message := ""
+		if r.Method == http.MethodPost {
+			if subtle.ConstantTimeCompare([]byte(r.FormValue("pin")), []byte(block.AllowPIN)) == 1 {
+				block.DNSDaemon.AllowTemporarily(name, time.Duration(block.AllowDurationSec)*time.Second)
+				logger.Printf("HandleBlockPage", clientIP, nil, "temporarily allowed \"%s\" for %d seconds", name, block.AllowDurationSec)
+				w.Write([]byte(fmt.Sprintf(HandleBlockPagePage, html.EscapeString(name),
+					fmt.Sprintf("<p>The name is now allowed for %d minutes, it will work again after a minute.</p>", block.AllowDurationSec/60))))
+				return
+			}
+			logger.Warningf("HandleBlockPage", clientIP, nil, "incorrect PIN to allow \"%s\"", name)
+			message = "Incorrect PIN."
+		}
+		w.Write([]byte(fmt.Sprintf(HandleBlockPagePage, html.EscapeString(name), fmt.Sprintf(HandleBlockPageForm, block.AllowDurationSec/60, message))))
+	}
+	return fun, nil
+}
+
+func (block *HandleBlockPage) GetRateLimitFactor() int {
+	return 5
+}
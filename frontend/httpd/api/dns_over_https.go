@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/frontend/dnsd"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const DNSMessageContentType = "application/dns-message" // RFC 8484 media type of DNS query and response
+
+/*
+Implement DNS-over-HTTPS (RFC 8484) server that answers queries using black list and forwarder of a DNS daemon. Queries
+come as base64url-encoded "dns" parameter in GET requests, or as request body of POST requests.
+*/
+type HandleDNSOverHTTPS struct {
+	DNSDaemon *dnsd.DNSD `json:"-"` // Answer queries using black list and forwarder of this initialised DNS daemon
+}
+
+func (doh *HandleDNSOverHTTPS) MakeHandler(logger global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if doh.DNSDaemon == nil {
+		return nil, errors.New("HandleDNSOverHTTPS.MakeHandler: DNS daemon must be configured")
+	}
+	// The DNS daemon might not be started as a frontend, make sure that its black list is up to date.
+	doh.DNSDaemon.StartBlacklistUpdater()
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		clientIP := r.RemoteAddr[:strings.LastIndexByte(r.RemoteAddr, ':')]
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.FormValue("dns"), "="))
+		case http.MethodPost:
+			if contentType := r.Header.Get("Content-Type"); contentType != DNSMessageContentType {
+				http.Error(w, "", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = ioutil.ReadAll(io.LimitReader(r.Body, dnsd.MaxPacketSize+1))
+		default:
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil || len(query) < dnsd.MinNameQuerySize || len(query) > dnsd.MaxPacketSize {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		response, err := doh.DNSDaemon.AnswerQuery(clientIP, query)
+		if err != nil {
+			logger.Warningf("HandleDNSOverHTTPS", clientIP, err, "failed to answer query")
+			http.Error(w, "", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", DNSMessageContentType)
+		NoCache(w)
+		w.Write(response)
+	}
+	return fun, nil
+}
+
+func (doh *HandleDNSOverHTTPS) GetRateLimitFactor() int {
+	return 10
+}
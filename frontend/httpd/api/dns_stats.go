@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/dnsstats"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"net/http"
+	"strconv"
+)
+
+// Present DNS query statistics collected by DNS daemon in JSON, or in plain text if "format=text" is requested.
+type HandleDNSStats struct {
+	TopN int `json:"TopN"` // Number of top queried and top blocked domain names to present, default to 10.
+}
+
+func (stats *HandleDNSStats) MakeHandler(logger global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	if stats.TopN < 1 {
+		stats.TopN = dnsstats.DefaultTopN
+	}
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		topN := stats.TopN
+		if n, err := strconv.Atoi(r.FormValue("top")); err == nil && n > 0 {
+			topN = n
+		}
+		if r.FormValue("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(dnsstats.Common.Format(topN)))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dnsstats.Common.GetSnapshot(topN)); err != nil {
+			logger.Warningf("HandleDNSStats", r.RemoteAddr, err, "failed to write response")
+		}
+	}
+	return fun, nil
+}
+
+func (stats *HandleDNSStats) GetRateLimitFactor() int {
+	return 2
+}
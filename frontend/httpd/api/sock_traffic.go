@@ -0,0 +1,33 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/HouzuoGuo/laitos/frontend/common"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/traffic"
+	"net/http"
+)
+
+// Present traffic counters and limits of sock daemon users in JSON, or in plain text if "format=text" is requested.
+type HandleSockTraffic struct {
+}
+
+func (_ *HandleSockTraffic) MakeHandler(logger global.Logger, _ *common.CommandProcessor) (http.HandlerFunc, error) {
+	fun := func(w http.ResponseWriter, r *http.Request) {
+		NoCache(w)
+		if r.FormValue("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(traffic.Common.Format()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(traffic.Common.GetSnapshot()); err != nil {
+			logger.Warningf("HandleSockTraffic", r.RemoteAddr, err, "failed to write response")
+		}
+	}
+	return fun, nil
+}
+
+func (_ *HandleSockTraffic) GetRateLimitFactor() int {
+	return 2
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/HouzuoGuo/laitos/frontend/httpd/api"
 	"github.com/HouzuoGuo/laitos/global"
 	"github.com/HouzuoGuo/laitos/ratelimit"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -33,12 +34,14 @@ type HTTPD struct {
 	BaseRateLimit    int               `json:"BaseRateLimit"`    // How many times in 5 seconds interval the most expensive HTTP handler may be invoked by an IP
 	ServeDirectories map[string]string `json:"ServeDirectories"` // Serve directories (value) on prefix paths (key)
 
-	SpecialHandlers map[string]api.HandlerFactory   `json:"-"` // Specialised handlers that implement api.HandlerFactory interface
-	AllRoutes       map[string]http.HandlerFunc     `json:"-"` // Aggregate all routes from all handlers
-	AllRateLimits   map[string]*ratelimit.RateLimit `json:"-"` // Aggregate all routes and their rate limit counters
-	Server          *http.Server                    `json:"-"` // Standard library HTTP server structure
-	Processor       *common.CommandProcessor        `json:"-"` // Feature command processor
-	Logger          global.Logger                   `json:"-"` // Logger
+	SpecialHandlers   map[string]api.HandlerFactory    `json:"-"` // Specialised handlers that implement api.HandlerFactory interface
+	BlockPageEndpoint string                           `json:"-"` // (Optional) serve visits made to black-listed host names via this endpoint
+	IsBlockedHost     func(clientIP, host string) bool `json:"-"` // (Optional) return true if the host name visited by client is black-listed
+	AllRoutes         map[string]http.HandlerFunc      `json:"-"` // Aggregate all routes from all handlers
+	AllRateLimits     map[string]*ratelimit.RateLimit  `json:"-"` // Aggregate all routes and their rate limit counters
+	Server            *http.Server                     `json:"-"` // Standard library HTTP server structure
+	Processor         *common.CommandProcessor         `json:"-"` // Feature command processor
+	Logger            global.Logger                    `json:"-"` // Logger
 }
 
 // Check configuration and initialise internal states.
@@ -150,6 +153,16 @@ func (httpd *HTTPD) MakeRootHandlerFunc() http.HandlerFunc {
 			assembledPath = assembledPath[0 : pathLen-1]
 		}
 		remoteIP := r.RemoteAddr[:strings.LastIndexByte(r.RemoteAddr, ':')]
+		// Visits made to black-listed host names arrive here via DNS sinkhole, serve them the block page.
+		if httpd.BlockPageEndpoint != "" && httpd.IsBlockedHost != nil {
+			host := r.Host
+			if hostOnly, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = hostOnly
+			}
+			if httpd.IsBlockedHost(remoteIP, host) {
+				assembledPath = httpd.BlockPageEndpoint
+			}
+		}
 		// Apply rate limit
 		if limit, routeFound := httpd.AllRateLimits[assembledPath]; routeFound {
 			if limit.Add(remoteIP, true) {
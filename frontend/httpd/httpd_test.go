@@ -7,6 +7,7 @@ import (
 	"github.com/HouzuoGuo/laitos/httpclient"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -118,3 +119,38 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 	}
 	global.EmergencyLockDown = false
 }
+
+func TestHTTPD_BlockPage(t *testing.T) {
+	daemon := HTTPD{
+		ListenAddress:     "127.0.0.1",
+		ListenPort:        13590,
+		Processor:         common.GetTestCommandProcessor(),
+		BaseRateLimit:     10,
+		BlockPageEndpoint: "/blocked",
+		IsBlockedHost: func(clientIP, host string) bool {
+			return host == "ads.example.com"
+		},
+		SpecialHandlers: map[string]api.HandlerFactory{
+			"/info":    &api.HandleSystemInfo{},
+			"/blocked": &api.HandleCommandForm{},
+		},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	handler := daemon.MakeRootHandlerFunc()
+	// Visits to black-listed hosts are served by block page regardless of the path
+	req := httptest.NewRequest(http.MethodGet, "http://ads.example.com:80/info", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "Command Form") {
+		t.Fatal(body)
+	}
+	// Other hosts are routed as usual
+	req = httptest.NewRequest(http.MethodGet, "http://laitos.example.com/info", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if body := w.Body.String(); strings.Contains(body, "Command Form") {
+		t.Fatal(body)
+	}
+}
@@ -0,0 +1,280 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/sockd"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/ratelimit"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitIntervalSec = 10       // Count requests of each client IP within this interval
+	ProxyAuthRealm       = "laitos" // Realm presented to clients that have not authenticated
+)
+
+// Headers that apply to a single hop and are not forwarded (RFC 7230 section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+/*
+An HTTP/1.1 forward proxy. It tunnels CONNECT requests and forwards requests made in absolute-URI form, clients
+authenticate via proxy basic authentication, and destinations are subject to access rules.
+*/
+type HTTPProxy struct {
+	ListenAddress string                 `json:"ListenAddress"`
+	ListenPort    int                    `json:"ListenPort"`
+	Users         map[string]string      `json:"Users"`        // Proxy clients authenticate via these usernames and passwords
+	PerIPLimit    int                    `json:"PerIPLimit"`   // Maximum number of requests a client IP may make within 10 seconds
+	Destinations  sockd.DestinationRules `json:"Destinations"` // (Optional) restrict destinations that clients may connect to, private addresses are denied by default.
+
+	Logger    global.Logger        `json:"-"`
+	server    *http.Server         `json:"-"`
+	transport *http.Transport      `json:"-"`
+	rateLimit *ratelimit.RateLimit `json:"-"`
+	mutex     *sync.Mutex          `json:"-"`
+}
+
+// Check configuration and initialise internal states.
+func (proxy *HTTPProxy) Initialise() error {
+	if proxy.ListenAddress == "" {
+		return errors.New("HTTPProxy.Initialise: listen address must not be empty")
+	}
+	if proxy.ListenPort < 1 {
+		return errors.New("HTTPProxy.Initialise: listen port must be greater than 0")
+	}
+	if len(proxy.Users) == 0 {
+		return errors.New("HTTPProxy.Initialise: Users must not be empty")
+	}
+	for username, password := range proxy.Users {
+		if username == "" || strings.ContainsRune(username, ':') || len(password) < 7 {
+			return fmt.Errorf("HTTPProxy.Initialise: user \"%s\" must have a valid name and a password of at least 7 characters", username)
+		}
+	}
+	if proxy.PerIPLimit < 10 {
+		return errors.New("HTTPProxy.Initialise: PerIPLimit must be greater than 9")
+	}
+	if err := proxy.Destinations.Initialise(); err != nil {
+		return fmt.Errorf("HTTPProxy.Initialise: %v", err)
+	}
+	proxy.rateLimit = &ratelimit.RateLimit{
+		Logger:   proxy.Logger,
+		MaxCount: proxy.PerIPLimit,
+		UnitSecs: RateLimitIntervalSec,
+	}
+	proxy.rateLimit.Initialise()
+	proxy.transport = &http.Transport{
+		// Destination rules decide which address to connect to
+		DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
+			return proxy.Destinations.Dial(addr)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: sockd.IOTimeoutSec,
+	}
+	proxy.mutex = new(sync.Mutex)
+	return nil
+}
+
+// Return the username if the request carries correct proxy basic authentication, otherwise return false.
+func (proxy *HTTPProxy) authenticate(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return "", false
+	}
+	colon := strings.IndexByte(string(decoded), ':')
+	if colon == -1 {
+		return "", false
+	}
+	username, password := string(decoded[:colon]), string(decoded[colon+1:])
+	expected, exists := proxy.Users[username]
+	if !exists || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return username, false
+	}
+	return username, true
+}
+
+// Connect to the destination and tell client about failure if there is any.
+func (proxy *HTTPProxy) dial(w http.ResponseWriter, clientIP, destAddr string) (net.Conn, bool) {
+	dest, err := proxy.Destinations.Dial(destAddr)
+	if err == sockd.ErrDestinationDenied {
+		proxy.Logger.Warningf("ServeHTTP", clientIP, nil, "denied access to destination \"%s\"", destAddr)
+		http.Error(w, "destination is not allowed", http.StatusForbidden)
+		return nil, false
+	} else if err != nil {
+		proxy.Logger.Warningf("ServeHTTP", clientIP, err, "failed to connect to destination \"%s\"", destAddr)
+		http.Error(w, "failed to connect to destination", http.StatusBadGateway)
+		return nil, false
+	}
+	return dest, true
+}
+
+// Tunnel the client connection to the destination of CONNECT request.
+func (proxy *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request, clientIP string) {
+	destAddr := r.Host
+	if _, _, err := net.SplitHostPort(destAddr); err != nil {
+		destAddr = net.JoinHostPort(destAddr, "443")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be tunnelled", http.StatusInternalServerError)
+		return
+	}
+	dest, ok := proxy.dial(w, clientIP, destAddr)
+	if !ok {
+		return
+	}
+	defer dest.Close()
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		proxy.Logger.Warningf("ServeHTTP", clientIP, err, "failed to hijack connection")
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	// Client may have sent data along with the request
+	if buffered := bufrw.Reader.Buffered(); buffered > 0 {
+		data, _ := bufrw.Reader.Peek(buffered)
+		if _, err := dest.Write(data); err != nil {
+			return
+		}
+	}
+	go sockd.PipeAndCloseConnection(conn, dest)
+	sockd.PipeAndCloseConnection(dest, conn)
+}
+
+// Forward a request made in absolute-URI form and copy the response back to client.
+func (proxy *HTTPProxy) handleForward(w http.ResponseWriter, r *http.Request, clientIP string) {
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "only absolute http:// URIs may be forwarded", http.StatusBadRequest)
+		return
+	}
+	destAddr := r.URL.Host
+	if _, _, err := net.SplitHostPort(destAddr); err != nil {
+		destAddr = net.JoinHostPort(destAddr, "80")
+	}
+	// Transport checks destination again when it connects
+	if _, _, err := proxy.Destinations.Resolve(destAddr); err == sockd.ErrDestinationDenied {
+		proxy.Logger.Warningf("ServeHTTP", clientIP, nil, "denied access to destination \"%s\"", destAddr)
+		http.Error(w, "destination is not allowed", http.StatusForbidden)
+		return
+	}
+	outReq := r.WithContext(r.Context())
+	outReq.RequestURI = ""
+	outReq.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		outReq.Header[name] = values
+	}
+	removeHopByHopHeaders(outReq.Header)
+	resp, err := proxy.transport.RoundTrip(outReq)
+	if err != nil {
+		proxy.Logger.Warningf("ServeHTTP", clientIP, err, "failed to forward request to \"%s\"", destAddr)
+		http.Error(w, "failed to forward request", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	removeHopByHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Remove hop-by-hop headers, including those listed by Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+func (proxy *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.RemoteAddr[:strings.LastIndexByte(r.RemoteAddr, ':')]
+	if !proxy.rateLimit.Add(clientIP, true) {
+		http.Error(w, "", http.StatusTooManyRequests)
+		return
+	}
+	username, ok := proxy.authenticate(r)
+	if !ok {
+		if username != "" {
+			proxy.Logger.Warningf("ServeHTTP", clientIP, nil, "failed to authenticate user \"%s\"", username)
+		}
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", ProxyAuthRealm))
+		http.Error(w, "", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		proxy.handleConnect(w, r, clientIP)
+	} else {
+		proxy.handleForward(w, r, clientIP)
+	}
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start HTTP proxy server and block until the server is stopped.
+*/
+func (proxy *HTTPProxy) StartAndBlock() error {
+	listenAddr := net.JoinHostPort(proxy.ListenAddress, strconv.Itoa(proxy.ListenPort))
+	proxy.Logger.Printf("StartAndBlock", listenAddr, nil, "going to listen for proxy requests")
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("HTTPProxy.StartAndBlock: failed to listen on %s - %v", listenAddr, err)
+	}
+	proxy.mutex.Lock()
+	proxy.server = &http.Server{
+		Handler:      proxy,
+		ReadTimeout:  sockd.IOTimeoutSec,
+		WriteTimeout: sockd.IOTimeoutSec,
+	}
+	server := proxy.server
+	proxy.mutex.Unlock()
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("HTTPProxy.StartAndBlock: failed to serve - %v", err)
+	}
+	return nil
+}
+
+// Stop HTTP proxy server.
+func (proxy *HTTPProxy) Stop() {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if proxy.server != nil {
+		if err := proxy.server.Close(); err != nil {
+			proxy.Logger.Warningf("Stop", "", err, "failed to close server")
+		}
+	}
+	proxy.transport.CloseIdleConnections()
+}
@@ -0,0 +1,265 @@
+package imapd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A data item requested by FETCH command.
+type fetchItem struct {
+	name       string // Upper case name without section, e.g. "BODY.PEEK".
+	section    string // Text within brackets, e.g. "HEADER.FIELDS (From To)".
+	hasSection bool
+	partial    bool // Only a portion of the section is requested
+	origin     int
+	count      int
+}
+
+// Return true if fetching the item sets \Seen flag.
+func (item fetchItem) setsSeen() bool {
+	return item.name == "RFC822" || item.name == "RFC822.TEXT" || (item.name == "BODY" && item.hasSection)
+}
+
+// Parse a data item such as "FLAGS" or "BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>".
+func parseFetchItem(str string) (fetchItem, error) {
+	open := strings.IndexByte(str, '[')
+	if open == -1 {
+		return fetchItem{name: strings.ToUpper(str)}, nil
+	}
+	item := fetchItem{name: strings.ToUpper(str[:open]), hasSection: true}
+	if item.name != "BODY" && item.name != "BODY.PEEK" {
+		return item, fmt.Errorf("data item %s does not take a section", item.name)
+	}
+	closing := strings.LastIndexByte(str, ']')
+	if closing < open {
+		return item, errors.New("missing closing bracket of section")
+	}
+	item.section = str[open+1 : closing]
+	if partial := str[closing+1:]; partial != "" {
+		var err1, err2 error
+		dot := strings.IndexByte(partial, '.')
+		if !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") || dot == -1 {
+			return item, fmt.Errorf("malformed partial specification %s", partial)
+		}
+		item.partial = true
+		item.origin, err1 = strconv.Atoi(partial[1:dot])
+		item.count, err2 = strconv.Atoi(partial[dot+1 : len(partial)-1])
+		if err1 != nil || err2 != nil || item.origin < 0 || item.count < 0 {
+			return item, fmt.Errorf("malformed partial specification %s", partial)
+		}
+	}
+	return item, nil
+}
+
+// Parse data items of FETCH command, macros are expanded.
+func parseFetchItems(args []token) ([]fetchItem, error) {
+	if len(args) == 1 && args[0].kind == tokenList {
+		args = args[0].list
+	}
+	if len(args) == 0 {
+		return nil, errors.New("FETCH expects data items")
+	}
+	var names []string
+	for _, arg := range args {
+		if arg.kind != tokenAtom {
+			return nil, errors.New("malformed data item")
+		}
+		switch arg.upper() {
+		case "ALL":
+			names = append(names, "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE")
+		case "FAST":
+			names = append(names, "FLAGS", "INTERNALDATE", "RFC822.SIZE")
+		case "FULL":
+			names = append(names, "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY")
+		default:
+			names = append(names, arg.value)
+		}
+	}
+	items := make([]fetchItem, 0, len(names))
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return nil, err
+		}
+		switch item.name {
+		case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE", "BODY", "BODY.PEEK",
+			"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		default:
+			return nil, fmt.Errorf("unknown data item %s", item.name)
+		}
+		if item.name == "BODY.PEEK" && !item.hasSection {
+			return nil, errors.New("BODY.PEEK requires a section")
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+/*
+Return the content of a body section such as "", "TEXT", "1.2", "1.MIME", or "HEADER.FIELDS (FROM TO)". Header and text
+sections of a part refer to the message encapsulated by the part.
+*/
+func sectionContent(root *mimePart, whole []byte, section string) ([]byte, error) {
+	var numbers []int
+	rest := section
+	for rest != "" {
+		piece := rest
+		dot := strings.IndexByte(rest, '.')
+		if dot != -1 {
+			piece = rest[:dot]
+		}
+		num, err := strconv.Atoi(piece)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, num)
+		if dot == -1 {
+			rest = ""
+		} else {
+			rest = rest[dot+1:]
+		}
+	}
+	part := root.findPart(numbers)
+	if part == nil {
+		return nil, fmt.Errorf("there is no section %s", section)
+	}
+	upperRest := strings.ToUpper(rest)
+	msgPart := part
+	if part.message != nil && upperRest != "" && upperRest != "MIME" {
+		msgPart = part.message
+	}
+	switch {
+	case upperRest == "" && len(numbers) == 0:
+		return whole, nil
+	case upperRest == "":
+		return part.body, nil
+	case upperRest == "MIME" && len(numbers) > 0:
+		return part.rawHeader, nil
+	case upperRest == "HEADER":
+		return msgPart.rawHeader, nil
+	case upperRest == "TEXT":
+		return msgPart.body, nil
+	case strings.HasPrefix(upperRest, "HEADER.FIELDS"):
+		open, closing := strings.IndexByte(rest, '('), strings.LastIndexByte(rest, ')')
+		if open == -1 || closing < open {
+			return nil, fmt.Errorf("malformed section %s", section)
+		}
+		var names []string
+		for _, name := range strings.Fields(rest[open+1 : closing]) {
+			names = append(names, strings.Trim(name, `"`))
+		}
+		return filterHeader(msgPart.rawHeader, names, strings.HasPrefix(upperRest, "HEADER.FIELDS.NOT")), nil
+	default:
+		return nil, fmt.Errorf("unknown section %s", section)
+	}
+}
+
+// Return data in the form of IMAP literal.
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+// Return the response of a data item of the message.
+func (sess *session) fetchItem(msg *message, item fetchItem, whole []byte, root *mimePart) (string, error) {
+	switch item.name {
+	case "FLAGS":
+		return fmt.Sprintf("FLAGS (%s)", strings.Join(msg.flags(), " ")), nil
+	case "UID":
+		return fmt.Sprintf("UID %d", msg.uid), nil
+	case "INTERNALDATE":
+		return fmt.Sprintf(`INTERNALDATE "%s"`, msg.modTime.Format(InternalDate)), nil
+	case "RFC822.SIZE":
+		return fmt.Sprintf("RFC822.SIZE %d", len(whole)), nil
+	case "ENVELOPE":
+		return "ENVELOPE " + root.envelope(), nil
+	case "BODYSTRUCTURE":
+		return "BODYSTRUCTURE " + root.structure(true), nil
+	case "RFC822":
+		return "RFC822 " + literal(whole), nil
+	case "RFC822.HEADER":
+		return "RFC822.HEADER " + literal(root.rawHeader), nil
+	case "RFC822.TEXT":
+		return "RFC822.TEXT " + literal(root.body), nil
+	}
+	if !item.hasSection {
+		return "BODY " + root.structure(false), nil
+	}
+	data, err := sectionContent(root, whole, item.section)
+	if err != nil {
+		return "", err
+	}
+	label := fmt.Sprintf("BODY[%s]", item.section)
+	if item.partial {
+		label += fmt.Sprintf("<%d>", item.origin)
+		if item.origin > len(data) {
+			data = nil
+		} else if end := item.origin + item.count; end < len(data) {
+			data = data[item.origin:end]
+		} else {
+			data = data[item.origin:]
+		}
+	}
+	return label + " " + literal(data), nil
+}
+
+func (sess *session) fetch(args []token, uid bool) (string, string) {
+	if len(args) < 2 || args[0].kind != tokenAtom {
+		return "BAD", "FETCH expects message set and data items"
+	}
+	items, err := parseFetchItems(args[1:])
+	if err != nil {
+		return "BAD", err.Error()
+	}
+	indexes, err := sess.selectMessages(args[0].value, uid)
+	if err != nil {
+		return "BAD", err.Error()
+	}
+	var setsSeen, hasFlags, hasUID, needsContent bool
+	for _, item := range items {
+		setsSeen = setsSeen || item.setsSeen()
+		hasFlags = hasFlags || item.name == "FLAGS"
+		hasUID = hasUID || item.name == "UID"
+		needsContent = needsContent || (item.name != "FLAGS" && item.name != "UID" && item.name != "INTERNALDATE")
+	}
+	// UID FETCH always responds with UID, and fetching message body responds with the new flags.
+	if uid && !hasUID {
+		items = append([]fetchItem{{name: "UID"}}, items...)
+	}
+	allOK := true
+	for _, i := range indexes {
+		msg := sess.mbox.messages[i]
+		var whole []byte
+		var root *mimePart
+		if needsContent {
+			if whole, err = sess.mbox.read(msg); err != nil {
+				sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to read message of user \"%s\"", sess.userName)
+				allOK = false
+				continue
+			}
+			root = parseMIMEPart(whole)
+		}
+		msgItems := items
+		if setsSeen && !sess.readOnly && !msg.hasFlag(`\Seen`) {
+			if err := sess.mbox.setLetters(msg, changeLetters(msg.letters, []string{`\Seen`}, true)); err != nil {
+				sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to set flags of message of user \"%s\"", sess.userName)
+			} else if !hasFlags {
+				msgItems = append(append([]fetchItem{}, items...), fetchItem{name: "FLAGS"})
+			}
+		}
+		values := make([]string, 0, len(msgItems))
+		for _, item := range msgItems {
+			value, err := sess.fetchItem(msg, item, whole, root)
+			if err != nil {
+				return "BAD", err.Error()
+			}
+			values = append(values, value)
+		}
+		sess.writeLine("* %d FETCH (%s)", i+1, strings.Join(values, " "))
+	}
+	if !allOK {
+		return "NO", "failed to read some of the messages"
+	}
+	return "OK", "FETCH completed"
+}
@@ -0,0 +1,265 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testMultipartMail = "From: Howard <howard@example.com>\r\n" +
+	"To: a@example.com, \"B \\\"Bee\\\"\" <b@example.com>\r\n" +
+	"Subject: multipart mail\r\n" +
+	"Date: Mon, 2 Jan 2017 15:04:05 +0000\r\n" +
+	"Message-ID: <id@example.com>\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"XYZ\"\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"plain text\r\n" +
+	"--XYZ\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=a.bin\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"--XYZ--\r\n"
+
+// Return a session that has selected the maildir, its responses are written into the buffer.
+func newTestSession(t *testing.T, dirPath string, readOnly bool) (*session, *bytes.Buffer) {
+	mbox, err := loadMailbox(dirPath, !readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	return &session{
+		daemon:   &IMAPD{},
+		writer:   bufio.NewWriter(out),
+		state:    stateSelected,
+		maildir:  dirPath,
+		mbox:     mbox,
+		readOnly: readOnly,
+	}, out
+}
+
+// Run a command in the session, its responses and tagged status are written into the session's buffer.
+func runTestCommand(t *testing.T, sess *session, cmd string) {
+	tag, name, args, err := parseCommand(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, text := sess.dispatch(name, args, false)
+	sess.writeLine("%s %s %s", tag, status, text)
+	sess.writer.Flush()
+}
+
+func TestMIMEPart(t *testing.T) {
+	root := parseMIMEPart([]byte(testMultipartMail))
+	if root.mediaType != "multipart" || root.subType != "mixed" || len(root.parts) != 2 {
+		t.Fatalf("%+v", root)
+	}
+	if body := string(root.parts[0].body); body != "plain text" {
+		t.Fatalf("%q", body)
+	}
+	if body := string(root.parts[1].body); body != "AAEC" {
+		t.Fatalf("%q", body)
+	}
+	envelope := root.envelope()
+	expected := `("Mon, 2 Jan 2017 15:04:05 +0000" "multipart mail" (("Howard" NIL "howard" "example.com")) (("Howard" NIL "howard" "example.com")) (("Howard" NIL "howard" "example.com")) ((NIL NIL "a" "example.com")("B \"Bee\"" NIL "b" "example.com")) NIL NIL NIL "<id@example.com>")`
+	if envelope != expected {
+		t.Fatal(envelope)
+	}
+	structure := root.structure(true)
+	expected = `(("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 10 1 NIL NIL NIL)("APPLICATION" "OCTET-STREAM" NIL NIL NIL "BASE64" 4 NIL ("ATTACHMENT" ("FILENAME" "a.bin")) NIL) "MIXED" ("BOUNDARY" "XYZ") NIL NIL)`
+	if structure != expected {
+		t.Fatal(structure)
+	}
+	if structure := root.structure(false); structure != `(("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 10 1)("APPLICATION" "OCTET-STREAM" NIL NIL NIL "BASE64" 4) "MIXED")` {
+		t.Fatal(structure)
+	}
+	// Single part message without content type is plain text
+	plain := parseMIMEPart([]byte("Subject: hi\r\n\r\nline 1\r\nline 2"))
+	if structure := plain.structure(false); structure != `("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 14 2)` {
+		t.Fatal(structure)
+	}
+}
+
+func TestSectionContent(t *testing.T) {
+	whole := []byte(testMultipartMail)
+	root := parseMIMEPart(whole)
+	for section, expected := range map[string]string{
+		"":                           testMultipartMail,
+		"TEXT":                       testMultipartMail[strings.Index(testMultipartMail, "preamble"):],
+		"HEADER":                     testMultipartMail[:strings.Index(testMultipartMail, "preamble")],
+		"header.fields (Subject To)": "To: a@example.com, \"B \\\"Bee\\\"\" <b@example.com>\r\nSubject: multipart mail\r\n\r\n",
+		"HEADER.FIELDS.NOT (From To Date Message-ID Content-Type)": "Subject: multipart mail\r\n\r\n",
+		"1":      "plain text",
+		"2":      "AAEC",
+		"2.MIME": "Content-Type: application/octet-stream\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=a.bin\r\n\r\n",
+	} {
+		if content, err := sectionContent(root, whole, section); err != nil || string(content) != expected {
+			t.Fatalf("section %s: %q %v", section, content, err)
+		}
+	}
+	for _, bad := range []string{"3", "1.2", "MIME", "UNKNOWN", "HEADER.FIELDS"} {
+		if _, err := sectionContent(root, whole, bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	// Part 1 of a single part message is its body
+	plain := parseMIMEPart([]byte("Subject: hi\r\n\r\nbody"))
+	if content, err := sectionContent(plain, nil, "1"); err != nil || string(content) != "body" {
+		t.Fatal(string(content), err)
+	}
+}
+
+func TestParseFetchItems(t *testing.T) {
+	items, err := parseFetchItems([]token{{kind: tokenAtom, value: "fast"}})
+	if err != nil || len(items) != 3 || items[0].name != "FLAGS" || items[2].name != "RFC822.SIZE" {
+		t.Fatal(items, err)
+	}
+	item, err := parseFetchItem("body.peek[HEADER.FIELDS (From)]<5.10>")
+	if err != nil || item.name != "BODY.PEEK" || item.section != "HEADER.FIELDS (From)" || !item.partial || item.origin != 5 || item.count != 10 {
+		t.Fatal(item, err)
+	}
+	if item.setsSeen() {
+		t.Fatal("peek should not set seen")
+	}
+	for _, bad := range []string{"UNKNOWN", "BODY.PEEK", "FLAGS[]", "BODY[", "BODY[]<1>", "BODY[]<a.1>"} {
+		if _, err := parseFetchItems([]token{{kind: tokenAtom, value: bad}}); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestSession_FetchStoreSearchExpunge(t *testing.T) {
+	dirPath := makeTestMaildir(t)
+	defer os.RemoveAll(dirPath)
+	deliverTestMail(t, dirPath, "1.M1P1Q1.host", testMultipartMail)
+	deliverTestMail(t, dirPath, "2.M1P1Q2.host", "From: other@example.com\nSubject: hello world\nDate: Tue, 3 Jan 2017 00:00:00 +0000\n\nsecond body\n")
+	sess, out := newTestSession(t, dirPath, false)
+
+	runTestCommand(t, sess, "a1 FETCH 1:* (FLAGS UID RFC822.SIZE)")
+	expected := "* 1 FETCH (FLAGS (\\Recent) UID 1 RFC822.SIZE " + strconv.Itoa(len(testMultipartMail)) + ")\r\n" +
+		"* 2 FETCH (FLAGS (\\Recent) UID 2 RFC822.SIZE 100)\r\n" +
+		"a1 OK FETCH completed\r\n"
+	if out.String() != expected {
+		t.Fatal(out.String())
+	}
+	// Peeking does not set \Seen flag, but fetching body does.
+	out.Reset()
+	runTestCommand(t, sess, "a2 FETCH 2 BODY.PEEK[TEXT]<0.6>")
+	if out.String() != "* 2 FETCH (BODY[TEXT]<0> {6}\r\nsecond)\r\na2 OK FETCH completed\r\n" {
+		t.Fatal(out.String())
+	}
+	out.Reset()
+	runTestCommand(t, sess, "a3 UID FETCH 2 BODY[1]")
+	if out.String() != "* 2 FETCH (UID 2 BODY[1] {13}\r\nsecond body\r\n FLAGS (\\Seen \\Recent))\r\na3 OK FETCH completed\r\n" {
+		t.Fatal(out.String())
+	}
+	// Search by flags, header, body, date, size, and sequence numbers
+	for criteria, expected := range map[string]string{
+		"ALL":                             "* SEARCH 1 2",
+		"SEEN":                            "* SEARCH 2",
+		"UNSEEN":                          "* SEARCH 1",
+		"NEW":                             "* SEARCH 1",
+		"FROM howard":                     "* SEARCH 1",
+		`SUBJECT "HELLO"`:                 "* SEARCH 2",
+		"BODY howard":                     "* SEARCH",
+		"TEXT howard":                     "* SEARCH 1",
+		"BODY {6}\r\nsecond":              "* SEARCH 2",
+		"SENTSINCE 3-Jan-2017":            "* SEARCH 2",
+		"SENTBEFORE 3-Jan-2017":           "* SEARCH 1",
+		"SENTON 02-Jan-2017":              "* SEARCH 1",
+		"LARGER 100":                      "* SEARCH 1",
+		"OR SEEN FROM howard":             "* SEARCH 1 2",
+		"NOT (SEEN SUBJECT hello)":        "* SEARCH 1",
+		"CHARSET UTF-8 2:*":               "* SEARCH 2",
+		"HEADER Message-ID id@example":    "* SEARCH 1",
+		"UID 1 UNDELETED KEYWORD $Junk":   "* SEARCH",
+		"UID 1 UNDELETED UNKEYWORD $Junk": "* SEARCH 1",
+	} {
+		out.Reset()
+		runTestCommand(t, sess, "s SEARCH "+criteria)
+		if out.String() != expected+"\r\ns OK SEARCH completed\r\n" {
+			t.Fatalf("%s: %q", criteria, out.String())
+		}
+	}
+	out.Reset()
+	runTestCommand(t, sess, "s1 SEARCH CHARSET KOI8-R ALL")
+	if !strings.HasPrefix(out.String(), "s1 NO [BADCHARSET") {
+		t.Fatal(out.String())
+	}
+	out.Reset()
+	runTestCommand(t, sess, "s2 SEARCH UNKNOWNKEY")
+	if !strings.HasPrefix(out.String(), "s2 BAD") {
+		t.Fatal(out.String())
+	}
+	// Store flags
+	out.Reset()
+	runTestCommand(t, sess, `a4 STORE 1 +FLAGS (\Deleted \Flagged)`)
+	if out.String() != "* 1 FETCH (FLAGS (\\Flagged \\Deleted \\Recent))\r\na4 OK STORE completed\r\n" {
+		t.Fatal(out.String())
+	}
+	out.Reset()
+	runTestCommand(t, sess, `a5 UID STORE 1:2 -FLAGS.SILENT (\Flagged)`)
+	runTestCommand(t, sess, `a6 STORE 2 FLAGS \Answered`)
+	if out.String() != "a5 OK STORE completed\r\n* 2 FETCH (FLAGS (\\Answered \\Recent))\r\na6 OK STORE completed\r\n" {
+		t.Fatal(out.String())
+	}
+	// Expunge the deleted message, the remaining one becomes number 1.
+	out.Reset()
+	runTestCommand(t, sess, "a7 EXPUNGE")
+	if out.String() != "* 1 EXPUNGE\r\na7 OK EXPUNGE completed\r\n" {
+		t.Fatal(out.String())
+	}
+	out.Reset()
+	runTestCommand(t, sess, "a8 FETCH * (UID FLAGS)")
+	if out.String() != "* 1 FETCH (UID 2 FLAGS (\\Answered \\Recent))\r\na8 OK FETCH completed\r\n" {
+		t.Fatal(out.String())
+	}
+
+	// Read-only session does not modify the mailbox
+	roSess, roOut := newTestSession(t, dirPath, true)
+	runTestCommand(t, roSess, `b1 STORE 1 +FLAGS (\Seen)`)
+	runTestCommand(t, roSess, "b2 EXPUNGE")
+	runTestCommand(t, roSess, "b3 FETCH 1 (BODY[TEXT] FLAGS)")
+	if roOut.String() != "b1 NO "+ReadOnlyText+"\r\nb2 NO "+ReadOnlyText+"\r\n* 1 FETCH (BODY[TEXT] {13}\r\nsecond body\r\n FLAGS (\\Answered))\r\nb3 OK FETCH completed\r\n" {
+		t.Fatal(roOut.String())
+	}
+
+	// Changes made by other sessions and new mails are reported upon refresh
+	out.Reset()
+	if err := sess.mbox.setLetters(&message{key: "2.M1P1Q2.host", subDir: "cur", fileName: "2.M1P1Q2.host:2,R"}, "RS"); err != nil {
+		t.Fatal(err)
+	}
+	deliverTestMail(t, dirPath, "3.M1P1Q3.host", "Subject: third\n\nbody 3\n")
+	runTestCommand(t, sess, "a9 NOOP")
+	if out.String() != "* 1 FETCH (FLAGS (\\Answered \\Seen \\Recent))\r\n* 2 EXISTS\r\n* 2 RECENT\r\na9 OK completed\r\n" {
+		t.Fatal(out.String())
+	}
+	if err := os.Remove(path.Join(dirPath, "cur", "2.M1P1Q2.host:2,RS")); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	runTestCommand(t, sess, "a10 NOOP")
+	if out.String() != "* 1 EXPUNGE\r\na10 OK completed\r\n" {
+		t.Fatal(out.String())
+	}
+	// CLOSE expunges silently
+	out.Reset()
+	runTestCommand(t, sess, `a11 STORE 1 +FLAGS.SILENT (\Deleted)`)
+	runTestCommand(t, sess, "a12 CLOSE")
+	runTestCommand(t, sess, "a13 FETCH 1 FLAGS")
+	if out.String() != "a11 OK STORE completed\r\na12 OK mailbox is closed\r\na13 BAD no mailbox is selected\r\n" {
+		t.Fatal(out.String())
+	}
+	if mbox, err := loadMailbox(dirPath, false); err != nil || len(mbox.messages) != 0 || mbox.uidNext != 4 {
+		t.Fatal(mbox, err)
+	}
+}
@@ -0,0 +1,153 @@
+package imapd
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/ratelimit"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitIntervalSec = 10   // Rate limit is calculated at 10 seconds interval
+	IOTimeoutSec         = 1860 // Disconnect client that has been silent for this many seconds, slightly longer than the 30 minutes auto-logout timer.
+	IdlePollIntervalSec  = 5    // Look for mailbox changes at this interval while client is idling
+)
+
+// A user who reads mails stored in a maildir.
+type User struct {
+	Password string `json:"Password"`
+	Maildir  string `json:"Maildir"` // Directory of the user's maildir, e.g. one that SMTP daemon stores mails in.
+}
+
+// An IMAP4rev1 (RFC 3501) daemon over TLS that serves mails stored in maildirs. Each user has an INBOX and nothing else.
+type IMAPD struct {
+	ListenAddress string          `json:"ListenAddress"` // Network address to listen to, e.g. 0.0.0.0 for all network interfaces.
+	ListenPort    int             `json:"ListenPort"`    // Port number to listen on, usually 993.
+	TLSCertPath   string          `json:"TLSCertPath"`   // Serve IMAP over TLS via this certificate
+	TLSKeyPath    string          `json:"TLSKeyPath"`    // Serve IMAP over TLS via this certificate (key)
+	PerIPLimit    int             `json:"PerIPLimit"`    // How many times in 10 seconds interval an IP may connect or log in
+	Users         map[string]User `json:"Users"`         // Users log in via these names and passwords
+
+	Listener       net.Listener         `json:"-"` // Once daemon is started, this is its TLS listener.
+	TLSCertificate tls.Certificate      `json:"-"` // TLS certificate read from the certificate and key files
+	RateLimit      *ratelimit.RateLimit `json:"-"` // Rate limit counter per IP address
+	Logger         global.Logger        `json:"-"` // Logger
+	mutex          *sync.Mutex
+}
+
+// Check configuration and initialise internal states.
+func (imapd *IMAPD) Initialise() error {
+	if imapd.ListenAddress == "" {
+		return errors.New("IMAPD.Initialise: listen address must not be empty")
+	}
+	if imapd.ListenPort < 1 {
+		return errors.New("IMAPD.Initialise: listen port must be greater than 0")
+	}
+	if imapd.TLSCertPath == "" || imapd.TLSKeyPath == "" {
+		return errors.New("IMAPD.Initialise: TLS certificate and key path must be present")
+	}
+	var err error
+	imapd.TLSCertificate, err = tls.LoadX509KeyPair(imapd.TLSCertPath, imapd.TLSKeyPath)
+	if err != nil {
+		return fmt.Errorf("IMAPD.Initialise: failed to read TLS certificate - %v", err)
+	}
+	if imapd.PerIPLimit < 10 {
+		return errors.New("IMAPD.Initialise: PerIPLimit must be greater than 9")
+	}
+	if len(imapd.Users) == 0 {
+		return errors.New("IMAPD.Initialise: Users must not be empty")
+	}
+	for name, user := range imapd.Users {
+		if name == "" || len(user.Password) < 7 {
+			return fmt.Errorf("IMAPD.Initialise: user \"%s\" must have a valid name and a password of at least 7 characters", name)
+		}
+		if user.Maildir == "" {
+			return fmt.Errorf("IMAPD.Initialise: maildir of user \"%s\" must not be empty", name)
+		}
+		// The maildir may not have received any mail yet
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(path.Join(user.Maildir, sub), 0700); err != nil {
+				return fmt.Errorf("IMAPD.Initialise: failed to create maildir of user \"%s\" - %v", name, err)
+			}
+		}
+	}
+	imapd.RateLimit = &ratelimit.RateLimit{
+		MaxCount: imapd.PerIPLimit,
+		UnitSecs: RateLimitIntervalSec,
+		Logger:   imapd.Logger,
+	}
+	imapd.RateLimit.Initialise()
+	imapd.mutex = new(sync.Mutex)
+	return nil
+}
+
+// Return the user's maildir if the name and password are correct, otherwise return false.
+func (imapd *IMAPD) authenticate(name, password string) (string, bool) {
+	user, exists := imapd.Users[name]
+	if !exists || subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		return "", false
+	}
+	return user.Maildir, true
+}
+
+// Converse with IMAP client until it logs out or disconnects. Finally close the connection.
+func (imapd *IMAPD) HandleConnection(clientConn net.Conn) {
+	defer clientConn.Close()
+	clientIP := clientConn.RemoteAddr().String()[:strings.LastIndexByte(clientConn.RemoteAddr().String(), ':')]
+	if !imapd.RateLimit.Add(clientIP, true) {
+		clientConn.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+		clientConn.Write([]byte("* BYE Try again later rate limit exceeded\r\n"))
+		return
+	}
+	sess := newSession(imapd, clientConn, clientIP)
+	sess.converse()
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start IMAP daemon and block until daemon is told to stop.
+*/
+func (imapd *IMAPD) StartAndBlock() error {
+	listenAddr := net.JoinHostPort(imapd.ListenAddress, strconv.Itoa(imapd.ListenPort))
+	imapd.Logger.Printf("StartAndBlock", listenAddr, nil, "going to listen for connections")
+	listener, err := tls.Listen("tcp", listenAddr, &tls.Config{Certificates: []tls.Certificate{imapd.TLSCertificate}})
+	if err != nil {
+		return fmt.Errorf("IMAPD.StartAndBlock: failed to listen on %s - %v", listenAddr, err)
+	}
+	imapd.mutex.Lock()
+	imapd.Listener = listener
+	imapd.mutex.Unlock()
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		clientConn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("IMAPD.StartAndBlock: failed to accept new connection - %v", err)
+		}
+		go imapd.HandleConnection(clientConn)
+	}
+}
+
+// If IMAP daemon has started (i.e. listener is set), close the listener so that its connection loop will terminate.
+func (imapd *IMAPD) Stop() {
+	imapd.mutex.Lock()
+	defer imapd.mutex.Unlock()
+	if imapd.Listener != nil {
+		if err := imapd.Listener.Close(); err != nil {
+			imapd.Logger.Warningf("Stop", "", err, "failed to close listener")
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package imapd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"github.com/HouzuoGuo/laitos/feature"
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read response lines until one of them begins with the prefix, return all of the lines.
+func expectLine(t *testing.T, reader *bufio.Reader, prefix string) string {
+	var lines string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q %v", lines, err)
+		}
+		lines += line
+		if strings.HasPrefix(line, prefix) {
+			return lines
+		}
+	}
+}
+
+func TestIMAPD(t *testing.T) {
+	certPath := "/tmp/test-laitos-imapd.crt"
+	keyPath := "/tmp/test-laitos-imapd.key"
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	testhelper.WriteTestCertificate(t, certPath, keyPath)
+	dirPath := makeTestMaildir(t)
+	defer os.RemoveAll(dirPath)
+	deliverTestMail(t, dirPath, "1.M1P1Q1.host", "From: a@example.com\nSubject: first\n\nbody 1\n")
+	deliverTestMail(t, dirPath, "2.M1P1Q2.host", "From: b@example.com\nSubject: second\n\nbody 2\n")
+
+	daemon := IMAPD{}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "listen address") {
+		t.Fatal(err)
+	}
+	daemon.ListenAddress = "127.0.0.1"
+	daemon.ListenPort = 8739
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Fatal(err)
+	}
+	daemon.TLSCertPath = certPath
+	daemon.TLSKeyPath = keyPath
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "PerIPLimit") {
+		t.Fatal(err)
+	}
+	daemon.PerIPLimit = 10
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "Users") {
+		t.Fatal(err)
+	}
+	daemon.Users = map[string]User{"howard": {Password: "short"}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Fatal(err)
+	}
+	daemon.Users = map[string]User{"howard": {Password: "pass1234", Maildir: dirPath}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- daemon.StartAndBlock()
+	}()
+	time.Sleep(1 * time.Second)
+
+	// Wrong password is refused
+	client := feature.IMAPS{
+		Host:               "127.0.0.1",
+		Port:               8739,
+		MailboxName:        "INBOX",
+		InsecureSkipVerify: true,
+		AuthUsername:       "howard",
+		AuthPassword:       "wrong-password",
+		IOTimeoutSec:       10,
+	}
+	if err := client.ConnectLoginSelect(); err == nil || !strings.Contains(err.Error(), "LOGIN") {
+		t.Fatal(err)
+	}
+	// Read mails via the IMAP client used by laitos feature
+	client.AuthPassword = "pass1234"
+	if err := client.ConnectLoginSelect(); err != nil {
+		t.Fatal(err)
+	}
+	if num, err := client.GetNumberMessages(); err != nil || num != 2 {
+		t.Fatal(num, err)
+	}
+	headers, err := client.GetHeaders(1, 2)
+	if err != nil || len(headers) != 2 || !strings.Contains(headers[1], "Subject: first") || !strings.Contains(headers[2], "Subject: second") {
+		t.Fatal(headers, err)
+	}
+	if msg, err := client.GetMessage(2); err != nil || !strings.Contains(msg, "Subject: second") || !strings.Contains(msg, "body 2") {
+		t.Fatal(msg, err)
+	}
+	// The mailbox was examined, hence reading message did not set \Seen flag.
+	if _, _, err := client.Converse(`SELECT "INBOX"`); err != nil {
+		t.Fatal(err)
+	}
+	if _, body, err := client.Converse("UID SEARCH UNSEEN"); err != nil || body != "* SEARCH 1 2\n" {
+		t.Fatal(body, err)
+	}
+	if _, body, err := client.Converse(`STORE 1 +FLAGS (\Deleted)`); err != nil || body != "* 1 FETCH (FLAGS (\\Deleted))\n" {
+		t.Fatal(body, err)
+	}
+	if _, body, err := client.Converse("EXPUNGE"); err != nil || body != "* 1 EXPUNGE\n" {
+		t.Fatal(body, err)
+	}
+	if _, _, err := client.Converse("CREATE Archive"); err == nil {
+		t.Fatal("did not error")
+	}
+	client.DisconnectLogout()
+	if files, _ := ioutil.ReadDir(dirPath + "/cur"); len(files) != 1 || !strings.HasPrefix(files[0].Name(), "2.M1P1Q2.host") {
+		t.Fatal(files)
+	}
+
+	// Idling client is told about new mails
+	conn, err := tls.Dial("tcp", "127.0.0.1:8739", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReader(conn)
+	expectLine(t, reader, "* OK")
+	conn.Write([]byte("a1 LOGIN howard pass1234\r\na2 SELECT INBOX\r\n"))
+	expectLine(t, reader, "a1 OK")
+	if lines := expectLine(t, reader, "a2 OK"); !strings.Contains(lines, "* 1 EXISTS\r\n") {
+		t.Fatal(lines)
+	}
+	conn.Write([]byte("a3 IDLE\r\n"))
+	expectLine(t, reader, "+ idling")
+	deliverTestMail(t, dirPath, "3.M1P1Q3.host", "Subject: third\n\nbody 3\n")
+	if lines := expectLine(t, reader, "* 2 EXISTS"); lines != "* 2 EXISTS\r\n" {
+		t.Fatal(lines)
+	}
+	conn.Write([]byte("DONE\r\n"))
+	expectLine(t, reader, "a3 OK")
+	conn.Write([]byte("a4 LOGOUT\r\n"))
+	if lines := expectLine(t, reader, "a4 OK"); !strings.Contains(lines, "* BYE") {
+		t.Fatal(lines)
+	}
+	conn.Close()
+
+	daemon.Stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not stop")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:8739"); err == nil {
+		t.Fatal("did not close listener")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	daemon.Stop()
+}
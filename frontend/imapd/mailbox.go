@@ -0,0 +1,299 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const UIDListFileName = "laitos-imap-uidlist" // Name of the file in maildir that remembers message UIDs
+
+// Maildir info letters and their corresponding IMAP system flags, letters are in the ASCII order required by Maildir.
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', `\Draft`},
+	{'F', `\Flagged`},
+	{'R', `\Answered`},
+	{'S', `\Seen`},
+	{'T', `\Deleted`},
+}
+
+// Serialise access to each maildir among all sessions.
+var (
+	maildirLocks      = make(map[string]*sync.Mutex)
+	maildirLocksMutex = new(sync.Mutex)
+)
+
+// Lock the maildir and return the function that unlocks it.
+func lockMaildir(dirPath string) func() {
+	maildirLocksMutex.Lock()
+	lock, exists := maildirLocks[dirPath]
+	if !exists {
+		lock = new(sync.Mutex)
+		maildirLocks[dirPath] = lock
+	}
+	maildirLocksMutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// A message stored in maildir.
+type message struct {
+	uid      uint32
+	key      string // Unique part of the file name that does not change with flags
+	subDir   string // "new" or "cur"
+	fileName string
+	letters  string // Maildir info letters that represent flags
+	recent   bool   // Message was found in "new" directory by this session
+	modTime  time.Time
+}
+
+// Return true if the message carries the flag.
+func (msg *message) hasFlag(flag string) bool {
+	if strings.EqualFold(flag, `\Recent`) {
+		return msg.recent
+	}
+	for _, f := range maildirFlags {
+		if strings.EqualFold(f.flag, flag) {
+			return strings.IndexByte(msg.letters, f.letter) != -1
+		}
+	}
+	return false
+}
+
+// Return IMAP flags of the message.
+func (msg *message) flags() []string {
+	ret := make([]string, 0, 4)
+	for _, f := range maildirFlags {
+		if strings.IndexByte(msg.letters, f.letter) != -1 {
+			ret = append(ret, f.flag)
+		}
+	}
+	if msg.recent {
+		ret = append(ret, `\Recent`)
+	}
+	return ret
+}
+
+// Return maildir info letters after adding or removing the IMAP flags. Letters that do not represent IMAP flags are kept.
+func changeLetters(letters string, flags []string, add bool) string {
+	set := make(map[byte]struct{})
+	for i := 0; i < len(letters); i++ {
+		set[letters[i]] = struct{}{}
+	}
+	for _, flag := range flags {
+		for _, f := range maildirFlags {
+			if strings.EqualFold(f.flag, flag) {
+				if add {
+					set[f.letter] = struct{}{}
+				} else {
+					delete(set, f.letter)
+				}
+			}
+		}
+	}
+	ret := make([]byte, 0, len(set))
+	for letter := range set {
+		ret = append(ret, letter)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return string(ret)
+}
+
+// Convert line endings to CRLF.
+func toCRLF(content []byte) []byte {
+	content = bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(content, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// A snapshot of messages stored in a maildir. Each message has a UID that persists across sessions.
+type mailbox struct {
+	dirPath     string
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*message // Sorted in ascending UID order
+}
+
+// Read the UID list file. Return UID validity, the next UID, and UIDs of message keys.
+func readUIDList(dirPath string) (validity, next uint32, uids map[string]uint32, err error) {
+	uids = make(map[string]uint32)
+	content, err := ioutil.ReadFile(path.Join(dirPath, UIDListFileName))
+	if os.IsNotExist(err) {
+		// A new UID validity value tells clients to forget UIDs they have cached
+		return uint32(time.Now().Unix()), 1, uids, nil
+	} else if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 0; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		first, parseErr := strconv.ParseUint(fields[0], 10, 32)
+		if parseErr != nil {
+			continue
+		}
+		if lineNum == 0 {
+			// The first line carries UID validity and the next UID
+			second, parseErr := strconv.ParseUint(fields[1], 10, 32)
+			if parseErr != nil {
+				return 0, 0, nil, fmt.Errorf("readUIDList: malformed header line in %s", UIDListFileName)
+			}
+			validity, next = uint32(first), uint32(second)
+			continue
+		}
+		uids[fields[1]] = uint32(first)
+	}
+	if validity == 0 || next == 0 {
+		return 0, 0, nil, fmt.Errorf("readUIDList: %s is missing its header line", UIDListFileName)
+	}
+	return
+}
+
+// Write the UID list file of the mailbox.
+func (mbox *mailbox) writeUIDList() error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %d\n", mbox.uidValidity, mbox.uidNext)
+	for _, msg := range mbox.messages {
+		fmt.Fprintf(&buf, "%d %s\n", msg.uid, msg.key)
+	}
+	tmpPath := path.Join(mbox.dirPath, UIDListFileName+".tmp")
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path.Join(mbox.dirPath, UIDListFileName))
+}
+
+/*
+Read messages stored in the maildir and assign UIDs to new messages. Messages found in "new" directory are recent, and
+if moveNew is true they are moved into "cur" directory so that other sessions no longer consider them recent.
+*/
+func loadMailbox(dirPath string, moveNew bool) (*mailbox, error) {
+	unlock := lockMaildir(dirPath)
+	defer unlock()
+	validity, next, uids, err := readUIDList(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("loadMailbox: failed to read UID list - %v", err)
+	}
+	mbox := &mailbox{dirPath: dirPath, uidValidity: validity, uidNext: next}
+	var newMessages []*message
+	for _, subDir := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(path.Join(dirPath, subDir))
+		if err != nil {
+			return nil, fmt.Errorf("loadMailbox: failed to read directory - %v", err)
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			msg := &message{subDir: subDir, fileName: file.Name(), key: file.Name(), modTime: file.ModTime()}
+			if colon := strings.IndexByte(file.Name(), ':'); colon != -1 {
+				msg.key = file.Name()[:colon]
+				if info := file.Name()[colon+1:]; strings.HasPrefix(info, "2,") {
+					msg.letters = info[2:]
+				}
+			}
+			if subDir == "new" {
+				msg.recent = true
+				if moveNew {
+					newName := msg.key + ":2," + msg.letters
+					if err := os.Rename(path.Join(dirPath, "new", msg.fileName), path.Join(dirPath, "cur", newName)); err == nil {
+						msg.subDir, msg.fileName = "cur", newName
+					}
+				}
+			}
+			if uid, exists := uids[msg.key]; exists {
+				msg.uid = uid
+				mbox.messages = append(mbox.messages, msg)
+			} else {
+				newMessages = append(newMessages, msg)
+			}
+		}
+	}
+	// File names of new messages begin with delivery time
+	sort.Slice(newMessages, func(i, j int) bool { return newMessages[i].key < newMessages[j].key })
+	for _, msg := range newMessages {
+		msg.uid = mbox.uidNext
+		mbox.uidNext++
+		mbox.messages = append(mbox.messages, msg)
+	}
+	sort.Slice(mbox.messages, func(i, j int) bool { return mbox.messages[i].uid < mbox.messages[j].uid })
+	if len(newMessages) > 0 || len(uids) != len(mbox.messages)-len(newMessages) || len(uids) == 0 {
+		if err := mbox.writeUIDList(); err != nil {
+			return nil, fmt.Errorf("loadMailbox: failed to write UID list - %v", err)
+		}
+	}
+	return mbox, nil
+}
+
+// Return the location of message file. If the file has been renamed by another session, find its current name.
+func (mbox *mailbox) locate(msg *message) (string, error) {
+	filePath := path.Join(mbox.dirPath, msg.subDir, msg.fileName)
+	if _, err := os.Stat(filePath); err == nil {
+		return filePath, nil
+	}
+	for _, subDir := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(path.Join(mbox.dirPath, subDir))
+		if err != nil {
+			return "", err
+		}
+		for _, file := range files {
+			if file.Name() == msg.key || strings.HasPrefix(file.Name(), msg.key+":") {
+				msg.subDir, msg.fileName = subDir, file.Name()
+				return path.Join(mbox.dirPath, subDir, file.Name()), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("mailbox.locate: message %d no longer exists", msg.uid)
+}
+
+// Return message content with CRLF line endings.
+func (mbox *mailbox) read(msg *message) ([]byte, error) {
+	filePath, err := mbox.locate(msg)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return toCRLF(content), nil
+}
+
+// Change the flags of message by renaming its file.
+func (mbox *mailbox) setLetters(msg *message, letters string) error {
+	unlock := lockMaildir(mbox.dirPath)
+	defer unlock()
+	filePath, err := mbox.locate(msg)
+	if err != nil {
+		return err
+	}
+	newName := msg.key + ":2," + letters
+	if err := os.Rename(filePath, path.Join(mbox.dirPath, "cur", newName)); err != nil {
+		return err
+	}
+	msg.subDir, msg.fileName, msg.letters = "cur", newName, letters
+	return nil
+}
+
+// Permanently remove the message.
+func (mbox *mailbox) remove(msg *message) error {
+	unlock := lockMaildir(mbox.dirPath)
+	defer unlock()
+	filePath, err := mbox.locate(msg)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
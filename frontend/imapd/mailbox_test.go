@@ -0,0 +1,122 @@
+package imapd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// Create an empty maildir and return its path.
+func makeTestMaildir(t *testing.T) string {
+	dirPath, err := ioutil.TempDir("", "laitos-test-imapd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(path.Join(dirPath, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dirPath
+}
+
+// Deliver a mail into "new" directory of the maildir.
+func deliverTestMail(t *testing.T, dirPath, fileName, content string) {
+	if err := ioutil.WriteFile(path.Join(dirPath, "new", fileName), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeLetters(t *testing.T) {
+	if s := changeLetters("PS", []string{`\Deleted`, `\flagged`, `\Recent`, "keyword"}, true); s != "FPST" {
+		t.Fatal(s)
+	}
+	if s := changeLetters("FPST", []string{`\Seen`, `\Draft`}, false); s != "FPT" {
+		t.Fatal(s)
+	}
+	msg := &message{letters: "FPT", recent: true}
+	if flags := msg.flags(); !reflect.DeepEqual(flags, []string{`\Flagged`, `\Deleted`, `\Recent`}) {
+		t.Fatal(flags)
+	}
+	if !msg.hasFlag(`\deleted`) || msg.hasFlag(`\Seen`) || !msg.hasFlag(`\Recent`) {
+		t.Fatal("wrong flags")
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	dirPath := makeTestMaildir(t)
+	defer os.RemoveAll(dirPath)
+	deliverTestMail(t, dirPath, "2.M1P1Q2.host", "Subject: second\n\nbody 2\n")
+	deliverTestMail(t, dirPath, "1.M1P1Q1.host", "Subject: first\n\nbody 1\n")
+	if err := ioutil.WriteFile(path.Join(dirPath, "cur", "0.M1P1Q0.host:2,S"), []byte("Subject: zero\r\n\r\nbody 0\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Examining a mailbox does not move new messages
+	mbox, err := loadMailbox(dirPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mbox.messages) != 3 || mbox.uidNext != 4 || mbox.uidValidity == 0 {
+		t.Fatalf("%+v", mbox)
+	}
+	for i, key := range []string{"0.M1P1Q0.host", "1.M1P1Q1.host", "2.M1P1Q2.host"} {
+		if msg := mbox.messages[i]; msg.key != key || msg.uid != uint32(i+1) || msg.recent != (i > 0) {
+			t.Fatalf("%+v", msg)
+		}
+	}
+	if !mbox.messages[0].hasFlag(`\Seen`) {
+		t.Fatal("missing flag")
+	}
+	if files, _ := ioutil.ReadDir(path.Join(dirPath, "new")); len(files) != 2 {
+		t.Fatal(files)
+	}
+	// Message content comes with CRLF line endings
+	if content, err := mbox.read(mbox.messages[1]); err != nil || string(content) != "Subject: first\r\n\r\nbody 1\r\n" {
+		t.Fatalf("%q %v", content, err)
+	}
+	// UIDs remain the same, and selecting mailbox moves new messages.
+	mbox, err = loadMailbox(dirPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mbox.messages) != 3 || mbox.messages[2].uid != 3 || mbox.messages[2].subDir != "cur" || !mbox.messages[2].recent {
+		t.Fatalf("%+v", mbox.messages[2])
+	}
+	if files, _ := ioutil.ReadDir(path.Join(dirPath, "new")); len(files) != 0 {
+		t.Fatal(files)
+	}
+	// Store flags
+	first := mbox.messages[1]
+	if err := mbox.setLetters(first, "FS"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dirPath, "cur", "1.M1P1Q1.host:2,FS")); err != nil {
+		t.Fatal(err)
+	}
+	// Another session finds the message after its flags have changed
+	stale := *first
+	stale.fileName = "1.M1P1Q1.host:2,"
+	if content, err := mbox.read(&stale); err != nil || len(content) == 0 || stale.fileName != "1.M1P1Q1.host:2,FS" {
+		t.Fatal(stale, err)
+	}
+	// Removed message does not come back, and its UID is not reused.
+	if err := mbox.remove(mbox.messages[0]); err != nil {
+		t.Fatal(err)
+	}
+	deliverTestMail(t, dirPath, "3.M1P1Q3.host", "Subject: third\n\nbody 3\n")
+	mbox, err = loadMailbox(dirPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mbox.messages) != 3 || mbox.messages[0].uid != 2 || mbox.messages[2].uid != 4 || mbox.uidNext != 5 {
+		t.Fatalf("%+v", mbox)
+	}
+	if mbox.messages[0].letters != "FS" || mbox.messages[0].recent {
+		t.Fatalf("%+v", mbox.messages[0])
+	}
+	if _, err := mbox.read(&message{key: "does-not-exist", subDir: "cur", fileName: "does-not-exist"}); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,248 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+var crlf = []byte("\r\n")
+
+// A MIME entity, which is either the message itself, a part of a multipart entity, or a message encapsulated by another.
+type mimePart struct {
+	rawHeader []byte // Header including the empty line that ends it
+	body      []byte
+	header    textproto.MIMEHeader
+	mediaType string // Lower case type, e.g. "text"
+	subType   string // Lower case subtype, e.g. "plain"
+	params    map[string]string
+	parts     []*mimePart // Parts of multipart entity
+	message   *mimePart   // Message encapsulated by message/rfc822 entity
+}
+
+// Split content into header (including the empty line that ends it) and body.
+func splitHeader(content []byte) (header, body []byte) {
+	if bytes.HasPrefix(content, crlf) {
+		return content[:2], content[2:]
+	}
+	if end := bytes.Index(content, []byte("\r\n\r\n")); end != -1 {
+		return content[:end+4], content[end+4:]
+	}
+	return content, nil
+}
+
+// Parse a MIME entity and its nested entities. Content must have CRLF line endings.
+func parseMIMEPart(content []byte) *mimePart {
+	part := &mimePart{}
+	part.rawHeader, part.body = splitHeader(content)
+	headerReader := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(append([]byte{}, part.rawHeader...), crlf...))))
+	part.header, _ = headerReader.ReadMIMEHeader()
+	if part.header == nil {
+		part.header = make(textproto.MIMEHeader)
+	}
+	part.mediaType, part.subType, part.params = "text", "plain", map[string]string{"charset": "us-ascii"}
+	if contentType := part.header.Get("Content-Type"); contentType != "" {
+		if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+			if slash := strings.IndexByte(mediaType, '/'); slash != -1 {
+				part.mediaType, part.subType, part.params = mediaType[:slash], mediaType[slash+1:], params
+			}
+		}
+	}
+	switch {
+	case part.mediaType == "multipart":
+		part.parts = splitMultipart(part.body, part.params["boundary"])
+	case part.mediaType == "message" && part.subType == "rfc822":
+		part.message = parseMIMEPart(part.body)
+	}
+	return part
+}
+
+// Split the body of multipart entity into parts.
+func splitMultipart(body []byte, boundary string) (parts []*mimePart) {
+	if boundary == "" {
+		return
+	}
+	// Each delimiter begins on a new line, including the first one that may be at the very beginning.
+	delimiter := []byte("\r\n--" + boundary)
+	chunks := bytes.Split(append(append([]byte{}, crlf...), body...), delimiter)
+	for _, chunk := range chunks[1:] {
+		// The close delimiter ends the multipart entity
+		if bytes.HasPrefix(chunk, []byte("--")) {
+			break
+		}
+		// Skip transport padding that follows the delimiter
+		lineEnd := bytes.Index(chunk, crlf)
+		if lineEnd == -1 {
+			continue
+		}
+		parts = append(parts, parseMIMEPart(chunk[lineEnd+2:]))
+	}
+	return
+}
+
+// Return the part identified by part numbers such as [1, 2], or nil if there is no such part.
+func (part *mimePart) findPart(numbers []int) *mimePart {
+	target := part
+	for _, num := range numbers {
+		// Part numbers of encapsulated message refer to the parts of that message
+		if target.message != nil {
+			target = target.message
+		}
+		if len(target.parts) > 0 {
+			if num < 1 || num > len(target.parts) {
+				return nil
+			}
+			target = target.parts[num-1]
+		} else if num != 1 {
+			// A non-multipart entity only has part 1, which is itself.
+			return nil
+		}
+	}
+	return target
+}
+
+// Return header fields that are (or are not, if exclude is true) among the names. The result ends with an empty line.
+func filterHeader(rawHeader []byte, names []string, exclude bool) []byte {
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[strings.ToLower(name)] = struct{}{}
+	}
+	var ret bytes.Buffer
+	var include bool
+	for _, line := range bytes.SplitAfter(rawHeader, crlf) {
+		if len(line) == 0 || bytes.Equal(line, crlf) {
+			continue
+		}
+		// Folded lines continue the previous field
+		if line[0] != ' ' && line[0] != '\t' {
+			var name string
+			if colon := bytes.IndexByte(line, ':'); colon != -1 {
+				name = strings.ToLower(strings.TrimSpace(string(line[:colon])))
+			}
+			_, found := wanted[name]
+			include = found != exclude
+		}
+		if include {
+			ret.Write(line)
+		}
+	}
+	ret.Write(crlf)
+	return ret.Bytes()
+}
+
+// Return the number of lines in body.
+func countLines(body []byte) int {
+	lines := bytes.Count(body, crlf)
+	if len(body) > 0 && !bytes.HasSuffix(body, crlf) {
+		lines++
+	}
+	return lines
+}
+
+// Return parameters in the form of parenthesised list, or NIL if there is none.
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]string, 0, len(params)*2)
+	for _, name := range names {
+		items = append(items, quote(strings.ToUpper(name)), quote(params[name]))
+	}
+	return "(" + strings.Join(items, " ") + ")"
+}
+
+// Return content disposition in the form of parenthesised list, or NIL if there is none.
+func (part *mimePart) disposition() string {
+	disposition, params, err := mime.ParseMediaType(part.header.Get("Content-Disposition"))
+	if err != nil {
+		return "NIL"
+	}
+	return fmt.Sprintf("(%s %s)", quote(strings.ToUpper(disposition)), paramList(params))
+}
+
+// Return the body structure of the entity. Extension data is only included in BODYSTRUCTURE.
+func (part *mimePart) structure(extension bool) string {
+	if part.mediaType == "multipart" && len(part.parts) > 0 {
+		var buf bytes.Buffer
+		buf.WriteByte('(')
+		for _, child := range part.parts {
+			buf.WriteString(child.structure(extension))
+		}
+		buf.WriteString(" " + quote(strings.ToUpper(part.subType)))
+		if extension {
+			buf.WriteString(fmt.Sprintf(" %s %s NIL", paramList(part.params), part.disposition()))
+		}
+		buf.WriteByte(')')
+		return buf.String()
+	}
+	mediaType, subType := part.mediaType, part.subType
+	if mediaType == "multipart" {
+		// A multipart entity without any part is presented as plain text
+		mediaType, subType = "text", "plain"
+	}
+	encoding := strings.ToUpper(strings.TrimSpace(part.header.Get("Content-Transfer-Encoding")))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	ret := fmt.Sprintf("(%s %s %s %s %s %s %d",
+		quote(strings.ToUpper(mediaType)), quote(strings.ToUpper(subType)), paramList(part.params),
+		nilOrQuote(part.header.Get("Content-Id")), nilOrQuote(part.header.Get("Content-Description")),
+		quote(encoding), len(part.body))
+	if part.message != nil {
+		ret += fmt.Sprintf(" %s %s %d", part.message.envelope(), part.message.structure(extension), countLines(part.body))
+	} else if mediaType == "text" {
+		ret += fmt.Sprintf(" %d", countLines(part.body))
+	}
+	if extension {
+		ret += fmt.Sprintf(" NIL %s NIL", part.disposition())
+	}
+	return ret + ")"
+}
+
+// Return addresses of the header field in the form of parenthesised list, or NIL if there is none.
+func (part *mimePart) addressList(field string) string {
+	value := part.header.Get(field)
+	if value == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	items := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		mailbox, host := addr.Address, ""
+		if at := strings.LastIndexByte(addr.Address, '@'); at != -1 {
+			mailbox, host = addr.Address[:at], addr.Address[at+1:]
+		}
+		items = append(items, fmt.Sprintf("(%s NIL %s %s)", nilOrQuote(addr.Name), nilOrQuote(mailbox), nilOrQuote(host)))
+	}
+	return "(" + strings.Join(items, "") + ")"
+}
+
+// Return the envelope structure of the message.
+func (part *mimePart) envelope() string {
+	from := part.addressList("From")
+	sender, replyTo := part.addressList("Sender"), part.addressList("Reply-To")
+	// Sender and Reply-To default to From
+	if sender == "NIL" {
+		sender = from
+	}
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		nilOrQuote(part.header.Get("Date")), nilOrQuote(part.header.Get("Subject")),
+		from, sender, replyTo, part.addressList("To"), part.addressList("Cc"), part.addressList("Bcc"),
+		nilOrQuote(part.header.Get("In-Reply-To")), nilOrQuote(part.header.Get("Message-Id")))
+}
@@ -0,0 +1,326 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxLineLength       = 8192               // Maximum length of a command line excluding literals
+	MaxLiteralSize      = 64 * 1024          // Maximum size of a literal sent by client
+	MaxLoginLiteralSize = 1024               // Maximum size of a literal sent by client before logging in, enough for user name and password.
+	MaxCommandSize      = 4 * MaxLiteralSize // Maximum size of a complete command including all of its lines and literals
+)
+
+var (
+	ErrLineTooLong     = errors.New("command line is too long")
+	ErrCommandTooLarge = errors.New("command is too large")
+)
+
+const (
+	tokenAtom   = iota // Atom, number, NIL, or an atom with a bracketed section such as BODY[HEADER.FIELDS (FROM)]<0.10>.
+	tokenString        // Quoted string or literal
+	tokenList          // Parenthesised list
+)
+
+// A token of an IMAP command.
+type token struct {
+	kind  int
+	value string
+	list  []token
+}
+
+// Return the token value in upper case.
+func (tok token) upper() string {
+	return strings.ToUpper(tok.value)
+}
+
+// Return true if the token is an atom or string, i.e. it carries a text value.
+func (tok token) isText() bool {
+	return tok.kind == tokenAtom || tok.kind == tokenString
+}
+
+// Read a line ending with CRLF or LF, and return it without the line ending.
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > MaxLineLength {
+			return "", ErrLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// Return the size of literal announced at the end of line, or -1 if there is none. Non-synchronising literals are marked by the plus sign.
+func literalAtLineEnd(line string) (size int, nonSync bool) {
+	if !strings.HasSuffix(line, "}") {
+		return -1, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open == -1 {
+		return -1, false
+	}
+	spec := line[open+1 : len(line)-1]
+	if strings.HasSuffix(spec, "+") {
+		nonSync = true
+		spec = spec[:len(spec)-1]
+	}
+	size, err := strconv.Atoi(spec)
+	if err != nil || size < 0 {
+		return -1, false
+	}
+	return size, nonSync
+}
+
+/*
+Read a complete command from client, literals included. Client is told to continue before each synchronising literal.
+The returned command keeps literals inline in the form of "{size}\r\n" followed by the literal bytes. Each literal may
+not exceed the maximum size, and the command as a whole may not exceed MaxCommandSize.
+*/
+func readCommand(reader *bufio.Reader, writer io.Writer, maxLiteralSize int) (string, error) {
+	var cmd bytes.Buffer
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return "", err
+		}
+		cmd.WriteString(line)
+		size, nonSync := literalAtLineEnd(line)
+		if size == -1 {
+			return cmd.String(), nil
+		}
+		if size > maxLiteralSize {
+			return "", fmt.Errorf("literal of %d bytes is too large", size)
+		}
+		if cmd.Len()+size > MaxCommandSize {
+			return "", ErrCommandTooLarge
+		}
+		if !nonSync {
+			if _, err := writer.Write([]byte("+ Ready for literal data\r\n")); err != nil {
+				return "", err
+			}
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(reader, literal); err != nil {
+			return "", err
+		}
+		cmd.WriteString("\r\n")
+		cmd.Write(literal)
+	}
+}
+
+// Split a command into tokens.
+type tokenizer struct {
+	input string
+	pos   int
+}
+
+// Parse tokens until the end of input or a closing parenthesis.
+func (tkz *tokenizer) parse(nested bool) ([]token, error) {
+	var ret []token
+	for {
+		for tkz.pos < len(tkz.input) && tkz.input[tkz.pos] == ' ' {
+			tkz.pos++
+		}
+		if tkz.pos >= len(tkz.input) {
+			if nested {
+				return nil, errors.New("missing closing parenthesis")
+			}
+			return ret, nil
+		}
+		switch tkz.input[tkz.pos] {
+		case ')':
+			if !nested {
+				return nil, errors.New("unexpected closing parenthesis")
+			}
+			tkz.pos++
+			return ret, nil
+		case '(':
+			tkz.pos++
+			list, err := tkz.parse(true)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, token{kind: tokenList, list: list})
+		case '"':
+			str, err := tkz.quoted()
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, token{kind: tokenString, value: str})
+		case '{':
+			str, err := tkz.literal()
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, token{kind: tokenString, value: str})
+		default:
+			ret = append(ret, token{kind: tokenAtom, value: tkz.atom()})
+		}
+	}
+}
+
+// Parse a quoted string.
+func (tkz *tokenizer) quoted() (string, error) {
+	var buf bytes.Buffer
+	for tkz.pos++; tkz.pos < len(tkz.input); tkz.pos++ {
+		switch c := tkz.input[tkz.pos]; c {
+		case '\\':
+			tkz.pos++
+			if tkz.pos >= len(tkz.input) {
+				return "", errors.New("unterminated quoted string")
+			}
+			buf.WriteByte(tkz.input[tkz.pos])
+		case '"':
+			tkz.pos++
+			return buf.String(), nil
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted string")
+}
+
+// Parse a literal that has been read inline by readCommand.
+func (tkz *tokenizer) literal() (string, error) {
+	end := strings.Index(tkz.input[tkz.pos:], "}\r\n")
+	if end == -1 {
+		return "", errors.New("malformed literal")
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(tkz.input[tkz.pos+1:tkz.pos+end], "+"))
+	start := tkz.pos + end + 3
+	if err != nil || size < 0 || start+size > len(tkz.input) {
+		return "", errors.New("malformed literal")
+	}
+	tkz.pos = start + size
+	return tkz.input[start:tkz.pos], nil
+}
+
+// Parse an atom. A bracketed section is part of the atom even if it contains spaces and parentheses.
+func (tkz *tokenizer) atom() string {
+	start := tkz.pos
+	depth := 0
+	for ; tkz.pos < len(tkz.input); tkz.pos++ {
+		switch tkz.input[tkz.pos] {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case ' ', '(', ')':
+			if depth == 0 {
+				return tkz.input[start:tkz.pos]
+			}
+		}
+	}
+	return tkz.input[start:]
+}
+
+// Split a command into its tag, command name in upper case, and argument tokens.
+func parseCommand(cmd string) (tag, name string, args []token, err error) {
+	space := strings.IndexByte(cmd, ' ')
+	if space < 1 {
+		return "", "", nil, errors.New("missing command name")
+	}
+	tag = cmd[:space]
+	if strings.ContainsAny(tag, "(){%*\"\\+") {
+		return "", "", nil, errors.New("malformed tag")
+	}
+	tkz := &tokenizer{input: cmd, pos: space + 1}
+	tokens, err := tkz.parse(false)
+	if err != nil {
+		return tag, "", nil, err
+	}
+	if len(tokens) == 0 || tokens[0].kind != tokenAtom {
+		return tag, "", nil, errors.New("missing command name")
+	}
+	return tag, tokens[0].upper(), tokens[1:], nil
+}
+
+// A range of message sequence numbers or UIDs, both ends are inclusive.
+type seqRange struct {
+	low, high uint32
+}
+
+// A set of message sequence numbers or UIDs.
+type seqSet []seqRange
+
+/*
+Parse a sequence set such as "1:3,5,7:*". The asterisk stands for the largest number in use, which is the number of
+messages for sequence numbers or the largest UID for UIDs.
+*/
+func parseSeqSet(str string, largest uint32) (seqSet, error) {
+	if str == "" {
+		return nil, errors.New("empty sequence set")
+	}
+	parseNum := func(num string) (uint32, error) {
+		if num == "*" {
+			return largest, nil
+		}
+		n, err := strconv.ParseUint(num, 10, 32)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("malformed sequence number \"%s\"", num)
+		}
+		return uint32(n), nil
+	}
+	var ret seqSet
+	for _, part := range strings.Split(str, ",") {
+		ends := strings.SplitN(part, ":", 2)
+		low, err := parseNum(ends[0])
+		if err != nil {
+			return nil, err
+		}
+		high := low
+		if len(ends) == 2 {
+			if high, err = parseNum(ends[1]); err != nil {
+				return nil, err
+			}
+		}
+		if low > high {
+			low, high = high, low
+		}
+		ret = append(ret, seqRange{low: low, high: high})
+	}
+	return ret, nil
+}
+
+// Return true if the number is in the set.
+func (set seqSet) contains(num uint32) bool {
+	for _, r := range set {
+		if num >= r.low && num <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a string quoted for IMAP response, or a literal if the string cannot be quoted.
+func quote(str string) string {
+	for i := 0; i < len(str); i++ {
+		if c := str[i]; c == '\r' || c == '\n' || c >= 0x80 {
+			return fmt.Sprintf("{%d}\r\n%s", len(str), str)
+		}
+	}
+	return `"` + strings.Replace(strings.Replace(str, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// Return a quoted string, or NIL if the string is empty.
+func nilOrQuote(str string) string {
+	if str == "" {
+		return "NIL"
+	}
+	return quote(str)
+}
@@ -0,0 +1,102 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	var written bytes.Buffer
+	reader := bufio.NewReader(strings.NewReader("a1 LOGIN {4}\r\nuser {9+}\r\npass word\r\na2 NOOP\r\n"))
+	cmd, err := readCommand(reader, &written, MaxLoginLiteralSize)
+	if err != nil || cmd != "a1 LOGIN {4}\r\nuser {9+}\r\npass word" {
+		t.Fatalf("%q %v", cmd, err)
+	}
+	// Only the synchronising literal asks client to continue
+	if written.String() != "+ Ready for literal data\r\n" {
+		t.Fatalf("%q", written.String())
+	}
+	if cmd, err := readCommand(reader, &written, MaxLoginLiteralSize); err != nil || cmd != "a2 NOOP" {
+		t.Fatal(cmd, err)
+	}
+	if _, err := readCommand(bufio.NewReader(strings.NewReader("a1 LOGIN {999999}\r\n")), &written, MaxLiteralSize); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := readCommand(bufio.NewReader(strings.NewReader(strings.Repeat("a", MaxLineLength+1)+"\r\n")), &written, MaxLiteralSize); err != ErrLineTooLong {
+		t.Fatal(err)
+	}
+	// Literal that is acceptable after logging in is too large for logging in
+	if _, err := readCommand(bufio.NewReader(strings.NewReader("a1 LOGIN {2000}\r\n")), &written, MaxLoginLiteralSize); err == nil || !strings.Contains(err.Error(), "literal") {
+		t.Fatal(err)
+	}
+	// Many literals add up to a command that is too large
+	manyLiterals := strings.Repeat("a1 SEARCH {"+strconv.Itoa(MaxLiteralSize)+"+}\r\n"+strings.Repeat("a", MaxLiteralSize), 5) + "\r\n"
+	if _, err := readCommand(bufio.NewReader(strings.NewReader(manyLiterals)), &written, MaxLiteralSize); err != ErrCommandTooLarge {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tag, name, args, err := parseCommand(`a1 login "us\"er" {4}` + "\r\npass")
+	if err != nil || tag != "a1" || name != "LOGIN" || len(args) != 2 || args[0].value != `us"er` || args[1].value != "pass" ||
+		args[0].kind != tokenString || args[1].kind != tokenString {
+		t.Fatal(tag, name, args, err)
+	}
+	tag, name, args, err = parseCommand(`a2 UID FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>)`)
+	if err != nil || tag != "a2" || name != "UID" || len(args) != 3 {
+		t.Fatal(tag, name, args, err)
+	}
+	expected := []token{
+		{kind: tokenAtom, value: "FETCH"},
+		{kind: tokenAtom, value: "1:*"},
+		{kind: tokenList, list: []token{
+			{kind: tokenAtom, value: "FLAGS"},
+			{kind: tokenAtom, value: "BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>"},
+		}},
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("%+v", args)
+	}
+	for _, bad := range []string{"", "a1", "a1 (", "a1 )", `a1 "unterminated`, "a1 {5}\r\nab", "a(1 NOOP"} {
+		if _, _, _, err := parseCommand(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestParseSeqSet(t *testing.T) {
+	set, err := parseSeqSet("1:3,5,9:*,20:18", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num, expected := range map[uint32]bool{1: true, 3: true, 4: false, 5: true, 8: false, 9: true, 10: true, 11: false, 19: true} {
+		if set.contains(num) != expected {
+			t.Fatal(num)
+		}
+	}
+	// Asterisk refers to the largest number even if the other end is larger
+	if set, err := parseSeqSet("15:*", 10); err != nil || !set.contains(12) || set.contains(9) {
+		t.Fatal(set, err)
+	}
+	for _, bad := range []string{"", "0", "a", "1:b", "1,,2"} {
+		if _, err := parseSeqSet(bad, 10); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if s := quote(`a "b" \c`); s != `"a \"b\" \\c"` {
+		t.Fatal(s)
+	}
+	if s := quote("line\r\n"); s != "{6}\r\nline\r\n" {
+		t.Fatalf("%q", s)
+	}
+	if s := nilOrQuote(""); s != "NIL" {
+		t.Fatal(s)
+	}
+}
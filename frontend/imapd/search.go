@@ -0,0 +1,294 @@
+package imapd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A message examined by search criteria. Its content is read upon first use.
+type searchTarget struct {
+	sess     *session
+	seq      uint32
+	msg      *message
+	whole    []byte
+	root     *mimePart
+	readDone bool
+}
+
+// Return message content and its parsed form, or nil if the message cannot be read.
+func (target *searchTarget) content() ([]byte, *mimePart) {
+	if !target.readDone {
+		target.readDone = true
+		var err error
+		if target.whole, err = target.sess.mbox.read(target.msg); err == nil {
+			target.root = parseMIMEPart(target.whole)
+		}
+	}
+	return target.whole, target.root
+}
+
+// A search key tells whether a message satisfies the search criteria.
+type searchKey func(target *searchTarget) bool
+
+// Return a search key that matches messages that have (or do not have, if negate is true) the flag.
+func flagKey(flag string, negate bool) searchKey {
+	return func(target *searchTarget) bool {
+		return target.msg.hasFlag(flag) != negate
+	}
+}
+
+// Return a search key that matches messages that have the text in the header field, case-insensitively.
+func headerKey(field, text string) searchKey {
+	text = strings.ToLower(text)
+	return func(target *searchTarget) bool {
+		_, root := target.content()
+		if root == nil {
+			return false
+		}
+		values, exists := root.header[mimeHeaderKey(field)]
+		// An empty text matches all messages that have the field
+		if exists && text == "" {
+			return true
+		}
+		for _, value := range values {
+			if strings.Contains(strings.ToLower(value), text) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Return the canonical form of header field name.
+func mimeHeaderKey(field string) string {
+	parts := strings.Split(strings.ToLower(field), "-")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// Return a search key that compares a date of the message with the date (day granularity).
+func dateKey(date time.Time, op string, sentDate bool) searchKey {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	return func(target *searchTarget) bool {
+		msgDate := target.msg.modTime
+		if sentDate {
+			_, root := target.content()
+			if root == nil {
+				return false
+			}
+			var err error
+			if msgDate, err = mail.Header(root.header).Date(); err != nil {
+				return false
+			}
+		}
+		msgDay := time.Date(msgDate.Year(), msgDate.Month(), msgDate.Day(), 0, 0, 0, 0, time.UTC)
+		switch op {
+		case "BEFORE":
+			return msgDay.Before(day)
+		case "ON":
+			return msgDay.Equal(day)
+		default:
+			return !msgDay.Before(day)
+		}
+	}
+}
+
+// Take the next text argument of a search key.
+func nextText(args []token, key string) (string, []token, error) {
+	if len(args) == 0 || !args[0].isText() {
+		return "", nil, fmt.Errorf("search key %s expects an argument", key)
+	}
+	return args[0].value, args[1:], nil
+}
+
+// Parse one search key and return the remaining arguments.
+func (sess *session) parseSearchKey(args []token, uid bool) (searchKey, []token, error) {
+	if len(args) == 0 {
+		return nil, nil, errors.New("missing search key")
+	}
+	arg := args[0]
+	args = args[1:]
+	if arg.kind == tokenList {
+		keys, err := sess.parseSearchKeys(arg.list, uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		return allOf(keys), args, nil
+	}
+	if arg.kind != tokenAtom {
+		return nil, nil, fmt.Errorf("unexpected search key \"%s\"", arg.value)
+	}
+	name := arg.upper()
+	switch name {
+	case "ALL":
+		return func(*searchTarget) bool { return true }, args, nil
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "RECENT", "SEEN":
+		return flagKey(`\`+name, false), args, nil
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		return flagKey(`\`+name[2:], true), args, nil
+	case "OLD":
+		return flagKey(`\Recent`, true), args, nil
+	case "NEW":
+		return allOf([]searchKey{flagKey(`\Recent`, false), flagKey(`\Seen`, true)}), args, nil
+	case "KEYWORD", "UNKEYWORD":
+		// Keywords cannot be stored, hence no message has any keyword.
+		_, args, err := nextText(args, name)
+		return func(*searchTarget) bool { return name == "UNKEYWORD" }, args, err
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		text, args, err := nextText(args, name)
+		return headerKey(name, text), args, err
+	case "HEADER":
+		field, args, err := nextText(args, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		text, args, err := nextText(args, name)
+		return headerKey(field, text), args, err
+	case "BODY", "TEXT":
+		text, args, err := nextText(args, name)
+		lowerText := []byte(strings.ToLower(text))
+		return func(target *searchTarget) bool {
+			whole, root := target.content()
+			if root == nil {
+				return false
+			}
+			haystack := root.body
+			if name == "TEXT" {
+				haystack = whole
+			}
+			return bytes.Contains(bytes.ToLower(haystack), lowerText)
+		}, args, err
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		text, args, err := nextText(args, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		date, err := time.Parse(SearchDate, text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed date \"%s\"", text)
+		}
+		return dateKey(date, strings.TrimPrefix(name, "SENT"), strings.HasPrefix(name, "SENT")), args, nil
+	case "LARGER", "SMALLER":
+		text, args, err := nextText(args, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		size, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed size \"%s\"", text)
+		}
+		return func(target *searchTarget) bool {
+			whole, _ := target.content()
+			if whole == nil {
+				return false
+			}
+			if name == "LARGER" {
+				return len(whole) > size
+			}
+			return len(whole) < size
+		}, args, nil
+	case "NOT":
+		key, args, err := sess.parseSearchKey(args, uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(target *searchTarget) bool { return !key(target) }, args, nil
+	case "OR":
+		key1, args, err := sess.parseSearchKey(args, uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		key2, args, err := sess.parseSearchKey(args, uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(target *searchTarget) bool { return key1(target) || key2(target) }, args, nil
+	case "UID":
+		text, args, err := nextText(args, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		var largest uint32
+		if len(sess.mbox.messages) > 0 {
+			largest = sess.mbox.messages[len(sess.mbox.messages)-1].uid
+		}
+		set, err := parseSeqSet(text, largest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(target *searchTarget) bool { return set.contains(target.msg.uid) }, args, nil
+	}
+	// A sequence set selects messages by sequence numbers
+	if set, err := parseSeqSet(arg.value, uint32(len(sess.mbox.messages))); err == nil {
+		return func(target *searchTarget) bool { return set.contains(target.seq) }, args, nil
+	}
+	return nil, nil, fmt.Errorf("unknown search key %s", arg.value)
+}
+
+// Parse all search keys among the arguments.
+func (sess *session) parseSearchKeys(args []token, uid bool) ([]searchKey, error) {
+	var keys []searchKey
+	for len(args) > 0 {
+		key, rest, err := sess.parseSearchKey(args, uid)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		args = rest
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("missing search key")
+	}
+	return keys, nil
+}
+
+// Return a search key that matches messages that satisfy all of the keys.
+func allOf(keys []searchKey) searchKey {
+	return func(target *searchTarget) bool {
+		for _, key := range keys {
+			if !key(target) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (sess *session) search(args []token, uid bool) (string, string) {
+	if len(args) >= 2 && args[0].kind == tokenAtom && args[0].upper() == "CHARSET" {
+		if charset := strings.ToUpper(args[1].value); charset != "UTF-8" && charset != "US-ASCII" {
+			return "NO", "[BADCHARSET (UTF-8 US-ASCII)] charset is not supported"
+		}
+		args = args[2:]
+	}
+	keys, err := sess.parseSearchKeys(args, uid)
+	if err != nil {
+		return "BAD", err.Error()
+	}
+	matchAll := allOf(keys)
+	results := make([]string, 0, len(sess.mbox.messages))
+	for i, msg := range sess.mbox.messages {
+		if matchAll(&searchTarget{sess: sess, seq: uint32(i + 1), msg: msg}) {
+			if uid {
+				results = append(results, strconv.FormatUint(uint64(msg.uid), 10))
+			} else {
+				results = append(results, strconv.Itoa(i+1))
+			}
+		}
+	}
+	if len(results) == 0 {
+		sess.writeLine("* SEARCH")
+	} else {
+		sess.writeLine("* SEARCH %s", strings.Join(results, " "))
+	}
+	return "OK", "SEARCH completed"
+}
@@ -0,0 +1,592 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	stateNotAuthenticated = iota
+	stateAuthenticated
+	stateSelected
+	stateLogout
+)
+
+const (
+	Capabilities   = "IMAP4rev1 IDLE UNSELECT"                            // Capabilities advertised to client
+	SystemFlags    = `\Answered \Flagged \Deleted \Seen \Draft`           // Flags that may be stored in messages
+	InboxName      = "INBOX"                                              // Name of the only mailbox of each user
+	HierarchyDelim = "/"                                                  // Hierarchy delimiter of mailbox names
+	InternalDate   = "02-Jan-2006 15:04:05 -0700"                         // Format of message internal date
+	SearchDate     = "2-Jan-2006"                                         // Format of dates in search criteria
+	ReadOnlyText   = "[READ-ONLY] mailbox is selected via EXAMINE"        // Response to modifications made in read-only mailbox
+	NoMailboxText  = "[NONEXISTENT] there is no mailbox other than INBOX" // Response to references of other mailboxes
+)
+
+// A command handler returns the status word and text of tagged response.
+type commandHandler func(sess *session, args []token, uid bool) (status, text string)
+
+// Commands and the lowest session state they may be used in.
+var commands = map[string]struct {
+	minState int
+	handle   commandHandler
+}{
+	"CAPABILITY":   {stateNotAuthenticated, (*session).capability},
+	"NOOP":         {stateNotAuthenticated, (*session).noop},
+	"LOGOUT":       {stateNotAuthenticated, (*session).logout},
+	"LOGIN":        {stateNotAuthenticated, (*session).login},
+	"AUTHENTICATE": {stateNotAuthenticated, unsupported("authentication mechanism is not supported, use LOGIN instead")},
+	"STARTTLS":     {stateNotAuthenticated, unsupported("connection is already protected by TLS")},
+	"SELECT":       {stateAuthenticated, (*session).selectMailbox},
+	"EXAMINE":      {stateAuthenticated, (*session).selectMailbox},
+	"LIST":         {stateAuthenticated, (*session).list},
+	"LSUB":         {stateAuthenticated, (*session).list},
+	"STATUS":       {stateAuthenticated, (*session).status},
+	"SUBSCRIBE":    {stateAuthenticated, (*session).subscribe},
+	"UNSUBSCRIBE":  {stateAuthenticated, (*session).subscribe},
+	"CREATE":       {stateAuthenticated, refused("mailboxes cannot be created")},
+	"DELETE":       {stateAuthenticated, refused("mailboxes cannot be deleted")},
+	"RENAME":       {stateAuthenticated, refused("mailboxes cannot be renamed")},
+	"APPEND":       {stateAuthenticated, refused("mails cannot be appended")},
+	"IDLE":         {stateAuthenticated, (*session).idle},
+	"CHECK":        {stateSelected, (*session).noop},
+	"CLOSE":        {stateSelected, (*session).closeMailbox},
+	"UNSELECT":     {stateSelected, (*session).closeMailbox},
+	"EXPUNGE":      {stateSelected, (*session).expungeMailbox},
+	"SEARCH":       {stateSelected, (*session).search},
+	"FETCH":        {stateSelected, (*session).fetch},
+	"STORE":        {stateSelected, (*session).store},
+	"COPY":         {stateSelected, refused("mails cannot be copied")},
+}
+
+// Return a handler that tells client the command is not supported.
+func unsupported(text string) commandHandler {
+	return func(*session, []token, bool) (string, string) {
+		return "BAD", text
+	}
+}
+
+// Return a handler that refuses the command.
+func refused(text string) commandHandler {
+	return func(*session, []token, bool) (string, string) {
+		return "NO", text
+	}
+}
+
+// An IMAP conversation with a client.
+type session struct {
+	daemon   *IMAPD
+	conn     net.Conn
+	clientIP string
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	state    int
+	userName string
+	maildir  string
+	command  string   // Name of the command being run
+	mbox     *mailbox // The selected mailbox
+	readOnly bool     // Mailbox is selected via EXAMINE
+}
+
+func newSession(daemon *IMAPD, conn net.Conn, clientIP string) *session {
+	return &session{
+		daemon:   daemon,
+		conn:     conn,
+		clientIP: clientIP,
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+		state:    stateNotAuthenticated,
+	}
+}
+
+// Write a response line, it is sent to client when the session flushes.
+func (sess *session) writeLine(format string, a ...interface{}) {
+	fmt.Fprintf(sess.writer, format, a...)
+	sess.writer.WriteString("\r\n")
+}
+
+// Send buffered responses to client.
+func (sess *session) flush() error {
+	sess.conn.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	return sess.writer.Flush()
+}
+
+// Converse with client until it logs out or disconnects.
+func (sess *session) converse() {
+	sess.writeLine("* OK [CAPABILITY %s] laitos IMAP server is ready", Capabilities)
+	if err := sess.flush(); err != nil {
+		return
+	}
+	for sess.state != stateLogout {
+		sess.conn.SetReadDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+		// Before logging in, client has no business sending large literals.
+		maxLiteralSize := MaxLiteralSize
+		if sess.state == stateNotAuthenticated {
+			maxLiteralSize = MaxLoginLiteralSize
+		}
+		cmd, err := readCommand(sess.reader, sess.conn, maxLiteralSize)
+		if err != nil {
+			if err == ErrLineTooLong || err == ErrCommandTooLarge || strings.Contains(err.Error(), "literal") {
+				sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to read command")
+				sess.writeLine("* BYE %v", err)
+				sess.flush()
+			}
+			return
+		}
+		tag, name, args, err := parseCommand(cmd)
+		if err != nil {
+			if tag == "" {
+				tag = "*"
+			}
+			sess.writeLine("%s BAD %v", tag, err)
+		} else {
+			status, text := sess.dispatch(name, args, false)
+			sess.writeLine("%s %s %s", tag, status, text)
+		}
+		if err := sess.flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Run the command if it may be used in the current session state.
+func (sess *session) dispatch(name string, args []token, uid bool) (status, text string) {
+	// UID prefix makes FETCH, SEARCH, and STORE refer to messages by UIDs
+	if name == "UID" && !uid {
+		if sess.state != stateSelected {
+			return "BAD", "no mailbox is selected"
+		}
+		if len(args) == 0 || args[0].kind != tokenAtom {
+			return "BAD", "UID expects a command"
+		}
+		switch name = args[0].upper(); name {
+		case "FETCH", "SEARCH", "STORE", "COPY":
+			return sess.dispatch(name, args[1:], true)
+		default:
+			return "BAD", fmt.Sprintf("UID %s is not supported", name)
+		}
+	}
+	command, exists := commands[name]
+	if !exists {
+		return "BAD", fmt.Sprintf("unknown command %s", name)
+	}
+	if sess.state < command.minState {
+		if command.minState == stateSelected {
+			return "BAD", "no mailbox is selected"
+		}
+		return "BAD", "please log in first"
+	}
+	sess.command = name
+	return command.handle(sess, args, uid)
+}
+
+func (sess *session) capability(args []token, uid bool) (string, string) {
+	sess.writeLine("* CAPABILITY %s", Capabilities)
+	return "OK", "CAPABILITY completed"
+}
+
+func (sess *session) noop(args []token, uid bool) (string, string) {
+	if sess.state == stateSelected {
+		if err := sess.refresh(); err != nil {
+			sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to refresh mailbox of user \"%s\"", sess.userName)
+		}
+	}
+	return "OK", "completed"
+}
+
+func (sess *session) logout(args []token, uid bool) (string, string) {
+	sess.writeLine("* BYE logging out")
+	sess.state = stateLogout
+	return "OK", "LOGOUT completed"
+}
+
+func (sess *session) login(args []token, uid bool) (string, string) {
+	if sess.state != stateNotAuthenticated {
+		return "BAD", "already logged in"
+	}
+	if len(args) != 2 || !args[0].isText() || !args[1].isText() {
+		return "BAD", "LOGIN expects user name and password"
+	}
+	if !sess.daemon.RateLimit.Add(sess.clientIP, true) {
+		return "NO", "try again later rate limit exceeded"
+	}
+	maildir, ok := sess.daemon.authenticate(args[0].value, args[1].value)
+	if !ok {
+		sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, nil, "failed to authenticate user \"%s\"", args[0].value)
+		return "NO", "[AUTHENTICATIONFAILED] invalid user name or password"
+	}
+	sess.userName = args[0].value
+	sess.maildir = maildir
+	sess.state = stateAuthenticated
+	sess.daemon.Logger.Printf("HandleConnection", sess.clientIP, nil, "user \"%s\" has logged in", sess.userName)
+	return "OK", fmt.Sprintf("[CAPABILITY %s] logged in", Capabilities)
+}
+
+// Return the number of recent messages and the sequence number of the first unseen message (0 if there is none).
+func (mbox *mailbox) countRecentUnseen() (recent, firstUnseen, unseen int) {
+	for i, msg := range mbox.messages {
+		if msg.recent {
+			recent++
+		}
+		if !msg.hasFlag(`\Seen`) {
+			unseen++
+			if firstUnseen == 0 {
+				firstUnseen = i + 1
+			}
+		}
+	}
+	return
+}
+
+func (sess *session) selectMailbox(args []token, uid bool) (string, string) {
+	if len(args) != 1 || !args[0].isText() {
+		return "BAD", "expecting a mailbox name"
+	}
+	// Selecting a mailbox deselects the current one even if the new selection fails
+	sess.mbox = nil
+	sess.state = stateAuthenticated
+	if !strings.EqualFold(args[0].value, InboxName) {
+		return "NO", NoMailboxText
+	}
+	readOnly := sess.command == "EXAMINE"
+	mbox, err := loadMailbox(sess.maildir, !readOnly)
+	if err != nil {
+		sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to load mailbox of user \"%s\"", sess.userName)
+		return "NO", "failed to read mailbox"
+	}
+	sess.mbox = mbox
+	sess.readOnly = readOnly
+	sess.state = stateSelected
+	recent, firstUnseen, _ := mbox.countRecentUnseen()
+	sess.writeLine("* FLAGS (%s)", SystemFlags)
+	if readOnly {
+		sess.writeLine("* OK [PERMANENTFLAGS ()] no permanent flags in read-only mailbox")
+	} else {
+		sess.writeLine("* OK [PERMANENTFLAGS (%s)] flags are permanent", SystemFlags)
+	}
+	sess.writeLine("* %d EXISTS", len(mbox.messages))
+	sess.writeLine("* %d RECENT", recent)
+	if firstUnseen > 0 {
+		sess.writeLine("* OK [UNSEEN %d] first unseen message", firstUnseen)
+	}
+	sess.writeLine("* OK [UIDVALIDITY %d] UIDs are valid", mbox.uidValidity)
+	sess.writeLine("* OK [UIDNEXT %d] predicted next UID", mbox.uidNext)
+	if readOnly {
+		return "OK", "[READ-ONLY] EXAMINE completed"
+	}
+	return "OK", "[READ-WRITE] SELECT completed"
+}
+
+// Convert a mailbox name pattern with wildcards into regular expression. Asterisk matches anything, percent sign does not match hierarchy delimiter.
+func patternToRegexp(pattern string) *regexp.Regexp {
+	var expr bytes.Buffer
+	expr.WriteString("(?i)^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			expr.WriteString(".*")
+		case '%':
+			expr.WriteString("[^" + regexp.QuoteMeta(HierarchyDelim) + "]*")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+func (sess *session) list(args []token, uid bool) (string, string) {
+	name := sess.command
+	if len(args) != 2 || !args[0].isText() || !args[1].isText() {
+		return "BAD", fmt.Sprintf("%s expects reference and mailbox name", name)
+	}
+	if args[1].value == "" {
+		// Client asks for hierarchy delimiter
+		sess.writeLine(`* %s (\Noselect) %s ""`, name, quote(HierarchyDelim))
+	} else if patternToRegexp(args[0].value + args[1].value).MatchString(InboxName) {
+		sess.writeLine(`* %s (\HasNoChildren) %s %s`, name, quote(HierarchyDelim), InboxName)
+	}
+	return "OK", fmt.Sprintf("%s completed", name)
+}
+
+func (sess *session) status(args []token, uid bool) (string, string) {
+	if len(args) != 2 || !args[0].isText() || args[1].kind != tokenList {
+		return "BAD", "STATUS expects mailbox name and a list of status items"
+	}
+	if !strings.EqualFold(args[0].value, InboxName) {
+		return "NO", NoMailboxText
+	}
+	mbox, err := loadMailbox(sess.maildir, false)
+	if err != nil {
+		sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to load mailbox of user \"%s\"", sess.userName)
+		return "NO", "failed to read mailbox"
+	}
+	recent, _, unseen := mbox.countRecentUnseen()
+	items := make([]string, 0, len(args[1].list))
+	for _, item := range args[1].list {
+		var value uint32
+		switch item.upper() {
+		case "MESSAGES":
+			value = uint32(len(mbox.messages))
+		case "RECENT":
+			value = uint32(recent)
+		case "UIDNEXT":
+			value = mbox.uidNext
+		case "UIDVALIDITY":
+			value = mbox.uidValidity
+		case "UNSEEN":
+			value = uint32(unseen)
+		default:
+			return "BAD", fmt.Sprintf("unknown status item %s", item.value)
+		}
+		items = append(items, fmt.Sprintf("%s %d", item.upper(), value))
+	}
+	sess.writeLine("* STATUS %s (%s)", InboxName, strings.Join(items, " "))
+	return "OK", "STATUS completed"
+}
+
+func (sess *session) subscribe(args []token, uid bool) (string, string) {
+	if len(args) != 1 || !args[0].isText() {
+		return "BAD", "expecting a mailbox name"
+	}
+	if !strings.EqualFold(args[0].value, InboxName) {
+		return "NO", NoMailboxText
+	}
+	// INBOX is always subscribed
+	return "OK", "completed"
+}
+
+func (sess *session) closeMailbox(args []token, uid bool) (string, string) {
+	// CLOSE silently expunges deleted messages, UNSELECT does not.
+	if !sess.readOnly && sess.command == "CLOSE" {
+		sess.expunge(false)
+	}
+	sess.mbox = nil
+	sess.state = stateAuthenticated
+	return "OK", "mailbox is closed"
+}
+
+func (sess *session) expungeMailbox(args []token, uid bool) (string, string) {
+	if sess.readOnly {
+		return "NO", ReadOnlyText
+	}
+	if !sess.expunge(true) {
+		return "NO", "failed to remove some of the deleted messages"
+	}
+	return "OK", "EXPUNGE completed"
+}
+
+// Permanently remove messages that have \Deleted flag. Return false if any of them could not be removed.
+func (sess *session) expunge(report bool) bool {
+	allOK := true
+	for i := 0; i < len(sess.mbox.messages); {
+		msg := sess.mbox.messages[i]
+		if !msg.hasFlag(`\Deleted`) {
+			i++
+			continue
+		}
+		if err := sess.mbox.remove(msg); err != nil {
+			sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to remove message of user \"%s\"", sess.userName)
+			allOK = false
+			i++
+			continue
+		}
+		// Sequence numbers of the following messages decrease right away
+		if report {
+			sess.writeLine("* %d EXPUNGE", i+1)
+		}
+		sess.mbox.messages = append(sess.mbox.messages[:i], sess.mbox.messages[i+1:]...)
+	}
+	return allOK
+}
+
+/*
+Reload the selected mailbox and tell client about the changes made by other sessions and newly arrived mails. Expunged
+messages are reported in descending order so that sequence numbers of the remaining messages stay valid.
+*/
+func (sess *session) refresh() error {
+	latest, err := loadMailbox(sess.mbox.dirPath, !sess.readOnly)
+	if err != nil {
+		return err
+	}
+	latestByUID := make(map[uint32]*message, len(latest.messages))
+	for _, msg := range latest.messages {
+		latestByUID[msg.uid] = msg
+	}
+	for i := len(sess.mbox.messages) - 1; i >= 0; i-- {
+		if _, exists := latestByUID[sess.mbox.messages[i].uid]; !exists {
+			sess.writeLine("* %d EXPUNGE", i+1)
+			sess.mbox.messages = append(sess.mbox.messages[:i], sess.mbox.messages[i+1:]...)
+		}
+	}
+	known := make(map[uint32]struct{}, len(sess.mbox.messages))
+	for i, msg := range sess.mbox.messages {
+		known[msg.uid] = struct{}{}
+		latestMsg := latestByUID[msg.uid]
+		msg.subDir, msg.fileName = latestMsg.subDir, latestMsg.fileName
+		if msg.letters != latestMsg.letters {
+			msg.letters = latestMsg.letters
+			sess.writeLine("* %d FETCH (FLAGS (%s))", i+1, strings.Join(msg.flags(), " "))
+		}
+	}
+	var numNew int
+	for _, msg := range latest.messages {
+		if _, exists := known[msg.uid]; !exists {
+			sess.mbox.messages = append(sess.mbox.messages, msg)
+			numNew++
+		}
+	}
+	sess.mbox.uidNext = latest.uidNext
+	if numNew > 0 {
+		recent, _, _ := sess.mbox.countRecentUnseen()
+		sess.writeLine("* %d EXISTS", len(sess.mbox.messages))
+		sess.writeLine("* %d RECENT", recent)
+	}
+	return nil
+}
+
+// Wait for client to finish idling, meanwhile tell client about mailbox changes.
+func (sess *session) idle(args []token, uid bool) (string, string) {
+	sess.writeLine("+ idling")
+	if err := sess.flush(); err != nil {
+		sess.state = stateLogout
+		return "BAD", "connection is broken"
+	}
+	type lineOrError struct {
+		line string
+		err  error
+	}
+	done := make(chan lineOrError, 1)
+	go func() {
+		sess.conn.SetReadDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+		line, err := readLine(sess.reader)
+		done <- lineOrError{line, err}
+	}()
+	ticker := time.NewTicker(IdlePollIntervalSec * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if sess.state != stateSelected {
+				continue
+			}
+			if err := sess.refresh(); err != nil {
+				sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to refresh mailbox of user \"%s\"", sess.userName)
+			}
+			// Upon failure the connection is closed, and the reader will give up.
+			if err := sess.flush(); err != nil {
+				sess.conn.Close()
+			}
+		case result := <-done:
+			if result.err != nil {
+				sess.state = stateLogout
+				return "BAD", "connection is broken"
+			}
+			if !strings.EqualFold(strings.TrimSpace(result.line), "DONE") {
+				return "BAD", "expecting DONE"
+			}
+			return "OK", "IDLE terminated"
+		}
+	}
+}
+
+/*
+Select messages by sequence numbers or UIDs. Return indexes of the selected messages. Numbers that do not refer to any
+message are ignored.
+*/
+func (sess *session) selectMessages(set string, uid bool) ([]int, error) {
+	msgs := sess.mbox.messages
+	var largest uint32
+	if uid {
+		if len(msgs) > 0 {
+			largest = msgs[len(msgs)-1].uid
+		}
+	} else {
+		largest = uint32(len(msgs))
+	}
+	seqs, err := parseSeqSet(set, largest)
+	if err != nil {
+		return nil, err
+	}
+	var ret []int
+	for i, msg := range msgs {
+		num := uint32(i + 1)
+		if uid {
+			num = msg.uid
+		}
+		if seqs.contains(num) {
+			ret = append(ret, i)
+		}
+	}
+	return ret, nil
+}
+
+// Return flags in parenthesised list, or the remaining arguments if they are not in a list.
+func flagArgs(args []token) []string {
+	if len(args) == 1 && args[0].kind == tokenList {
+		args = args[0].list
+	}
+	ret := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg.isText() {
+			ret = append(ret, arg.value)
+		}
+	}
+	return ret
+}
+
+func (sess *session) store(args []token, uid bool) (string, string) {
+	if len(args) < 3 || args[0].kind != tokenAtom || args[1].kind != tokenAtom {
+		return "BAD", "STORE expects message set, data item, and flags"
+	}
+	if sess.readOnly {
+		return "NO", ReadOnlyText
+	}
+	item := args[1].upper()
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		return "BAD", fmt.Sprintf("unknown data item %s", args[1].value)
+	}
+	flags := flagArgs(args[2:])
+	indexes, err := sess.selectMessages(args[0].value, uid)
+	if err != nil {
+		return "BAD", err.Error()
+	}
+	allOK := true
+	for _, i := range indexes {
+		msg := sess.mbox.messages[i]
+		var letters string
+		switch item {
+		case "FLAGS":
+			letters = changeLetters(changeLetters(msg.letters, strings.Fields(SystemFlags), false), flags, true)
+		case "+FLAGS":
+			letters = changeLetters(msg.letters, flags, true)
+		case "-FLAGS":
+			letters = changeLetters(msg.letters, flags, false)
+		}
+		if letters != msg.letters {
+			if err := sess.mbox.setLetters(msg, letters); err != nil {
+				sess.daemon.Logger.Warningf("HandleConnection", sess.clientIP, err, "failed to store flags of user \"%s\"", sess.userName)
+				allOK = false
+				continue
+			}
+		}
+		if !silent {
+			if uid {
+				sess.writeLine("* %d FETCH (FLAGS (%s) UID %d)", i+1, strings.Join(msg.flags(), " "), msg.uid)
+			} else {
+				sess.writeLine("* %d FETCH (FLAGS (%s))", i+1, strings.Join(msg.flags(), " "))
+			}
+		}
+	}
+	if !allOK {
+		return "NO", "failed to store flags of some messages"
+	}
+	return "OK", "STORE completed"
+}
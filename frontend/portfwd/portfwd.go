@@ -0,0 +1,167 @@
+package portfwd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/sockd"
+	"github.com/HouzuoGuo/laitos/global"
+	"github.com/HouzuoGuo/laitos/ipfilter"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DialTimeoutSec = 10 // Give up connecting to forward target after this many seconds
+
+// Forward connections made to a local port toward a remote host and port.
+type Forward struct {
+	ListenAddress string   `json:"ListenAddress"` // (Optional) listen on this address, default to 0.0.0.0.
+	ListenPort    int      `json:"ListenPort"`
+	Target        string   `json:"Target"`      // Forward connections to this address in "host:port" form
+	AllowCIDRs    []string `json:"AllowCIDRs"`  // (Optional) only accept connections from these CIDR blocks or IP addresses, empty means all.
+	TLSCertPath   string   `json:"TLSCertPath"` // (Optional) terminate TLS on the listening side via this certificate
+	TLSKeyPath    string   `json:"TLSKeyPath"`  // (Optional) terminate TLS on the listening side via this key
+
+	clientFilter   *ipfilter.IPFilter
+	tlsCertificate *tls.Certificate
+	listener       net.Listener
+}
+
+// Return listen address in "host:port" form.
+func (fwd *Forward) listenAddr() string {
+	return net.JoinHostPort(fwd.ListenAddress, strconv.Itoa(fwd.ListenPort))
+}
+
+// Forward configured local ports to remote host and port pairs.
+type PortForward struct {
+	Forwards []*Forward `json:"Forwards"`
+
+	Logger global.Logger `json:"-"`
+	mutex  *sync.Mutex
+}
+
+// Check configuration and initialise internal states.
+func (pf *PortForward) Initialise() error {
+	if len(pf.Forwards) == 0 {
+		return errors.New("PortForward.Initialise: Forwards must not be empty")
+	}
+	listenAddrs := make(map[string]struct{})
+	for _, fwd := range pf.Forwards {
+		if fwd.ListenAddress == "" {
+			fwd.ListenAddress = "0.0.0.0"
+		}
+		if fwd.ListenPort < 1 {
+			return errors.New("PortForward.Initialise: listen port must be greater than 0")
+		}
+		if _, exists := listenAddrs[fwd.listenAddr()]; exists {
+			return fmt.Errorf("PortForward.Initialise: %s is forwarded more than once", fwd.listenAddr())
+		}
+		listenAddrs[fwd.listenAddr()] = struct{}{}
+		if _, _, err := net.SplitHostPort(fwd.Target); err != nil {
+			return fmt.Errorf("PortForward.Initialise: malformed target address \"%s\" of port %d - %v", fwd.Target, fwd.ListenPort, err)
+		}
+		fwd.clientFilter = &ipfilter.IPFilter{Allow: fwd.AllowCIDRs}
+		if err := fwd.clientFilter.Initialise(); err != nil {
+			return fmt.Errorf("PortForward.Initialise: %v", err)
+		}
+		fwd.tlsCertificate = nil
+		if fwd.TLSCertPath != "" || fwd.TLSKeyPath != "" {
+			if fwd.TLSCertPath == "" || fwd.TLSKeyPath == "" {
+				return errors.New("PortForward.Initialise: if TLS is to be enabled, both TLS certificate and key path must be present.")
+			}
+			cert, err := tls.LoadX509KeyPair(fwd.TLSCertPath, fwd.TLSKeyPath)
+			if err != nil {
+				return fmt.Errorf("PortForward.Initialise: failed to read TLS certificate - %v", err)
+			}
+			fwd.tlsCertificate = &cert
+		}
+	}
+	pf.mutex = new(sync.Mutex)
+	return nil
+}
+
+// Connect to the forward target and pipe data in both directions until either side closes.
+func (pf *PortForward) HandleConnection(fwd *Forward, conn net.Conn) {
+	defer conn.Close()
+	clientIP := conn.RemoteAddr().String()
+	clientIP = clientIP[:strings.LastIndexByte(clientIP, ':')]
+	if !fwd.clientFilter.IsAllowed(clientIP) {
+		pf.Logger.Warningf("HandleConnection", clientIP, nil, "client is not allowed to connect to port %d", fwd.ListenPort)
+		return
+	}
+	dest, err := net.DialTimeout("tcp", fwd.Target, DialTimeoutSec*time.Second)
+	if err != nil {
+		pf.Logger.Warningf("HandleConnection", clientIP, err, "failed to connect to target \"%s\"", fwd.Target)
+		return
+	}
+	defer dest.Close()
+	go sockd.PipeAndCloseConnection(conn, dest)
+	sockd.PipeAndCloseConnection(dest, conn)
+}
+
+// Listen on the forward's port and handle connections until the listener is closed.
+func (pf *PortForward) startAndBlockForward(fwd *Forward) error {
+	pf.Logger.Printf("StartAndBlock", fwd.listenAddr(), nil, "going to forward connections to %s", fwd.Target)
+	var listener net.Listener
+	var err error
+	if fwd.tlsCertificate == nil {
+		listener, err = net.Listen("tcp", fwd.listenAddr())
+	} else {
+		listener, err = tls.Listen("tcp", fwd.listenAddr(), &tls.Config{Certificates: []tls.Certificate{*fwd.tlsCertificate}})
+	}
+	if err != nil {
+		return fmt.Errorf("PortForward.StartAndBlock: failed to listen on %s - %v", fwd.listenAddr(), err)
+	}
+	pf.mutex.Lock()
+	fwd.listener = listener
+	pf.mutex.Unlock()
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("PortForward.StartAndBlock: failed to accept new connection on %s - %v", fwd.listenAddr(), err)
+		}
+		go pf.HandleConnection(fwd, conn)
+	}
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start listening on all forwarded ports and block until all listeners are closed or any of them fails.
+*/
+func (pf *PortForward) StartAndBlock() error {
+	errChan := make(chan error, len(pf.Forwards))
+	for _, fwd := range pf.Forwards {
+		go func(fwd *Forward) {
+			errChan <- pf.startAndBlockForward(fwd)
+		}(fwd)
+	}
+	for range pf.Forwards {
+		if err := <-errChan; err != nil {
+			pf.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Close all listeners.
+func (pf *PortForward) Stop() {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	for _, fwd := range pf.Forwards {
+		if fwd.listener != nil {
+			if err := fwd.listener.Close(); err != nil && !strings.Contains(err.Error(), "closed") {
+				pf.Logger.Warningf("Stop", fwd.listenAddr(), err, "failed to close listener")
+			}
+		}
+	}
+}
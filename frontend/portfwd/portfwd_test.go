@@ -0,0 +1,113 @@
+package portfwd
+
+import (
+	"crypto/tls"
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send a line through the connection and expect it to be echoed back.
+func expectEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello forward")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 13)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello forward" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	certPath := "/tmp/test-laitos-portfwd.crt"
+	keyPath := "/tmp/test-laitos-portfwd.key"
+	defer os.Remove(certPath)
+	defer os.Remove(keyPath)
+	testhelper.WriteTestCertificate(t, certPath, keyPath)
+	target := testhelper.StartEchoServer(t)
+
+	pf := PortForward{}
+	if err := pf.Initialise(); err == nil || !strings.Contains(err.Error(), "Forwards") {
+		t.Fatal(err)
+	}
+	pf.Forwards = []*Forward{{ListenAddress: "127.0.0.1"}}
+	if err := pf.Initialise(); err == nil || !strings.Contains(err.Error(), "listen port") {
+		t.Fatal(err)
+	}
+	pf.Forwards[0].ListenPort = 8736
+	if err := pf.Initialise(); err == nil || !strings.Contains(err.Error(), "target") {
+		t.Fatal(err)
+	}
+	pf.Forwards[0].Target = target
+	pf.Forwards[0].AllowCIDRs = []string{"bad"}
+	if err := pf.Initialise(); err == nil || !strings.Contains(err.Error(), "allow list") {
+		t.Fatal(err)
+	}
+	pf.Forwards[0].AllowCIDRs = []string{"127.0.0.0/8"}
+	pf.Forwards = append(pf.Forwards, &Forward{ListenAddress: "127.0.0.1", ListenPort: 8736, Target: target})
+	if err := pf.Initialise(); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatal(err)
+	}
+	pf.Forwards[1].ListenPort = 8737
+	pf.Forwards[1].TLSCertPath = certPath
+	if err := pf.Initialise(); err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Fatal(err)
+	}
+	pf.Forwards[1].TLSKeyPath = keyPath
+	// The third forward only accepts clients that are not on this computer
+	pf.Forwards = append(pf.Forwards, &Forward{ListenAddress: "127.0.0.1", ListenPort: 8738, Target: target, AllowCIDRs: []string{"192.0.2.0/24"}})
+	if err := pf.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- pf.StartAndBlock()
+	}()
+	time.Sleep(1 * time.Second)
+
+	// Plain forward
+	conn, err := net.Dial("tcp", "127.0.0.1:8736")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+	conn.Close()
+	// TLS is terminated by the forward, target receives plain data.
+	tlsConn, err := tls.Dial("tcp", "127.0.0.1:8737", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, tlsConn)
+	tlsConn.Close()
+	// Client outside of allowed CIDR blocks is disconnected right away
+	conn, err = net.Dial("tcp", "127.0.0.1:8738")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello forward"))
+	if n, err := conn.Read(make([]byte, 13)); err == nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	conn.Close()
+
+	pf.Stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not stop")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:8736"); err == nil {
+		t.Fatal("did not close listener")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	pf.Stop()
+}
@@ -0,0 +1,112 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrMaildirQuotaExceeded = errors.New("maildir quota is exceeded")
+
+var maildirDeliveryCounter int64 // Makes unique file names of mails delivered within the same microsecond
+
+/*
+A mailbox in Maildir format. Mails are first written into "tmp" and then moved into "new", so that mail readers never
+see a partially written mail.
+*/
+type Maildir struct {
+	Path    string `json:"Path"`    // Directory of the mailbox, its "cur", "new", and "tmp" sub-directories are created automatically.
+	QuotaMB int64  `json:"QuotaMB"` // (Optional) maximum megabytes of mails stored in the mailbox, 0 means unlimited.
+
+	mutex *sync.Mutex
+}
+
+// Create the mailbox directories if they do not yet exist.
+func (dir *Maildir) Initialise() error {
+	if dir.Path == "" {
+		return errors.New("Maildir.Initialise: path must not be empty")
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(path.Join(dir.Path, sub), 0700); err != nil {
+			return fmt.Errorf("Maildir.Initialise: failed to create directory - %v", err)
+		}
+	}
+	dir.mutex = new(sync.Mutex)
+	return nil
+}
+
+// Return the total size of mails stored in "cur" and "new" directories.
+func (dir *Maildir) Usage() (int64, error) {
+	var size int64
+	for _, sub := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(path.Join(dir.Path, sub))
+		if err != nil {
+			return 0, fmt.Errorf("Maildir.Usage: failed to read directory - %v", err)
+		}
+		for _, file := range files {
+			if file.Mode().IsRegular() {
+				size += file.Size()
+			}
+		}
+	}
+	return size, nil
+}
+
+// Return true if the mailbox has reached its quota and cannot take any more mail.
+func (dir *Maildir) IsFull() bool {
+	if dir.QuotaMB < 1 {
+		return false
+	}
+	usage, err := dir.Usage()
+	return err == nil && usage >= dir.QuotaMB*1048576
+}
+
+// Store the mail into "new" directory. Return ErrMaildirQuotaExceeded if there is not enough room left for the mail.
+func (dir *Maildir) Deliver(mailContent []byte) error {
+	dir.mutex.Lock()
+	defer dir.mutex.Unlock()
+	if dir.QuotaMB > 0 {
+		usage, err := dir.Usage()
+		if err != nil {
+			return fmt.Errorf("Maildir.Deliver: %v", err)
+		}
+		if usage+int64(len(mailContent)) > dir.QuotaMB*1048576 {
+			return ErrMaildirQuotaExceeded
+		}
+	}
+	hostName, err := os.Hostname()
+	if err != nil || hostName == "" {
+		hostName = "localhost"
+	}
+	// Slash and colon have special meanings in Maildir file names
+	hostName = strings.Replace(strings.Replace(hostName, "/", "\\057", -1), ":", "\\072", -1)
+	now := time.Now()
+	fileName := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&maildirDeliveryCounter, 1), hostName)
+	tmpPath := path.Join(dir.Path, "tmp", fileName)
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Maildir.Deliver: failed to create file - %v", err)
+	}
+	_, err = tmpFile.Write(mailContent)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Maildir.Deliver: failed to write file - %v", err)
+	}
+	if err := os.Rename(tmpPath, path.Join(dir.Path, "new", fileName)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Maildir.Deliver: failed to move file - %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMaildir(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "laitos-test-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	dir := Maildir{}
+	if err := dir.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	dir = Maildir{Path: path.Join(dirPath, "box"), QuotaMB: 1}
+	if err := dir.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if info, err := os.Stat(path.Join(dir.Path, sub)); err != nil || !info.IsDir() {
+			t.Fatal(sub, err)
+		}
+	}
+	// Deliver two mails, each goes into its own file.
+	if err := dir.Deliver([]byte("mail 1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Deliver([]byte("mail 22")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(path.Join(dir.Path, "new"))
+	if err != nil || len(files) != 2 {
+		t.Fatal(files, err)
+	}
+	if tmpFiles, err := ioutil.ReadDir(path.Join(dir.Path, "tmp")); err != nil || len(tmpFiles) != 0 {
+		t.Fatal(tmpFiles, err)
+	}
+	if usage, err := dir.Usage(); err != nil || usage != 13 {
+		t.Fatal(usage, err)
+	}
+	// Mails that have been read are still counted toward quota
+	if err := os.Rename(path.Join(dir.Path, "new", files[0].Name()), path.Join(dir.Path, "cur", files[0].Name()+":2,S")); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := dir.Usage(); err != nil || usage != 13 {
+		t.Fatal(usage, err)
+	}
+	if dir.IsFull() {
+		t.Fatal("should not be full")
+	}
+	// A mail that does not fit into quota is refused
+	if err := dir.Deliver(make([]byte, 1048576)); err != ErrMaildirQuotaExceeded {
+		t.Fatal(err)
+	}
+	if err := dir.Deliver(make([]byte, 1048576-13)); err != nil {
+		t.Fatal(err)
+	}
+	if !dir.IsFull() {
+		t.Fatal("should be full")
+	}
+	// Unlimited mailbox is never full
+	dir.QuotaMB = 0
+	if dir.IsFull() {
+		t.Fatal("should not be full")
+	}
+	if err := dir.Deliver([]byte("mail 3")); err != nil {
+		t.Fatal(err)
+	}
+}
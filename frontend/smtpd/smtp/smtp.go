@@ -495,6 +495,18 @@ func (c *Conn) Reject() {
 	c.replied = true
 }
 
+// Tempfail temporarily rejects the current SMTP command, ie gives the
+// client an appropriate 4xx message.
+func (c *Conn) Tempfail() {
+	switch c.curcmd {
+	case HELO, EHLO:
+		c.reply("421 Not available now")
+	case MAILFROM, RCPTTO, DATA:
+		c.reply("450 Not available")
+	}
+	c.replied = true
+}
+
 // Inform sender to slow down by replying a temporary failure code and then abort the sequence.
 func (c *Conn) ReplyRateExceeded() {
 	c.reply("451 Try again later rate limit exceeded")
@@ -21,15 +21,16 @@ const (
 	MaxConversationLength = 64  // Only converse up to this number of messages in an SMTP connection
 )
 
-// An SMTP daemon that receives mails addressed to its domain name, and optionally forward the received mails to other addresses.
+// An SMTP daemon that receives mails addressed to its domain name, stores them in local mailboxes, and optionally forward the received mails to other addresses.
 type SMTPD struct {
-	ListenAddress string   `json:"ListenAddress"` // Network address to listen to, e.g. 0.0.0.0 for all network interfaces.
-	ListenPort    int      `json:"ListenPort"`    // Port number to listen on
-	TLSCertPath   string   `json:"TLSCertPath"`   // (Optional) serve StartTLS via this certificate
-	TLSKeyPath    string   `json:"TLSKeyPath"`    // (Optional) serve StartTLS via this certificate (key)
-	PerIPLimit    int      `json:"PerIPLimit"`    // How many times in 10 seconds interval an IP may deliver an email to this server
-	MyDomains     []string `json:"MyDomains"`     // Only accept mails addressed to these domain names
-	ForwardTo     []string `json:"ForwardTo"`     // Forward received mails to these addresses
+	ListenAddress string              `json:"ListenAddress"` // Network address to listen to, e.g. 0.0.0.0 for all network interfaces.
+	ListenPort    int                 `json:"ListenPort"`    // Port number to listen on
+	TLSCertPath   string              `json:"TLSCertPath"`   // (Optional) serve StartTLS via this certificate
+	TLSKeyPath    string              `json:"TLSKeyPath"`    // (Optional) serve StartTLS via this certificate (key)
+	PerIPLimit    int                 `json:"PerIPLimit"`    // How many times in 10 seconds interval an IP may deliver an email to this server
+	MyDomains     []string            `json:"MyDomains"`     // Only accept mails addressed to these domain names
+	ForwardTo     []string            `json:"ForwardTo"`     // (Optional) forward received mails to these addresses
+	Maildirs      map[string]*Maildir `json:"Maildirs"`      // (Optional) store received mails in these mailboxes, keyed by recipient address or domain name.
 
 	MyDomainsHash map[string]struct{} `json:"-"` // "MyDomains" values in map keys
 	ForwardMailer email.Mailer        `json:"-"` // Use this mailer to forward arrived mails
@@ -55,8 +56,11 @@ func (smtpd *SMTPD) Initialise() error {
 	if smtpd.ListenPort < 1 {
 		return errors.New("SMTPD.Initialise: listen port must be greater than 0")
 	}
-	if smtpd.ForwardTo == nil || len(smtpd.ForwardTo) == 0 || !smtpd.ForwardMailer.IsConfigured() {
-		return errors.New("SMTPD.Initialise: the server is not useful if forward addresses/forward mailer are not configured")
+	if len(smtpd.ForwardTo) == 0 && len(smtpd.Maildirs) == 0 {
+		return errors.New("SMTPD.Initialise: the server is not useful if neither forward addresses nor maildirs are configured")
+	}
+	if len(smtpd.ForwardTo) > 0 && !smtpd.ForwardMailer.IsConfigured() {
+		return errors.New("SMTPD.Initialise: forward mailer must be configured to forward mails")
 	}
 	if smtpd.MyDomains == nil || len(smtpd.MyDomains) == 0 {
 		return errors.New("SMTPD.Initialise: my domain names must be configured")
@@ -77,13 +81,18 @@ func (smtpd *SMTPD) Initialise() error {
 		// Not a fatal error
 		smtpd.Logger.Warningf("Initialise", "", nil, "unable to determine public IP address, some SMTP conversations will be off-standard.")
 	}
+	// Without public IP, greet SMTP client using my domain name instead.
+	serverName := smtpd.MyPublicIP
+	if serverName == "" {
+		serverName = smtpd.MyDomains[0]
+	}
 	smtpd.SMTPConfig = smtp.Config{
 		Limits: &smtp.Limits{
 			MsgSize:   2 * 1024 * 1024,            // Accept mails up to 2 MB large
 			IOTimeout: IOTimeoutSec * time.Second, // IO timeout is a reasonable minute
 			BadCmds:   64,                         // Abort connection after consecutive bad commands
 		},
-		ServerName: smtpd.MyPublicIP,
+		ServerName: serverName,
 	}
 	if smtpd.TLSCertPath != "" {
 		smtpd.SMTPConfig.TLSConfig = &tls.Config{Certificates: []tls.Certificate{smtpd.TLSCertificate}}
@@ -95,7 +104,7 @@ func (smtpd *SMTPD) Initialise() error {
 	}
 	smtpd.RateLimit.Initialise()
 	// Do not allow forward to this daemon itself
-	if (strings.HasPrefix(smtpd.ForwardMailer.MTAHost, "127.") || smtpd.ForwardMailer.MTAHost == smtpd.MyPublicIP) &&
+	if len(smtpd.ForwardTo) > 0 && (strings.HasPrefix(smtpd.ForwardMailer.MTAHost, "127.") || smtpd.ForwardMailer.MTAHost == smtpd.MyPublicIP) &&
 		smtpd.ForwardMailer.MTAPort == smtpd.ListenPort {
 		return errors.New("SMTPD.Initialise: forward MTA must not be myself")
 	}
@@ -119,17 +128,69 @@ func (smtpd *SMTPD) Initialise() error {
 			return fmt.Errorf("SMTPD.Initialise: forward address \"%s\" must not loop back to this mail server's domain", fwd)
 		}
 	}
+	// Mailboxes must belong to my domains, recipients are looked up in lower case.
+	maildirs := make(map[string]*Maildir, len(smtpd.Maildirs))
+	for recipient, dir := range smtpd.Maildirs {
+		recipient = strings.ToLower(recipient)
+		if _, exists := smtpd.MyDomainsHash[recipient[strings.IndexRune(recipient, '@')+1:]]; !exists {
+			return fmt.Errorf("SMTPD.Initialise: maildir recipient \"%s\" does not belong to my domain names", recipient)
+		}
+		if dir == nil {
+			return fmt.Errorf("SMTPD.Initialise: maildir of recipient \"%s\" must not be empty", recipient)
+		}
+		if err := dir.Initialise(); err != nil {
+			return fmt.Errorf("SMTPD.Initialise: failed to initialise maildir of recipient \"%s\" - %v", recipient, err)
+		}
+		maildirs[recipient] = dir
+	}
+	smtpd.Maildirs = maildirs
 	return nil
 }
 
-// Unconditionally forward the mail to forward addresses, then process feature commands if they are found.
+// Return the mailbox of the recipient address, or nil if there is none. Mailbox of the address takes precedence over that of its domain.
+func (smtpd *SMTPD) GetMaildir(toAddr string) *Maildir {
+	toAddr = strings.ToLower(toAddr)
+	if dir, exists := smtpd.Maildirs[toAddr]; exists {
+		return dir
+	}
+	return smtpd.Maildirs[toAddr[strings.IndexRune(toAddr, '@')+1:]]
+}
+
+/*
+Store the mail into mailboxes of the recipients, each mailbox receives one copy. Return the number of mailboxes that
+have successfully stored the mail, and the number of mailboxes that failed to.
+*/
+func (smtpd *SMTPD) StoreMail(fromAddr string, toAddrs []string, mailBody string) (stored, failed int) {
+	seen := make(map[*Maildir]struct{})
+	for _, toAddr := range toAddrs {
+		dir := smtpd.GetMaildir(toAddr)
+		if dir == nil {
+			continue
+		}
+		if _, exists := seen[dir]; exists {
+			continue
+		}
+		seen[dir] = struct{}{}
+		if err := dir.Deliver([]byte(mailBody)); err == nil {
+			stored++
+		} else {
+			failed++
+			smtpd.Logger.Warningf("StoreMail", fromAddr, err, "failed to store mail for \"%s\"", toAddr)
+		}
+	}
+	return
+}
+
+// Forward the mail to forward addresses if there are any, then process feature commands if they are found.
 func (smtpd *SMTPD) ProcessMail(fromAddr, mailBody string) {
 	bodyBytes := []byte(mailBody)
 	// Forward the mail
-	if err := smtpd.ForwardMailer.SendRaw(smtpd.ForwardMailer.MailFrom, bodyBytes, smtpd.ForwardTo...); err == nil {
-		smtpd.Logger.Printf("ProcessMail", fromAddr, nil, "successfully forwarded mail to %v", smtpd.ForwardTo)
-	} else {
-		smtpd.Logger.Warningf("ProcessMail", fromAddr, err, "failed to forward email")
+	if len(smtpd.ForwardTo) > 0 {
+		if err := smtpd.ForwardMailer.SendRaw(smtpd.ForwardMailer.MailFrom, bodyBytes, smtpd.ForwardTo...); err == nil {
+			smtpd.Logger.Printf("ProcessMail", fromAddr, nil, "successfully forwarded mail to %v", smtpd.ForwardTo)
+		} else {
+			smtpd.Logger.Warningf("ProcessMail", fromAddr, err, "failed to forward email")
+		}
 	}
 	// Run feature command from mail body
 	if err := smtpd.MailProcessor.Process(bodyBytes, smtpd.ForwardTo...); err != nil {
@@ -171,7 +232,9 @@ func (smtpd *SMTPD) HandleConnection(clientConn net.Conn) {
 		case smtp.COMMAND:
 			switch ev.Cmd {
 			case smtp.MAILFROM:
+				// A new mail transaction begins
 				fromAddr = ev.Arg
+				toAddrs = toAddrs[:0]
 			case smtp.RCPTTO:
 				atSign := strings.IndexRune(ev.Arg, '@')
 				if atSign == -1 {
@@ -184,9 +247,29 @@ func (smtpd *SMTPD) HandleConnection(clientConn net.Conn) {
 					smtpConn.Reject()
 					goto conversationDone
 				}
+				dir := smtpd.GetMaildir(ev.Arg)
+				if dir == nil && len(smtpd.ForwardTo) == 0 {
+					finishReason = "rejected for unknown recipient"
+					smtpConn.Reject()
+					goto conversationDone
+				}
+				// Sender should try again later when the mailbox has room
+				if dir != nil && dir.IsFull() {
+					smtpd.Logger.Warningf("HandleConnection", clientIP, ErrMaildirQuotaExceeded, "temporarily rejected recipient \"%s\"", ev.Arg)
+					smtpConn.Tempfail()
+					continue
+				}
 				toAddrs = append(toAddrs, ev.Arg)
 			}
 		case smtp.GOTDATA:
+			// Unless the mail is also forwarded, sender should try again later if none of the mailboxes could store it.
+			if stored, failed := smtpd.StoreMail(fromAddr, toAddrs, ev.Arg); stored == 0 && failed > 0 && len(smtpd.ForwardTo) == 0 {
+				finishReason = "temporarily rejected for failing to store mail"
+				smtpConn.Tempfail()
+				goto conversationDone
+			} else if stored > 0 {
+				smtpd.Logger.Printf("HandleConnection", clientIP, nil, "stored a mail from \"%s\" in %d mailboxes", fromAddr, stored)
+			}
 			mailBody = ev.Arg
 		}
 	}
@@ -4,7 +4,10 @@ import (
 	"github.com/HouzuoGuo/laitos/email"
 	"github.com/HouzuoGuo/laitos/frontend/common"
 	"github.com/HouzuoGuo/laitos/frontend/mailp"
+	"io/ioutil"
 	"net/smtp"
+	"os"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -134,3 +137,84 @@ func TestSMTPD_StartAndBlock(t *testing.T) {
 		t.Fatal("did not stop")
 	}
 }
+
+func TestSMTPD_Maildir(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "laitos-test-smtpd-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	goodMailer := email.Mailer{
+		MailFrom: "howard@localhost",
+		MTAHost:  "127.0.0.1",
+		MTAPort:  25,
+	}
+	daemon := SMTPD{
+		ListenAddress: "127.0.0.1",
+		ListenPort:    61359, // hard coded port is a random choice
+		PerIPLimit:    10,
+		MyDomains:     []string{"example.com", "howard.name"},
+		MailProcessor: &mailp.MailProcessor{
+			CommandTimeoutSec: 10,
+			Processor:         common.GetTestCommandProcessor(),
+			ReplyMailer:       goodMailer,
+		},
+	}
+	// Mailbox must belong to my domains
+	daemon.Maildirs = map[string]*Maildir{"howard@not-my-domain": {Path: path.Join(dirPath, "howard")}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "does not belong") {
+		t.Fatal(err)
+	}
+	// Without forward addresses, only recipients with a mailbox are accepted.
+	daemon.Maildirs = map[string]*Maildir{
+		"Howard@Example.com": {Path: path.Join(dirPath, "howard")},
+		"howard.name":        {Path: path.Join(dirPath, "all"), QuotaMB: 1},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if daemon.GetMaildir("HOWARD@example.com") != daemon.Maildirs["howard@example.com"] ||
+		daemon.GetMaildir("anyone@howard.name") != daemon.Maildirs["howard.name"] ||
+		daemon.GetMaildir("other@example.com") != nil {
+		t.Fatal("wrong maildir lookup")
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- daemon.StartAndBlock()
+	}()
+	time.Sleep(3 * time.Second)
+	testMessage := "Content-type: text/plain; charset=utf-8\r\nFrom: MsgFrom@whatever\r\nTo: MsgTo@whatever\r\nSubject: text subject\r\n\r\ntest body"
+	// Each mailbox stores one copy of the mail
+	if err := smtp.SendMail("127.0.0.1:61359", nil, "ClientFrom@localhost", []string{"howard@example.com", "a@howard.name", "b@howard.name"}, []byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	for _, box := range []string{"howard", "all"} {
+		if files, err := ioutil.ReadDir(path.Join(dirPath, box, "new")); err != nil || len(files) != 1 {
+			t.Fatal(box, files, err)
+		}
+	}
+	// Recipient without a mailbox is rejected
+	if err := smtp.SendMail("127.0.0.1:61359", nil, "ClientFrom@localhost", []string{"other@example.com"}, []byte(testMessage)); err == nil || !strings.Contains(err.Error(), "Bad address") {
+		t.Fatal(err)
+	}
+	// Recipient of a full mailbox is temporarily rejected
+	usage, err := daemon.Maildirs["howard.name"].Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Maildirs["howard.name"].Deliver(make([]byte, 1048576-usage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail("127.0.0.1:61359", nil, "ClientFrom@localhost", []string{"a@howard.name"}, []byte(testMessage)); err == nil || !strings.Contains(err.Error(), "450") {
+		t.Fatal(err)
+	}
+	daemon.Stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not stop")
+	}
+}
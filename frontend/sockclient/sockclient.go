@@ -0,0 +1,316 @@
+package sockclient
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/sockd"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolCipher = "cipher" // The legacy encrypted protocol of sock daemon
+	ProtocolAEAD   = "aead"   // The authenticated encryption protocol of sock daemon
+
+	DialTimeoutSec      = 10 // Give up connecting to a remote server after this many seconds
+	MaxBackoffSec       = 60 // Skip a failing remote server for up to this many seconds
+	HandshakeTimeoutSec = 30 // Local client must make its request within this many seconds
+)
+
+// A remote sock daemon and its recent failures.
+type remoteServer struct {
+	addr        string
+	failures    int
+	failedUntil time.Time // Do not use the server until this time unless all servers are failing
+}
+
+/*
+Serve SOCKS5 (without authentication) and HTTP proxy (CONNECT and absolute-URI requests) on a local port, and tunnel each
+connection to one of the remote sock daemons. Remote servers are used in turn, a server that fails to connect is skipped
+for a while, and a connection is retried on the next server.
+*/
+type SockClient struct {
+	ListenAddress string   `json:"ListenAddress"` // (Optional) listen on this address, default to 127.0.0.1.
+	ListenPort    int      `json:"ListenPort"`    // Serve SOCKS5 and HTTP proxy on this port
+	Servers       []string `json:"Servers"`       // Remote sock daemons in "host:port" form
+	Password      string   `json:"Password"`      // Password shared with the remote sock daemons
+	Protocol      string   `json:"Protocol"`      // (Optional) "cipher" (default) or "aead", the remote port must speak the same protocol.
+
+	Listener net.Listener  `json:"-"`
+	Logger   global.Logger `json:"-"`
+
+	cipher  *sockd.Cipher
+	aeadKey []byte
+	servers []*remoteServer
+	next    int // Index of the server to try first for the next connection
+	mutex   *sync.Mutex
+}
+
+// Check configuration and initialise internal states.
+func (client *SockClient) Initialise() error {
+	if client.ListenAddress == "" {
+		client.ListenAddress = "127.0.0.1"
+	}
+	if client.ListenPort < 1 {
+		return errors.New("SockClient.Initialise: listen port must be greater than 0")
+	}
+	if len(client.Servers) == 0 {
+		return errors.New("SockClient.Initialise: there must be at least one remote server")
+	}
+	if len(client.Password) < 7 {
+		return errors.New("SockClient.Initialise: password must be at least 7 characters long")
+	}
+	if client.Protocol == "" {
+		client.Protocol = ProtocolCipher
+	}
+	switch client.Protocol {
+	case ProtocolCipher:
+		client.cipher = &sockd.Cipher{}
+		client.cipher.Initialise(client.Password)
+	case ProtocolAEAD:
+		client.aeadKey = sockd.DeriveAEADKey(client.Password)
+	default:
+		return fmt.Errorf("SockClient.Initialise: protocol must be either \"%s\" or \"%s\"", ProtocolCipher, ProtocolAEAD)
+	}
+	client.servers = make([]*remoteServer, 0, len(client.Servers))
+	for _, addr := range client.Servers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("SockClient.Initialise: malformed server address \"%s\" - %v", addr, err)
+		}
+		client.servers = append(client.servers, &remoteServer{addr: addr})
+	}
+	client.next = 0
+	client.mutex = new(sync.Mutex)
+	return nil
+}
+
+// Return remote servers in the order they should be tried, servers that recently failed come last.
+func (client *SockClient) orderServers() []*remoteServer {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	now := time.Now()
+	healthy := make([]*remoteServer, 0, len(client.servers))
+	var failing []*remoteServer
+	for i := range client.servers {
+		server := client.servers[(client.next+i)%len(client.servers)]
+		if now.Before(server.failedUntil) {
+			failing = append(failing, server)
+		} else {
+			healthy = append(healthy, server)
+		}
+	}
+	client.next = (client.next + 1) % len(client.servers)
+	return append(healthy, failing...)
+}
+
+// Record the outcome of connecting to a remote server.
+func (client *SockClient) recordResult(server *remoteServer, err error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if err == nil {
+		server.failures = 0
+		server.failedUntil = time.Time{}
+		return
+	}
+	server.failures++
+	backoff := MaxBackoffSec
+	if server.failures < 6 {
+		backoff = 1 << uint(server.failures)
+	}
+	server.failedUntil = time.Now().Add(time.Duration(backoff) * time.Second)
+}
+
+/*
+Connect to a remote server and ask it to connect to the destination. Servers are tried in turn until one of them
+accepts the connection. The initial data is sent along with the destination address.
+*/
+func (client *SockClient) DialTunnel(destAddr string, initialData []byte) (net.Conn, error) {
+	var lastErr error
+	for _, server := range client.orderServers() {
+		netConn, err := net.DialTimeout("tcp", server.addr, DialTimeoutSec*time.Second)
+		client.recordResult(server, err)
+		if err != nil {
+			client.Logger.Warningf("DialTunnel", server.addr, err, "failed to connect to server, trying the next one")
+			lastErr = err
+			continue
+		}
+		var tunnel net.Conn
+		if client.Protocol == ProtocolAEAD {
+			tunnel = sockd.NewAEADConnection(netConn, client.aeadKey)
+		} else {
+			tunnel = sockd.NewCipherConnection(netConn, client.cipher.Copy(), nil)
+		}
+		tunnel.SetWriteDeadline(time.Now().Add(sockd.IOTimeoutSec))
+		if _, err := tunnel.Write(append(sockd.EncodeSOCKS5Address(destAddr), initialData...)); err != nil {
+			netConn.Close()
+			client.recordResult(server, err)
+			lastErr = err
+			continue
+		}
+		return tunnel, nil
+	}
+	return nil, fmt.Errorf("SockClient.DialTunnel: all servers failed, the last error is - %v", lastErr)
+}
+
+// A local connection that reads from buffered reader first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// Carry out SOCKS5 CONNECT request of a local client. Return the destination address.
+func handleSOCKS5Request(conn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	// Local clients do not authenticate
+	if _, err := conn.Write([]byte{sockd.SOCKS5Version, 0}); err != nil {
+		return "", err
+	}
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", err
+	}
+	destAddr, err := sockd.ReadSOCKS5Address(reader)
+	if err != nil {
+		return "", err
+	}
+	if request[1] != sockd.SOCKS5CmdConnect {
+		conn.Write(append([]byte{sockd.SOCKS5Version, sockd.SOCKS5ReplyCommandNotSupported, 0}, sockd.EncodeSOCKS5Address("")...))
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+	return destAddr, nil
+}
+
+// Tunnel the local connection to its destination, it speaks either SOCKS5 or HTTP proxy protocol.
+func (client *SockClient) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeoutSec * time.Second))
+	reader := bufio.NewReader(conn)
+	firstByte, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	isSOCKS5 := firstByte[0] == sockd.SOCKS5Version
+	var destAddr string
+	var initialData []byte
+	var httpConnect bool
+	if isSOCKS5 {
+		if destAddr, err = handleSOCKS5Request(conn, reader); err != nil {
+			client.Logger.Warningf("HandleConnection", remoteAddr, err, "failed to read SOCKS5 request")
+			return
+		}
+	} else {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			client.Logger.Warningf("HandleConnection", remoteAddr, err, "failed to read HTTP proxy request")
+			return
+		}
+		destAddr = req.Host
+		if req.Method == http.MethodConnect {
+			httpConnect = true
+		} else {
+			if req.URL.Scheme != "http" || req.URL.Host == "" {
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+				return
+			}
+			destAddr = req.URL.Host
+			// Forward the request in origin form, one request per connection.
+			req.Header.Del("Proxy-Connection")
+			req.Header.Del("Proxy-Authorization")
+			req.Close = true
+			buf := new(bytes.Buffer)
+			if err := req.Write(buf); err != nil {
+				return
+			}
+			initialData = buf.Bytes()
+		}
+		if _, _, err := net.SplitHostPort(destAddr); err != nil {
+			port := 80
+			if httpConnect {
+				port = 443
+			}
+			destAddr = net.JoinHostPort(destAddr, strconv.Itoa(port))
+		}
+	}
+	tunnel, err := client.DialTunnel(destAddr, initialData)
+	if err != nil {
+		client.Logger.Warningf("HandleConnection", remoteAddr, err, "failed to make tunnel to \"%s\"", destAddr)
+		if isSOCKS5 {
+			conn.Write(append([]byte{sockd.SOCKS5Version, sockd.SOCKS5ReplyGeneralFailure, 0}, sockd.EncodeSOCKS5Address("")...))
+		} else {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n"))
+		}
+		return
+	}
+	defer tunnel.Close()
+	if isSOCKS5 {
+		_, err = conn.Write(append([]byte{sockd.SOCKS5Version, sockd.SOCKS5ReplySucceeded, 0}, sockd.EncodeSOCKS5Address(conn.LocalAddr().String())...))
+	} else if httpConnect {
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}
+	if err != nil {
+		return
+	}
+	local := &bufferedConn{Conn: conn, reader: reader}
+	go sockd.PipeAndCloseConnection(local, tunnel)
+	sockd.PipeAndCloseConnection(tunnel, local)
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start local proxy listener and block until listener is closed.
+*/
+func (client *SockClient) StartAndBlock() error {
+	listenAddr := net.JoinHostPort(client.ListenAddress, strconv.Itoa(client.ListenPort))
+	client.Logger.Printf("StartAndBlock", listenAddr, nil, "going to listen for proxy connections")
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("SockClient.StartAndBlock: failed to listen on %s - %v", listenAddr, err)
+	}
+	client.mutex.Lock()
+	client.Listener = listener
+	client.mutex.Unlock()
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("SockClient.StartAndBlock: failed to accept new connection - %v", err)
+		}
+		go client.HandleConnection(conn)
+	}
+}
+
+// Close local proxy listener.
+func (client *SockClient) Stop() {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.Listener != nil {
+		if err := client.Listener.Close(); err != nil {
+			client.Logger.Warningf("Stop", "", err, "failed to close listener")
+		}
+	}
+}
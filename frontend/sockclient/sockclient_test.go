@@ -0,0 +1,147 @@
+package sockclient
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"github.com/HouzuoGuo/laitos/frontend/sockd"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write the message to the connection and expect it to be echoed back.
+func expectEcho(t *testing.T, conn io.ReadWriter, message string) {
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != message {
+		t.Fatal(err, string(buf))
+	}
+}
+
+// Test SOCKS5, HTTP CONNECT, and HTTP proxy of the client.
+func testClient(t *testing.T, proxyAddr, echoAddr, webURL string) {
+	// SOCKS5
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte{sockd.SOCKS5Version, 1, 0})
+	conn.Write(append([]byte{sockd.SOCKS5Version, sockd.SOCKS5CmdConnect, 0}, sockd.EncodeSOCKS5Address(echoAddr)...))
+	reply := make([]byte, 2+3)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 || reply[3] != sockd.SOCKS5ReplySucceeded {
+		t.Fatal(err, reply)
+	}
+	if _, err := sockd.ReadSOCKS5Address(conn); err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn, "hello SOCKS5")
+
+	// HTTP CONNECT
+	conn2, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn2, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+	reader := bufio.NewReader(conn2)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal(err, resp)
+	}
+	expectEcho(t, struct {
+		io.Reader
+		io.Writer
+	}{reader, conn2}, "hello CONNECT")
+
+	// HTTP proxy
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 10 * time.Second}
+	resp, err = client.Get(webURL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || string(body) != "hello /hello" {
+		t.Fatal(err, string(body))
+	}
+}
+
+func TestSockClient(t *testing.T) {
+	client := SockClient{}
+	if err := client.Initialise(); err == nil || !strings.Contains(err.Error(), "port") {
+		t.Fatal(err)
+	}
+	client.ListenPort = 8733
+	if err := client.Initialise(); err == nil || !strings.Contains(err.Error(), "server") {
+		t.Fatal(err)
+	}
+	client.Servers = []string{"127.0.0.1:8731"}
+	if err := client.Initialise(); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Fatal(err)
+	}
+	client.Password = "abcdefg"
+	client.Protocol = "wrong"
+	if err := client.Initialise(); err == nil || !strings.Contains(err.Error(), "protocol") {
+		t.Fatal(err)
+	}
+
+	daemon := sockd.Sockd{
+		ListenAddress:  "127.0.0.1",
+		ListenPort:     8731,
+		AEADListenPort: 8732,
+		Password:       "abcdefg",
+		PerIPLimit:     100,
+		Destinations:   sockd.DestinationRules{AllowPrivate: true},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	echoAddr := testhelper.StartEchoServer(t)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer web.Close()
+
+	// The first server is not reachable, client moves on to the next one.
+	deadServer, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := deadServer.Addr().String()
+	deadServer.Close()
+	for _, client := range []*SockClient{
+		{ListenPort: 8733, Servers: []string{deadAddr, "127.0.0.1:8731"}, Password: "abcdefg"},
+		{ListenPort: 8734, Servers: []string{deadAddr, "127.0.0.1:8732"}, Password: "abcdefg", Protocol: ProtocolAEAD},
+	} {
+		if err := client.Initialise(); err != nil {
+			t.Fatal(err)
+		}
+		go func(client *SockClient) {
+			if err := client.StartAndBlock(); err != nil {
+				t.Error(err)
+			}
+		}(client)
+		defer client.Stop()
+		time.Sleep(1 * time.Second)
+		testClient(t, fmt.Sprintf("127.0.0.1:%d", client.ListenPort), echoAddr, web.URL)
+		// The dead server is skipped for a while
+		if servers := client.orderServers(); servers[len(servers)-1].addr != deadAddr {
+			t.Fatal(servers[len(servers)-1].addr)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package sockd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AEADKeyLength        = 32                    // AES-256 key length
+	AEADSaltLength       = 32                    // Each direction of a connection begins with a random salt of this length
+	AEADMaxPayloadLength = 0x3FFF                // Maximum length of payload in a single chunk
+	AEADTagLength        = 16                    // Length of authentication tag of AES-GCM
+	AEADKDFIterations    = 4096                  // Number of PBKDF2 iterations that derive master key from password
+	AEADKDFSalt          = "laitos-sockd-aead"   // PBKDF2 salt that derives master key from password
+	AEADSubkeyInfo       = "laitos-sockd-subkey" // HKDF info that derives per-connection key from master key and salt
+)
+
+var ErrAEADChunk = errors.New("failed to authenticate chunk")
+
+// Derive a key from the secret via HMAC-SHA256 based HKDF (RFC 5869).
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	ret := make([]byte, 0, length+sha256.Size)
+	var block []byte
+	for counter := byte(1); len(ret) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		ret = append(ret, block...)
+	}
+	return ret[:length]
+}
+
+// Derive a key from the password via HMAC-SHA256 based PBKDF2 (RFC 8018).
+func pbkdf2SHA256(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	ret := make([]byte, 0, length+sha256.Size)
+	for blockIndex := uint32(1); len(ret) < length; blockIndex++ {
+		prf.Reset()
+		prf.Write(salt)
+		indexBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(indexBytes, blockIndex)
+		prf.Write(indexBytes)
+		u := prf.Sum(nil)
+		block := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range block {
+				block[j] ^= u[j]
+			}
+		}
+		ret = append(ret, block...)
+	}
+	return ret[:length]
+}
+
+// Derive the master key of authenticated encryption protocol from password.
+func DeriveAEADKey(password string) []byte {
+	return pbkdf2SHA256([]byte(password), []byte(AEADKDFSalt), AEADKDFIterations, AEADKeyLength)
+}
+
+// Create AES-256-GCM cipher of the per-connection key derived from master key and salt.
+func newAEADCipher(masterKey, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(hkdfSHA256(masterKey, salt, []byte(AEADSubkeyInfo), AEADKeyLength))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Increase the little-endian nonce by one.
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+/*
+A connection of authenticated encryption protocol. Each direction begins with a random salt, followed by chunks made of
+encrypted 2-byte payload length and encrypted payload, each carries its own authentication tag. The per-direction key is
+derived from master key and salt, and the nonce counts up from zero for each length and payload.
+*/
+type AEADConnection struct {
+	net.Conn
+	reader             io.Reader // Read encrypted data from here, it begins with the data consumed by IdentifyKey.
+	masterKey          []byte
+	peerSalt           []byte
+	encrypter          cipher.AEAD
+	decrypter          cipher.AEAD
+	encNonce, decNonce []byte
+	pending            []byte // Decrypted payload that has not been read yet
+	readBuf            []byte
+}
+
+// Wrap the network connection into an authenticated encryption connection.
+func NewAEADConnection(netConn net.Conn, masterKey []byte) *AEADConnection {
+	return &AEADConnection{Conn: netConn, reader: netConn, masterKey: masterKey}
+}
+
+/*
+Read the peer's salt and the first chunk's length, and find out which of the master keys the peer uses. Return name of the
+key, or ErrAEADChunk if none of them authenticates the chunk. It must be called before the first read.
+*/
+func (conn *AEADConnection) IdentifyKey(masterKeys map[string][]byte) (string, error) {
+	header := make([]byte, AEADSaltLength+2+AEADTagLength)
+	if _, err := io.ReadFull(conn.Conn, header); err != nil {
+		return "", err
+	}
+	conn.reader = io.MultiReader(bytes.NewReader(header), conn.Conn)
+	for name, key := range masterKeys {
+		decrypter, err := newAEADCipher(key, header[:AEADSaltLength])
+		if err != nil {
+			return "", err
+		}
+		if _, err := decrypter.Open(nil, make([]byte, decrypter.NonceSize()), header[AEADSaltLength:], nil); err == nil {
+			conn.masterKey = key
+			return name, nil
+		}
+	}
+	return "", ErrAEADChunk
+}
+
+// Read the peer's salt and initialise decryption. It is called upon the first read.
+func (conn *AEADConnection) initDecrypter() error {
+	salt := make([]byte, AEADSaltLength)
+	if _, err := io.ReadFull(conn.reader, salt); err != nil {
+		return err
+	}
+	conn.peerSalt = salt
+	var err error
+	if conn.decrypter, err = newAEADCipher(conn.masterKey, salt); err != nil {
+		return err
+	}
+	conn.decNonce = make([]byte, conn.decrypter.NonceSize())
+	conn.readBuf = make([]byte, AEADMaxPayloadLength+conn.decrypter.Overhead())
+	return nil
+}
+
+// Read and decrypt the next chunk.
+func (conn *AEADConnection) readChunk() ([]byte, error) {
+	overhead := conn.decrypter.Overhead()
+	lenBuf := conn.readBuf[:2+overhead]
+	if _, err := io.ReadFull(conn.reader, lenBuf); err != nil {
+		return nil, err
+	}
+	plainLen, err := conn.decrypter.Open(lenBuf[:0], conn.decNonce, lenBuf, nil)
+	if err != nil {
+		return nil, ErrAEADChunk
+	}
+	incrementNonce(conn.decNonce)
+	payloadLen := int(binary.BigEndian.Uint16(plainLen)) & AEADMaxPayloadLength
+	payload := conn.readBuf[:payloadLen+overhead]
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return nil, err
+	}
+	plain, err := conn.decrypter.Open(payload[:0], conn.decNonce, payload, nil)
+	if err != nil {
+		return nil, ErrAEADChunk
+	}
+	incrementNonce(conn.decNonce)
+	return plain, nil
+}
+
+// Return the salt chosen by peer, it is available after the first read.
+func (conn *AEADConnection) Salt() []byte {
+	return conn.peerSalt
+}
+
+func (conn *AEADConnection) Read(b []byte) (n int, err error) {
+	if conn.decrypter == nil {
+		if err = conn.initDecrypter(); err != nil {
+			return
+		}
+	}
+	for len(conn.pending) == 0 {
+		if conn.pending, err = conn.readChunk(); err != nil {
+			return
+		}
+	}
+	n = copy(b, conn.pending)
+	conn.pending = conn.pending[n:]
+	return
+}
+
+func (conn *AEADConnection) Write(b []byte) (n int, err error) {
+	var out []byte
+	if conn.encrypter == nil {
+		salt := make([]byte, AEADSaltLength)
+		if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+			return
+		}
+		if conn.encrypter, err = newAEADCipher(conn.masterKey, salt); err != nil {
+			return
+		}
+		conn.encNonce = make([]byte, conn.encrypter.NonceSize())
+		out = salt
+	}
+	overhead := conn.encrypter.Overhead()
+	for remaining := b; len(remaining) > 0; {
+		payload := remaining
+		if len(payload) > AEADMaxPayloadLength {
+			payload = payload[:AEADMaxPayloadLength]
+		}
+		remaining = remaining[len(payload):]
+		chunk := make([]byte, 2, 2+overhead+len(payload)+overhead)
+		binary.BigEndian.PutUint16(chunk, uint16(len(payload)))
+		chunk = conn.encrypter.Seal(chunk[:0], conn.encNonce, chunk, nil)
+		incrementNonce(conn.encNonce)
+		chunk = conn.encrypter.Seal(chunk, conn.encNonce, payload, nil)
+		incrementNonce(conn.encNonce)
+		out = append(out, chunk...)
+	}
+	if _, err = conn.Conn.Write(out); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// Read destination address, connect to it, and pipe data in both directions until either side closes.
+func (sock *Sockd) HandleAEADConnection(netConn net.Conn) {
+	conn := NewAEADConnection(netConn, nil)
+	defer conn.Close()
+	remoteAddr := conn.RemoteAddr().String()
+	conn.SetReadDeadline(time.Now().Add(IOTimeoutSec))
+	user, err := conn.IdentifyKey(sock.aeadKeys)
+	if err != nil {
+		sock.Logger.Warningf("HandleAEADConnection", remoteAddr, err, "failed to authenticate client")
+		sock.handleBadHandshake(netConn)
+		return
+	}
+	destAddr, err := ReadSOCKS5Address(conn)
+	if err != nil {
+		sock.Logger.Warningf("HandleAEADConnection", remoteAddr, err, "failed to get destination address")
+		sock.handleBadHandshake(netConn)
+		return
+	}
+	if !sock.replayFilter.Check(conn.Salt()) {
+		sock.Logger.Warningf("HandleAEADConnection", remoteAddr, nil, "rejected replayed handshake of user \"%s\"", user)
+		sock.handleBadHandshake(netConn)
+		return
+	}
+	client, err := accountConnection(conn, user)
+	if err != nil {
+		sock.Logger.Warningf("HandleAEADConnection", remoteAddr, err, "refused connection of user \"%s\"", user)
+		return
+	}
+	defer client.Close()
+	dest, err := sock.Destinations.Dial(destAddr)
+	if err == ErrDestinationDenied {
+		sock.Logger.Warningf("HandleAEADConnection", remoteAddr, nil, "denied access to destination \"%s\"", destAddr)
+		return
+	} else if err != nil {
+		sock.Logger.Warningf("HandleAEADConnection", remoteAddr, err, "failed to connect to destination \"%s\"", destAddr)
+		return
+	}
+	defer dest.Close()
+	go PipeAndCloseConnection(client, dest)
+	PipeAndCloseConnection(dest, client)
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start listener of authenticated encryption protocol and block until listener is closed.
+*/
+func (sock *Sockd) StartAndBlockAEAD() error {
+	listenAddr := net.JoinHostPort(sock.ListenAddress, strconv.Itoa(sock.AEADListenPort))
+	sock.Logger.Printf("StartAndBlockAEAD", listenAddr, nil, "going to listen for connections")
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("Sockd.StartAndBlockAEAD: failed to listen on %s - %v", listenAddr, err)
+	}
+	sock.mutex.Lock()
+	sock.AEADListener = listener
+	sock.mutex.Unlock()
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("Sockd.StartAndBlockAEAD: failed to accept new connection - %v", err)
+		}
+		clientIP := conn.RemoteAddr().String()[:strings.LastIndexByte(conn.RemoteAddr().String(), ':')]
+		if sock.rateLimit.Add(clientIP, true) {
+			go sock.HandleAEADConnection(conn)
+		} else {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package sockd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKDF(t *testing.T) {
+	// Test vector of RFC 7914 section 11
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if key := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)); key != expected {
+		t.Fatal(key)
+	}
+	// Test case 1 of RFC 5869
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected = "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+	if key := hex.EncodeToString(hkdfSHA256(ikm, salt, info, 42)); key != expected {
+		t.Fatal(key)
+	}
+	if len(DeriveAEADKey("abcdefg")) != AEADKeyLength || bytes.Equal(DeriveAEADKey("abcdefg"), DeriveAEADKey("abcdefh")) {
+		t.Fatal("wrong key")
+	}
+}
+
+func TestAEADConnection(t *testing.T) {
+	key := DeriveAEADKey("abcdefg")
+	clientNet, serverNet := net.Pipe()
+	client := NewAEADConnection(clientNet, key)
+	server := NewAEADConnection(serverNet, key)
+	// Large payload is split into several chunks
+	payload := bytes.Repeat([]byte("0123456789"), 5000)
+	go func() {
+		client.Write([]byte("hello"))
+		client.Write(payload)
+	}()
+	buf := make([]byte, len("hello")+len(payload))
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf[:5]) != "hello" || !bytes.Equal(buf[5:], payload) {
+		t.Fatal(err)
+	}
+	// Tampered chunk fails authentication
+	clientNet, serverNet = net.Pipe()
+	go func() {
+		recorder, writer := net.Pipe()
+		go NewAEADConnection(writer, key).Write([]byte("hello"))
+		encrypted := make([]byte, AEADSaltLength+2+16+5+16)
+		io.ReadFull(recorder, encrypted)
+		encrypted[len(encrypted)-1] ^= 1
+		clientNet.Write(encrypted)
+	}()
+	if _, err := NewAEADConnection(serverNet, key).Read(buf); err != ErrAEADChunk {
+		t.Fatal(err)
+	}
+}
+
+func TestSockd_AEAD(t *testing.T) {
+	daemon := Sockd{ListenAddress: "127.0.0.1", AEADListenPort: 8722, PerIPLimit: 10, Destinations: DestinationRules{AllowPrivate: true}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Fatal(err)
+	}
+	daemon.Password = "abcdefg"
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	time.Sleep(1 * time.Second)
+	echoAddr := testhelper.StartEchoServer(t)
+
+	netConn, err := net.Dial("tcp", "127.0.0.1:8722")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := NewAEADConnection(netConn, DeriveAEADKey("abcdefg"))
+	if _, err := conn.Write(append(EncodeSOCKS5Address(echoAddr), "hello AEAD"...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello AEAD" {
+		t.Fatal(err, string(buf))
+	}
+	// Wrong password does not get anywhere
+	netConn2, err := net.Dial("tcp", "127.0.0.1:8722")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn2.Close()
+	netConn2.SetDeadline(time.Now().Add(5 * time.Second))
+	conn2 := NewAEADConnection(netConn2, DeriveAEADKey("wrong password"))
+	if _, err := conn2.Write(append(EncodeSOCKS5Address(echoAddr), "hello AEAD"...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn2, buf); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,181 @@
+package sockd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/ipfilter"
+	"github.com/HouzuoGuo/laitos/namepattern"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+Loopback, private, link-local (including cloud metadata service), carrier-grade NAT, IETF protocol assignment, benchmark,
+multicast, reserved, broadcast, and unspecified addresses. NAT64 and 6to4 prefixes are included because they can carry
+any IPv4 address, including private ones.
+*/
+var PrivateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var ErrDestinationDenied = errors.New("destination is denied by rules")
+
+/*
+Decide which destinations clients may connect to. A destination is denied if its port is in DenyPorts or not in a
+non-empty AllowPorts; if its domain name matches DenyNames or does not match a non-empty AllowNames; or if none of the IP
+addresses it resolves to is allowed. An IP address is denied if it is in DenyCIDRs or not in a non-empty AllowCIDRs, and
+private addresses are denied unless AllowPrivate is true or AllowCIDRs contains them. IP address destinations are only
+subject to IP rules, hence configure AllowCIDRs as well to permit nothing but AllowNames.
+The IP addresses are checked after name resolution, and connection is made to the checked address, so that a name that
+resolves to different addresses over time (DNS rebinding) cannot be used to reach a denied address.
+*/
+type DestinationRules struct {
+	AllowCIDRs   []string `json:"AllowCIDRs"`   // (Optional) only connect to IP addresses in these CIDR blocks
+	DenyCIDRs    []string `json:"DenyCIDRs"`    // (Optional) never connect to IP addresses in these CIDR blocks
+	AllowPorts   []int    `json:"AllowPorts"`   // (Optional) only connect to these port numbers
+	DenyPorts    []int    `json:"DenyPorts"`    // (Optional) never connect to these port numbers
+	AllowNames   []string `json:"AllowNames"`   // (Optional) only connect to domain names matching these patterns, e.g. "example.com", "*.example.com", "/regex/"
+	DenyNames    []string `json:"DenyNames"`    // (Optional) never connect to domain names matching these patterns
+	AllowPrivate bool     `json:"AllowPrivate"` // (Optional) allow connections to loopback, private, and link-local addresses
+
+	ipFilter     *ipfilter.IPFilter
+	allowNets    []*net.IPNet
+	privateNets  []*net.IPNet
+	allowNames   *namepattern.NamePatterns
+	denyNames    *namepattern.NamePatterns
+	allowPorts   map[int]struct{}
+	denyPorts    map[int]struct{}
+	lookupIPFunc func(host string) ([]net.IP, error) // Resolve domain name into IP addresses, tests may override it.
+}
+
+// Parse the rules. Return an error if any of the CIDR blocks, ports, or name patterns is invalid.
+func (rules *DestinationRules) Initialise() error {
+	rules.ipFilter = &ipfilter.IPFilter{Allow: rules.AllowCIDRs, Deny: rules.DenyCIDRs}
+	if err := rules.ipFilter.Initialise(); err != nil {
+		return fmt.Errorf("DestinationRules.Initialise: %v", err)
+	}
+	rules.allowNets = make([]*net.IPNet, 0, len(rules.AllowCIDRs))
+	for _, entry := range rules.AllowCIDRs {
+		ipNet, _ := ipfilter.ParseCIDR(entry)
+		rules.allowNets = append(rules.allowNets, ipNet)
+	}
+	rules.privateNets = make([]*net.IPNet, 0, len(PrivateCIDRs))
+	for _, entry := range PrivateCIDRs {
+		ipNet, _ := ipfilter.ParseCIDR(entry)
+		rules.privateNets = append(rules.privateNets, ipNet)
+	}
+	var err error
+	if rules.allowNames, err = namepattern.NewNamePatterns(rules.AllowNames); err != nil {
+		return fmt.Errorf("DestinationRules.Initialise: invalid AllowNames - %v", err)
+	}
+	if rules.denyNames, err = namepattern.NewNamePatterns(rules.DenyNames); err != nil {
+		return fmt.Errorf("DestinationRules.Initialise: invalid DenyNames - %v", err)
+	}
+	rules.allowPorts = make(map[int]struct{})
+	rules.denyPorts = make(map[int]struct{})
+	for _, ports := range []struct {
+		list []int
+		set  map[int]struct{}
+	}{{rules.AllowPorts, rules.allowPorts}, {rules.DenyPorts, rules.denyPorts}} {
+		for _, port := range ports.list {
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("DestinationRules.Initialise: port number %d is out of range", port)
+			}
+			ports.set[port] = struct{}{}
+		}
+	}
+	if rules.lookupIPFunc == nil {
+		rules.lookupIPFunc = net.LookupIP
+	}
+	return nil
+}
+
+// Return true if the IP address may be connected to.
+func (rules *DestinationRules) IsAllowedIP(ip net.IP) bool {
+	if !rules.ipFilter.IsAllowed(ip.String()) {
+		return false
+	}
+	if rules.AllowPrivate {
+		return true
+	}
+	for _, privateNet := range rules.privateNets {
+		if privateNet.Contains(ip) {
+			// Private address must be explicitly allowed
+			for _, allowNet := range rules.allowNets {
+				if allowNet.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Check the destination "host:port" against the rules and resolve its host name. Return the first allowed IP address and
+the port number, or ErrDestinationDenied if the destination is denied.
+*/
+func (rules *DestinationRules) Resolve(destAddr string) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(destAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, 0, fmt.Errorf("DestinationRules.Resolve: invalid port number in \"%s\"", destAddr)
+	}
+	if _, denied := rules.denyPorts[port]; denied {
+		return nil, 0, ErrDestinationDenied
+	}
+	if _, allowed := rules.allowPorts[port]; !allowed && len(rules.allowPorts) > 0 {
+		return nil, 0, ErrDestinationDenied
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !rules.IsAllowedIP(ip) {
+			return nil, 0, ErrDestinationDenied
+		}
+		return ip, port, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if rules.denyNames.Match([]string{name}) || rules.allowNames.Len() > 0 && !rules.allowNames.Match([]string{name}) {
+		return nil, 0, ErrDestinationDenied
+	}
+	ips, err := rules.lookupIPFunc(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, ip := range ips {
+		if rules.IsAllowedIP(ip) {
+			return ip, port, nil
+		}
+	}
+	return nil, 0, ErrDestinationDenied
+}
+
+// Check the destination against the rules and connect to its allowed IP address via TCP.
+func (rules *DestinationRules) Dial(destAddr string) (net.Conn, error) {
+	ip, port, err := rules.Resolve(destAddr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)), IOTimeoutSec)
+}
@@ -0,0 +1,115 @@
+package sockd
+
+import (
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDestinationRules(t *testing.T) {
+	rules := DestinationRules{DenyPorts: []int{0}}
+	if err := rules.Initialise(); err == nil || !strings.Contains(err.Error(), "port") {
+		t.Fatal(err)
+	}
+	rules = DestinationRules{DenyNames: []string{"/(/"}}
+	if err := rules.Initialise(); err == nil || !strings.Contains(err.Error(), "DenyNames") {
+		t.Fatal(err)
+	}
+
+	// Private addresses are denied by default
+	rules = DestinationRules{}
+	if err := rules.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"127.0.0.1:80", "[::1]:80", "10.1.2.3:22", "169.254.169.254:80", "192.168.0.1:443", "[::ffff:127.0.0.1]:80", "0.0.0.0:80"} {
+		if _, _, err := rules.Resolve(addr); err != ErrDestinationDenied {
+			t.Fatal(addr, err)
+		}
+	}
+	// Multicast, broadcast, reserved, and addresses that embed IPv4 addresses (NAT64 and 6to4) are denied as well
+	for _, addr := range []string{"224.0.0.1:80", "255.255.255.255:80", "240.0.0.1:80", "192.0.0.1:80", "198.18.0.1:80", "[ff02::1]:80", "[64:ff9b::a00:1]:80", "[2002:a00:1::]:80"} {
+		if _, _, err := rules.Resolve(addr); err != ErrDestinationDenied {
+			t.Fatal(addr, err)
+		}
+	}
+	if ip, port, err := rules.Resolve("1.2.3.4:80"); err != nil || !ip.Equal(net.IPv4(1, 2, 3, 4)) || port != 80 {
+		t.Fatal(ip, port, err)
+	}
+
+	rules = DestinationRules{
+		AllowCIDRs: []string{"1.0.0.0/8", "192.168.1.1"},
+		DenyCIDRs:  []string{"1.1.1.1"},
+		DenyPorts:  []int{25},
+		AllowNames: []string{"example.com"},
+		DenyNames:  []string{"bad.example.com"},
+	}
+	if err := rules.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Resolve names without network
+	rules.lookupIPFunc = func(host string) ([]net.IP, error) {
+		switch host {
+		case "example.com":
+			return []net.IP{net.ParseIP("1.2.3.4")}, nil
+		case "rebind.example.com":
+			return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("1.1.1.1")}, nil
+		case "mixed.example.com":
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("1.2.3.5")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	for addr, allowedIP := range map[string]string{
+		"1.2.3.4:80":             "1.2.3.4",
+		"192.168.1.1:80":         "192.168.1.1", // private but explicitly allowed
+		"example.com:443":        "1.2.3.4",
+		"EXAMPLE.COM.:443":       "1.2.3.4",
+		"mixed.example.com:443":  "1.2.3.5",
+		"1.1.1.1:80":             "",
+		"2.2.2.2:80":             "",
+		"192.168.1.2:80":         "",
+		"1.2.3.4:25":             "",
+		"bad.example.com:80":     "",
+		"example.net:80":         "",
+		"rebind.example.com:443": "",
+	} {
+		ip, _, err := rules.Resolve(addr)
+		if allowedIP == "" {
+			if err != ErrDestinationDenied {
+				t.Fatal(addr, ip, err)
+			}
+		} else if err != nil || ip.String() != allowedIP {
+			t.Fatal(addr, ip, err)
+		}
+	}
+	if _, _, err := rules.Resolve("nonexistent.example.com:80"); err == nil || err == ErrDestinationDenied {
+		t.Fatal(err)
+	}
+}
+
+func TestSockd_DestinationDenied(t *testing.T) {
+	daemon := Sockd{
+		ListenAddress:    "127.0.0.1",
+		SOCKS5ListenPort: 8726,
+		Users:            map[string]User{"user": {Password: "password"}},
+		PerIPLimit:       10,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	time.Sleep(1 * time.Second)
+	echoAddr := testhelper.StartEchoServer(t)
+	// Echo server is on loopback address, which is denied by default.
+	if conn, reply := dialSOCKS5(t, "127.0.0.1:8726", "user", "password", SOCKS5CmdConnect, echoAddr); reply != SOCKS5ReplyNotAllowed {
+		t.Fatal(reply)
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package sockd
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReplayWindowSec = 3600  // Remember handshake IVs and salts of this many recent seconds by default
+	ReplayFilterBuckets    = 6     // Number of time buckets that make up the replay window
+	ReplayBucketCapacity   = 50000 // Maximum number of IVs and salts remembered by each bucket
+
+	BadHandshakeClose = "close" // Close connection right away upon a bad handshake
+	BadHandshakeHold  = "hold"  // Read and discard data until client closes connection or IO times out
+)
+
+// A bucket remembers IVs and salts seen within a period of time.
+type replayBucket struct {
+	period int64 // Number of bucket periods since Unix epoch
+	seen   map[string]struct{}
+}
+
+/*
+Reject IVs and salts that have been seen within a window of time. The window is divided into time buckets, the oldest
+bucket is cleared and reused as time moves on, hence memory usage is bounded by number and capacity of the buckets.
+*/
+type ReplayFilter struct {
+	WindowSec int // Remember IVs and salts seen within this many seconds
+	bucketSec int64
+	buckets   []replayBucket
+	mutex     *sync.Mutex
+}
+
+// Initialise internal states.
+func (filter *ReplayFilter) Initialise() {
+	if filter.WindowSec < ReplayFilterBuckets {
+		filter.WindowSec = DefaultReplayWindowSec
+	}
+	filter.bucketSec = int64(filter.WindowSec / ReplayFilterBuckets)
+	filter.buckets = make([]replayBucket, ReplayFilterBuckets)
+	filter.mutex = new(sync.Mutex)
+}
+
+/*
+Return true if the IV or salt has not been seen within the window, and remember it. Return false if it was seen, or if
+the current bucket is full. Caller should only check IVs of handshakes that have been authenticated or parsed, so that
+garbage does not fill up the buckets.
+*/
+func (filter *ReplayFilter) Check(iv []byte) bool {
+	return filter.CheckAt(time.Now(), iv)
+}
+
+// Return true if the IV or salt has not been seen within the window that ends at the time, and remember it.
+func (filter *ReplayFilter) CheckAt(now time.Time, iv []byte) bool {
+	key := string(iv)
+	period := now.Unix() / filter.bucketSec
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	for _, bucket := range filter.buckets {
+		if period-bucket.period < ReplayFilterBuckets {
+			if _, seen := bucket.seen[key]; seen {
+				return false
+			}
+		}
+	}
+	current := &filter.buckets[period%ReplayFilterBuckets]
+	if current.period != period || current.seen == nil {
+		current.period = period
+		current.seen = make(map[string]struct{})
+	}
+	// An IV that cannot be remembered could be replayed later, hence reject it until the next period begins.
+	if len(current.seen) >= ReplayBucketCapacity {
+		return false
+	}
+	current.seen[key] = struct{}{}
+	return true
+}
+
+/*
+Respond to a malformed, unauthentic, or replayed handshake according to configuration, so that probes cannot easily tell
+the daemon apart from a server that expects more data. Caller closes the connection afterwards.
+*/
+func (sock *Sockd) handleBadHandshake(conn net.Conn) {
+	if sock.BadHandshake == BadHandshakeHold {
+		conn.SetReadDeadline(time.Now().Add(IOTimeoutSec))
+		io.Copy(ioutil.Discard, conn)
+	}
+}
@@ -0,0 +1,122 @@
+package sockd
+
+import (
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayFilter(t *testing.T) {
+	filter := &ReplayFilter{WindowSec: 60}
+	filter.Initialise()
+	now := time.Unix(1000000, 0)
+	if !filter.CheckAt(now, []byte("a")) || !filter.CheckAt(now, []byte("b")) {
+		t.Fatal("should have accepted new IVs")
+	}
+	if filter.CheckAt(now, []byte("a")) || filter.CheckAt(now.Add(50*time.Second), []byte("b")) {
+		t.Fatal("should have rejected replayed IVs")
+	}
+	// IVs are forgotten after the window
+	if !filter.CheckAt(now.Add(70*time.Second), []byte("a")) {
+		t.Fatal("should have forgotten old IV")
+	}
+	if filter.CheckAt(now.Add(71*time.Second), []byte("a")) {
+		t.Fatal("should have rejected replayed IV")
+	}
+	// A full bucket rejects new IVs until the next period begins
+	later := now.Add(200 * time.Second)
+	for i := 0; i < ReplayBucketCapacity; i++ {
+		if !filter.CheckAt(later, []byte(strconv.Itoa(i))) {
+			t.Fatal("should have accepted new IV", i)
+		}
+	}
+	if filter.CheckAt(later, []byte("new")) {
+		t.Fatal("should have rejected IV of a full bucket")
+	}
+	if !filter.CheckAt(later.Add(10*time.Second), []byte("new")) {
+		t.Fatal("should have accepted new IV in the next period")
+	}
+}
+
+// Return what the client connection writes to server when it sends the payload.
+func recordHandshake(t *testing.T, makeConn func(net.Conn) net.Conn, payload []byte, length int) []byte {
+	recorder, writer := net.Pipe()
+	go makeConn(writer).Write(payload)
+	recorder.SetDeadline(time.Now().Add(5 * time.Second))
+	handshake := make([]byte, length)
+	if _, err := io.ReadFull(recorder, handshake); err != nil {
+		t.Fatal(err)
+	}
+	return handshake
+}
+
+// Send handshake to server, return the error of reading its response.
+func sendHandshake(t *testing.T, serverAddr string, handshake []byte) error {
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(handshake); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return err
+}
+
+func TestSockd_Replay(t *testing.T) {
+	daemon := Sockd{
+		ListenAddress:  "127.0.0.1",
+		ListenPort:     8729,
+		AEADListenPort: 8730,
+		Password:       "abcdefg",
+		PerIPLimit:     10,
+		Destinations:   DestinationRules{AllowPrivate: true},
+		BadHandshake:   "wrong",
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "BadHandshake") {
+		t.Fatal(err)
+	}
+	daemon.BadHandshake = BadHandshakeHold
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	time.Sleep(1 * time.Second)
+	echoAddr := testhelper.StartEchoServer(t)
+	payload := append(EncodeSOCKS5Address(echoAddr), "hello"...)
+
+	cip := &Cipher{}
+	cip.Initialise("abcdefg")
+	legacy := recordHandshake(t, func(conn net.Conn) net.Conn {
+		return NewCipherConnection(conn, cip.Copy(), nil)
+	}, payload, cip.IVLength+len(payload))
+	aead := recordHandshake(t, func(conn net.Conn) net.Conn {
+		return NewAEADConnection(conn, DeriveAEADKey("abcdefg"))
+	}, payload, AEADSaltLength+2+AEADTagLength+len(payload)+AEADTagLength)
+
+	for serverAddr, handshake := range map[string][]byte{"127.0.0.1:8729": legacy, "127.0.0.1:8730": aead} {
+		// The first handshake is served
+		if err := sendHandshake(t, serverAddr, handshake); err != nil {
+			t.Fatal(serverAddr, err)
+		}
+		// Replayed handshake and garbage are held until timeout instead of getting an immediate close
+		for _, probe := range [][]byte{handshake, []byte(strings.Repeat("garbage", 20))} {
+			if err := sendHandshake(t, serverAddr, probe); err == nil {
+				t.Fatal(serverAddr, "should not have been served")
+			} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Fatal(serverAddr, err)
+			}
+		}
+	}
+}
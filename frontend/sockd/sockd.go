@@ -10,10 +10,12 @@ import (
 	"fmt"
 	"github.com/HouzuoGuo/laitos/global"
 	"github.com/HouzuoGuo/laitos/ratelimit"
+	"github.com/HouzuoGuo/laitos/traffic"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -39,62 +41,161 @@ const (
 
 // Intentionally undocumented magic, please move along.
 type Sockd struct {
-	ListenAddress string               `json:"ListenAddress"`
-	ListenPort    int                  `json:"ListenPort"`
-	Password      string               `json:"Password"`
-	PerIPLimit    int                  `json:"PerIPLimit"`
-	Listener      net.Listener         `json:"-"`
-	Logger        global.Logger        `json:"-"`
-	cipher        *Cipher              `json:"-"`
-	rateLimit     *ratelimit.RateLimit `json:"-"`
+	ListenAddress    string               `json:"ListenAddress"`
+	ListenPort       int                  `json:"ListenPort"`
+	Password         string               `json:"Password"`
+	PerIPLimit       int                  `json:"PerIPLimit"`
+	AEADListenPort   int                  `json:"AEADListenPort"`   // (Optional) also serve authenticated encryption protocol on this port, it shares the password.
+	SOCKS5ListenPort int                  `json:"SOCKS5ListenPort"` // (Optional) also serve standard SOCKS5 (RFC 1928) on this port
+	EnableUDP        bool                 `json:"EnableUDP"`        // (Optional) relay encrypted datagrams on UDP ports of the same numbers as ListenPort and AEADListenPort
+	Destinations     DestinationRules     `json:"Destinations"`     // (Optional) restrict destinations that clients may connect to, private addresses are denied by default.
+	Users            map[string]User      `json:"Users"`            // (Optional) named users of SOCKS5 and authenticated encryption protocol, each has own traffic counters and limits.
+	TrafficFile      string               `json:"TrafficFile"`      // (Optional) persist traffic counters of users in this JSON file across restarts
+	ReplayWindowSec  int                  `json:"ReplayWindowSec"`  // (Optional) reject handshakes that replay an IV or salt seen within this many seconds, default to 3600.
+	BadHandshake     string               `json:"BadHandshake"`     // (Optional) respond to bad handshakes of encrypted protocols by "close" (default) or "hold"
+	Listener         net.Listener         `json:"-"`
+	AEADListener     net.Listener         `json:"-"`
+	SOCKS5Listener   net.Listener         `json:"-"`
+	Logger           global.Logger        `json:"-"`
+	cipher           *Cipher              `json:"-"`
+	aeadKey          []byte               `json:"-"`
+	aeadKeys         map[string][]byte    `json:"-"` // Master keys of authenticated encryption protocol keyed by user name
+	socks5Passwords  map[string]string    `json:"-"` // SOCKS5 passwords keyed by user name
+	stopSaving       chan struct{}        `json:"-"`
+	replayFilter     *ReplayFilter        `json:"-"`
+	datagramFilter   *ReplayFilter        `json:"-"` // Reject replayed datagrams, kept apart from handshakes so that busy UDP traffic does not crowd them out.
+	rateLimit        *ratelimit.RateLimit `json:"-"`
+	udpRelays        []*UDPRelay          `json:"-"`
+	mutex            *sync.Mutex          `json:"-"`
 }
 
 func (sock *Sockd) Initialise() error {
 	if sock.ListenAddress == "" {
 		return errors.New("Sockd.Initialise: listen address must not be empty")
 	}
-	if sock.ListenPort < 1 {
+	if sock.ListenPort < 1 && sock.AEADListenPort < 1 && sock.SOCKS5ListenPort < 1 {
 		return errors.New("Sockd.Initialise: listen port must be greater than 0")
 	}
-	if len(sock.Password) < 7 {
+	if (sock.ListenPort > 0 || sock.AEADListenPort > 0) && len(sock.Password) < 7 {
 		return errors.New("Sockd.Initialise: password must be at least 7 characters long")
 	}
+	if sock.SOCKS5ListenPort > 0 && len(sock.Users) == 0 {
+		return errors.New("Sockd.Initialise: Users must not be empty if SOCKS5 is enabled")
+	}
+	for name, user := range sock.Users {
+		if name == "" || name == SharedPasswordUser || len(user.Password) < 7 {
+			return fmt.Errorf("Sockd.Initialise: user \"%s\" must have a valid name and a password of at least 7 characters", name)
+		}
+	}
 	if sock.PerIPLimit < 10 {
 		return errors.New("Sockd.Initialise: PerIPLimit must be greater than 9")
 	}
+	if sock.BadHandshake == "" {
+		sock.BadHandshake = BadHandshakeClose
+	}
+	if sock.BadHandshake != BadHandshakeClose && sock.BadHandshake != BadHandshakeHold {
+		return fmt.Errorf("Sockd.Initialise: BadHandshake must be either \"%s\" or \"%s\"", BadHandshakeClose, BadHandshakeHold)
+	}
+	if err := sock.Destinations.Initialise(); err != nil {
+		return fmt.Errorf("Sockd.Initialise: %v", err)
+	}
 	sock.cipher = &Cipher{}
 	sock.cipher.Initialise(sock.Password)
+	sock.aeadKey = DeriveAEADKey(sock.Password)
+	sock.aeadKeys = map[string][]byte{SharedPasswordUser: sock.aeadKey}
+	sock.socks5Passwords = make(map[string]string)
+	for name, user := range sock.Users {
+		sock.aeadKeys[name] = DeriveAEADKey(user.Password)
+		sock.socks5Passwords[name] = user.Password
+		traffic.Common.SetLimits(name, user.MaxConnections, user.MonthlyQuotaMB*1048576)
+	}
+	if sock.TrafficFile != "" {
+		if err := traffic.Common.Load(sock.TrafficFile); err != nil {
+			return fmt.Errorf("Sockd.Initialise: %v", err)
+		}
+	}
+	sock.stopSaving = make(chan struct{})
+	sock.replayFilter = &ReplayFilter{WindowSec: sock.ReplayWindowSec}
+	sock.replayFilter.Initialise()
+	sock.datagramFilter = &ReplayFilter{WindowSec: sock.ReplayWindowSec}
+	sock.datagramFilter.Initialise()
 	sock.rateLimit = &ratelimit.RateLimit{
 		Logger:   sock.Logger,
 		MaxCount: sock.PerIPLimit,
 		UnitSecs: RateLimitIntervalSec,
 	}
 	sock.rateLimit.Initialise()
+	sock.mutex = new(sync.Mutex)
 	return nil
 }
 
+/*
+You may call this function only after having called Initialise()!
+Start all configured listeners and block until any of them stops.
+*/
 func (sock *Sockd) StartAndBlock() error {
-	sock.Logger.Printf("StartAndBlock", "", nil, "going to listen for connections")
-	var err error
-	sock.Listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", sock.ListenAddress, sock.ListenPort))
+	errChan := make(chan error, 5)
+	if sock.ListenPort > 0 {
+		go func() {
+			errChan <- sock.StartAndBlockCipher()
+		}()
+		if sock.EnableUDP {
+			go func() {
+				decode, encode := sock.cipher.DatagramCodec(sock.datagramFilter)
+				errChan <- sock.StartAndBlockUDP(sock.ListenPort, decode, encode)
+			}()
+		}
+	}
+	if sock.AEADListenPort > 0 {
+		go func() {
+			errChan <- sock.StartAndBlockAEAD()
+		}()
+		if sock.EnableUDP {
+			go func() {
+				decode, encode := AEADDatagramCodec(sock.aeadKey, sock.datagramFilter)
+				errChan <- sock.StartAndBlockUDP(sock.AEADListenPort, decode, encode)
+			}()
+		}
+	}
+	if sock.SOCKS5ListenPort > 0 {
+		go func() {
+			errChan <- sock.StartAndBlockSOCKS5()
+		}()
+	}
+	if sock.TrafficFile != "" {
+		go sock.saveTrafficPeriodically()
+	}
+	return <-errChan
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start listener of the legacy encrypted protocol (AES-CTR without integrity protection) and block until listener is closed.
+*/
+func (sock *Sockd) StartAndBlockCipher() error {
+	sock.Logger.Printf("StartAndBlockCipher", "", nil, "going to listen for connections")
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", sock.ListenAddress, sock.ListenPort))
 	if err != nil {
-		return fmt.Errorf("Sockd.StartAndBlock: failed to listen on %s:%d - %v", sock.ListenAddress, sock.ListenPort, err)
+		return fmt.Errorf("Sockd.StartAndBlockCipher: failed to listen on %s:%d - %v", sock.ListenAddress, sock.ListenPort, err)
 	}
+	sock.mutex.Lock()
+	sock.Listener = listener
+	sock.mutex.Unlock()
 	for {
 		if global.EmergencyLockDown {
 			return global.ErrEmergencyLockDown
 		}
-		conn, err := sock.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), "closed") {
 				return nil
 			} else {
-				return fmt.Errorf("Sockd.StartAndBlock: failed to accept new connection - %v", err)
+				return fmt.Errorf("Sockd.StartAndBlockCipher: failed to accept new connection - %v", err)
 			}
 		}
 		clientIP := conn.RemoteAddr().String()[:strings.LastIndexByte(conn.RemoteAddr().String(), ':')]
 		if sock.rateLimit.Add(clientIP, true) {
-			go NewCipherConnection(conn, sock.cipher.Copy(), sock.Logger).HandleAndCloseConnection()
+			go NewCipherConnection(conn, sock.cipher.Copy(), sock).HandleAndCloseConnection()
 		} else {
 			conn.Close()
 		}
@@ -102,11 +203,33 @@ func (sock *Sockd) StartAndBlock() error {
 }
 
 func (sock *Sockd) Stop() {
+	sock.mutex.Lock()
+	defer sock.mutex.Unlock()
 	if sock.Listener != nil {
 		if err := sock.Listener.Close(); err != nil {
 			sock.Logger.Warningf("Stop", "", err, "failed to close listener")
 		}
 	}
+	if sock.AEADListener != nil {
+		if err := sock.AEADListener.Close(); err != nil {
+			sock.Logger.Warningf("Stop", "", err, "failed to close AEAD listener")
+		}
+	}
+	if sock.SOCKS5Listener != nil {
+		if err := sock.SOCKS5Listener.Close(); err != nil {
+			sock.Logger.Warningf("Stop", "", err, "failed to close SOCKS5 listener")
+		}
+	}
+	for _, relay := range sock.udpRelays {
+		relay.Close()
+	}
+	sock.udpRelays = nil
+	select {
+	case <-sock.stopSaving:
+	default:
+		close(sock.stopSaving)
+		sock.saveTraffic()
+	}
 }
 
 type Cipher struct {
@@ -195,16 +318,16 @@ type CipherConnection struct {
 	net.Conn
 	*Cipher
 	readBuf, writeBuf []byte
-	logger            global.Logger
+	daemon            *Sockd
 }
 
-func NewCipherConnection(netConn net.Conn, cip *Cipher, logger global.Logger) *CipherConnection {
+func NewCipherConnection(netConn net.Conn, cip *Cipher, daemon *Sockd) *CipherConnection {
 	return &CipherConnection{
 		Conn:     netConn,
 		Cipher:   cip,
 		readBuf:  make([]byte, MaxPacketSize),
 		writeBuf: make([]byte, MaxPacketSize),
-		logger:   logger,
+		daemon:   daemon,
 	}
 }
 
@@ -318,23 +441,40 @@ func (conn *CipherConnection) HandleAndCloseConnection() {
 		conn.Close()
 	}()
 
+	logger := conn.daemon.Logger
 	destAddr, err := conn.ParseRequest()
 	if err != nil {
-		conn.logger.Warningf("HandleAndCloseConnection", remoteAddr, err, "failed to get destination address")
+		logger.Warningf("HandleAndCloseConnection", remoteAddr, err, "failed to get destination address")
+		conn.daemon.handleBadHandshake(conn.Conn)
 		return
 	}
 	if strings.ContainsRune(destAddr, 0x00) {
-		conn.logger.Warningf("HandleAndCloseConnection", remoteAddr, err, "will not serve invalid destination address with 0 in it")
+		logger.Warningf("HandleAndCloseConnection", remoteAddr, err, "will not serve invalid destination address with 0 in it")
+		conn.daemon.handleBadHandshake(conn.Conn)
+		return
+	}
+	if !conn.daemon.replayFilter.Check(conn.IV) {
+		logger.Warningf("HandleAndCloseConnection", remoteAddr, nil, "rejected replayed handshake")
+		conn.daemon.handleBadHandshake(conn.Conn)
 		return
 	}
-	dest, err := net.DialTimeout("tcp", destAddr, IOTimeoutSec)
+	client, err := accountConnection(conn, SharedPasswordUser)
 	if err != nil {
-		conn.logger.Warningf("HandleAndCloseConnection", remoteAddr, err, "failed to connect to destination \"%s\"", destAddr)
+		logger.Warningf("HandleAndCloseConnection", remoteAddr, err, "refused connection")
+		return
+	}
+	defer client.Close()
+	dest, err := conn.daemon.Destinations.Dial(destAddr)
+	if err == ErrDestinationDenied {
+		logger.Warningf("HandleAndCloseConnection", remoteAddr, nil, "denied access to destination \"%s\"", destAddr)
+		return
+	} else if err != nil {
+		logger.Warningf("HandleAndCloseConnection", remoteAddr, err, "failed to connect to destination \"%s\"", destAddr)
 		return
 	}
 	defer dest.Close()
-	go PipeAndCloseConnection(conn, dest)
-	PipeAndCloseConnection(dest, conn)
+	go PipeAndCloseConnection(client, dest)
+	PipeAndCloseConnection(dest, client)
 	return
 }
 
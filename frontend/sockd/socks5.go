@@ -0,0 +1,251 @@
+package sockd
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SOCKS5Version            = 5    // Protocol version of SOCKS5 (RFC 1928)
+	SOCKS5AuthVersion        = 1    // Version of username/password authentication sub-negotiation (RFC 1929)
+	SOCKS5MethodUserPass     = 2    // Authentication method of username/password
+	SOCKS5MethodNoAcceptable = 0xff // None of the authentication methods offered by client is acceptable
+
+	SOCKS5CmdConnect      = 1 // Command that connects to a TCP destination
+	SOCKS5CmdUDPAssociate = 3 // Command that relays UDP datagrams
+
+	SOCKS5ReplySucceeded           = 0 // Request is granted
+	SOCKS5ReplyGeneralFailure      = 1 // General server failure
+	SOCKS5ReplyNotAllowed          = 2 // Connection is not allowed by rule set
+	SOCKS5ReplyHostUnreachable     = 4 // Destination cannot be reached
+	SOCKS5ReplyCommandNotSupported = 7 // Command is not supported
+	SOCKS5ReplyAddressNotSupported = 8 // Address type is not supported
+)
+
+var ErrSOCKS5AddressType = errors.New("unsupported SOCKS5 address type")
+
+// Read a SOCKS5 address made of address type, address, and port, and return it in "host:port" form.
+func ReadSOCKS5Address(reader io.Reader) (string, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(reader, addrType); err != nil {
+		return "", err
+	}
+	var host string
+	switch addrType[0] {
+	case AddressTypeIPv4, AddressTypeIPv6:
+		ip := make([]byte, net.IPv4len)
+		if addrType[0] == AddressTypeIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case AddressTypeDM:
+		nameLen := make([]byte, 1)
+		if _, err := io.ReadFull(reader, nameLen); err != nil {
+			return "", err
+		}
+		name := make([]byte, nameLen[0])
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+		if strings.ContainsRune(host, 0x00) {
+			return "", errors.New("invalid destination address with 0 in it")
+		}
+	default:
+		return "", ErrSOCKS5AddressType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Encode "host:port" address into SOCKS5 address made of address type, address, and port.
+func EncodeSOCKS5Address(addr string) []byte {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []byte{AddressTypeIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	port, _ := strconv.Atoi(portStr)
+	var ret []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			host = host[:255]
+		}
+		ret = append([]byte{AddressTypeDM, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		ret = append([]byte{AddressTypeIPv4}, ip4...)
+	} else {
+		ret = append([]byte{AddressTypeIPv6}, ip.To16()...)
+	}
+	return append(ret, byte(port>>8), byte(port))
+}
+
+// Send a reply to SOCKS5 client, the reply carries the bound address.
+func writeSOCKS5Reply(conn net.Conn, reply byte, boundAddr string) error {
+	conn.SetWriteDeadline(time.Now().Add(IOTimeoutSec))
+	_, err := conn.Write(append([]byte{SOCKS5Version, reply, 0}, EncodeSOCKS5Address(boundAddr)...))
+	return err
+}
+
+// Negotiate authentication method with SOCKS5 client and check its username and password. Return the username.
+func (sock *Sockd) authenticateSOCKS5(conn net.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(IOTimeoutSec))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != SOCKS5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	conn.SetWriteDeadline(time.Now().Add(IOTimeoutSec))
+	if !strings.ContainsRune(string(methods), SOCKS5MethodUserPass) {
+		conn.Write([]byte{SOCKS5Version, SOCKS5MethodNoAcceptable})
+		return "", errors.New("client does not offer username/password authentication")
+	}
+	if _, err := conn.Write([]byte{SOCKS5Version, SOCKS5MethodUserPass}); err != nil {
+		return "", err
+	}
+	// Username and password sub-negotiation (RFC 1929)
+	readString := func() (string, error) {
+		strLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, strLen); err != nil {
+			return "", err
+		}
+		str := make([]byte, strLen[0])
+		_, err := io.ReadFull(conn, str)
+		return string(str), err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return "", err
+	}
+	if version[0] != SOCKS5AuthVersion {
+		return "", fmt.Errorf("unsupported authentication version %d", version[0])
+	}
+	username, err := readString()
+	if err != nil {
+		return "", err
+	}
+	password, err := readString()
+	if err != nil {
+		return "", err
+	}
+	expected, exists := sock.socks5Passwords[username]
+	if !exists || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		conn.Write([]byte{SOCKS5AuthVersion, 1})
+		return username, errors.New("incorrect username or password")
+	}
+	_, err = conn.Write([]byte{SOCKS5AuthVersion, 0})
+	return username, err
+}
+
+// Authenticate SOCKS5 client, carry out its request, and close the connection.
+func (sock *Sockd) HandleSOCKS5Connection(netConn net.Conn) {
+	defer netConn.Close()
+	remoteAddr := netConn.RemoteAddr().String()
+	username, err := sock.authenticateSOCKS5(netConn)
+	if err != nil {
+		sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, err, "failed to authenticate user \"%s\"", username)
+		return
+	}
+	conn, err := accountConnection(netConn, username)
+	if err != nil {
+		writeSOCKS5Reply(netConn, SOCKS5ReplyNotAllowed, "")
+		sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, err, "refused connection of user \"%s\"", username)
+		return
+	}
+	defer conn.Close()
+	// Read request made of version, command, reserved byte, and destination address
+	conn.SetReadDeadline(time.Now().Add(IOTimeoutSec))
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, err, "failed to read request")
+		return
+	}
+	destAddr, err := ReadSOCKS5Address(conn)
+	if err != nil {
+		if err == ErrSOCKS5AddressType {
+			writeSOCKS5Reply(conn, SOCKS5ReplyAddressNotSupported, "")
+		}
+		sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, err, "failed to get destination address")
+		return
+	}
+	if header[0] != SOCKS5Version || header[1] != SOCKS5CmdConnect && header[1] != SOCKS5CmdUDPAssociate {
+		writeSOCKS5Reply(conn, SOCKS5ReplyCommandNotSupported, "")
+		sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, nil, "unsupported command %d", header[1])
+		return
+	}
+	if header[1] == SOCKS5CmdUDPAssociate {
+		if err := sock.associateSOCKS5UDP(netConn, username); err != nil {
+			sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, err, "failed to relay UDP datagrams")
+		}
+		return
+	}
+	dest, err := sock.Destinations.Dial(destAddr)
+	if err == ErrDestinationDenied {
+		writeSOCKS5Reply(conn, SOCKS5ReplyNotAllowed, "")
+		sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, nil, "denied access to destination \"%s\"", destAddr)
+		return
+	} else if err != nil {
+		writeSOCKS5Reply(conn, SOCKS5ReplyHostUnreachable, "")
+		sock.Logger.Warningf("HandleSOCKS5Connection", remoteAddr, err, "failed to connect to destination \"%s\"", destAddr)
+		return
+	}
+	defer dest.Close()
+	if err := writeSOCKS5Reply(conn, SOCKS5ReplySucceeded, dest.LocalAddr().String()); err != nil {
+		return
+	}
+	go PipeAndCloseConnection(conn, dest)
+	PipeAndCloseConnection(dest, conn)
+}
+
+/*
+You may call this function only after having called Initialise()!
+Start standard SOCKS5 listener and block until listener is closed.
+*/
+func (sock *Sockd) StartAndBlockSOCKS5() error {
+	listenAddr := net.JoinHostPort(sock.ListenAddress, strconv.Itoa(sock.SOCKS5ListenPort))
+	sock.Logger.Printf("StartAndBlockSOCKS5", listenAddr, nil, "going to listen for SOCKS5 connections")
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("Sockd.StartAndBlockSOCKS5: failed to listen on %s - %v", listenAddr, err)
+	}
+	sock.mutex.Lock()
+	sock.SOCKS5Listener = listener
+	sock.mutex.Unlock()
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("Sockd.StartAndBlockSOCKS5: failed to accept new connection - %v", err)
+		}
+		clientIP := conn.RemoteAddr().String()[:strings.LastIndexByte(conn.RemoteAddr().String(), ':')]
+		if sock.rateLimit.Add(clientIP, true) {
+			go sock.HandleSOCKS5Connection(conn)
+		} else {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package sockd
+
+import (
+	"bytes"
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Authenticate with SOCKS5 server and send a request of the command, return the connection and server's reply code.
+func dialSOCKS5(t *testing.T, serverAddr, username, password string, cmd byte, destAddr string) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{SOCKS5Version, 2, 0, SOCKS5MethodUserPass}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, []byte{SOCKS5Version, SOCKS5MethodUserPass}) {
+		t.Fatal(err, reply)
+	}
+	auth := append([]byte{SOCKS5AuthVersion, byte(len(username))}, username...)
+	auth = append(auth, byte(len(password)))
+	if _, err := conn.Write(append(auth, password...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	} else if reply[1] != 0 {
+		conn.Close()
+		return nil, SOCKS5ReplyNotAllowed
+	}
+	if _, err := conn.Write(append([]byte{SOCKS5Version, cmd, 0}, EncodeSOCKS5Address(destAddr)...)); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSOCKS5Address(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn, header[1]
+}
+
+func TestSOCKS5Address(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:80", "[fd00::1]:443", "example.com:8080"} {
+		if decoded, err := ReadSOCKS5Address(bytes.NewReader(EncodeSOCKS5Address(addr))); err != nil || decoded != addr {
+			t.Fatal(decoded, err)
+		}
+	}
+	if _, err := ReadSOCKS5Address(bytes.NewReader([]byte{9, 1, 2, 3})); err != ErrSOCKS5AddressType {
+		t.Fatal(err)
+	}
+	if _, err := ReadSOCKS5Address(bytes.NewReader([]byte{AddressTypeDM, 3, 'a', 0, 'b', 0, 80})); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestSockd_SOCKS5(t *testing.T) {
+	daemon := Sockd{ListenAddress: "127.0.0.1", SOCKS5ListenPort: 8721, PerIPLimit: 10, Destinations: DestinationRules{AllowPrivate: true}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "Users") {
+		t.Fatal(err)
+	}
+	daemon.Users = map[string]User{"user": {Password: "short"}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Fatal(err)
+	}
+	daemon.Users = map[string]User{"user": {Password: "password"}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- daemon.StartAndBlock()
+	}()
+	time.Sleep(1 * time.Second)
+	echoAddr := testhelper.StartEchoServer(t)
+
+	// Incorrect password
+	if conn, _ := dialSOCKS5(t, "127.0.0.1:8721", "user", "wrong password", SOCKS5CmdConnect, echoAddr); conn != nil {
+		t.Fatal("should not have authenticated")
+	}
+	// Unsupported command (BIND)
+	if conn, reply := dialSOCKS5(t, "127.0.0.1:8721", "user", "password", 2, echoAddr); reply != SOCKS5ReplyCommandNotSupported {
+		t.Fatal(reply)
+	} else {
+		conn.Close()
+	}
+	// Connect to echo server through SOCKS5
+	conn, reply := dialSOCKS5(t, "127.0.0.1:8721", "user", "password", SOCKS5CmdConnect, echoAddr)
+	if reply != SOCKS5ReplySucceeded {
+		t.Fatal(reply)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello SOCKS5")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello SOCKS5" {
+		t.Fatal(err, string(buf))
+	}
+
+	daemon.Stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not stop")
+	}
+}
@@ -0,0 +1,484 @@
+package sockd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/HouzuoGuo/laitos/global"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UDPAssociationTimeout = 2 * time.Minute // Forget a UDP association after it has been idle for this long
+	UDPResolveCacheTTL    = 1 * time.Minute // Remember the resolved destination of datagrams for this long
+	MaxUDPResolveCache    = 1024            // Maximum number of resolved destinations remembered by a relay
+	MaxUDPPendingLookups  = 16              // Maximum number of destination name lookups carried out concurrently by a relay
+)
+
+var (
+	ErrBadDatagram      = errors.New("malformed or unauthentic datagram")
+	ErrReplayedDatagram = errors.New("replayed datagram")
+)
+
+// Decode a datagram received from client into destination address and payload.
+type DatagramDecoder func(datagram []byte) (destAddr string, payload []byte, err error)
+
+// Encode payload received from source address into a datagram for client.
+type DatagramEncoder func(srcAddr string, payload []byte) ([]byte, error)
+
+// A UDP association relays datagrams between a client and destinations via its own outbound socket.
+type udpAssociation struct {
+	clientAddr   *net.UDPAddr
+	outbound     *net.UDPConn
+	lastActive   int64               // Unix nanoseconds of the latest datagram in either direction
+	destinations map[string]struct{} // Destinations that client has sent datagrams to, protected by relay mutex.
+}
+
+// Destination of datagrams that was recently resolved and checked against destination rules.
+type resolvedDestination struct {
+	addr   *net.UDPAddr // Nil if the destination is denied
+	expiry time.Time
+}
+
+/*
+Relay datagrams between clients and destinations. Each client address gets its own association and outbound socket, an
+association is closed after it has been idle for a while.
+*/
+type UDPRelay struct {
+	Conn         *net.UDPConn                     // Receive datagrams from clients and send replies to them
+	Decode       DatagramDecoder                  // Decode datagrams made by clients
+	Encode       DatagramEncoder                  // Encode replies for clients
+	AllowClient  func(*net.UDPAddr) bool          // (Optional) decide whether a new client association is allowed
+	AllowDest    func(*net.UDPAddr, string) bool  // (Optional) decide whether client may send to a destination its association has not used
+	Timeout      time.Duration                    // Close idle associations after this long, default to UDPAssociationTimeout.
+	Destinations *DestinationRules                // (Optional) restrict destinations of datagrams
+	Account      func(upload, download int) error // (Optional) count payload bytes, datagram is dropped if it returns an error.
+	Logger       global.Logger                    // Logger
+	assocs       map[string]*udpAssociation       // Associations keyed by client address
+	resolved     map[string]resolvedDestination   // Recently resolved destinations keyed by destination address
+	lookupSlots  chan struct{}                    // Limit number of concurrent destination name lookups
+	mutex        *sync.Mutex                      // Protect against concurrent access to associations and resolved destinations
+}
+
+// Initialise internal states.
+func (relay *UDPRelay) Initialise() {
+	if relay.Timeout <= 0 {
+		relay.Timeout = UDPAssociationTimeout
+	}
+	relay.assocs = make(map[string]*udpAssociation)
+	relay.resolved = make(map[string]resolvedDestination)
+	relay.lookupSlots = make(chan struct{}, MaxUDPPendingLookups)
+	relay.mutex = new(sync.Mutex)
+}
+
+// Return the number of active associations.
+func (relay *UDPRelay) NumAssociations() int {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return len(relay.assocs)
+}
+
+// Return the recently resolved destination. The second return value is false if the destination is not yet resolved.
+func (relay *UDPRelay) getResolved(destAddr string) (resolvedDestination, bool) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	dest, found := relay.resolved[destAddr]
+	if found && time.Now().After(dest.expiry) {
+		delete(relay.resolved, destAddr)
+		return dest, false
+	}
+	return dest, found
+}
+
+// Return true if resolving the destination address involves a name lookup that may take a while.
+func (relay *UDPRelay) needsLookup(destAddr string) bool {
+	host, _, err := net.SplitHostPort(destAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		return false
+	}
+	_, found := relay.getResolved(destAddr)
+	return !found
+}
+
+/*
+Resolve destination address of a datagram, return ErrDestinationDenied if destination rules deny it. Both resolved and
+denied destinations are remembered for a while.
+*/
+func (relay *UDPRelay) resolve(destAddr string) (*net.UDPAddr, error) {
+	if dest, found := relay.getResolved(destAddr); found {
+		if dest.addr == nil {
+			return nil, ErrDestinationDenied
+		}
+		return dest.addr, nil
+	}
+	var udpDestAddr *net.UDPAddr
+	var err error
+	if relay.Destinations == nil {
+		udpDestAddr, err = net.ResolveUDPAddr("udp", destAddr)
+	} else {
+		var ip net.IP
+		var port int
+		if ip, port, err = relay.Destinations.Resolve(destAddr); err == nil {
+			udpDestAddr = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+	if err == nil || err == ErrDestinationDenied {
+		relay.mutex.Lock()
+		if len(relay.resolved) >= MaxUDPResolveCache {
+			relay.resolved = make(map[string]resolvedDestination)
+		}
+		relay.resolved[destAddr] = resolvedDestination{addr: udpDestAddr, expiry: time.Now().Add(UDPResolveCacheTTL)}
+		relay.mutex.Unlock()
+	}
+	return udpDestAddr, err
+}
+
+/*
+Return the association of client address, create a new one if it does not yet exist. The first destination of a new
+association is considered used, hence it is only subject to AllowClient.
+*/
+func (relay *UDPRelay) getAssociation(clientAddr *net.UDPAddr, destAddr string) (*udpAssociation, error) {
+	key := clientAddr.String()
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if assoc, exists := relay.assocs[key]; exists {
+		return assoc, nil
+	}
+	if relay.AllowClient != nil && !relay.AllowClient(clientAddr) {
+		return nil, errors.New("client is not allowed to make new association")
+	}
+	outbound, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	assoc := &udpAssociation{
+		clientAddr:   clientAddr,
+		outbound:     outbound,
+		lastActive:   time.Now().UnixNano(),
+		destinations: map[string]struct{}{destAddr: {}},
+	}
+	relay.assocs[key] = assoc
+	go relay.relayReplies(assoc)
+	return assoc, nil
+}
+
+// Send replies of destinations back to client until the association becomes idle.
+func (relay *UDPRelay) relayReplies(assoc *udpAssociation) {
+	defer func() {
+		relay.mutex.Lock()
+		if relay.assocs[assoc.clientAddr.String()] == assoc {
+			delete(relay.assocs, assoc.clientAddr.String())
+		}
+		relay.mutex.Unlock()
+		assoc.outbound.Close()
+	}()
+	buf := make([]byte, MaxPacketSize)
+	for {
+		assoc.outbound.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&assoc.lastActive)).Add(relay.Timeout))
+		n, srcAddr, err := assoc.outbound.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&assoc.lastActive))) < relay.Timeout {
+				continue
+			}
+			return
+		}
+		atomic.StoreInt64(&assoc.lastActive, time.Now().UnixNano())
+		if relay.Account != nil && relay.Account(0, n) != nil {
+			continue
+		}
+		reply, err := relay.Encode(srcAddr.String(), buf[:n])
+		if err != nil {
+			continue
+		}
+		relay.Conn.SetWriteDeadline(time.Now().Add(IOTimeoutSec))
+		if _, err := relay.Conn.WriteToUDP(reply, assoc.clientAddr); err != nil {
+			relay.Logger.Warningf("UDPRelay", assoc.clientAddr.String(), err, "failed to send reply to client")
+		}
+	}
+}
+
+/*
+You may call this function only after having called Initialise()!
+Relay datagrams made by clients and block until the relay is closed.
+*/
+func (relay *UDPRelay) StartAndBlock() error {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		if global.EmergencyLockDown {
+			return global.ErrEmergencyLockDown
+		}
+		n, clientAddr, err := relay.Conn.ReadFromUDP(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return err
+		}
+		destAddr, payload, err := relay.Decode(buf[:n])
+		if err != nil {
+			relay.Logger.Warningf("UDPRelay", clientAddr.String(), err, "failed to decode datagram")
+			continue
+		}
+		if !relay.needsLookup(destAddr) {
+			relay.forward(clientAddr, destAddr, payload)
+			continue
+		}
+		// Look up destination name in background so that datagrams of other clients are not held up
+		select {
+		case relay.lookupSlots <- struct{}{}:
+			go func(payload []byte) {
+				relay.forward(clientAddr, destAddr, payload)
+				<-relay.lookupSlots
+			}(append([]byte{}, payload...))
+		default:
+			relay.Logger.Warningf("UDPRelay", clientAddr.String(), nil, "too many pending lookups, dropped datagram to \"%s\"", destAddr)
+		}
+	}
+}
+
+/*
+Check and resolve destination of the datagram, and then send its payload via the client's association. The association
+is only made for datagrams of allowed destinations.
+*/
+func (relay *UDPRelay) forward(clientAddr *net.UDPAddr, destAddr string, payload []byte) {
+	udpDestAddr, err := relay.resolve(destAddr)
+	if err == ErrDestinationDenied {
+		relay.Logger.Warningf("UDPRelay", clientAddr.String(), nil, "denied access to destination \"%s\"", destAddr)
+		return
+	} else if err != nil {
+		relay.Logger.Warningf("UDPRelay", clientAddr.String(), err, "failed to resolve destination \"%s\"", destAddr)
+		return
+	}
+	assoc, err := relay.getAssociation(clientAddr, udpDestAddr.String())
+	if err != nil {
+		relay.Logger.Warningf("UDPRelay", clientAddr.String(), err, "failed to make association")
+		return
+	}
+	if !relay.allowDestination(assoc, udpDestAddr.String()) {
+		relay.Logger.Warningf("UDPRelay", clientAddr.String(), nil, "dropped datagram to new destination \"%s\"", destAddr)
+		return
+	}
+	atomic.StoreInt64(&assoc.lastActive, time.Now().UnixNano())
+	if relay.Account != nil {
+		if err := relay.Account(len(payload), 0); err != nil {
+			relay.Logger.Warningf("UDPRelay", clientAddr.String(), err, "dropped datagram")
+			return
+		}
+	}
+	if _, err := assoc.outbound.WriteToUDP(payload, udpDestAddr); err != nil {
+		relay.Logger.Warningf("UDPRelay", clientAddr.String(), err, "failed to send datagram to \"%s\"", destAddr)
+	}
+}
+
+// Return true if the association has used the destination before, or if it may send datagrams to the new destination.
+func (relay *UDPRelay) allowDestination(assoc *udpAssociation, destAddr string) bool {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if _, used := assoc.destinations[destAddr]; used {
+		return true
+	}
+	if relay.AllowDest != nil && !relay.AllowDest(assoc.clientAddr, destAddr) {
+		return false
+	}
+	assoc.destinations[destAddr] = struct{}{}
+	return true
+}
+
+// Close the client-facing socket and all associations.
+func (relay *UDPRelay) Close() {
+	relay.Conn.Close()
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	for key, assoc := range relay.assocs {
+		assoc.outbound.Close()
+		delete(relay.assocs, key)
+	}
+}
+
+// Decode SOCKS5 UDP request header (RFC 1928 section 7). Fragmented datagrams are not supported.
+func DecodeSOCKS5Datagram(datagram []byte) (string, []byte, error) {
+	if len(datagram) < 4 || datagram[2] != 0 {
+		return "", nil, ErrBadDatagram
+	}
+	reader := bytes.NewReader(datagram[3:])
+	destAddr, err := ReadSOCKS5Address(reader)
+	if err != nil {
+		return "", nil, ErrBadDatagram
+	}
+	return destAddr, datagram[len(datagram)-reader.Len():], nil
+}
+
+// Encode payload into SOCKS5 UDP reply that carries source address.
+func EncodeSOCKS5Datagram(srcAddr string, payload []byte) ([]byte, error) {
+	return append(append([]byte{0, 0, 0}, EncodeSOCKS5Address(srcAddr)...), payload...), nil
+}
+
+// Split decrypted datagram into destination address and payload.
+func splitAddressAndPayload(plain []byte) (string, []byte, error) {
+	reader := bytes.NewReader(plain)
+	destAddr, err := ReadSOCKS5Address(reader)
+	if err != nil {
+		return "", nil, ErrBadDatagram
+	}
+	return destAddr, plain[len(plain)-reader.Len():], nil
+}
+
+/*
+Return datagram codec of the legacy encrypted protocol, each datagram is made of IV followed by AES-CTR encrypted address
+and payload. If replay filter is given, decoder rejects datagrams that reuse an IV.
+*/
+func (cip *Cipher) DatagramCodec(replayFilter *ReplayFilter) (DatagramDecoder, DatagramEncoder) {
+	decode := func(datagram []byte) (string, []byte, error) {
+		if len(datagram) <= cip.IVLength {
+			return "", nil, ErrBadDatagram
+		}
+		stream, err := cip.GetCipherStream(cip.Key, datagram[:cip.IVLength])
+		if err != nil {
+			return "", nil, err
+		}
+		plain := make([]byte, len(datagram)-cip.IVLength)
+		stream.XORKeyStream(plain, datagram[cip.IVLength:])
+		destAddr, payload, err := splitAddressAndPayload(plain)
+		if err == nil && replayFilter != nil && !replayFilter.Check(datagram[:cip.IVLength]) {
+			return "", nil, ErrReplayedDatagram
+		}
+		return destAddr, payload, err
+	}
+	encode := func(srcAddr string, payload []byte) ([]byte, error) {
+		plain := append(EncodeSOCKS5Address(srcAddr), payload...)
+		datagram := make([]byte, cip.IVLength+len(plain))
+		if _, err := io.ReadFull(rand.Reader, datagram[:cip.IVLength]); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(cip.Key)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCTR(block, datagram[:cip.IVLength]).XORKeyStream(datagram[cip.IVLength:], plain)
+		return datagram, nil
+	}
+	return decode, encode
+}
+
+/*
+Return datagram codec of authenticated encryption protocol. Each datagram is made of random salt followed by address and
+payload sealed by the key derived from master key and salt, the nonce is zero. If replay filter is given, decoder rejects
+datagrams that reuse a salt.
+*/
+func AEADDatagramCodec(masterKey []byte, replayFilter *ReplayFilter) (DatagramDecoder, DatagramEncoder) {
+	decode := func(datagram []byte) (string, []byte, error) {
+		if len(datagram) <= AEADSaltLength {
+			return "", nil, ErrBadDatagram
+		}
+		aead, err := newAEADCipher(masterKey, datagram[:AEADSaltLength])
+		if err != nil {
+			return "", nil, err
+		}
+		plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), datagram[AEADSaltLength:], nil)
+		if err != nil {
+			return "", nil, ErrBadDatagram
+		}
+		// Only authentic datagrams are remembered by replay filter
+		if replayFilter != nil && !replayFilter.Check(datagram[:AEADSaltLength]) {
+			return "", nil, ErrReplayedDatagram
+		}
+		return splitAddressAndPayload(plain)
+	}
+	encode := func(srcAddr string, payload []byte) ([]byte, error) {
+		salt := make([]byte, AEADSaltLength)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+		aead, err := newAEADCipher(masterKey, salt)
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), append(EncodeSOCKS5Address(srcAddr), payload...), nil), nil
+	}
+	return decode, encode
+}
+
+/*
+You may call this function only after having called Initialise()!
+Relay encrypted datagrams on the UDP port and block until the relay is closed. New associations are subject to per-IP
+rate limit.
+*/
+func (sock *Sockd) StartAndBlockUDP(port int, decode DatagramDecoder, encode DatagramEncoder) error {
+	listenAddr := net.JoinHostPort(sock.ListenAddress, strconv.Itoa(port))
+	udpAddr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("Sockd.StartAndBlockUDP: failed to resolve %s - %v", listenAddr, err)
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("Sockd.StartAndBlockUDP: failed to listen on %s - %v", listenAddr, err)
+	}
+	relay := &UDPRelay{
+		Conn:   udpConn,
+		Decode: decode,
+		Encode: encode,
+		AllowClient: func(clientAddr *net.UDPAddr) bool {
+			return sock.rateLimit.Add(clientAddr.IP.String(), true)
+		},
+		AllowDest: func(clientAddr *net.UDPAddr, _ string) bool {
+			return sock.rateLimit.Add(clientAddr.IP.String(), true)
+		},
+		Destinations: &sock.Destinations,
+		Account:      accountDatagrams(SharedPasswordUser),
+		Logger:       sock.Logger,
+	}
+	relay.Initialise()
+	sock.mutex.Lock()
+	sock.udpRelays = append(sock.udpRelays, relay)
+	sock.mutex.Unlock()
+	sock.Logger.Printf("StartAndBlockUDP", listenAddr, nil, "going to relay datagrams")
+	return relay.StartAndBlock()
+}
+
+/*
+Carry out SOCKS5 UDP associate request. Datagrams are relayed via a new UDP socket for as long as the control connection
+stays open, and only the client of the control connection may use it.
+*/
+func (sock *Sockd) associateSOCKS5UDP(conn net.Conn, username string) error {
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: conn.LocalAddr().(*net.TCPAddr).IP})
+	if err != nil {
+		writeSOCKS5Reply(conn, SOCKS5ReplyGeneralFailure, "")
+		return err
+	}
+	relay := &UDPRelay{
+		Conn:   udpConn,
+		Decode: DecodeSOCKS5Datagram,
+		Encode: EncodeSOCKS5Datagram,
+		AllowClient: func(clientAddr *net.UDPAddr) bool {
+			return clientAddr.IP.Equal(clientIP) && sock.rateLimit.Add(clientAddr.IP.String(), true)
+		},
+		AllowDest: func(clientAddr *net.UDPAddr, _ string) bool {
+			return sock.rateLimit.Add(clientAddr.IP.String(), true)
+		},
+		Destinations: &sock.Destinations,
+		Account:      accountDatagrams(username),
+		Logger:       sock.Logger,
+	}
+	relay.Initialise()
+	defer relay.Close()
+	if err := writeSOCKS5Reply(conn, SOCKS5ReplySucceeded, udpConn.LocalAddr().String()); err != nil {
+		return err
+	}
+	go relay.StartAndBlock()
+	// The association terminates when control connection closes
+	conn.SetReadDeadline(time.Time{})
+	io.Copy(ioutil.Discard, conn)
+	return nil
+}
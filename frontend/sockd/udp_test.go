@@ -0,0 +1,268 @@
+package sockd
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Start a UDP server that echoes every datagram, return its address.
+func startUDPEchoServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// Send a datagram encoded by client codec to the relay and return decoded reply.
+func exchangeDatagram(t *testing.T, relayAddr string, encode DatagramEncoder, decode DatagramDecoder, destAddr string, payload []byte) (string, []byte) {
+	conn, err := net.Dial("udp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Client encodes destination address the same way as relay encodes source address
+	datagram, err := encode(destAddr, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(datagram); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MaxPacketSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcAddr, reply, err := decode(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srcAddr, reply
+}
+
+func TestDatagramCodec(t *testing.T) {
+	cip := &Cipher{}
+	cip.Initialise("abcdefg")
+	legacyDecode, legacyEncode := cip.DatagramCodec(nil)
+	aeadDecode, aeadEncode := AEADDatagramCodec(DeriveAEADKey("abcdefg"), nil)
+	for _, codec := range []struct {
+		decode DatagramDecoder
+		encode DatagramEncoder
+	}{{legacyDecode, legacyEncode}, {aeadDecode, aeadEncode}, {DecodeSOCKS5Datagram, EncodeSOCKS5Datagram}} {
+		datagram, err := codec.encode("example.com:53", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr, payload, err := codec.decode(datagram); err != nil || addr != "example.com:53" || string(payload) != "hello" {
+			t.Fatal(addr, payload, err)
+		}
+	}
+	// Tampered datagram of authenticated encryption is rejected
+	datagram, _ := aeadEncode("example.com:53", []byte("hello"))
+	datagram[len(datagram)-1] ^= 1
+	if _, _, err := aeadDecode(datagram); err != ErrBadDatagram {
+		t.Fatal(err)
+	}
+	// Datagrams that reuse an IV or salt are rejected
+	filter := &ReplayFilter{}
+	filter.Initialise()
+	legacyDecode, legacyEncode = cip.DatagramCodec(filter)
+	aeadDecode, aeadEncode = AEADDatagramCodec(DeriveAEADKey("abcdefg"), filter)
+	for _, codec := range []struct {
+		decode DatagramDecoder
+		encode DatagramEncoder
+	}{{legacyDecode, legacyEncode}, {aeadDecode, aeadEncode}} {
+		datagram, _ := codec.encode("example.com:53", []byte("hello"))
+		if _, _, err := codec.decode(datagram); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := codec.decode(datagram); err != ErrReplayedDatagram {
+			t.Fatal(err)
+		}
+	}
+	// Fragmented SOCKS5 datagram is not supported
+	if _, _, err := DecodeSOCKS5Datagram([]byte{0, 0, 1, AddressTypeIPv4, 1, 2, 3, 4, 0, 53}); err != ErrBadDatagram {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPRelay_Timeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &UDPRelay{Conn: conn, Decode: DecodeSOCKS5Datagram, Encode: EncodeSOCKS5Datagram, Timeout: 1 * time.Second}
+	relay.Initialise()
+	go relay.StartAndBlock()
+	defer relay.Close()
+	echoAddr := startUDPEchoServer(t)
+	if _, reply := exchangeDatagram(t, conn.LocalAddr().String(), EncodeSOCKS5Datagram, DecodeSOCKS5Datagram, echoAddr, []byte("hi")); string(reply) != "hi" {
+		t.Fatal(string(reply))
+	}
+	if relay.NumAssociations() != 1 {
+		t.Fatal(relay.NumAssociations())
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if relay.NumAssociations() != 0 {
+		t.Fatal("association did not time out")
+	}
+}
+
+func TestUDPRelay_Destination(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoAddr := startUDPEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+	var numLookups int32
+	rules := &DestinationRules{AllowPrivate: true, DenyNames: []string{"denied.example.com"}}
+	if err := rules.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	rules.lookupIPFunc = func(host string) ([]net.IP, error) {
+		atomic.AddInt32(&numLookups, 1)
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+	}
+	relay := &UDPRelay{Conn: conn, Decode: DecodeSOCKS5Datagram, Encode: EncodeSOCKS5Datagram, Destinations: rules}
+	relay.Initialise()
+	go relay.StartAndBlock()
+	defer relay.Close()
+	// Datagram toward denied destination does not make an association
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	datagram, _ := EncodeSOCKS5Datagram("denied.example.com:"+echoPort, []byte("hi"))
+	client.Write(datagram)
+	time.Sleep(500 * time.Millisecond)
+	if relay.NumAssociations() != 0 {
+		t.Fatal(relay.NumAssociations())
+	}
+	// Destination name is looked up only once
+	for i := 0; i < 2; i++ {
+		if _, reply := exchangeDatagram(t, conn.LocalAddr().String(), EncodeSOCKS5Datagram, DecodeSOCKS5Datagram, "allowed.example.com:"+echoPort, []byte("hi")); string(reply) != "hi" {
+			t.Fatal(string(reply))
+		}
+	}
+	if lookups := atomic.LoadInt32(&numLookups); lookups != 1 {
+		t.Fatal(lookups)
+	}
+}
+
+func TestUDPRelay_AllowDest(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numAllowed int32
+	relay := &UDPRelay{
+		Conn:   conn,
+		Decode: DecodeSOCKS5Datagram,
+		Encode: EncodeSOCKS5Datagram,
+		AllowDest: func(*net.UDPAddr, string) bool {
+			return atomic.AddInt32(&numAllowed, 1) <= 1
+		},
+	}
+	relay.Initialise()
+	go relay.StartAndBlock()
+	defer relay.Close()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Return true if the datagram sent to destination is echoed back
+	exchange := func(destAddr string) bool {
+		datagram, _ := EncodeSOCKS5Datagram(destAddr, []byte("hi"))
+		client.Write(datagram)
+		client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err := client.Read(make([]byte, MaxPacketSize))
+		return err == nil
+	}
+	// The first destination comes with the association, the second one is allowed, and the third one is not.
+	echoAddrs := []string{startUDPEchoServer(t), startUDPEchoServer(t), startUDPEchoServer(t)}
+	if !exchange(echoAddrs[0]) || !exchange(echoAddrs[1]) || exchange(echoAddrs[2]) {
+		t.Fatal(atomic.LoadInt32(&numAllowed))
+	}
+	// Destinations used earlier are not checked again
+	if !exchange(echoAddrs[0]) || !exchange(echoAddrs[1]) || atomic.LoadInt32(&numAllowed) != 2 {
+		t.Fatal(atomic.LoadInt32(&numAllowed))
+	}
+}
+
+func TestSockd_UDP(t *testing.T) {
+	daemon := Sockd{
+		ListenAddress:    "127.0.0.1",
+		ListenPort:       8723,
+		AEADListenPort:   8724,
+		SOCKS5ListenPort: 8725,
+		Users:            map[string]User{"user": {Password: "password"}},
+		Password:         "abcdefg",
+		PerIPLimit:       10,
+		EnableUDP:        true,
+		Destinations:     DestinationRules{AllowPrivate: true},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	time.Sleep(1 * time.Second)
+	echoAddr := startUDPEchoServer(t)
+
+	// Legacy and authenticated encryption datagrams
+	cip := &Cipher{}
+	cip.Initialise("abcdefg")
+	decode, encode := cip.DatagramCodec(nil)
+	if srcAddr, reply := exchangeDatagram(t, "127.0.0.1:8723", encode, decode, echoAddr, []byte("legacy")); srcAddr != echoAddr || string(reply) != "legacy" {
+		t.Fatal(srcAddr, string(reply))
+	}
+	decode, encode = AEADDatagramCodec(DeriveAEADKey("abcdefg"), nil)
+	if srcAddr, reply := exchangeDatagram(t, "127.0.0.1:8724", encode, decode, echoAddr, []byte("aead")); srcAddr != echoAddr || string(reply) != "aead" {
+		t.Fatal(srcAddr, string(reply))
+	}
+
+	// SOCKS5 UDP associate, the reply carries address of the relay.
+	control, err := net.Dial("tcp", "127.0.0.1:8725")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	control.Write([]byte{SOCKS5Version, 1, SOCKS5MethodUserPass})
+	control.Write(append(append([]byte{SOCKS5AuthVersion, 4}, "user"...), append([]byte{8}, "password"...)...))
+	control.Write(append([]byte{SOCKS5Version, SOCKS5CmdUDPAssociate, 0}, EncodeSOCKS5Address("0.0.0.0:0")...))
+	buf := make([]byte, 2+2+3)
+	if _, err := io.ReadFull(control, buf); err != nil || buf[3] != 0 || buf[5] != SOCKS5ReplySucceeded {
+		t.Fatal(err, buf)
+	}
+	relayAddr, err := ReadSOCKS5Address(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srcAddr, reply := exchangeDatagram(t, relayAddr, EncodeSOCKS5Datagram, DecodeSOCKS5Datagram, echoAddr, []byte("socks5")); srcAddr != echoAddr || !bytes.Equal(reply, []byte("socks5")) {
+		t.Fatal(srcAddr, string(reply))
+	}
+}
@@ -0,0 +1,96 @@
+package sockd
+
+import (
+	"github.com/HouzuoGuo/laitos/traffic"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	SharedPasswordUser     = "(shared)" // Traffic made via the shared Password is accounted to this user name
+	TrafficSaveIntervalSec = 60         // Save traffic counters into file at this interval
+)
+
+/*
+A user of sock daemon. The user authenticates to SOCKS5 via its name and password, and to authenticated encryption
+protocol via its password. The legacy encrypted protocol and encrypted UDP relays only use the shared Password.
+*/
+type User struct {
+	Password       string `json:"Password"`
+	MaxConnections int    `json:"MaxConnections"` // (Optional) maximum number of concurrent connections, 0 means unlimited.
+	MonthlyQuotaMB int64  `json:"MonthlyQuotaMB"` // (Optional) maximum megabytes uploaded and downloaded within a calendar month, 0 means unlimited.
+}
+
+// A client connection that counts the bytes it reads (upload) and writes (download) toward a user.
+type accountedConn struct {
+	net.Conn
+	user      string
+	closeOnce *sync.Once
+}
+
+// Count a new connection of the user and return the connection wrapped for traffic accounting. Return an error if the user's limits do not allow it.
+func accountConnection(conn net.Conn, user string) (net.Conn, error) {
+	if err := traffic.Common.Begin(user); err != nil {
+		return nil, err
+	}
+	return &accountedConn{Conn: conn, user: user, closeOnce: new(sync.Once)}, nil
+}
+
+func (conn *accountedConn) Read(b []byte) (n int, err error) {
+	n, err = conn.Conn.Read(b)
+	if n > 0 {
+		if quotaErr := traffic.Common.Add(conn.user, int64(n), 0); quotaErr != nil && err == nil {
+			err = quotaErr
+		}
+	}
+	return
+}
+
+func (conn *accountedConn) Write(b []byte) (n int, err error) {
+	n, err = conn.Conn.Write(b)
+	if n > 0 {
+		if quotaErr := traffic.Common.Add(conn.user, 0, int64(n)); quotaErr != nil && err == nil {
+			err = quotaErr
+		}
+	}
+	return
+}
+
+func (conn *accountedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		traffic.Common.End(conn.user)
+	})
+	return conn.Conn.Close()
+}
+
+// Return a function that counts relayed datagrams toward the user.
+func accountDatagrams(user string) func(upload, download int) error {
+	return func(upload, download int) error {
+		return traffic.Common.Add(user, int64(upload), int64(download))
+	}
+}
+
+// Save traffic counters into file.
+func (sock *Sockd) saveTraffic() {
+	if sock.TrafficFile == "" {
+		return
+	}
+	if err := traffic.Common.Save(sock.TrafficFile); err != nil {
+		sock.Logger.Warningf("saveTraffic", sock.TrafficFile, err, "failed to save traffic counters")
+	}
+}
+
+// Save traffic counters into file at regular interval until daemon stops.
+func (sock *Sockd) saveTrafficPeriodically() {
+	ticker := time.NewTicker(TrafficSaveIntervalSec * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sock.saveTraffic()
+		case <-sock.stopSaving:
+			return
+		}
+	}
+}
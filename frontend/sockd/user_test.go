@@ -0,0 +1,108 @@
+package sockd
+
+import (
+	"github.com/HouzuoGuo/laitos/frontend/common/testhelper"
+	"github.com/HouzuoGuo/laitos/traffic"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSockd_Users(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-sockd-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	daemon := Sockd{
+		ListenAddress:    "127.0.0.1",
+		AEADListenPort:   8727,
+		SOCKS5ListenPort: 8728,
+		Password:         "abcdefg",
+		PerIPLimit:       10,
+		Destinations:     DestinationRules{AllowPrivate: true},
+		Users:            map[string]User{"alice": {Password: "short"}},
+		TrafficFile:      filepath.Join(dir, "traffic.json"),
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "alice") {
+		t.Fatal(err)
+	}
+	daemon.Users = map[string]User{
+		"alice": {Password: "alice password", MaxConnections: 1},
+		"bob":   {Password: "bob password"},
+		"carol": {Password: "carol password", MonthlyQuotaMB: 1},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	echoAddr := testhelper.StartEchoServer(t)
+
+	// Alice connects via authenticated encryption protocol using her own password
+	netConn, err := net.Dial("tcp", "127.0.0.1:8727")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := NewAEADConnection(netConn, DeriveAEADKey("alice password"))
+	if _, err := conn.Write(append(EncodeSOCKS5Address(echoAddr), "hello alice"...)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello alice" {
+		t.Fatal(err, string(buf))
+	}
+	// Alice may not have a second connection
+	if conn, reply := dialSOCKS5(t, "127.0.0.1:8728", "alice", "alice password", SOCKS5CmdConnect, echoAddr); reply != SOCKS5ReplyNotAllowed {
+		t.Fatal(reply)
+	} else {
+		conn.Close()
+	}
+	// Bob connects via SOCKS5
+	bobConn, reply := dialSOCKS5(t, "127.0.0.1:8728", "bob", "bob password", SOCKS5CmdConnect, echoAddr)
+	if reply != SOCKS5ReplySucceeded {
+		t.Fatal(reply)
+	}
+	if _, err := bobConn.Write([]byte("hello bob")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(bobConn, buf[:9]); err != nil || string(buf[:9]) != "hello bob" {
+		t.Fatal(err, string(buf))
+	}
+	bobConn.Close()
+	// Carol has used up her quota
+	traffic.Common.Add("carol", 2*1048576, 0)
+	if conn, reply := dialSOCKS5(t, "127.0.0.1:8728", "carol", "carol password", SOCKS5CmdConnect, echoAddr); reply != SOCKS5ReplyNotAllowed {
+		t.Fatal(reply)
+	} else {
+		conn.Close()
+	}
+
+	counters := make(map[string]traffic.Counters)
+	for _, user := range traffic.Common.GetSnapshot() {
+		counters[user.Name] = user
+	}
+	if alice := counters["alice"]; alice.ActiveConnections != 1 || alice.TotalUpload < 11 || alice.TotalDownload != 11 {
+		t.Fatalf("%+v", alice)
+	}
+	if bob := counters["bob"]; bob.TotalUpload < 9 || bob.TotalDownload < 9 {
+		t.Fatalf("%+v", bob)
+	}
+	// Counters are saved when daemon stops
+	daemon.Stop()
+	content, err := ioutil.ReadFile(daemon.TrafficFile)
+	if err != nil || !strings.Contains(string(content), "alice") || !strings.Contains(string(content), "bob") {
+		t.Fatal(err, string(content))
+	}
+}
@@ -0,0 +1,159 @@
+package ipfilter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Allow or deny IPv4 and IPv6 addresses according to CIDR blocks. Deny list takes precedence over allow list. If the allow
+list is empty, all addresses that are not denied are allowed. Entries may also be plain IP addresses, which are treated
+as single-host blocks (/32 and /128).
+*/
+type IPFilter struct {
+	Allow []string // CIDR blocks or IP addresses to allow, e.g. 192.168.0.0/16, 2001:db8::/32, 10.0.0.1
+	Deny  []string // CIDR blocks or IP addresses to deny, they take precedence over the allow list.
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+	mutex     *sync.RWMutex
+}
+
+// Parse a CIDR block or plain IP address.
+func ParseCIDR(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil, errors.New("ParseCIDR: entry must not be empty")
+	}
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("ParseCIDR: \"%s\" is neither a CIDR block nor an IP address", entry)
+		}
+		if v4 := ip.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, fmt.Errorf("ParseCIDR: malformed CIDR block \"%s\" - %v", entry, err)
+	}
+	return ipNet, nil
+}
+
+/*
+Convert a legacy textual IP prefix into CIDR block, the prefix is cut at octet (IPv4) or group (IPv6) boundary. For
+example, "127" becomes 127.0.0.0/8, "10.1." becomes 10.1.0.0/16, and "fe80:" becomes fe80::/16.
+*/
+func PrefixToCIDR(prefix string) (string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return "", errors.New("PrefixToCIDR: prefix must not be empty")
+	}
+	if strings.Contains(prefix, ":") {
+		if strings.Contains(prefix, "::") {
+			// A complete IPv6 address
+			if ip := net.ParseIP(prefix); ip != nil {
+				return ip.String() + "/128", nil
+			}
+			return "", fmt.Errorf("PrefixToCIDR: malformed IPv6 prefix \"%s\"", prefix)
+		}
+		groups := strings.Split(strings.TrimSuffix(prefix, ":"), ":")
+		if len(groups) > 8 {
+			return "", fmt.Errorf("PrefixToCIDR: malformed IPv6 prefix \"%s\"", prefix)
+		}
+		for _, group := range groups {
+			if _, err := strconv.ParseUint(group, 16, 16); err != nil {
+				return "", fmt.Errorf("PrefixToCIDR: malformed IPv6 prefix \"%s\"", prefix)
+			}
+		}
+		address := strings.Join(groups, ":")
+		if len(groups) < 8 {
+			address += "::"
+		}
+		return fmt.Sprintf("%s/%d", net.ParseIP(address).String(), len(groups)*16), nil
+	}
+	octets := strings.Split(strings.TrimSuffix(prefix, "."), ".")
+	if len(octets) > 4 {
+		return "", fmt.Errorf("PrefixToCIDR: malformed IPv4 prefix \"%s\"", prefix)
+	}
+	maskLen := len(octets) * 8
+	for _, octet := range octets {
+		if _, err := strconv.ParseUint(octet, 10, 8); err != nil {
+			return "", fmt.Errorf("PrefixToCIDR: malformed IPv4 prefix \"%s\"", prefix)
+		}
+	}
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+	return fmt.Sprintf("%s/%d", strings.Join(octets, "."), maskLen), nil
+}
+
+// Parse allow and deny lists. Return an error if any of the entries is invalid.
+func (filter *IPFilter) Initialise() error {
+	filter.mutex = new(sync.RWMutex)
+	filter.allowNets = make([]*net.IPNet, 0, len(filter.Allow))
+	filter.denyNets = make([]*net.IPNet, 0, len(filter.Deny))
+	for _, entry := range filter.Allow {
+		ipNet, err := ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("IPFilter.Initialise: invalid allow list entry - %v", err)
+		}
+		filter.allowNets = append(filter.allowNets, ipNet)
+	}
+	for _, entry := range filter.Deny {
+		ipNet, err := ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("IPFilter.Initialise: invalid deny list entry - %v", err)
+		}
+		filter.denyNets = append(filter.denyNets, ipNet)
+	}
+	return nil
+}
+
+// Add a CIDR block or IP address to allow list. This is useful for allowing the computer's own public IP.
+func (filter *IPFilter) AddAllow(entry string) error {
+	ipNet, err := ParseCIDR(entry)
+	if err != nil {
+		return fmt.Errorf("IPFilter.AddAllow: %v", err)
+	}
+	filter.mutex.Lock()
+	filter.Allow = append(filter.Allow, entry)
+	filter.allowNets = append(filter.allowNets, ipNet)
+	filter.mutex.Unlock()
+	return nil
+}
+
+// Return true if the IP address (without port number) is not denied and is allowed.
+func (filter *IPFilter) IsAllowed(ipStr string) bool {
+	// IPv6 addresses in host:port form may come with brackets and zone
+	ipStr = strings.TrimSuffix(strings.TrimPrefix(ipStr, "["), "]")
+	if zone := strings.IndexByte(ipStr, '%'); zone != -1 {
+		ipStr = ipStr[:zone]
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+	for _, ipNet := range filter.denyNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(filter.allowNets) == 0 {
+		return true
+	}
+	for _, ipNet := range filter.allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package ipfilter
+
+import "testing"
+
+func TestPrefixToCIDR(t *testing.T) {
+	for prefix, cidr := range map[string]string{
+		"127":          "127.0.0.0/8",
+		"10.1":         "10.1.0.0/16",
+		"10.1.":        "10.1.0.0/16",
+		"192.168.1.10": "192.168.1.10/32",
+		"fe80:":        "fe80::/16",
+		"2001:db8:1":   "2001:db8:1::/48",
+		"::1":          "::1/128",
+	} {
+		if converted, err := PrefixToCIDR(prefix); err != nil || converted != cidr {
+			t.Fatal(prefix, converted, err)
+		}
+	}
+	for _, bad := range []string{"", "300", "1.2.3.4.5", "a.b", "fffff:", "1:2:3:4:5:6:7:8:9"} {
+		if _, err := PrefixToCIDR(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	filter := IPFilter{Allow: []string{"10.1.0.0/16", "2001:db8::/32", "192.168.1.1"}, Deny: []string{"10.1.2.0/24"}}
+	if err := filter.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.1.0.1":       true,
+		"10.100.0.1":     false,
+		"10.1.2.3":       false,
+		"192.168.1.1":    true,
+		"192.168.1.2":    false,
+		"2001:db8::1":    true,
+		"[2001:db8::1]":  true,
+		"2001:db9::1":    false,
+		"not an address": false,
+	} {
+		if filter.IsAllowed(ip) != allowed {
+			t.Fatal(ip, allowed)
+		}
+	}
+	if err := filter.AddAllow("192.168.1.2"); err != nil || !filter.IsAllowed("192.168.1.2") {
+		t.Fatal(err)
+	}
+	if err := filter.AddAllow("bad"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Empty allow list allows everything that is not denied
+	filter = IPFilter{Deny: []string{"::1"}}
+	if err := filter.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !filter.IsAllowed("1.2.3.4") || filter.IsAllowed("::1") {
+		t.Fatal("wrong result")
+	}
+	// Invalid entries are rejected
+	for _, bad := range []IPFilter{{Allow: []string{"10.0.0.0/33"}}, {Deny: []string{"abc"}}, {Allow: []string{""}}} {
+		if err := bad.Initialise(); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
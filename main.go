@@ -125,7 +125,7 @@ func main() {
 	var conflictFree, debug bool
 	var gomaxprocs int
 	flag.StringVar(&configFile, "config", "", "(Mandatory) path to configuration file in JSON syntax")
-	flag.StringVar(&frontend, "frontend", "", "(Mandatory) comma-separated frontend services to start (dnsd, healthcheck, httpd, lighthttpd, mailp, smtpd, sockd, telegram)")
+	flag.StringVar(&frontend, "frontend", "", "(Mandatory) comma-separated frontend services to start (ddns, dnsd, healthcheck, httpd, httpproxy, imapd, lighthttpd, mailp, portfwd, smtpd, sockclient, sockd, telegram)")
 	flag.BoolVar(&conflictFree, "conflictfree", false, "(Optional) automatically stop and disable system daemons that may run into port conflict with laitos")
 	flag.BoolVar(&debug, "debug", false, "(Optional) print goroutine stack traces upon receiving interrupt signal")
 	flag.IntVar(&gomaxprocs, "gomaxprocs", 0, "(Optional) set gomaxprocs")
@@ -191,12 +191,18 @@ func main() {
 	var numDaemons int32
 	for _, frontendName := range frontends {
 		switch frontendName {
+		case "ddns":
+			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetDDNS())
 		case "dnsd":
 			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetDNSD())
 		case "healthcheck":
 			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetHealthCheck())
 		case "httpd":
 			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetHTTPD())
+		case "httpproxy":
+			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetHTTPProxy())
+		case "imapd":
+			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetIMAPDaemon())
 		case "lighthttpd":
 			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetLightHTTPD())
 		case "mailp":
@@ -208,8 +214,12 @@ func main() {
 			if err := config.GetMailProcessor().Process(mailContent); err != nil {
 				logger.Fatalf("main", "", err, "failed to process mail")
 			}
+		case "portfwd":
+			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetPortForward())
 		case "smtpd":
 			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetMailDaemon())
+		case "sockclient":
+			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetSockClient())
 		case "sockd":
 			StartDaemon(&numDaemons, waitGroup, frontendName, config.GetSockDaemon())
 		case "telegram":
@@ -220,6 +230,14 @@ func main() {
 	}
 	if numDaemons > 0 {
 		logger.Printf("main", "", nil, "started %d daemons", numDaemons)
+		// Retry delivery of queued outgoing mails in background. One-shot frontends such as mailp leave it to daemons.
+		if queue := config.GetMailQueue(); queue != nil {
+			go func() {
+				if err := queue.StartAndBlock(); err != nil {
+					logger.Warningf("main", "MailQueue", err, "mail queue stopped")
+				}
+			}()
+		}
 	}
 	// Daemons are not really supposed to quit
 	waitGroup.Wait()
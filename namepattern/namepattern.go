@@ -0,0 +1,115 @@
+package namepattern
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A node in suffix trie, children are keyed by domain name label.
+type labelNode struct {
+	children map[string]*labelNode
+	self     bool // pattern matches the domain name that ends at this node
+	subs     bool // pattern matches sub-domains of the domain name that ends at this node
+}
+
+/*
+Match domain names against patterns using a trie built from name labels in reverse order. Patterns look like:
+- "example.com" matches example.com and all of its sub-domains.
+- "*.example.com" matches sub-domains of example.com, but not example.com itself.
+- "/regex/" is a regular expression matched against the complete domain name.
+*/
+type NamePatterns struct {
+	root    *labelNode
+	regexes []*regexp.Regexp
+	size    int
+}
+
+// Compile patterns into a trie and regular expressions. Return an error if a pattern is malformed.
+func NewNamePatterns(patterns []string) (*NamePatterns, error) {
+	ret := &NamePatterns{root: &labelNode{}}
+	for _, pattern := range patterns {
+		if err := ret.Add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Add a pattern to the collection. Return an error if the pattern is malformed.
+func (pat *NamePatterns) Add(pattern string) error {
+	pattern = strings.TrimSpace(pattern)
+	if len(pattern) > 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		regex, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("NamePatterns.Add: malformed regular expression %s - %v", pattern, err)
+		}
+		pat.regexes = append(pat.regexes, regex)
+		pat.size++
+		return nil
+	}
+	onlySubs := strings.HasPrefix(pattern, "*.")
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(pattern, "*.")), ".")
+	if name == "" || strings.ContainsAny(name, " */") {
+		return fmt.Errorf("NamePatterns.Add: malformed domain name pattern \"%s\"", pattern)
+	}
+	labels := strings.Split(name, ".")
+	node := pat.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		if labels[i] == "" {
+			return fmt.Errorf("NamePatterns.Add: malformed domain name pattern \"%s\"", pattern)
+		}
+		if node.children == nil {
+			node.children = make(map[string]*labelNode)
+		}
+		child, exists := node.children[labels[i]]
+		if !exists {
+			child = &labelNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.subs = true
+	if !onlySubs {
+		node.self = true
+	}
+	pat.size++
+	return nil
+}
+
+// Return number of patterns in the collection.
+func (pat *NamePatterns) Len() int {
+	if pat == nil {
+		return 0
+	}
+	return pat.size
+}
+
+/*
+Return true if any pattern matches the domain name. The first input name is the complete domain name, for example the
+name queried by DNS client or the destination name of a proxy connection.
+*/
+func (pat *NamePatterns) Match(names []string) bool {
+	if pat == nil || len(names) == 0 {
+		return false
+	}
+	name := strings.TrimSuffix(strings.ToLower(names[0]), ".")
+	labels := strings.Split(name, ".")
+	node := pat.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, exists := node.children[labels[i]]
+		if !exists {
+			break
+		}
+		node = child
+		if i == 0 && node.self || i > 0 && node.subs {
+			return true
+		}
+	}
+	for _, regex := range pat.regexes {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package namepattern
+
+import (
+	"testing"
+)
+
+func TestNamePatterns(t *testing.T) {
+	if _, err := NewNamePatterns([]string{"/[/"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := NewNamePatterns([]string{"a..b"}); err == nil {
+		t.Fatal("did not error")
+	}
+	var nilPatterns *NamePatterns
+	if nilPatterns.Match([]string{"example.com"}) || nilPatterns.Len() != 0 {
+		t.Fatal("nil patterns should not match")
+	}
+	pat, err := NewNamePatterns([]string{"Example.com", "*.wild.net", `/^ads[0-9]+\./`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pat.Len() != 3 {
+		t.Fatal(pat.Len())
+	}
+	for _, name := range []string{"example.com", "a.b.example.com", "x.wild.net", "ads123.somewhere.org", "EXAMPLE.COM."} {
+		if !pat.Match([]string{name}) {
+			t.Fatal(name)
+		}
+	}
+	for _, name := range []string{"com", "notexample.com", "wild.net", "ads.somewhere.org", "example.org"} {
+		if pat.Match([]string{name}) {
+			t.Fatal(name)
+		}
+	}
+	if pat.Match([]string{}) {
+		t.Fatal("empty names")
+	}
+}
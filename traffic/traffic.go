@@ -0,0 +1,192 @@
+// Account traffic and enforce connection limits and monthly quotas of sock daemon users.
+package traffic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const MonthFormat = "2006-01" // Monthly counters are reset when the calendar month in this format changes
+
+var (
+	Common = NewAccounting() // Traffic of all users served by sock daemons of this program
+
+	ErrTooManyConnections = errors.New("user has too many concurrent connections")
+	ErrQuotaExceeded      = errors.New("user has used up the monthly quota")
+)
+
+// Counters of a user, suitable for serialising into JSON.
+type Counters struct {
+	Name              string `json:"Name"`
+	Month             string `json:"Month"`             // The calendar month of monthly counters
+	MonthUpload       int64  `json:"MonthUpload"`       // Bytes sent by user within the month
+	MonthDownload     int64  `json:"MonthDownload"`     // Bytes received by user within the month
+	TotalUpload       int64  `json:"TotalUpload"`       // Bytes sent by user since counting began
+	TotalDownload     int64  `json:"TotalDownload"`     // Bytes received by user since counting began
+	ActiveConnections int    `json:"ActiveConnections"` // Number of connections currently open, it is not persisted.
+	MaxConnections    int    `json:"MaxConnections"`    // Limit of concurrent connections, 0 means unlimited.
+	MonthlyQuota      int64  `json:"MonthlyQuota"`      // Limit of bytes uploaded and downloaded within a month, 0 means unlimited.
+}
+
+// Keep counters and limits of each user.
+type Accounting struct {
+	mutex *sync.Mutex
+	users map[string]*Counters
+}
+
+// Return initialised and empty accounting.
+func NewAccounting() *Accounting {
+	return &Accounting{
+		mutex: new(sync.Mutex),
+		users: make(map[string]*Counters),
+	}
+}
+
+// Return counters of the user, create them if they do not yet exist. Reset monthly counters if a new month has begun. Caller must lock mutex.
+func (acct *Accounting) getUser(name string, now time.Time) *Counters {
+	user, exists := acct.users[name]
+	if !exists {
+		user = &Counters{Name: name}
+		acct.users[name] = user
+	}
+	if month := now.Format(MonthFormat); user.Month != month {
+		user.Month = month
+		user.MonthUpload = 0
+		user.MonthDownload = 0
+	}
+	return user
+}
+
+// Set the limits of concurrent connections and monthly bytes of the user, 0 means unlimited.
+func (acct *Accounting) SetLimits(name string, maxConnections int, monthlyQuota int64) {
+	acct.mutex.Lock()
+	defer acct.mutex.Unlock()
+	user := acct.getUser(name, time.Now())
+	user.MaxConnections = maxConnections
+	user.MonthlyQuota = monthlyQuota
+}
+
+// Count a new connection of the user. Return an error if the user has too many connections or has used up the quota.
+func (acct *Accounting) Begin(name string) error {
+	acct.mutex.Lock()
+	defer acct.mutex.Unlock()
+	user := acct.getUser(name, time.Now())
+	if user.MonthlyQuota > 0 && user.MonthUpload+user.MonthDownload >= user.MonthlyQuota {
+		return ErrQuotaExceeded
+	}
+	if user.MaxConnections > 0 && user.ActiveConnections >= user.MaxConnections {
+		return ErrTooManyConnections
+	}
+	user.ActiveConnections++
+	return nil
+}
+
+// Count the end of a connection that was successfully begun.
+func (acct *Accounting) End(name string) {
+	acct.mutex.Lock()
+	defer acct.mutex.Unlock()
+	if user := acct.getUser(name, time.Now()); user.ActiveConnections > 0 {
+		user.ActiveConnections--
+	}
+}
+
+// Add bytes to the user's counters. Return ErrQuotaExceeded if the user has used up the quota.
+func (acct *Accounting) Add(name string, upload, download int64) error {
+	acct.mutex.Lock()
+	defer acct.mutex.Unlock()
+	user := acct.getUser(name, time.Now())
+	user.MonthUpload += upload
+	user.MonthDownload += download
+	user.TotalUpload += upload
+	user.TotalDownload += download
+	if user.MonthlyQuota > 0 && user.MonthUpload+user.MonthDownload > user.MonthlyQuota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Return a copy of all users' counters sorted by name.
+func (acct *Accounting) GetSnapshot() []Counters {
+	acct.mutex.Lock()
+	defer acct.mutex.Unlock()
+	now := time.Now()
+	ret := make([]Counters, 0, len(acct.users))
+	for name := range acct.users {
+		ret = append(ret, *acct.getUser(name, now))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// Return counters of all users in a multi-line text, one user per line.
+func (acct *Accounting) Format() string {
+	snapshot := acct.GetSnapshot()
+	if len(snapshot) == 0 {
+		return "No traffic yet"
+	}
+	buf := new(bytes.Buffer)
+	for _, user := range snapshot {
+		quota := "unlimited"
+		if user.MonthlyQuota > 0 {
+			quota = fmt.Sprintf("%d MB", user.MonthlyQuota/1048576)
+		}
+		fmt.Fprintf(buf, "%s: %d connections, %s up %d MB down %d MB of %s, total up %d MB down %d MB\n",
+			user.Name, user.ActiveConnections, user.Month, user.MonthUpload/1048576, user.MonthDownload/1048576, quota,
+			user.TotalUpload/1048576, user.TotalDownload/1048576)
+	}
+	return buf.String()
+}
+
+// Restore byte counters from the JSON file. Limits and connection counts are not restored. A missing file is not an error.
+func (acct *Accounting) Load(filePath string) error {
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Accounting.Load: failed to read file - %v", err)
+	}
+	var saved []Counters
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return fmt.Errorf("Accounting.Load: failed to parse file \"%s\" - %v", filePath, err)
+	}
+	acct.mutex.Lock()
+	defer acct.mutex.Unlock()
+	for _, counters := range saved {
+		user, exists := acct.users[counters.Name]
+		if !exists {
+			user = &Counters{Name: counters.Name}
+			acct.users[counters.Name] = user
+		}
+		user.Month = counters.Month
+		user.MonthUpload = counters.MonthUpload
+		user.MonthDownload = counters.MonthDownload
+		user.TotalUpload = counters.TotalUpload
+		user.TotalDownload = counters.TotalDownload
+	}
+	return nil
+}
+
+// Save byte counters of all users into the JSON file.
+func (acct *Accounting) Save(filePath string) error {
+	content, err := json.MarshalIndent(acct.GetSnapshot(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("Accounting.Save: failed to serialise counters - %v", err)
+	}
+	// Write into a temporary file first so that an interrupted write does not lose the counters
+	if err := ioutil.WriteFile(filePath+".tmp", content, 0600); err != nil {
+		return fmt.Errorf("Accounting.Save: failed to write file - %v", err)
+	}
+	if err := os.Rename(filePath+".tmp", filePath); err != nil {
+		return fmt.Errorf("Accounting.Save: failed to replace file \"%s\" - %v", filePath, err)
+	}
+	return nil
+}
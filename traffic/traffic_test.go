@@ -0,0 +1,92 @@
+package traffic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccounting(t *testing.T) {
+	acct := NewAccounting()
+	acct.SetLimits("alice", 2, 1000)
+	if err := acct.Begin("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acct.Begin("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acct.Begin("alice"); err != ErrTooManyConnections {
+		t.Fatal(err)
+	}
+	acct.End("alice")
+	if err := acct.Add("alice", 400, 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := acct.Add("alice", 0, 200); err != ErrQuotaExceeded {
+		t.Fatal(err)
+	}
+	if err := acct.Begin("alice"); err != ErrQuotaExceeded {
+		t.Fatal(err)
+	}
+	// Users without limits
+	if err := acct.Begin("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acct.Add("bob", 1<<30, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := acct.GetSnapshot()
+	if len(snapshot) != 2 || snapshot[0].Name != "alice" || snapshot[0].MonthUpload != 400 || snapshot[0].MonthDownload != 700 ||
+		snapshot[0].ActiveConnections != 1 || snapshot[1].Name != "bob" || snapshot[1].TotalDownload != 1<<30 {
+		t.Fatalf("%+v", snapshot)
+	}
+	if text := acct.Format(); !strings.Contains(text, "alice: 1 connections") || !strings.Contains(text, "bob") {
+		t.Fatal(text)
+	}
+	// Monthly counters are reset in a new month
+	acct.mutex.Lock()
+	alice := acct.getUser("alice", time.Now().AddDate(0, 1, 0))
+	acct.mutex.Unlock()
+	if alice.MonthUpload != 0 || alice.MonthDownload != 0 || alice.TotalUpload != 400 || alice.TotalDownload != 700 {
+		t.Fatalf("%+v", alice)
+	}
+}
+
+func TestAccounting_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "traffic.json")
+	acct := NewAccounting()
+	// Missing file is not an error
+	if err := acct.Load(filePath); err != nil {
+		t.Fatal(err)
+	}
+	acct.SetLimits("alice", 1, 0)
+	acct.Begin("alice")
+	acct.Add("alice", 10, 20)
+	if err := acct.Save(filePath); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewAccounting()
+	restored.SetLimits("alice", 3, 0)
+	if err := restored.Load(filePath); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := restored.GetSnapshot()
+	if len(snapshot) != 1 || snapshot[0].MonthUpload != 10 || snapshot[0].TotalDownload != 20 ||
+		snapshot[0].ActiveConnections != 0 || snapshot[0].MaxConnections != 3 {
+		t.Fatalf("%+v", snapshot)
+	}
+	if err := ioutil.WriteFile(filePath, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Load(filePath); err == nil {
+		t.Fatal("did not error")
+	}
+}